@@ -0,0 +1,425 @@
+// Package main is the entry point of the application, handling user commands via a CLI interface.
+// This file contains the batch command, which downloads the files of a list concurrently and
+// reports what was downloaded, what failed and the bytes transferred.
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"go-to-peer/file"
+	"go-to-peer/peer"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// defaultBatchJobs is the number of files batch downloads at once unless -jobs says otherwise.
+const defaultBatchJobs = 4
+
+// batchCatalogTTL is how long batch reuses the catalogs of the peers, so that they are fetched
+// once for the whole list rather than once per file.
+const batchCatalogTTL = time.Minute
+
+// errInterrupted is the error of the files of a batch that were stopped, or never started, when
+// the command was interrupted.
+var errInterrupted = errors.New("interrupted")
+
+// batchEntry is a file listed in a batch list.
+type batchEntry struct {
+	line   int              // Line of the list naming the file.
+	target getTarget        // The file to download.
+	dest   file.Destination // Where the file is written.
+}
+
+// batchResult is the outcome of downloading a file of a batch.
+type batchResult struct {
+	path     string        // Path the file was written to.
+	bytes    int64         // Bytes of chunk data transferred for the file.
+	duration time.Duration // Time the download took.
+	err      error         // Why the download failed, or nil.
+}
+
+// batchResultJSON is a "result" event of batch, reporting the outcome of downloading a file of the list.
+type batchResultJSON struct {
+	resultJSON
+	Line  int   `json:"line"`
+	Bytes int64 `json:"bytes"` // Bytes of chunk data transferred; chunks already stored are not transferred again.
+}
+
+// batchSummaryJSON is the final "summary" event of batch.
+type batchSummaryJSON struct {
+	Event      string `json:"event"`
+	Files      int    `json:"files"`
+	Succeeded  int    `json:"succeeded"`
+	Failed     int    `json:"failed"`
+	Bytes      int64  `json:"bytes"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// runBatch downloads the files listed in a file, or on stdin, several at once from the -connect peers.
+func runBatch(args []string) int {
+	fs := newFlagSet("batch")
+	node := addNodeFlags(fs)
+	peerAddresses := addPeersFlag(fs, "Comma-separated list of peer addresses to download from")
+	jobs := fs.Int("jobs", defaultBatchJobs, "Number of files downloaded at once")
+	workers := fs.Int("workers", settings.Client.Workers, "Number of chunks downloaded in parallel, shared by the files downloaded at once")
+	dir := fs.String("dir", settings.Node.DownloadsDir, "Directory the files are written to, and relative destinations are resolved against")
+	force := fs.Bool("force", false, "Overwrite existing files")
+	inPlace := fs.Bool("in-place", false, "Write downloaded chunks directly into the target files instead of the chunk store")
+	output := addOutputFlag(fs)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	addresses := splitCommaSeparated(*peerAddresses)
+	if len(addresses) == 0 {
+		return usageError(fs, "no peers given with -connect")
+	}
+	if fs.NArg() != 1 {
+		return usageError(fs, "expected one list file, or - for stdin")
+	}
+	if !validOutput(*output) {
+		return usageError(fs, "unsupported output format %q", *output)
+	}
+	if *jobs < 1 {
+		return usageError(fs, "-jobs must be at least 1")
+	}
+	if *workers < 1 {
+		return usageError(fs, "-workers must be at least 1")
+	}
+
+	listPath := fs.Arg(0)
+	list := os.Stdin
+	if listPath != "-" {
+		f, err := os.Open(listPath)
+		if err != nil {
+			return fail("failed to open list: %v", err)
+		}
+		defer f.Close()
+		list = f
+	} else {
+		listPath = "stdin"
+	}
+	base := file.Destination{Dir: *dir, Overwrite: *force, InPlace: *inPlace}
+	entries, err := parseBatchList(list, listPath, base, addresses)
+	if err != nil {
+		return fail("%v", err)
+	}
+	if len(entries) == 0 {
+		return fail("%s lists no files", listPath)
+	}
+
+	if err := node.apply(); err != nil {
+		return fail("%v", err)
+	}
+	peer.DownloadWorkers = *workers
+	peer.CatalogCacheTTL = batchCatalogTTL
+	reportBans(nil)
+	if err := checkBatchOutputs(entries, listPath, fetchMergedCatalog); err != nil {
+		return fail("%v", err)
+	}
+
+	// Interrupting the command stops the downloads and removes their incomplete output.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// The files downloaded at once share -workers chunk slots between them.
+	ctx = peer.WithSlots(ctx, make(batchSlots, *workers))
+
+	start := time.Now()
+	results := make([]batchResult, len(entries))
+	var mu sync.Mutex
+	done := 0
+	runBatchEntries(ctx, entries, *jobs, func(i int, result batchResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		results[i] = result
+		done++
+		printBatchResult(entries[i], result, done, len(entries), *output)
+	})
+	return printBatchSummary(entries, results, time.Since(start), *output)
+}
+
+// runBatchEntries downloads the entries of a batch, jobs at a time, and calls report with the
+// result of each as it finishes. Entries not started when ctx is cancelled fail with errInterrupted.
+func runBatchEntries(ctx context.Context, entries []batchEntry, jobs int, report func(i int, result batchResult)) {
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(jobs, len(entries)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				report(i, downloadBatchEntry(ctx, entries[i]))
+			}
+		}()
+	}
+	for i := range entries {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// downloadBatchEntry downloads a file of a batch, counting the bytes transferred for it.
+func downloadBatchEntry(ctx context.Context, entry batchEntry) batchResult {
+	if ctx.Err() != nil {
+		return batchResult{err: errInterrupted}
+	}
+	start := time.Now()
+	counter := &transferCounter{}
+	ctx = peer.WithProgress(ctx, counter)
+
+	var result batchResult
+	if entry.target.shareLink {
+		result.path, result.err = peer.DownloadSharedFile(ctx, entry.target.arg, entry.target.servers, entry.dest)
+	} else {
+		result.path, result.err = peer.DownloadFileFromMultipleServers(ctx, entry.target.fileHash, entry.target.servers, entry.dest)
+	}
+	if result.err != nil && ctx.Err() != nil {
+		result.err = errInterrupted
+	}
+	result.bytes = counter.bytes.Load()
+	result.duration = time.Since(start)
+	return result
+}
+
+// printBatchResult reports a file of a batch that finished downloading, the done-th of total.
+func printBatchResult(entry batchEntry, result batchResult, done int, total int, output string) {
+	if output == outputJSON {
+		event := batchResultJSON{
+			resultJSON: resultJSON{
+				Event:      "result",
+				FileHash:   entry.target.fileHash,
+				ShareLink:  entry.target.shareLink,
+				OK:         result.err == nil,
+				Path:       result.path,
+				DurationMS: result.duration.Milliseconds(),
+			},
+			Line:  entry.line,
+			Bytes: result.bytes,
+		}
+		if result.err != nil {
+			event.Error = result.err.Error()
+		}
+		printJSON(event)
+		return
+	}
+	if result.err != nil {
+		fmt.Printf("[%d/%d] Failed line %d: %s: %v\n", done, total, entry.line, entry.target, result.err)
+		return
+	}
+	fmt.Printf("[%d/%d] Downloaded %s (%s transferred in %s)\n", done, total, result.path, formatBytes(result.bytes), result.duration.Round(time.Millisecond))
+}
+
+// printBatchSummary reports the files of a batch downloaded and failed and the bytes transferred,
+// and returns exitFailure if any file failed.
+func printBatchSummary(entries []batchEntry, results []batchResult, elapsed time.Duration, output string) int {
+	summary := batchSummaryJSON{Event: "summary", Files: len(entries), DurationMS: elapsed.Milliseconds()}
+	var failed []int
+	for i, result := range results {
+		summary.Bytes += result.bytes
+		if result.err != nil {
+			failed = append(failed, i)
+		}
+	}
+	summary.Failed = len(failed)
+	summary.Succeeded = summary.Files - summary.Failed
+
+	if output == outputJSON {
+		printJSON(summary)
+	} else {
+		rate := float64(summary.Bytes) / max(elapsed.Seconds(), 0.001)
+		fmt.Printf("\nDownloaded %d of %d %s, %s transferred in %s (%s/s)\n", summary.Succeeded, summary.Files,
+			plural(summary.Files, "file", "files"), formatBytes(summary.Bytes), elapsed.Round(time.Millisecond), formatBytes(int64(rate)))
+		if len(failed) > 0 {
+			fmt.Printf("%d %s failed:\n", len(failed), plural(len(failed), "file", "files"))
+			for _, i := range failed {
+				fmt.Printf("  line %d: %s: %v\n", entries[i].line, entries[i].target, results[i].err)
+			}
+		}
+	}
+	if len(failed) > 0 {
+		for _, i := range failed {
+			if errors.Is(results[i].err, file.ErrOutputExists) {
+				fmt.Fprintln(os.Stderr, "Pass -force to overwrite existing files.")
+				break
+			}
+		}
+		return fail("%d of %d %s failed to download", len(failed), summary.Files, plural(summary.Files, "file", "files"))
+	}
+	return exitOK
+}
+
+// parseBatchList parses a batch list. Every line names a file by hash or share link, optionally
+// followed by where to write it: a file name or path, or a directory if it ends with a separator
+// or is an existing directory. Relative destinations are resolved against the directory of base.
+// Blank lines and lines starting with # are ignored.
+//
+// Parameters:
+// - r: The list.
+// - name: The name of the list in error messages.
+// - base: The destination of the files listed without one.
+// - servers: The servers to download the files from.
+//
+// Returns:
+// - []batchEntry: The files listed, in order.
+// - error: An error object naming the offending line if the list cannot be read or is invalid.
+func parseBatchList(r io.Reader, name string, base file.Destination, servers []string) ([]batchEntry, error) {
+	var entries []batchEntry
+	seen := make(map[string]int) // Line of every file and destination, to reject duplicates.
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		arg, destination := text, ""
+		if i := strings.IndexAny(text, " \t"); i >= 0 {
+			arg, destination = text[:i], strings.TrimSpace(text[i+1:])
+		}
+
+		target := getTarget{arg: arg, servers: servers}
+		switch {
+		case file.IsShareLink(arg):
+			fileHash, _, err := file.ParseShareLink(arg)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid share link: %v", name, line, err)
+			}
+			target.fileHash, target.shareLink = fileHash, true
+		case file.ValidateFileHash(arg) == nil:
+			target.fileHash = arg
+		default:
+			// The argument may be a share link, so it is never printed.
+			return nil, fmt.Errorf("%s:%d: expected a file hash or share link", name, line)
+		}
+		dest, err := batchDestination(base, destination)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, line, err)
+		}
+
+		// Two downloads of the same file into the same directory, or into the same path, would
+		// race to write it. Files written under their catalog names are checked against the
+		// names by checkBatchOutputs.
+		key := "dir\x00" + target.fileHash + "\x00" + filepath.Clean(dest.Dir)
+		if dest.Path != "" {
+			key = "path\x00" + filepath.Clean(dest.Path)
+		}
+		if previous, ok := seen[key]; ok {
+			return nil, fmt.Errorf("%s:%d: same file or destination as line %d", name, line, previous)
+		}
+		seen[key] = line
+		entries = append(entries, batchEntry{line: line, target: target, dest: dest})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return entries, nil
+}
+
+// checkBatchOutputs checks that no two files of a batch are written to the same path, where they
+// would race to write the file, or its .part files with -in-place. Files written into a directory
+// are named from the merged catalog of the peers, which the downloads then reuse. The names of
+// shared files are encrypted, so they are only known once decrypted; those files are written
+// through a temporary file, and one clashing with another file fails with file.ErrOutputExists.
+//
+// Parameters:
+// - entries: The files of the batch.
+// - name: The name of the list in error messages.
+// - fetchCatalog: Fetches the merged catalog of the peers.
+//
+// Returns:
+// - error: An error object naming the lines of two files written to the same path.
+func checkBatchOutputs(entries []batchEntry, name string, fetchCatalog catalogFetcher) error {
+	var names map[string]string  // Name of every file in the catalog, by hash.
+	seen := make(map[string]int) // Line of every file, by output path.
+	for _, entry := range entries {
+		path := entry.dest.Path
+		if path == "" && !entry.target.shareLink {
+			if names == nil {
+				names = make(map[string]string)
+				catalog, err := fetchCatalog(entry.target.servers)
+				if err != nil {
+					// The downloads fail on their own, without writing anything.
+					return nil
+				}
+				for _, catalogEntry := range catalog {
+					names[catalogEntry.Hash] = catalogEntry.Name
+				}
+			}
+			if fileName, ok := names[entry.target.fileHash]; ok {
+				path = filepath.Join(entry.dest.Dir, fileName)
+			}
+		}
+		if path == "" {
+			continue
+		}
+		path = filepath.Clean(path)
+		if previous, ok := seen[path]; ok {
+			return fmt.Errorf("%s:%d: writes to %s, like line %d", name, entry.line, path, previous)
+		}
+		seen[path] = entry.line
+	}
+	return nil
+}
+
+// batchDestination returns where a file of a batch is written, from the destination given for it
+// in the list, if any.
+func batchDestination(base file.Destination, destination string) (file.Destination, error) {
+	if destination == "" {
+		return base, nil
+	}
+	dest := base
+	resolved := filepath.Clean(destination)
+	if !filepath.IsAbs(resolved) {
+		resolved = filepath.Join(base.Dir, resolved)
+	}
+	info, err := os.Stat(resolved)
+	switch {
+	case os.IsPathSeparator(destination[len(destination)-1]), err == nil && info.IsDir():
+		dest.Dir = resolved
+	case err != nil && !errors.Is(err, os.ErrNotExist):
+		return dest, fmt.Errorf("failed to check destination: %w", err)
+	default:
+		dest.Path = resolved
+	}
+	return dest, nil
+}
+
+// batchSlots is a peer.SlotScheduler handing out a fixed number of chunk slots to the files of a
+// batch, in the order they ask.
+type batchSlots chan struct{}
+
+// Acquire implements peer.SlotScheduler.
+func (s batchSlots) Acquire(ctx context.Context) (func(), error) {
+	select {
+	case s <- struct{}{}:
+		return func() { <-s }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// transferCounter is a peer.ProgressReporter counting the bytes of the chunks downloaded.
+type transferCounter struct {
+	bytes atomic.Int64
+}
+
+// DownloadStarted implements peer.ProgressReporter.
+func (c *transferCounter) DownloadStarted(peer.DownloadInfo) {}
+
+// Received implements peer.ProgressReporter. Only verified chunks are counted.
+func (c *transferCounter) Received(string, string, int64) {}
+
+// ChunkFinished implements peer.ProgressReporter.
+func (c *transferCounter) ChunkFinished(event peer.ChunkEvent) {
+	if event.Err == nil {
+		c.bytes.Add(event.Size)
+	}
+}
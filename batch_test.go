@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"go-to-peer/file"
+	"go-to-peer/peer"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBatchDestination(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "existing"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	base := file.Destination{Dir: dir, Overwrite: true, InPlace: true}
+
+	tests := []struct {
+		destination string
+		dir         string
+		path        string
+	}{
+		{"", dir, ""},
+		{"renamed.bin", dir, filepath.Join(dir, "renamed.bin")},
+		{"sub/renamed.bin", dir, filepath.Join(dir, "sub", "renamed.bin")},
+		{"archives/", filepath.Join(dir, "archives"), ""},
+		{"existing", filepath.Join(dir, "existing"), ""},
+		{"/srv/data/c.bin", dir, "/srv/data/c.bin"},
+		{"/srv/data/", "/srv/data", ""},
+	}
+	for _, test := range tests {
+		dest, err := batchDestination(base, test.destination)
+		if err != nil {
+			t.Fatalf("%q: %v", test.destination, err)
+		}
+		if dest.Dir != test.dir || dest.Path != test.path {
+			t.Errorf("%q: written to dir %q, path %q; expected dir %q, path %q", test.destination, dest.Dir, dest.Path, test.dir, test.path)
+		}
+		if !dest.Overwrite || !dest.InPlace {
+			t.Errorf("%q: lost the -force and -in-place options", test.destination)
+		}
+	}
+}
+
+func TestParseBatchList(t *testing.T) {
+	dir := t.TempDir()
+	base := file.Destination{Dir: dir}
+	servers := []string{"s1"}
+	shareLink := file.FormatShareLink(testHash('d'), make([]byte, file.ShareKeySize))
+
+	type parsed struct {
+		line     int
+		fileHash string
+		dir      string
+		path     string
+	}
+	tests := []struct {
+		name    string
+		list    string
+		entries []parsed
+		err     string
+	}{
+		{
+			name: "comments and blank lines",
+			list: "# files\n\n" + testHash('a') + "\n  \n\t" + testHash('b') + "\n",
+			entries: []parsed{
+				{line: 3, fileHash: testHash('a'), dir: dir},
+				{line: 5, fileHash: testHash('b'), dir: dir},
+			},
+		},
+		{
+			name: "destinations",
+			list: testHash('a') + " renamed.bin\n" + testHash('a') + "\tarchives/\n" + shareLink + "  /srv/c.bin\n",
+			entries: []parsed{
+				{line: 1, fileHash: testHash('a'), dir: dir, path: filepath.Join(dir, "renamed.bin")},
+				{line: 2, fileHash: testHash('a'), dir: filepath.Join(dir, "archives")},
+				{line: 3, fileHash: testHash('d'), dir: dir, path: "/srv/c.bin"},
+			},
+		},
+		{
+			name: "destination with spaces",
+			list: testHash('a') + " my file.bin\n",
+			entries: []parsed{
+				{line: 1, fileHash: testHash('a'), dir: dir, path: filepath.Join(dir, "my file.bin")},
+			},
+		},
+		{
+			name: "same file and directory",
+			list: testHash('a') + "\n" + testHash('b') + "\n" + testHash('a') + " ./\n",
+			err:  "list:3: same file or destination as line 1",
+		},
+		{
+			name: "same path",
+			list: testHash('a') + " out.bin\n" + testHash('b') + " sub/../out.bin\n",
+			err:  "list:2: same file or destination as line 1",
+		},
+		{
+			name: "same share link",
+			list: shareLink + "\n" + shareLink + "\n",
+			err:  "list:2: same file or destination as line 1",
+		},
+		{
+			name: "invalid hash",
+			list: testHash('a') + "\nreport.pdf\n",
+			err:  "list:2: expected a file hash or share link",
+		},
+		{
+			name: "invalid share link",
+			list: "gtp://" + testHash('a') + "#short\n",
+			err:  "list:1: invalid share link",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, err := parseBatchList(strings.NewReader(test.list), "list", base, servers)
+			if test.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+					t.Fatalf("got error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(test.entries) {
+				t.Fatalf("parsed %d entries, expected %d", len(entries), len(test.entries))
+			}
+			for i, entry := range entries {
+				expected := test.entries[i]
+				got := parsed{line: entry.line, fileHash: entry.target.fileHash, dir: entry.dest.Dir, path: entry.dest.Path}
+				if got != expected {
+					t.Errorf("entry %d parsed as %+v, expected %+v", i, got, expected)
+				}
+				if len(entry.target.servers) != 1 || entry.target.servers[0] != "s1" {
+					t.Errorf("entry %d downloaded from %v, expected the given servers", i, entry.target.servers)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckBatchOutputs(t *testing.T) {
+	dir := t.TempDir()
+	base := file.Destination{Dir: dir}
+	shareLink := file.FormatShareLink(testHash('d'), make([]byte, file.ShareKeySize))
+	fetchCatalog := func([]string) ([]peer.CatalogEntry, error) { return testCatalog, nil }
+
+	tests := []struct {
+		name string
+		list string
+		err  string
+	}{
+		{
+			// b and c are both notes.txt in the catalog.
+			name: "same catalog name",
+			list: testHash('a') + "\n" + testHash('b') + "\n" + testHash('c') + "\n",
+			err:  "list:3: writes to " + filepath.Join(dir, "notes.txt") + ", like line 2",
+		},
+		{
+			name: "same catalog name in other directories",
+			list: testHash('b') + "\n" + testHash('c') + " old/\n",
+		},
+		{
+			name: "catalog name and path",
+			list: testHash('a') + " notes.txt\n" + testHash('b') + "\n",
+			err:  "list:2: writes to " + filepath.Join(dir, "notes.txt") + ", like line 1",
+		},
+		{
+			name: "renamed",
+			list: testHash('b') + "\n" + testHash('c') + " old-notes.txt\n",
+		},
+		{
+			// Unknown files and the encrypted names of shared files cannot be checked.
+			name: "unknown names",
+			list: testHash('9') + "\n" + shareLink + "\n" + testHash('b') + "\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, err := parseBatchList(strings.NewReader(test.list), "list", base, []string{"s1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = checkBatchOutputs(entries, "list", fetchCatalog)
+			switch {
+			case test.err == "" && err != nil:
+				t.Fatal(err)
+			case test.err != "" && (err == nil || err.Error() != test.err):
+				t.Fatalf("got error %v, expected %q", err, test.err)
+			}
+		})
+	}
+
+	// Without a catalog, the files are named by no peer and fail to download.
+	entries, err := parseBatchList(strings.NewReader(testHash('b')+"\n"+testHash('c')+"\n"), "list", base, []string{"s1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetches := 0
+	unreachable := func([]string) ([]peer.CatalogEntry, error) {
+		fetches++
+		return nil, errors.New("no server answered")
+	}
+	if err := checkBatchOutputs(entries, "list", unreachable); err != nil || fetches != 1 {
+		t.Fatalf("got %v after %d fetches, expected nil after 1", err, fetches)
+	}
+}
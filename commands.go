@@ -0,0 +1,715 @@
+// Package main is the entry point of the application, handling user commands via a CLI interface.
+// This file contains the subcommands of the CLI.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-to-peer/daemon"
+	"go-to-peer/file"
+	"go-to-peer/peer"
+	"go-to-peer/util"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// runServe shares the files in peer.SharedDir with other peers until the process is stopped.
+func runServe(args []string) int {
+	fs := newFlagSet("serve")
+	node := addNodeFlags(fs)
+	port := fs.Int("port", settings.Server.Port, "Port to listen on")
+	peerAddresses := addPeersFlag(fs, "Comma-separated list of peers to repair damaged chunks from when scrubbing")
+	aclPath := fs.String("acl", settings.Server.ACLFile, "Path to a JSON access control list restricting which peers may access shared files")
+
+	// Chunking of shared files.
+	chunking := fs.String("chunking", file.ChunkingAuto, "How shared files are split into chunks: auto (sized from the file size), fixed or cdc (content-defined)")
+	chunkSize := fs.Int64("chunk-size", 0, "Chunk size in bytes for fixed chunking; implies -chunking fixed")
+	chunkingRulesPath := fs.String("chunking-rules", "", "Path to a JSON file assigning chunking parameters to shared files by path")
+	cdcMin := fs.Int64("cdc-min", file.DefaultCDCMinSize, "Minimum chunk size in bytes for content-defined chunking")
+	cdcAvg := fs.Int64("cdc-avg", file.DefaultCDCAvgSize, "Average chunk size in bytes for content-defined chunking")
+	cdcMax := fs.Int64("cdc-max", file.DefaultCDCMaxSize, "Maximum chunk size in bytes for content-defined chunking")
+	ecData := fs.Int("ec-data", 0, "Number of data chunks per erasure coding group (0 to disable erasure coding)")
+	ecParity := fs.Int("ec-parity", 0, "Number of parity chunks per erasure coding group; any -ec-data chunks of a group recover the rest")
+
+	// Background maintenance of the chunk store.
+	scrubInterval := fs.Duration("scrub-interval", settings.Server.ScrubInterval, "Scrub the chunk store in the background at this interval (0 to disable)")
+	gcInterval := fs.Duration("gc-interval", settings.Server.GCInterval, "Collect garbage in the background at this interval (0 to disable)")
+	gcQuota := fs.Int64("gc-quota", settings.Node.GCQuota, "Maximum size in bytes of the chunk store; cached files are evicted, least recently used first (0 for no quota)")
+	gcGrace := fs.Duration("gc-grace", settings.Node.GCGrace, "Keep unreferenced chunks younger than this, and downloads that stored a chunk more recently")
+
+	// Server resource limits.
+	defaults := peer.DefaultLimits()
+	maxMessageSize := fs.Int("max-message-size", defaults.MaxMessageSize, "Maximum size in bytes of a request accepted from a peer")
+	maxConnections := fs.Int("max-conns", defaults.MaxConnections, "Maximum number of concurrently connected peers")
+	maxRequests := fs.Int("max-requests", defaults.MaxRequestsPerConnection, "Maximum number of requests served per connection")
+	idleTimeout := fs.Duration("idle-timeout", defaults.IdleTimeout, "Disconnect peers that send no request for this long")
+	readTimeout := fs.Duration("read-timeout", defaults.ReadTimeout, "Maximum time to receive a single request")
+	writeTimeout := fs.Duration("write-timeout", defaults.WriteTimeout, "Maximum time to send a single response")
+	maxInFlight := fs.Int64("max-inflight", defaults.MaxInFlightBytes, "Maximum chunk bytes being sent to all peers at once")
+
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() > 0 {
+		return usageError(fs, "unexpected arguments: %v", fs.Args())
+	}
+	if *port < 1 || *port > 65535 {
+		return usageError(fs, "invalid port %d", *port)
+	}
+	if err := node.apply(); err != nil {
+		return fail("%v", err)
+	}
+	pins, err := node.loadPins()
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	peer.ServerLimits = peer.Limits{
+		MaxMessageSize:           *maxMessageSize,
+		MaxConnections:           *maxConnections,
+		MaxRequestsPerConnection: *maxRequests,
+		IdleTimeout:              *idleTimeout,
+		ReadTimeout:              *readTimeout,
+		WriteTimeout:             *writeTimeout,
+		MaxInFlightBytes:         *maxInFlight,
+	}
+	if *aclPath != "" {
+		if err := loadServerACL(*aclPath); err != nil {
+			return fail("%v", err)
+		}
+	}
+
+	switch {
+	case *chunking == file.ChunkingCDC:
+		peer.ServerChunking = file.CDCChunking(*cdcMin, *cdcAvg, *cdcMax)
+	case *chunking == file.ChunkingFixed || *chunkSize != 0:
+		peer.ServerChunking = file.FixedChunking(*chunkSize)
+	default:
+		peer.ServerChunking = file.Chunking{Mode: *chunking}
+	}
+	peer.ServerChunking.DataShards, peer.ServerChunking.ParityShards = *ecData, *ecParity
+	if err := peer.ServerChunking.Validate(); err != nil {
+		return usageError(fs, "%v", err)
+	}
+	if *chunkingRulesPath != "" {
+		rules, err := peer.LoadChunkingRules(*chunkingRulesPath)
+		if err != nil {
+			return fail("failed to load chunking rules: %v", err)
+		}
+		peer.ServerChunkingRules = rules
+	}
+
+	if *scrubInterval > 0 {
+		reportBans(nil)
+		peer.StartScrubber(*scrubInterval, peer.SharedDir, splitCommaSeparated(*peerAddresses))
+	}
+	if *gcInterval > 0 {
+		gcOptions := file.GCOptions{MaxBytes: *gcQuota, GracePeriod: *gcGrace}
+		peer.StartGarbageCollector(*gcInterval, peer.SharedDir, pins, gcOptions)
+	}
+	if err := peer.StartServer(strconv.Itoa(*port)); err != nil {
+		return fail("%v", err)
+	}
+	return exitOK
+}
+
+// runList lists the files shared by the -connect peers.
+func runList(args []string) int {
+	fs := newFlagSet("ls")
+	node := addNodeFlags(fs)
+	daemonFlags := addDaemonFlags(fs)
+	peerAddresses := addPeersFlag(fs, "Comma-separated list of peer addresses to query")
+	metrics := fs.Bool("metrics", false, "Print performance metrics when done")
+	output := addOutputFlag(fs)
+	refresh := fs.Bool("refresh", false, "Fetch the catalogs again instead of using those cached by the daemon")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	addresses := splitCommaSeparated(*peerAddresses)
+	if len(addresses) == 0 {
+		return usageError(fs, "no peers given with -connect")
+	}
+	if !validOutput(*output) {
+		return usageError(fs, "unsupported output format %q", *output)
+	}
+
+	// A running daemon answers from the catalogs it keeps.
+	startTime, startMemStats := startMeasuring()
+	var entries []peer.CatalogEntry
+	var availability []peer.ServerAvailability
+	var err error
+	if client := daemonFlags.dial(); client != nil {
+		catalog, callErr := client.Catalog(addresses, *refresh)
+		if callErr != nil {
+			return fail("%v", callErr)
+		}
+		entries, availability, err = catalog.Files, catalog.Availability(), catalog.Err()
+	} else {
+		if err := node.apply(); err != nil {
+			return fail("%v", err)
+		}
+		entries, availability, err = peer.FetchMergedCatalog(addresses)
+	}
+	if *output == outputJSON {
+		catalog := newCatalogJSON(entries, availability)
+		if *metrics {
+			catalog.Metrics = newMetricsJSON(measurePerformance(startTime, startMemStats))
+		}
+		printJSON(catalog)
+	}
+	if err != nil {
+		return fail("failed to fetch file catalogs: %v", err)
+	}
+	if *output == outputJSON {
+		return exitOK
+	}
+
+	for _, server := range availability {
+		if server.Err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s is unavailable: %v\n", server.Address, server.Err)
+		}
+	}
+	for _, entry := range entries {
+		fmt.Printf("%s  %12d  %s\n", entry.Hash, entry.Size, entry.Name)
+		for _, server := range entry.Servers {
+			fmt.Printf("  available on %s\n", server)
+		}
+	}
+	if *metrics {
+		measurePerformance(startTime, startMemStats).print(os.Stdout)
+	}
+	return exitOK
+}
+
+// runGet downloads files by hash, name or glob pattern, or encrypted files by share link, into the
+// downloads directory, another directory, an exact path or stdout. When a daemon is running, the
+// downloads are queued on it.
+func runGet(args []string) int {
+	fs := newFlagSet("get")
+	node := addNodeFlags(fs)
+	daemonFlags := addDaemonFlags(fs)
+	peerAddresses := addPeersFlag(fs, "Comma-separated list of peer addresses to download from")
+	inPlace := fs.Bool("in-place", false, "Write downloaded chunks directly into the target file instead of the chunk store")
+	workers := fs.Int("workers", settings.Client.Workers, "Number of chunks downloaded in parallel (the daemon uses its own)")
+	metrics := fs.Bool("metrics", false, "Print performance metrics when done")
+	output := addOutputFlag(fs)
+	progress := fs.String("progress", progressAuto, "Progress display: auto (a bar on a terminal, periodic lines otherwise), bar, lines or none")
+	all := fs.Bool("all", false, "Download every file matching a name or pattern instead of failing when several do")
+	name := fs.String("name", "", "Name to save the file under in the downloads directory, instead of its shared name")
+	outputPath := fs.String("o", "", "Path to write the file to, a directory to write files into (ending with a separator or existing), or - for stdout")
+	force := fs.Bool("force", false, "Overwrite existing files")
+	detach := fs.Bool("detach", false, "Queue the downloads on the daemon and return without waiting for them")
+	priority := fs.String("priority", "", "Priority of the downloads queued on the daemon: low, normal or high (default normal)")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	addresses := splitCommaSeparated(*peerAddresses)
+	if len(addresses) == 0 {
+		return usageError(fs, "no peers given with -connect")
+	}
+	if fs.NArg() == 0 {
+		return usageError(fs, "no file hash, name or share link given")
+	}
+	if !validOutput(*output) {
+		return usageError(fs, "unsupported output format %q", *output)
+	}
+	if *progress != progressAuto && *progress != progressBar && *progress != progressLines && *progress != progressNone {
+		return usageError(fs, "unsupported progress display %q", *progress)
+	}
+	if *workers < 1 {
+		return usageError(fs, "-workers must be at least 1")
+	}
+	if *name != "" && *outputPath != "" {
+		return usageError(fs, "-name and -o cannot be used together")
+	}
+	if *name != "" {
+		if err := file.ValidateFileName(*name); err != nil {
+			return usageError(fs, "invalid -name: %v", err)
+		}
+	}
+	toStdout := *outputPath == "-"
+	if toStdout && *output == outputJSON {
+		return usageError(fs, "-o - cannot be used with -output json")
+	}
+	if toStdout && *inPlace {
+		return usageError(fs, "-o - cannot be used with -in-place")
+	}
+	if toStdout && *detach {
+		return usageError(fs, "-o - cannot be used with -detach")
+	}
+	if *priority != "" {
+		if err := daemon.ValidatePriority(*priority); err != nil {
+			return usageError(fs, "%v", err)
+		}
+	}
+	dest, err := getDestination(*name, *outputPath, *force)
+	if err != nil {
+		return fail("%v", err)
+	}
+	dest.InPlace = *inPlace
+
+	// A running daemon downloads the files, except those written to stdout.
+	var client *daemon.Client
+	if !toStdout {
+		client = daemonFlags.dial()
+	}
+	if *detach && client == nil {
+		return fail("-detach requires a daemon, but none is listening on %s", daemonFlags.socket)
+	}
+	if *priority != "" && client == nil {
+		return fail("-priority requires a daemon, but none is listening on %s", daemonFlags.socket)
+	}
+	fetchCatalog := fetchMergedCatalog
+	if client != nil {
+		fetchCatalog = func(servers []string) ([]peer.CatalogEntry, error) {
+			catalog, err := client.Catalog(servers, false)
+			if err != nil {
+				return nil, err
+			}
+			return catalog.Files, catalog.Err()
+		}
+	} else {
+		if err := node.apply(); err != nil {
+			return fail("%v", err)
+		}
+		peer.DownloadWorkers = *workers
+	}
+
+	targets := resolveTargets(fs.Args(), addresses, *all, fetchCatalog)
+	if len(targets) > 1 && (dest.Path != "" || dest.Writer != nil) {
+		return usageError(fs, "%d files to download, but -name and -o with a file path or - take a single file", len(targets))
+	}
+
+	// Messages go to stderr when the file itself is written to stdout.
+	messages := os.Stdout
+	if toStdout {
+		messages = os.Stderr
+	}
+	if client != nil {
+		return getWithDaemon(client, targets, dest, daemonGetOptions{priority: *priority, output: *output, progress: *progress, detach: *detach})
+	}
+
+	// Report the progress as JSON events, or on a progress display that is finished before
+	// anything else is printed.
+	reporter, display := newGetReporter(*output, *progress, messages)
+	if display != nil {
+		defer display.close()
+	}
+	peer.Progress = reporter
+	reportBans(display)
+
+	// Interrupting the command stops the download and removes its incomplete output.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	startTime, startMemStats := startMeasuring()
+	code := exitOK
+	for _, target := range targets {
+		start := time.Now()
+		result := resultJSON{Event: "result", FileHash: target.fileHash, ShareLink: target.shareLink, Name: target.name, Pattern: target.pattern}
+		var outputPath string
+		err := target.err
+		switch {
+		case err != nil:
+		case target.shareLink:
+			// Download and decrypt an end-to-end encrypted file using its share link.
+			outputPath, err = peer.DownloadSharedFile(ctx, target.arg, target.servers, dest)
+		default:
+			outputPath, err = peer.DownloadFileFromMultipleServers(ctx, target.fileHash, target.servers, dest)
+		}
+		result.DurationMS = time.Since(start).Milliseconds()
+		if display != nil {
+			display.finish()
+		}
+		if ctx.Err() != nil {
+			return fail("download of %s interrupted", target)
+		}
+		if err != nil {
+			code = reportFailure(result, target, *output, err)
+			continue
+		}
+		result.OK, result.Path = true, outputPath
+		switch {
+		case *output == outputJSON:
+			printJSON(result)
+		case toStdout:
+			fmt.Fprintf(messages, "Downloaded %s to stdout\n", target)
+		default:
+			fmt.Fprintf(messages, "Downloaded %s\n", outputPath)
+		}
+	}
+	if *metrics {
+		performance := measurePerformance(startTime, startMemStats)
+		if *output == outputJSON {
+			event := newMetricsJSON(performance)
+			event.Event = "metrics"
+			printJSON(event)
+		} else {
+			performance.print(messages)
+		}
+	}
+	return code
+}
+
+// newGetReporter returns the progress reporter of get: JSON events, a progress display writing to
+// out, or nil for no progress at all. The display, if any, must be closed once done.
+func newGetReporter(output string, progress string, out *os.File) (peer.ProgressReporter, *progressDisplay) {
+	switch {
+	case output == outputJSON:
+		return &jsonProgress{}, nil
+	case progress == progressNone:
+		return nil, nil
+	default:
+		bar := progress == progressBar || (progress == progressAuto && isTerminal(out))
+		display := newProgressDisplay(out, bar)
+		return display, display
+	}
+}
+
+// reportFailure reports a file that could not be downloaded and returns exitFailure.
+func reportFailure(result resultJSON, target getTarget, output string, err error) int {
+	result.Error = err.Error()
+	if output == outputJSON {
+		printJSON(result)
+	}
+	code := fail("failed to download %s: %v", target, err)
+	// Errors reported by the daemon arrive as text.
+	if strings.Contains(err.Error(), file.ErrOutputExists.Error()) {
+		fmt.Fprintln(os.Stderr, "Pass -force to overwrite it.")
+	}
+	return code
+}
+
+// getDestination returns where get writes downloaded files, from its -name, -o and -force flags.
+// A -o path ending with a separator, or naming an existing directory, is a directory receiving
+// the files under their shared names; any other path is the path of the file itself.
+func getDestination(name string, outputPath string, force bool) (file.Destination, error) {
+	dest := file.Destination{Dir: settings.Node.DownloadsDir, Overwrite: force}
+	switch {
+	case name != "":
+		dest.Path = filepath.Join(dest.Dir, name)
+	case outputPath == "-":
+		dest.Writer = os.Stdout
+	case outputPath != "":
+		info, err := os.Stat(outputPath)
+		switch {
+		case os.IsPathSeparator(outputPath[len(outputPath)-1]), err == nil && info.IsDir():
+			dest.Dir = outputPath
+		case err != nil && !errors.Is(err, os.ErrNotExist):
+			return dest, fmt.Errorf("failed to check output path: %w", err)
+		default:
+			dest.Path = outputPath
+		}
+	}
+	return dest, nil
+}
+
+// getTarget is a file to download, resolved from an argument of get.
+type getTarget struct {
+	arg       string   // The argument naming the file.
+	fileHash  string   // Hash of the file, or "" if the argument could not be resolved.
+	shareLink bool     // Whether the argument is a share link, which must never be printed.
+	pattern   string   // The name or pattern the file was found by, if any.
+	name      string   // Name of the file in the catalog, if it was looked up.
+	servers   []string // Servers to download the file from.
+	err       error    // Why the argument could not be resolved, or nil.
+}
+
+// String describes the target in messages. Share links hold the decryption key, so only their file hash is shown.
+func (t getTarget) String() string {
+	switch {
+	case t.shareLink:
+		return strings.TrimSpace("shared file " + t.fileHash)
+	case t.pattern != "" && t.fileHash != "":
+		return fmt.Sprintf("%s (%s)", t.name, t.fileHash)
+	default:
+		return t.arg
+	}
+}
+
+// catalogFetcher returns the merged catalog of servers.
+type catalogFetcher func(servers []string) ([]peer.CatalogEntry, error)
+
+// fetchMergedCatalog fetches the merged catalog of servers directly from them.
+func fetchMergedCatalog(servers []string) ([]peer.CatalogEntry, error) {
+	entries, _, err := peer.FetchMergedCatalog(servers)
+	return entries, err
+}
+
+// resolveTargets resolves the arguments of get. Hashes and share links stand for themselves;
+// any other argument is a file name or glob pattern, looked up in the merged catalog of the
+// servers and downloaded from the servers sharing the file. A name or pattern matching several
+// files is an error unless all is set. Files named by several arguments are downloaded once.
+func resolveTargets(args []string, servers []string, all bool, fetchCatalog catalogFetcher) []getTarget {
+	var entries []peer.CatalogEntry
+	var catalogErr error
+	fetched := false
+
+	targets := []getTarget{}
+	seen := make(map[string]bool)
+	add := func(target getTarget) {
+		if target.err == nil && !target.shareLink {
+			if seen[target.fileHash] {
+				return
+			}
+			seen[target.fileHash] = true
+		}
+		targets = append(targets, target)
+	}
+
+	for _, arg := range args {
+		switch {
+		case file.IsShareLink(arg):
+			fileHash, _, _ := file.ParseShareLink(arg)
+			add(getTarget{arg: arg, fileHash: fileHash, shareLink: true, servers: servers})
+			continue
+		case file.ValidateFileHash(arg) == nil:
+			add(getTarget{arg: arg, fileHash: arg, servers: servers})
+			continue
+		}
+
+		if !fetched {
+			entries, catalogErr = fetchCatalog(servers)
+			fetched = true
+		}
+		target := getTarget{arg: arg, pattern: arg}
+		matches, err := peer.MatchCatalog(entries, arg)
+		switch {
+		case catalogErr != nil:
+			target.err = fmt.Errorf("failed to fetch file catalogs: %w", catalogErr)
+		case err != nil:
+			target.err = err
+		case len(matches) == 0:
+			target.err = fmt.Errorf("no file shared by the peers matches %q", arg)
+		case len(matches) > 1 && !all:
+			var b strings.Builder
+			fmt.Fprintf(&b, "%q matches %d files; pass -all to download them all, or give the hash of one:", arg, len(matches))
+			for _, entry := range matches {
+				fmt.Fprintf(&b, "\n  %s  %12d  %s", entry.Hash, entry.Size, displayPath(entry))
+			}
+			target.err = errors.New(b.String())
+		}
+		if target.err != nil {
+			add(target)
+			continue
+		}
+		for _, entry := range matches {
+			add(getTarget{arg: arg, fileHash: entry.Hash, pattern: arg, name: entry.Name, servers: entry.Servers})
+		}
+	}
+	return targets
+}
+
+// displayPath returns the path of a catalog entry in the shared directory, or its name.
+func displayPath(entry peer.CatalogEntry) string {
+	if entry.Path != "" {
+		return entry.Path
+	}
+	return entry.Name
+}
+
+// runShare encrypts a file into peer.SharedDir for sharing through untrusted seeders.
+func runShare(args []string) int {
+	fs := newFlagSet("share")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() != 1 {
+		return usageError(fs, "expected exactly one file to share")
+	}
+
+	link, outputPath, err := file.EncryptForSharing(fs.Arg(0), peer.SharedDir)
+	if err != nil {
+		return fail("failed to encrypt %s: %v", fs.Arg(0), err)
+	}
+	util.Logger.Printf("Encrypted %s into %s", fs.Arg(0), outputPath)
+	fmt.Printf("Encrypted file written to %s\n", outputPath)
+	fmt.Printf("Share link (keep it secret, it contains the decryption key):\n%s\n", link)
+	return exitOK
+}
+
+// runVerify checks that the given files, or every file with a manifest, are complete in the chunk store.
+func runVerify(args []string) int {
+	fs := newFlagSet("verify")
+	node := addNodeFlags(fs)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if err := node.apply(); err != nil {
+		return fail("%v", err)
+	}
+
+	fileHashes := fs.Args()
+	if len(fileHashes) == 0 {
+		files, err := file.StoredFiles(peer.Store)
+		if err != nil {
+			return fail("failed to list stored files: %v", err)
+		}
+		for _, metadata := range files {
+			fileHashes = append(fileHashes, metadata.Hash)
+		}
+	}
+	code := exitOK
+	for _, fileHash := range fileHashes {
+		if err := file.VerifyFile(peer.Store, fileHash); err != nil {
+			code = fail("%s FAILED: %v", fileHash, err)
+			continue
+		}
+		fmt.Printf("%s OK\n", fileHash)
+	}
+	return code
+}
+
+// runStatus prints the state of the local node.
+func runStatus(args []string) int {
+	fs := newFlagSet("status")
+	node := addNodeFlags(fs)
+	output := addOutputFlag(fs)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if !validOutput(*output) {
+		return usageError(fs, "unsupported output format %q", *output)
+	}
+	if err := node.apply(); err != nil {
+		return fail("%v", err)
+	}
+	pins, err := node.loadPins()
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	status, err := peer.NodeStatus(peer.SharedDir, pins)
+	if err != nil {
+		return fail("failed to read node status: %v", err)
+	}
+	if *output == outputJSON {
+		printJSON(status)
+		return exitOK
+	}
+	fmt.Printf("Peer ID:      %q\n", status.PeerID)
+	fmt.Printf("Shared files: %d\n", status.SharedFiles)
+	fmt.Printf("Stored files: %d (%d pinned)\n", status.StoredFiles, status.PinnedFiles)
+	fmt.Printf("Chunks:       %d (%d bytes)\n", status.Chunks, status.ChunkBytes)
+	fmt.Printf("Known peers:  %d (%d banned)\n", status.KnownPeers, len(status.BannedPeers))
+	for _, server := range status.BannedPeers {
+		fmt.Printf("  banned: %s\n", server)
+	}
+	return exitOK
+}
+
+// runGC collects garbage in the chunk store.
+func runGC(args []string) int {
+	fs := newFlagSet("gc")
+	node := addNodeFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "Report what garbage collection would remove without removing anything")
+	quota := fs.Int64("quota", settings.Node.GCQuota, "Maximum size in bytes of the chunk store; cached files are evicted, least recently used first (0 for no quota)")
+	grace := fs.Duration("grace", settings.Node.GCGrace, "Keep unreferenced chunks younger than this, and downloads that stored a chunk more recently")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if err := node.apply(); err != nil {
+		return fail("%v", err)
+	}
+	pins, err := node.loadPins()
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	opts := file.GCOptions{DryRun: *dryRun, MaxBytes: *quota, GracePeriod: *grace}
+	report, err := peer.CollectGarbage(peer.SharedDir, pins, opts)
+	if err != nil {
+		return fail("failed to collect garbage: %v", err)
+	}
+	printGCReport(report, opts)
+	return exitOK
+}
+
+// runScrub re-hashes the chunk store and repairs damaged chunks from the shared files or the -connect peers.
+func runScrub(args []string) int {
+	fs := newFlagSet("scrub")
+	node := addNodeFlags(fs)
+	peerAddresses := addPeersFlag(fs, "Comma-separated list of peers to repair damaged chunks from")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if err := node.apply(); err != nil {
+		return fail("%v", err)
+	}
+
+	report, err := peer.ScrubStore(peer.SharedDir, splitCommaSeparated(*peerAddresses))
+	if err != nil {
+		return fail("failed to scrub chunk store: %v", err)
+	}
+	printScrubReport(report)
+	if len(report.Damaged()) > len(report.Repaired) || len(report.Unreadable) > 0 {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// runPin pins files so garbage collection never evicts them.
+func runPin(args []string) int {
+	return updatePins("pin", args, (*peer.Pins).Pin)
+}
+
+// runUnpin unpins files.
+func runUnpin(args []string) int {
+	return updatePins("unpin", args, (*peer.Pins).Unpin)
+}
+
+// updatePins applies update to the pins file for every file hash given on the command line.
+func updatePins(name string, args []string, update func(*peer.Pins, string) error) int {
+	fs := newFlagSet(name)
+	node := addNodeFlags(fs)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() == 0 {
+		return usageError(fs, "no file hash given")
+	}
+	pins, err := node.loadPins()
+	if err != nil {
+		return fail("%v", err)
+	}
+	for _, fileHash := range fs.Args() {
+		if err := update(pins, fileHash); err != nil {
+			return fail("failed to update pins: %v", err)
+		}
+	}
+	fmt.Println("Pins updated.")
+	return exitOK
+}
+
+// startMeasuring collects the start time and memory stats for performance measurement.
+func startMeasuring() (time.Time, runtime.MemStats) {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	return time.Now(), memStats
+}
+
+// runConfig validates the configuration, which run has already loaded, and prints the settings in effect.
+func runConfig(args []string) int {
+	fs := newFlagSet("config")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() > 0 {
+		return usageError(fs, "unexpected arguments: %v", fs.Args())
+	}
+
+	if settingsPath != "" {
+		fmt.Printf("# Settings from %s and the environment\n", settingsPath)
+	} else {
+		fmt.Printf("# Built-in settings and the environment; no configuration file found\n")
+	}
+	settings.Write(os.Stdout)
+	return exitOK
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"go-to-peer/file"
+	"go-to-peer/peer"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testHash returns a distinct valid file hash.
+func testHash(c byte) string {
+	return strings.Repeat(string(c), 64)
+}
+
+// testCatalog is the merged catalog the stub fetcher returns.
+var testCatalog = []peer.CatalogEntry{
+	{FileMetadata: peer.FileMetadata{Name: "report.pdf", Hash: testHash('a'), Path: "docs/report.pdf"}, Servers: []string{"s1"}},
+	{FileMetadata: peer.FileMetadata{Name: "notes.txt", Hash: testHash('b'), Path: "docs/notes.txt"}, Servers: []string{"s1", "s2"}},
+	{FileMetadata: peer.FileMetadata{Name: "notes.txt", Hash: testHash('c'), Path: "old/notes.txt"}, Servers: []string{"s2"}},
+	{FileMetadata: peer.FileMetadata{Name: testHash('e'), Hash: testHash('f')}, Servers: []string{"s2"}},
+}
+
+func TestResolveTargets(t *testing.T) {
+	shareLink := file.FormatShareLink(testHash('d'), make([]byte, file.ShareKeySize))
+	servers := []string{"s1", "s2"}
+
+	type resolved struct {
+		fileHash string
+		servers  []string
+		err      string
+	}
+	tests := []struct {
+		name    string
+		args    []string
+		all     bool
+		fetches int
+		targets []resolved
+	}{
+		{
+			name:    "name",
+			args:    []string{"report.pdf"},
+			fetches: 1,
+			targets: []resolved{{fileHash: testHash('a'), servers: []string{"s1"}}},
+		},
+		{
+			name:    "glob",
+			args:    []string{"*.pdf"},
+			fetches: 1,
+			targets: []resolved{{fileHash: testHash('a'), servers: []string{"s1"}}},
+		},
+		{
+			name:    "path",
+			args:    []string{"old/*"},
+			fetches: 1,
+			targets: []resolved{{fileHash: testHash('c'), servers: []string{"s2"}}},
+		},
+		{
+			name:    "ambiguous name",
+			args:    []string{"notes.txt"},
+			fetches: 1,
+			targets: []resolved{{err: `"notes.txt" matches 2 files; pass -all`}},
+		},
+		{
+			name:    "ambiguous name with all",
+			args:    []string{"notes.txt"},
+			all:     true,
+			fetches: 1,
+			targets: []resolved{
+				{fileHash: testHash('b'), servers: []string{"s1", "s2"}},
+				{fileHash: testHash('c'), servers: []string{"s2"}},
+			},
+		},
+		{
+			name:    "no match",
+			args:    []string{"*.mp4"},
+			fetches: 1,
+			targets: []resolved{{err: `no file shared by the peers matches "*.mp4"`}},
+		},
+		{
+			name:    "invalid pattern",
+			args:    []string{"[a-"},
+			fetches: 1,
+			targets: []resolved{{err: `invalid pattern "[a-"`}},
+		},
+		{
+			name:    "hash without fetching the catalogs",
+			args:    []string{testHash('9')},
+			targets: []resolved{{fileHash: testHash('9'), servers: servers}},
+		},
+		{
+			name:    "hash takes precedence over a file with that name",
+			args:    []string{testHash('e')},
+			targets: []resolved{{fileHash: testHash('e'), servers: servers}},
+		},
+		{
+			name:    "share link",
+			args:    []string{shareLink},
+			targets: []resolved{{fileHash: testHash('d'), servers: servers}},
+		},
+		{
+			name:    "duplicates",
+			args:    []string{"report.pdf", testHash('a'), "*.pdf", "notes.txt", "notes.txt"},
+			fetches: 1,
+			targets: []resolved{
+				{fileHash: testHash('a'), servers: []string{"s1"}},
+				{err: "matches 2 files"},
+				{err: "matches 2 files"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fetches := 0
+			fetch := func(fetched []string) ([]peer.CatalogEntry, error) {
+				fetches++
+				if !slices.Equal(fetched, servers) {
+					t.Fatalf("fetched the catalogs of %v", fetched)
+				}
+				return testCatalog, nil
+			}
+			targets := resolveTargets(test.args, servers, test.all, fetch)
+			if fetches != test.fetches {
+				t.Fatalf("fetched the catalogs %d times, expected %d", fetches, test.fetches)
+			}
+			if len(targets) != len(test.targets) {
+				t.Fatalf("resolved %d targets, expected %d: %+v", len(targets), len(test.targets), targets)
+			}
+			for i, expected := range test.targets {
+				target := targets[i]
+				if expected.err != "" {
+					if target.err == nil || !strings.Contains(target.err.Error(), expected.err) {
+						t.Fatalf("target %d: got error %v, expected %q", i, target.err, expected.err)
+					}
+					continue
+				}
+				if target.err != nil {
+					t.Fatalf("target %d: %v", i, target.err)
+				}
+				if target.fileHash != expected.fileHash || !slices.Equal(target.servers, expected.servers) {
+					t.Fatalf("target %d: resolved %s on %v, expected %s on %v", i, target.fileHash, target.servers, expected.fileHash, expected.servers)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveTargetsCatalogError(t *testing.T) {
+	fetch := func([]string) ([]peer.CatalogEntry, error) { return nil, errors.New("connection refused") }
+	targets := resolveTargets([]string{testHash('a'), "report.pdf"}, []string{"s1"}, false, fetch)
+	if len(targets) != 2 || targets[0].err != nil {
+		t.Fatalf("resolved %+v", targets)
+	}
+	if err := targets[1].err; err == nil || !strings.Contains(err.Error(), "failed to fetch file catalogs: connection refused") {
+		t.Fatalf("got %v, expected the catalog error", err)
+	}
+}
+
+// TestGetTargetString checks that share links, which hold the decryption key, are never shown.
+func TestGetTargetString(t *testing.T) {
+	shareLink := file.FormatShareLink(testHash('d'), make([]byte, file.ShareKeySize))
+	targets := resolveTargets([]string{shareLink}, nil, false, nil)
+	if s := targets[0].String(); strings.Contains(s, "#") || !strings.Contains(s, testHash('d')) {
+		t.Fatalf("share link shown as %q", s)
+	}
+}
@@ -0,0 +1,374 @@
+// Package config loads the settings of a node from a configuration file and the environment.
+// Settings are resolved in order of precedence: command-line flags, then environment variables,
+// then the configuration file, then the built-in defaults.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"go-to-peer/peer"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPath is the configuration file read when no other file is named.
+const DefaultPath = "go-to-peer.toml"
+
+// PathEnv is the environment variable naming the configuration file.
+const PathEnv = "GTP_CONFIG"
+
+// maxWorkers bounds the number of parallel chunk downloads.
+const maxWorkers = 256
+
+// Config holds the settings of a node.
+type Config struct {
+	LogFile string // File the log is written to.
+	Node    NodeConfig
+	Server  ServerConfig
+	Client  ClientConfig
+	Daemon  DaemonConfig
+}
+
+// NodeConfig holds the settings shared by every command using the local node.
+type NodeConfig struct {
+	PeerID         string        // Peer ID announced to other peers, or "".
+	Peers          []string      // Addresses of the peers to connect to.
+	SharedDir      string        // Directory of the files this node shares.
+	ChunksDir      string        // Root directory of the chunk store.
+	DownloadsDir   string        // Directory downloaded files are written to.
+	ReputationFile string        // File recording peer reputation and bans.
+	PinsFile       string        // File listing pinned files.
+	Compression    string        // Chunk compression: "gzip" or "none".
+	GCQuota        int64         // Maximum size in bytes of the chunk store, or 0.
+	GCGrace        time.Duration // Age below which unreferenced chunks are kept by garbage collection.
+	TLSCert        string        // PEM certificate of the node, or "" to serve plain TCP.
+	TLSKey         string        // PEM private key of TLSCert.
+	TLSCA          string        // PEM certificates of the CAs signing the certificates of peers, or "".
+}
+
+// ServerConfig holds the settings of the serve command.
+type ServerConfig struct {
+	Port          int           // Port to listen on.
+	ACLFile       string        // Access control list, or "" to share every file with every peer.
+	ScrubInterval time.Duration // Interval of background scrubs, or 0.
+	GCInterval    time.Duration // Interval of background garbage collection, or 0.
+}
+
+// ClientConfig holds the settings of downloads.
+type ClientConfig struct {
+	Workers int // Number of chunks downloaded in parallel.
+}
+
+// DaemonConfig holds the settings of the daemon and of the commands talking to it.
+type DaemonConfig struct {
+	Socket     string        // Unix socket of the daemon's control API.
+	CatalogTTL time.Duration // How long the daemon reuses the catalogs of peers.
+	QueueFile  string        // File keeping the download queue of the daemon across restarts.
+	MaxJobs    int           // Number of jobs the daemon downloads at once.
+	MaxRate    int64         // Bytes per second the daemon downloads at most, or 0 for no cap.
+}
+
+// Default returns the built-in settings.
+func Default() Config {
+	return Config{
+		LogFile: "go-to-peer.log",
+		Node: NodeConfig{
+			Peers:          []string{},
+			SharedDir:      "server_files",
+			ChunksDir:      "chunks",
+			DownloadsDir:   "downloads",
+			ReputationFile: "reputation.json",
+			PinsFile:       "pins.json",
+			Compression:    peer.CompressionGzip,
+			GCGrace:        peer.DefaultGCGracePeriod,
+		},
+		Server: ServerConfig{
+			Port: 8080,
+		},
+		Client: ClientConfig{
+			Workers: 10,
+		},
+		Daemon: DaemonConfig{
+			Socket:     "go-to-peer.sock",
+			CatalogTTL: 30 * time.Second,
+			QueueFile:  "queue.json",
+			MaxJobs:    3,
+		},
+	}
+}
+
+// setting ties a key of the configuration file and an environment variable to a field.
+type setting struct {
+	key    string // Dotted key in the configuration file.
+	env    string // Environment variable overriding it.
+	target any    // *string, *[]string, *int, *int64 or *time.Duration.
+}
+
+// settings returns every setting of c. This is the schema of the configuration file.
+func (c *Config) settings() []setting {
+	return []setting{
+		{"log_file", "GTP_LOG_FILE", &c.LogFile},
+		{"node.peer_id", "GTP_PEER_ID", &c.Node.PeerID},
+		{"node.peers", "GTP_PEERS", &c.Node.Peers},
+		{"node.shared_dir", "GTP_SHARED_DIR", &c.Node.SharedDir},
+		{"node.chunks_dir", "GTP_CHUNKS_DIR", &c.Node.ChunksDir},
+		{"node.downloads_dir", "GTP_DOWNLOADS_DIR", &c.Node.DownloadsDir},
+		{"node.reputation_file", "GTP_REPUTATION_FILE", &c.Node.ReputationFile},
+		{"node.pins_file", "GTP_PINS_FILE", &c.Node.PinsFile},
+		{"node.compression", "GTP_COMPRESSION", &c.Node.Compression},
+		{"node.gc_quota", "GTP_GC_QUOTA", &c.Node.GCQuota},
+		{"node.gc_grace", "GTP_GC_GRACE", &c.Node.GCGrace},
+		{"node.tls_cert", "GTP_TLS_CERT", &c.Node.TLSCert},
+		{"node.tls_key", "GTP_TLS_KEY", &c.Node.TLSKey},
+		{"node.tls_ca", "GTP_TLS_CA", &c.Node.TLSCA},
+		{"server.port", "GTP_PORT", &c.Server.Port},
+		{"server.acl_file", "GTP_ACL_FILE", &c.Server.ACLFile},
+		{"server.scrub_interval", "GTP_SCRUB_INTERVAL", &c.Server.ScrubInterval},
+		{"server.gc_interval", "GTP_GC_INTERVAL", &c.Server.GCInterval},
+		{"client.workers", "GTP_WORKERS", &c.Client.Workers},
+		{"daemon.socket", "GTP_SOCKET", &c.Daemon.Socket},
+		{"daemon.catalog_ttl", "GTP_CATALOG_TTL", &c.Daemon.CatalogTTL},
+		{"daemon.queue_file", "GTP_QUEUE_FILE", &c.Daemon.QueueFile},
+		{"daemon.max_jobs", "GTP_MAX_JOBS", &c.Daemon.MaxJobs},
+		{"daemon.max_rate", "GTP_MAX_RATE", &c.Daemon.MaxRate},
+	}
+}
+
+// Load resolves the settings of the node: the built-in defaults, overridden by the configuration
+// file, overridden by the environment. The settings are validated.
+//
+// Parameters:
+// - path: The configuration file, or "" to use $GTP_CONFIG or, if it exists, go-to-peer.toml.
+//
+// Returns:
+// - Config: The settings.
+// - string: The configuration file read, or "" if none was.
+// - error: An error object if the file cannot be read, or a setting is unknown or invalid.
+func Load(path string) (Config, string, error) {
+	config := Default()
+
+	explicit := path != ""
+	if !explicit {
+		path = os.Getenv(PathEnv)
+		explicit = path != ""
+	}
+	if !explicit {
+		path = DefaultPath
+	}
+	f, err := os.Open(path)
+	switch {
+	case err == nil:
+		defer f.Close()
+		if err := config.read(f); err != nil {
+			return config, path, fmt.Errorf("invalid configuration file %s: %w", path, err)
+		}
+	case errors.Is(err, os.ErrNotExist) && !explicit:
+		path = ""
+	default:
+		return config, path, fmt.Errorf("failed to open configuration file: %w", err)
+	}
+
+	if err := config.applyEnv(os.LookupEnv); err != nil {
+		return config, path, err
+	}
+	if err := config.Validate(); err != nil {
+		return config, path, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return config, path, nil
+}
+
+// read overrides the settings with the values of a configuration file.
+func (c *Config) read(r io.Reader) error {
+	values, lines, err := parseTOML(r)
+	if err != nil {
+		return err
+	}
+	for _, s := range c.settings() {
+		value, ok := values[s.key]
+		if !ok {
+			continue
+		}
+		delete(values, s.key)
+		if err := setValue(s.target, value); err != nil {
+			return fmt.Errorf("line %d: %s: %w", lines[s.key], s.key, err)
+		}
+	}
+	for key := range values {
+		return fmt.Errorf("line %d: unknown setting %s", lines[key], key)
+	}
+	return nil
+}
+
+// applyEnv overrides the settings with the environment variables that are set.
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	for _, s := range c.settings() {
+		raw, ok := lookup(s.env)
+		if !ok {
+			continue
+		}
+		var value any = raw
+		switch s.target.(type) {
+		case *[]string:
+			value = splitList(raw)
+		case *int, *int64:
+			n, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %q is not an integer", s.env, raw)
+			}
+			value = n
+		}
+		if err := setValue(s.target, value); err != nil {
+			return fmt.Errorf("invalid %s: %w", s.env, err)
+		}
+	}
+	return nil
+}
+
+// setValue stores a parsed value in the field a setting points to.
+func setValue(target any, value any) error {
+	switch target := target.(type) {
+	case *string:
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("expected a string")
+		}
+		*target = s
+	case *[]string:
+		list, ok := value.([]string)
+		if !ok {
+			return fmt.Errorf("expected an array of strings")
+		}
+		*target = list
+	case *int:
+		n, ok := value.(int64)
+		if !ok || int64(int(n)) != n {
+			return fmt.Errorf("expected an integer")
+		}
+		*target = int(n)
+	case *int64:
+		n, ok := value.(int64)
+		if !ok {
+			return fmt.Errorf("expected an integer")
+		}
+		*target = n
+	case *time.Duration:
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf(`expected a duration such as "90s" or "1h"`)
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf(`invalid duration %q: expected a duration such as "90s" or "1h"`, s)
+		}
+		*target = d
+	}
+	return nil
+}
+
+// splitList splits a comma-separated environment variable, ignoring empty entries.
+func splitList(raw string) []string {
+	list := []string{}
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// optionalSettings are the string settings that may be left empty.
+var optionalSettings = map[string]bool{
+	"node.peer_id":    true,
+	"node.tls_cert":   true,
+	"node.tls_key":    true,
+	"node.tls_ca":     true,
+	"server.acl_file": true,
+}
+
+// Validate checks that the settings are usable.
+//
+// Returns:
+// - error: An error naming the first invalid setting, or nil.
+func (c *Config) Validate() error {
+	for _, s := range c.settings() {
+		if target, ok := s.target.(*string); ok && *target == "" && !optionalSettings[s.key] {
+			return fmt.Errorf("%s must not be empty", s.key)
+		}
+		if target, ok := s.target.(*time.Duration); ok && *target < 0 {
+			return fmt.Errorf("%s must not be negative", s.key)
+		}
+	}
+	if err := peer.ValidatePeerID(c.Node.PeerID); err != nil {
+		return fmt.Errorf("node.peer_id: %w", err)
+	}
+	for _, address := range c.Node.Peers {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return fmt.Errorf("node.peers: invalid address %q: expected host:port", address)
+		}
+	}
+	if c.Node.Compression != "none" {
+		if err := peer.ValidateCompression(c.Node.Compression); err != nil {
+			return fmt.Errorf("node.compression: %w", err)
+		}
+	}
+	if (c.Node.TLSCert == "") != (c.Node.TLSKey == "") {
+		return fmt.Errorf("node.tls_cert and node.tls_key must be set together")
+	}
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		return fmt.Errorf("server.port must be between 1 and 65535")
+	}
+	if c.Node.GCQuota < 0 {
+		return fmt.Errorf("node.gc_quota must not be negative")
+	}
+	if c.Client.Workers < 1 || c.Client.Workers > maxWorkers {
+		return fmt.Errorf("client.workers must be between 1 and %d", maxWorkers)
+	}
+	if c.Daemon.MaxJobs < 1 {
+		return fmt.Errorf("daemon.max_jobs must be at least 1")
+	}
+	if c.Daemon.MaxRate < 0 {
+		return fmt.Errorf("daemon.max_rate must not be negative")
+	}
+	return nil
+}
+
+// Write prints the settings as a configuration file, with the environment variable overriding each one.
+//
+// Parameters:
+// - w: The writer receiving the configuration file.
+func (c *Config) Write(w io.Writer) {
+	table := ""
+	for _, s := range c.settings() {
+		name := s.key
+		if dot := strings.IndexByte(s.key, '.'); dot >= 0 {
+			if s.key[:dot] != table {
+				table = s.key[:dot]
+				fmt.Fprintf(w, "\n[%s]\n", table)
+			}
+			name = s.key[dot+1:]
+		}
+
+		var value string
+		switch target := s.target.(type) {
+		case *string:
+			value = strconv.Quote(*target)
+		case *[]string:
+			quoted := make([]string, len(*target))
+			for i, item := range *target {
+				quoted[i] = strconv.Quote(item)
+			}
+			value = "[" + strings.Join(quoted, ", ") + "]"
+		case *int:
+			value = strconv.Itoa(*target)
+		case *int64:
+			value = strconv.FormatInt(*target, 10)
+		case *time.Duration:
+			value = strconv.Quote(target.String())
+		}
+		fmt.Fprintf(w, "%s = %s # $%s\n", name, value, s.env)
+	}
+}
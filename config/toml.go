@@ -0,0 +1,225 @@
+// Package config loads the settings of a node from a configuration file and the environment.
+// This file contains a parser for the subset of TOML used by configuration files: comments,
+// [table] headers, and key = value pairs whose values are strings, integers, booleans or arrays
+// of strings. Arrays may span several lines.
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// parseTOML parses a configuration file into a map from dotted keys ("table.key") to values,
+// which are strings, int64s, bools or []strings.
+//
+// Parameters:
+// - r: The configuration file.
+//
+// Returns:
+// - map[string]any: The values by dotted key.
+// - map[string]int: The line on which each key is set, for error messages.
+// - error: An error object naming the line of the first syntax error.
+func parseTOML(r io.Reader) (map[string]any, map[string]int, error) {
+	values := make(map[string]any)
+	lines := make(map[string]int)
+	table := ""
+
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		start := lineNumber
+		line := stripComment(scanner.Text())
+
+		// An array continues until its closing bracket.
+		for strings.Contains(line, "[") && !strings.HasPrefix(strings.TrimSpace(line), "[") && !arrayClosed(line) {
+			if !scanner.Scan() {
+				return nil, nil, fmt.Errorf("line %d: unterminated array", start)
+			}
+			lineNumber++
+			line += " " + stripComment(scanner.Text())
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, nil, fmt.Errorf("line %d: invalid table header %q", start, line)
+			}
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			if !validKey(table) {
+				return nil, nil, fmt.Errorf("line %d: invalid table name %q", start, table)
+			}
+			continue
+		}
+
+		key, raw, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !found || !validKey(key) {
+			return nil, nil, fmt.Errorf("line %d: expected key = value", start)
+		}
+		if table != "" {
+			key = table + "." + key
+		}
+		if _, ok := values[key]; ok {
+			return nil, nil, fmt.Errorf("line %d: %s is set twice", start, key)
+		}
+		value, err := parseValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %s: %w", start, key, err)
+		}
+		values[key] = value
+		lines[key] = start
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return values, lines, nil
+}
+
+// parseValue parses the value of a key.
+func parseValue(raw string) (any, error) {
+	switch {
+	case raw == "":
+		return nil, fmt.Errorf("missing value")
+	case raw == "true" || raw == "false":
+		return raw == "true", nil
+	case strings.HasPrefix(raw, `"`):
+		s, rest, err := parseString(raw)
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(rest) != "" {
+			return nil, fmt.Errorf("unexpected text after string: %q", rest)
+		}
+		return s, nil
+	case strings.HasPrefix(raw, "["):
+		return parseArray(raw)
+	default:
+		n, err := strconv.ParseInt(strings.ReplaceAll(raw, "_", ""), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q (strings must be quoted)", raw)
+		}
+		return n, nil
+	}
+}
+
+// parseString parses a basic string at the start of raw and returns it with the text following it.
+func parseString(raw string) (string, string, error) {
+	var b strings.Builder
+	for i := 1; i < len(raw); i++ {
+		switch c := raw[i]; c {
+		case '"':
+			return b.String(), raw[i+1:], nil
+		case '\\':
+			i++
+			if i == len(raw) {
+				return "", "", fmt.Errorf("unterminated string")
+			}
+			switch raw[i] {
+			case '"', '\\':
+				b.WriteByte(raw[i])
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				return "", "", fmt.Errorf("unsupported escape \\%c", raw[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string")
+}
+
+// parseArray parses an array of strings, which may end with a trailing comma.
+func parseArray(raw string) ([]string, error) {
+	rest := strings.TrimSpace(raw[1:])
+	items := []string{}
+	for {
+		if strings.HasPrefix(rest, "]") {
+			if strings.TrimSpace(rest[1:]) != "" {
+				return nil, fmt.Errorf("unexpected text after array: %q", rest[1:])
+			}
+			return items, nil
+		}
+		if !strings.HasPrefix(rest, `"`) {
+			return nil, fmt.Errorf("arrays may only contain strings")
+		}
+		item, after, err := parseString(rest)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		rest = strings.TrimSpace(after)
+		if strings.HasPrefix(rest, ",") {
+			rest = strings.TrimSpace(rest[1:])
+		} else if !strings.HasPrefix(rest, "]") {
+			return nil, fmt.Errorf("expected , or ] in array")
+		}
+	}
+}
+
+// stripComment removes a comment from a line, ignoring # inside strings.
+func stripComment(line string) string {
+	inString := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			if inString {
+				i++
+			}
+		case '"':
+			inString = !inString
+		case '#':
+			if !inString {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+// arrayClosed reports whether every bracket outside strings in a line is closed.
+func arrayClosed(line string) bool {
+	depth := 0
+	inString := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			if inString {
+				i++
+			}
+		case '"':
+			inString = !inString
+		case '[':
+			if !inString {
+				depth++
+			}
+		case ']':
+			if !inString {
+				depth--
+			}
+		}
+	}
+	return depth <= 0
+}
+
+// validKey reports whether a key or table name is a bare TOML key: letters, digits, '_' and '-'.
+func validKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
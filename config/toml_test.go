@@ -0,0 +1,134 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected map[string]any
+		lines    map[string]int
+	}{
+		{
+			name:     "empty",
+			input:    "",
+			expected: map[string]any{},
+			lines:    map[string]int{},
+		},
+		{
+			name:     "top-level keys",
+			input:    "name = \"node\"\nport = 8080\n",
+			expected: map[string]any{"name": "node", "port": int64(8080)},
+			lines:    map[string]int{"name": 1, "port": 2},
+		},
+		{
+			name:     "tables",
+			input:    "top = 1\n[server]\nport = 8080\n\n[ client ]\nport = 9090\n",
+			expected: map[string]any{"top": int64(1), "server.port": int64(8080), "client.port": int64(9090)},
+			lines:    map[string]int{"top": 1, "server.port": 3, "client.port": 6},
+		},
+		{
+			name:     "strings",
+			input:    `plain = "a b"` + "\n" + `empty = ""` + "\n" + `escaped = "quote \" backslash \\ newline \n tab \t"` + "\n" + `hash = "not # a comment"`,
+			expected: map[string]any{"plain": "a b", "empty": "", "escaped": "quote \" backslash \\ newline \n tab \t", "hash": "not # a comment"},
+			lines:    map[string]int{"plain": 1, "empty": 2, "escaped": 3, "hash": 4},
+		},
+		{
+			name:     "integers",
+			input:    "zero = 0\nnegative = -42\nplus = +7\nunderscores = 1_048_576\nlarge = 9223372036854775807",
+			expected: map[string]any{"zero": int64(0), "negative": int64(-42), "plus": int64(7), "underscores": int64(1048576), "large": int64(9223372036854775807)},
+			lines:    map[string]int{"zero": 1, "negative": 2, "plus": 3, "underscores": 4, "large": 5},
+		},
+		{
+			name:     "booleans",
+			input:    "yes = true\nno = false",
+			expected: map[string]any{"yes": true, "no": false},
+			lines:    map[string]int{"yes": 1, "no": 2},
+		},
+		{
+			name:     "arrays",
+			input:    "empty = []\none = [\"a\"]\ntrailing = [ \"a\" , \"b\", ]\nbrackets = [\"[x]\", \"]\"]",
+			expected: map[string]any{"empty": []string{}, "one": []string{"a"}, "trailing": []string{"a", "b"}, "brackets": []string{"[x]", "]"}},
+			lines:    map[string]int{"empty": 1, "one": 2, "trailing": 3, "brackets": 4},
+		},
+		{
+			name:     "multiline array",
+			input:    "peers = [\n  \"a:1\", # first\n  # nothing\n  \"b:2\",\n]\nafter = 1",
+			expected: map[string]any{"peers": []string{"a:1", "b:2"}, "after": int64(1)},
+			lines:    map[string]int{"peers": 1, "after": 6},
+		},
+		{
+			name:     "comments and blank lines",
+			input:    "# header\n\n   \n[node] # the node\nport = 1 # trailing\n  # indented\nname = \"x\"#tight",
+			expected: map[string]any{"node.port": int64(1), "node.name": "x"},
+			lines:    map[string]int{"node.port": 5, "node.name": 7},
+		},
+		{
+			name:     "same key in different tables",
+			input:    "[a]\nkey = 1\n[b]\nkey = 2",
+			expected: map[string]any{"a.key": int64(1), "b.key": int64(2)},
+			lines:    map[string]int{"a.key": 2, "b.key": 4},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values, lines, err := parseTOML(strings.NewReader(test.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(values, test.expected) {
+				t.Fatalf("parsed %#v, expected %#v", values, test.expected)
+			}
+			if !reflect.DeepEqual(lines, test.lines) {
+				t.Fatalf("parsed lines %v, expected %v", lines, test.lines)
+			}
+		})
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{"duplicate key", "port = 1\nport = 2", "line 2: port is set twice"},
+		{"duplicate key in table", "[server]\nport = 1\n\n[server]\nport = 2", "line 5: server.port is set twice"},
+		{"missing value", "# comment\nport =", "line 2: port: missing value"},
+		{"missing equals", "\n\nport 8080", "line 3: expected key = value"},
+		{"invalid key", "bad key = 1", "line 1: expected key = value"},
+		{"dotted key", "server.port = 1", "line 1: expected key = value"},
+		{"unquoted string", "name = node", `line 1: name: invalid value "node" (strings must be quoted)`},
+		{"integer overflow", "n = 9223372036854775808", "line 1: n: invalid value"},
+		{"float", "n = 1.5", "line 1: n: invalid value"},
+		{"unterminated string", "a = 1\nname = \"node", "line 2: name: unterminated string"},
+		{"trailing backslash", `name = "node\`, "line 1: name: unterminated string"},
+		{"unsupported escape", `name = "\x41"`, `line 1: name: unsupported escape \x`},
+		{"text after string", `name = "a" "b"`, "line 1: name: unexpected text after string"},
+		{"non-string array", "peers = [1, 2]", "line 1: peers: arrays may only contain strings"},
+		{"missing comma", `peers = ["a" "b"]`, "line 1: peers: expected , or ] in array"},
+		{"text after array", `peers = ["a"] x`, "line 1: peers: unexpected text after array"},
+		{"unterminated array", "a = 1\npeers = [\n\"a\",\n\"b\"", "line 2: unterminated array"},
+		{"error inside multiline array", "peers = [\n\"a\",\n3,\n]\nport = \"x\"\nport = 1", "line 1: peers: arrays may only contain strings"},
+		{"line after multiline array", "peers = [\n\"a\",\n]\nport = 1\nport = 2", "line 5: port is set twice"},
+		{"unclosed table header", "[server\nport = 1", "line 1: invalid table header"},
+		{"array of tables", "[[server]]", "line 1: invalid table header"},
+		{"empty table name", "\n[ ]", "line 2: invalid table name"},
+		{"dotted table name", "[server.limits]", "line 1: invalid table name"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := parseTOML(strings.NewReader(test.input))
+			if err == nil {
+				t.Fatalf("parsed %q", test.input)
+			}
+			if !strings.HasPrefix(err.Error(), test.err) {
+				t.Fatalf("got %q, expected %q", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,389 @@
+// Package main is the entry point of the application, handling user commands via a CLI interface.
+// This file contains the daemon command, the queue command managing its downloads, and the way
+// ls and get hand their work to a running daemon.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"go-to-peer/daemon"
+	"go-to-peer/file"
+	"go-to-peer/peer"
+	"go-to-peer/util"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// daemonOptions holds the flags of the commands that use a running daemon.
+type daemonOptions struct {
+	socket   string
+	noDaemon bool
+}
+
+// addDaemonFlags registers the flags of the commands that use a running daemon.
+func addDaemonFlags(fs *flag.FlagSet) *daemonOptions {
+	o := &daemonOptions{}
+	fs.StringVar(&o.socket, "socket", settings.Daemon.Socket, "Unix socket of the daemon, used when a daemon is listening on it")
+	fs.BoolVar(&o.noDaemon, "no-daemon", false, "Contact the peers directly even if a daemon is running")
+	return o
+}
+
+// dial returns a client of the running daemon, or nil if none is listening or -no-daemon is set.
+func (o *daemonOptions) dial() *daemon.Client {
+	if o.noDaemon {
+		return nil
+	}
+	client, err := daemon.Dial(o.socket)
+	if err != nil {
+		return nil
+	}
+	util.Logger.Printf("Using the daemon listening on %s", o.socket)
+	return client
+}
+
+// runDaemon runs a long-running node serving the control API until it is interrupted.
+func runDaemon(args []string) int {
+	fs := newFlagSet("daemon")
+	node := addNodeFlags(fs)
+	socket := fs.String("socket", settings.Daemon.Socket, "Unix socket to serve the control API on")
+	peerAddresses := addPeersFlag(fs, "Comma-separated list of peers to download from and list, unless a command names others")
+	workers := fs.Int("workers", settings.Client.Workers, "Number of chunks downloaded in parallel, shared by the running jobs")
+	catalogTTL := fs.Duration("catalog-ttl", settings.Daemon.CatalogTTL, "How long the catalogs of peers are reused (0 to fetch them for every request)")
+	queueFile := fs.String("queue", settings.Daemon.QueueFile, "File keeping the download queue across restarts (\"\" to keep it in memory)")
+	maxJobs := fs.Int("max-jobs", settings.Daemon.MaxJobs, "Number of jobs downloaded at once")
+	maxRate := fs.Int64("max-rate", settings.Daemon.MaxRate, "Bytes per second downloaded by all jobs together (0 for no cap)")
+	serve := fs.Bool("serve", false, "Also share the files in the shared directory with other peers, as serve does")
+	port := fs.Int("port", settings.Server.Port, "Port to share files on with -serve")
+	aclPath := fs.String("acl", settings.Server.ACLFile, "Path to a JSON access control list restricting which peers may access shared files, with -serve")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() > 0 {
+		return usageError(fs, "unexpected argument %q", fs.Arg(0))
+	}
+	if *workers < 1 {
+		return usageError(fs, "-workers must be at least 1")
+	}
+	if *catalogTTL < 0 {
+		return usageError(fs, "-catalog-ttl must not be negative")
+	}
+	if *maxJobs < 1 {
+		return usageError(fs, "-max-jobs must be at least 1")
+	}
+	if *maxRate < 0 {
+		return usageError(fs, "-max-rate must not be negative")
+	}
+	if err := node.apply(); err != nil {
+		return fail("%v", err)
+	}
+	peer.DownloadWorkers = *workers
+	peer.CatalogCacheTTL = *catalogTTL
+	peer.MaxDownloadRate = *maxRate
+	options := daemon.Options{
+		Peers:        splitCommaSeparated(*peerAddresses),
+		DownloadsDir: settings.Node.DownloadsDir,
+		QueueFile:    *queueFile,
+		MaxJobs:      *maxJobs,
+		Slots:        *workers,
+	}
+	if *serve {
+		if *aclPath != "" {
+			if err := loadServerACL(*aclPath); err != nil {
+				return fail("%v", err)
+			}
+		}
+		options.Port = *port
+	}
+
+	d, err := daemon.New(options)
+	if err != nil {
+		return fail("%v", err)
+	}
+	listener, err := daemon.Listen(*socket)
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	serveErr := make(chan error, 1)
+	if *serve {
+		// The server runs until the process exits; it only returns if it cannot listen.
+		go func() {
+			serveErr <- peer.StartServer(strconv.Itoa(*port))
+			stop()
+		}()
+	}
+	fmt.Printf("Daemon listening on %s\n", *socket)
+	err = d.Serve(ctx, listener)
+	peer.CloseIdleConnections()
+	select {
+	case err := <-serveErr:
+		return fail("daemon stopped: %v", err)
+	default:
+	}
+	if err != nil {
+		return fail("daemon stopped: %v", err)
+	}
+	util.Logger.Println("Daemon stopped")
+	return exitOK
+}
+
+// runQueue lists the downloads of the daemon, pauses, resumes, cancels or reprioritizes some of
+// them, or clears those that are done or cancelled.
+func runQueue(args []string) int {
+	fs := newFlagSet("queue")
+	socket := fs.String("socket", settings.Daemon.Socket, "Unix socket of the daemon")
+	output := addOutputFlag(fs)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if !validOutput(*output) {
+		return usageError(fs, "unsupported output format %q", *output)
+	}
+	client, err := daemon.Dial(*socket)
+	if err != nil {
+		return fail("no daemon is listening on %s; start one with '%s daemon'", *socket, programName)
+	}
+
+	switch {
+	case fs.NArg() == 0 || fs.Arg(0) == "list":
+		jobs, err := client.Jobs()
+		if err != nil {
+			return fail("%v", err)
+		}
+		if *output == outputJSON {
+			printJSON(jobs)
+		} else {
+			printJobs(jobs)
+		}
+		return exitOK
+	case fs.Arg(0) == "clear":
+		if fs.NArg() > 1 {
+			return usageError(fs, "unexpected argument %q", fs.Arg(1))
+		}
+		jobs, err := client.Clear()
+		if err != nil {
+			return fail("%v", err)
+		}
+		if *output == outputJSON {
+			printJSON(jobs)
+		} else {
+			fmt.Printf("Cleared %d finished jobs\n", len(jobs))
+		}
+		return exitOK
+	}
+
+	var apply func(id int) (daemon.Job, error)
+	ids := fs.Args()[1:]
+	switch fs.Arg(0) {
+	case "pause":
+		apply = client.Pause
+	case "resume":
+		apply = client.Resume
+	case "cancel":
+		apply = client.Cancel
+	case "priority":
+		if fs.NArg() < 2 {
+			return usageError(fs, "no priority given")
+		}
+		priority := fs.Arg(1)
+		if err := daemon.ValidatePriority(priority); err != nil {
+			return usageError(fs, "%v", err)
+		}
+		apply = func(id int) (daemon.Job, error) { return client.SetPriority(id, priority) }
+		ids = ids[1:]
+	default:
+		return usageError(fs, "unknown action %q", fs.Arg(0))
+	}
+	if len(ids) == 0 {
+		return usageError(fs, "no job ID given")
+	}
+	code := exitOK
+	for _, arg := range ids {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			return usageError(fs, "invalid job ID %q", arg)
+		}
+		job, err := apply(id)
+		if err != nil {
+			code = fail("%v", err)
+			continue
+		}
+		if *output == outputJSON {
+			printJSON(job)
+		} else {
+			fmt.Printf("Job %d is %s with %s priority\n", job.ID, job.State, job.Priority)
+		}
+	}
+	return code
+}
+
+// printJobs prints the jobs of the daemon as a table.
+func printJobs(jobs []daemon.Job) {
+	if len(jobs) == 0 {
+		fmt.Println("No downloads queued")
+		return
+	}
+	fmt.Printf("%-5s %-9s %-8s %8s  %s\n", "ID", "STATE", "PRIORITY", "PROGRESS", "FILE")
+	for _, job := range jobs {
+		progress := "-"
+		switch {
+		case job.State == daemon.StateDone:
+			progress = "100%"
+		case job.Bytes > 0:
+			progress = fmt.Sprintf("%d%%", 100*job.Done/job.Bytes)
+		}
+		name := job.Name
+		if name == "" {
+			name = job.FileHash
+		}
+		fmt.Printf("%-5d %-9s %-8s %8s  %s\n", job.ID, job.State, job.Priority, progress, name)
+		switch {
+		case job.Output != "":
+			fmt.Printf("      -> %s\n", job.Output)
+		case job.Error != "":
+			fmt.Printf("      error: %s\n", job.Error)
+		}
+	}
+}
+
+// daemonGetOptions holds the flags of get that apply to downloads queued on the daemon.
+type daemonGetOptions struct {
+	priority string
+	output   string
+	progress string
+	detach   bool
+}
+
+// getWithDaemon queues the downloads of get on the daemon and, unless detached, follows their
+// progress until they stop. Interrupting the command stops following them, not the downloads.
+func getWithDaemon(client *daemon.Client, targets []getTarget, dest file.Destination, options daemonGetOptions) int {
+	// The daemon resolves relative paths from its own working directory.
+	var err error
+	if dest.Dir != "" {
+		if dest.Dir, err = filepath.Abs(dest.Dir); err != nil {
+			return fail("%v", err)
+		}
+	}
+	if dest.Path != "" {
+		if dest.Path, err = filepath.Abs(dest.Path); err != nil {
+			return fail("%v", err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var events *daemon.EventStream
+	if !options.detach {
+		// Subscribe before queuing, so that no event of the new jobs is missed.
+		if events, err = client.Events(ctx); err != nil {
+			return fail("%v", err)
+		}
+		defer events.Close()
+	}
+
+	code := exitOK
+	pending := make(map[int]getTarget)
+	for _, target := range targets {
+		result := resultJSON{Event: "result", FileHash: target.fileHash, ShareLink: target.shareLink, Name: target.name, Pattern: target.pattern}
+		if target.err != nil {
+			code = reportFailure(result, target, options.output, target.err)
+			continue
+		}
+		request := daemon.JobRequest{
+			Target:    target.fileHash,
+			Name:      target.name,
+			Servers:   target.servers,
+			Dir:       dest.Dir,
+			Path:      dest.Path,
+			Overwrite: dest.Overwrite,
+			InPlace:   dest.InPlace,
+			Priority:  options.priority,
+		}
+		if target.shareLink {
+			request.Target = target.arg
+		}
+		job, err := client.Add(request)
+		if err != nil {
+			code = reportFailure(result, target, options.output, err)
+			continue
+		}
+		if options.output == outputJSON {
+			printJSON(queuedEventJSON{Event: "queued", JobID: job.ID, FileHash: job.FileHash})
+		} else {
+			fmt.Printf("Queued job %d: %s\n", job.ID, target)
+		}
+		pending[job.ID] = target
+	}
+	if options.detach || len(pending) == 0 {
+		return code
+	}
+
+	reporter, display := newGetReporter(options.output, options.progress, os.Stdout)
+	if display != nil {
+		defer display.close()
+	}
+	for len(pending) > 0 {
+		event, err := events.Next()
+		if err != nil {
+			if display != nil {
+				display.finish()
+			}
+			if ctx.Err() != nil {
+				fmt.Fprintf(os.Stderr, "Stopped waiting; the downloads continue in the daemon (see '%s queue')\n", programName)
+				return exitFailure
+			}
+			return fail("lost the connection to the daemon: %v; the downloads continue in it", err)
+		}
+		target, ok := pending[event.JobID]
+		if !ok {
+			continue
+		}
+		switch {
+		case event.Type == daemon.EventJob:
+			job := event.Job
+			if job == nil || !job.Stopped() {
+				continue
+			}
+			delete(pending, job.ID)
+			if display != nil {
+				display.finish()
+			}
+			result := resultJSON{Event: "result", FileHash: job.FileHash, JobID: job.ID, ShareLink: job.ShareLink, Name: target.name, Pattern: target.pattern,
+				DurationMS: job.Finished.Sub(job.Started).Milliseconds()}
+			switch job.State {
+			case daemon.StateDone:
+				result.OK, result.Path = true, job.Output
+				if options.output == outputJSON {
+					printJSON(result)
+				} else {
+					fmt.Printf("Downloaded %s\n", job.Output)
+				}
+			case daemon.StateFailed:
+				code = reportFailure(result, target, options.output, errors.New(job.Error))
+			default:
+				code = reportFailure(result, target, options.output, fmt.Errorf("job %d was %s", job.ID, job.State))
+			}
+		case reporter == nil:
+		case event.Type == daemon.EventStart:
+			reporter.DownloadStarted(peer.DownloadInfo{FileHash: event.FileHash, Name: event.Name, Chunks: event.Chunks, Bytes: event.Bytes})
+		case event.Type == daemon.EventReceived:
+			reporter.Received(event.Server, event.ChunkID, event.Bytes)
+		case event.Type == daemon.EventChunk:
+			chunk := peer.ChunkEvent{FileHash: event.FileHash, ChunkID: event.ChunkID, Server: event.Server, Size: event.Bytes,
+				Duration: time.Duration(event.DurationMS) * time.Millisecond}
+			if event.Error != "" {
+				chunk.Err = errors.New(event.Error)
+			}
+			reporter.ChunkFinished(chunk)
+		}
+	}
+	return code
+}
@@ -0,0 +1,428 @@
+// Package daemon runs a long-running node that keeps its connections to peers, their catalogs and
+// a queue of downloads alive between commands.
+// This file serves the control API: JSON over HTTP on a Unix socket, which only the user running
+// the daemon may connect to.
+//
+//	GET    /v1/status             the state of the daemon
+//	GET    /v1/catalog            the merged catalog of the peers (?peers=a,b to choose them, ?refresh=true to skip the cache)
+//	GET    /v1/peers              the servers the daemon is connected to, and the peers downloading from it
+//	GET    /v1/jobs               every job
+//	POST   /v1/jobs               queue a download described by a JobRequest
+//	DELETE /v1/jobs               remove the jobs that are done or cancelled
+//	GET    /v1/jobs/{id}          a job
+//	POST   /v1/jobs/{id}/pause    pause a job; likewise resume and cancel
+//	POST   /v1/jobs/{id}/priority change the priority of a job to that of a PriorityRequest
+//	GET    /v1/events             newline-delimited JSON events, until the client disconnects
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-to-peer/peer"
+	"go-to-peer/util"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shutdownTimeout bounds how long the daemon waits for API requests in progress when it stops.
+const shutdownTimeout = 5 * time.Second
+
+// Status is the state of the daemon.
+type Status struct {
+	PID     int            `json:"pid"`
+	Started time.Time      `json:"started"`
+	Peers   []string       `json:"peers"`
+	Port    int            `json:"port,omitempty"` // Port the daemon shares files on, if it does.
+	Jobs    map[string]int `json:"jobs"`           // Number of jobs in each state.
+}
+
+// Peers describes the peers of the daemon: the servers it downloads from and the clients
+// downloading from it, if it shares files.
+type Peers struct {
+	Servers []PeerStatus      `json:"servers"`
+	Clients []peer.ClientInfo `json:"clients"`
+}
+
+// PeerStatus describes the connections of the daemon to a server and what it observed about it.
+type PeerStatus struct {
+	Address    string  `json:"address"`
+	Active     int     `json:"active"`     // Connections running a request.
+	Idle       int     `json:"idle"`       // Connections kept open for later requests.
+	Downloaded int64   `json:"downloaded"` // Bytes downloaded from the server, across downloads.
+	Throughput float64 `json:"throughput"` // Average download rate from the server, in bytes per second.
+	Banned     bool    `json:"banned"`
+}
+
+// PriorityRequest changes the priority of a job.
+type PriorityRequest struct {
+	Priority string `json:"priority"`
+}
+
+// Catalog is the merged catalog of the peers.
+type Catalog struct {
+	Files   []peer.CatalogEntry `json:"files"`
+	Servers []ServerStatus      `json:"servers"`
+	Error   string              `json:"error,omitempty"` // Why no server answered, if none did.
+}
+
+// ServerStatus is whether a server answered a catalog request.
+type ServerStatus struct {
+	Address   string `json:"address"`
+	Available bool   `json:"available"`
+	Files     int    `json:"files"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Err returns why no server answered, or nil.
+func (c Catalog) Err() error {
+	if c.Error == "" {
+		return nil
+	}
+	return errors.New(c.Error)
+}
+
+// Availability converts the servers of the catalog for the peer package.
+func (c Catalog) Availability() []peer.ServerAvailability {
+	availability := make([]peer.ServerAvailability, len(c.Servers))
+	for i, server := range c.Servers {
+		availability[i] = peer.ServerAvailability{Address: server.Address, Available: server.Available, Files: server.Files}
+		if server.Error != "" {
+			availability[i].Err = errors.New(server.Error)
+		}
+	}
+	return availability
+}
+
+// Serve runs the daemon: it downloads the queued jobs and serves the control API on a listener
+// created by Listen until ctx is cancelled. The jobs running when the daemon stops are queued
+// again, and resume when it next starts.
+//
+// Parameters:
+// - ctx: Stops the daemon.
+// - listener: The Unix socket of the control API; Serve closes it.
+//
+// Returns:
+// - error: An error object if serving the API fails.
+func (d *Daemon) Serve(ctx context.Context, listener net.Listener) error {
+	server := &http.Server{Handler: d.handler()}
+	server.RegisterOnShutdown(d.closeSubscribers)
+
+	runCtx, stopRunning := context.WithCancel(ctx)
+	defer stopRunning()
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		d.run(runCtx)
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	util.Logger.Printf("Daemon listening on %s", listener.Addr())
+	err := server.Serve(listener)
+	stopRunning()
+	<-stopped
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Listen creates the Unix socket of the control API, replacing a stale socket left by a daemon
+// that did not stop cleanly. Only the current user may connect to it.
+//
+// Parameters:
+// - socketPath: The path of the socket.
+//
+// Returns:
+// - net.Listener: The socket, which is removed when closed.
+// - error: An error object if the socket cannot be created, or another daemon listens on it.
+func Listen(socketPath string) (net.Listener, error) {
+	if _, err := os.Stat(socketPath); err == nil {
+		if conn, err := net.DialTimeout("unix", socketPath, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("a daemon is already listening on %s", socketPath)
+		}
+		if err := os.Remove(socketPath); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+
+	// The API can write files anywhere the daemon can, so only its user may use it. The socket is
+	// created in a directory only that user may enter and moved into place once restricted, so no
+	// other user can connect to it in between.
+	dir, err := os.MkdirTemp(filepath.Dir(socketPath), ".socket-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the directory of %s: %w", socketPath, err)
+	}
+	defer os.RemoveAll(dir)
+	tmpPath := filepath.Join(dir, "socket")
+	listener, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", socketPath, err)
+	}
+	if err := os.Chmod(tmpPath, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict access to %s: %w", socketPath, err)
+	}
+	if err := os.Rename(tmpPath, socketPath); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to listen on %s: %w", socketPath, err)
+	}
+	// The listener would only remove the socket under its temporary path.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	return &socketListener{Listener: listener, path: socketPath}, nil
+}
+
+// socketListener is a listener on a Unix socket moved into place after it was created, which
+// removes the socket when closed.
+type socketListener struct {
+	net.Listener
+	path string
+	once sync.Once
+}
+
+// Close implements net.Listener.
+func (l *socketListener) Close() error {
+	err := l.Listener.Close()
+	l.once.Do(func() { os.Remove(l.path) })
+	return err
+}
+
+// handler routes the requests of the control API.
+func (d *Daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/status", d.handleStatus)
+	mux.HandleFunc("GET /v1/catalog", d.handleCatalog)
+	mux.HandleFunc("GET /v1/peers", d.handlePeers)
+	mux.HandleFunc("GET /v1/jobs", d.handleJobs)
+	mux.HandleFunc("POST /v1/jobs", d.handleAddJob)
+	mux.HandleFunc("DELETE /v1/jobs", d.handleClearJobs)
+	mux.HandleFunc("GET /v1/jobs/{id}", d.handleJob)
+	mux.HandleFunc("POST /v1/jobs/{id}/priority", d.handleJobPriority)
+	mux.HandleFunc("POST /v1/jobs/{id}/{action}", d.handleJobAction)
+	mux.HandleFunc("GET /v1/events", d.handleEvents)
+	return mux
+}
+
+func (d *Daemon) handleStatus(w http.ResponseWriter, _ *http.Request) {
+	status := Status{PID: os.Getpid(), Started: d.started, Peers: d.options.Peers, Port: d.options.Port, Jobs: make(map[string]int)}
+	for _, job := range d.Jobs() {
+		status.Jobs[job.State]++
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (d *Daemon) handleCatalog(w http.ResponseWriter, r *http.Request) {
+	peers := d.options.Peers
+	if list := r.URL.Query().Get("peers"); list != "" {
+		peers = strings.Split(list, ",")
+	}
+	if refresh, _ := strconv.ParseBool(r.URL.Query().Get("refresh")); refresh {
+		peer.InvalidateCatalogs()
+	}
+	entries, availability, err := peer.FetchMergedCatalog(peers)
+	catalog := Catalog{Files: entries, Servers: []ServerStatus{}}
+	if catalog.Files == nil {
+		catalog.Files = []peer.CatalogEntry{}
+	}
+	for _, server := range availability {
+		status := ServerStatus{Address: server.Address, Available: server.Available, Files: server.Files}
+		if server.Err != nil {
+			status.Error = server.Err.Error()
+		}
+		catalog.Servers = append(catalog.Servers, status)
+	}
+	if err != nil {
+		catalog.Error = err.Error()
+	}
+	writeJSON(w, http.StatusOK, catalog)
+}
+
+func (d *Daemon) handlePeers(w http.ResponseWriter, _ *http.Request) {
+	// The daemon's own peers come first, then the other servers jobs are downloading from.
+	peers := Peers{Servers: []PeerStatus{}, Clients: peer.ConnectedClients()}
+	index := make(map[string]int)
+	add := func(address string) *PeerStatus {
+		if i, ok := index[address]; ok {
+			return &peers.Servers[i]
+		}
+		stats := peer.PeerReputation.Stats(address)
+		index[address] = len(peers.Servers)
+		peers.Servers = append(peers.Servers, PeerStatus{
+			Address:    address,
+			Downloaded: stats.Bytes,
+			Throughput: stats.Throughput(),
+			Banned:     peer.PeerReputation.IsBanned(address),
+		})
+		return &peers.Servers[len(peers.Servers)-1]
+	}
+	for _, address := range d.options.Peers {
+		add(address)
+	}
+	for _, conns := range peer.OpenConnections() {
+		server := add(conns.Address)
+		server.Active, server.Idle = conns.Active, conns.Idle
+	}
+	writeJSON(w, http.StatusOK, peers)
+}
+
+func (d *Daemon) handleJobs(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, d.Jobs())
+}
+
+func (d *Daemon) handleAddJob(w http.ResponseWriter, r *http.Request) {
+	var request JobRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&request); err != nil {
+		writeError(w, fmt.Errorf("invalid job request: %w", err))
+		return
+	}
+	job, err := d.Add(request)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, job)
+}
+
+func (d *Daemon) handleClearJobs(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, d.Clear())
+}
+
+func (d *Daemon) handleJobPriority(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, fmt.Errorf("%w: %q", ErrJobNotFound, r.PathValue("id")))
+		return
+	}
+	var request PriorityRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&request); err != nil {
+		writeError(w, fmt.Errorf("invalid priority request: %w", err))
+		return
+	}
+	job, err := d.SetPriority(id, request.Priority)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func (d *Daemon) handleJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, fmt.Errorf("%w: %q", ErrJobNotFound, r.PathValue("id")))
+		return
+	}
+	job, err := d.Job(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func (d *Daemon) handleJobAction(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, fmt.Errorf("%w: %q", ErrJobNotFound, r.PathValue("id")))
+		return
+	}
+	var job Job
+	switch action := r.PathValue("action"); action {
+	case "pause":
+		job, err = d.Pause(id)
+	case "resume":
+		job, err = d.Resume(id)
+	case "cancel":
+		job, err = d.Cancel(id)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func (d *Daemon) handleEvents(w http.ResponseWriter, r *http.Request) {
+	events, unsubscribe := d.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+			// Send the events already waiting in one write.
+			for more := len(events); more > 0; more-- {
+				if event, ok = <-events; !ok || encoder.Encode(event) != nil {
+					return
+				}
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// closeSubscribers ends the event streams, so that the daemon can stop.
+func (d *Daemon) closeSubscribers() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for events := range d.subscribers {
+		delete(d.subscribers, events)
+		close(events)
+	}
+}
+
+// apiError is the body of an error response.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// writeJSON writes a JSON response.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error response with the status matching the error.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, ErrJobNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrInvalidState):
+		status = http.StatusConflict
+	}
+	writeJSON(w, status, apiError{Error: err.Error()})
+}
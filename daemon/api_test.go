@@ -0,0 +1,56 @@
+package daemon
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestListen checks that the control socket is only accessible to its user, leaves nothing else
+// behind, replaces a stale socket and is removed when closed.
+func TestListen(t *testing.T) {
+	dir := t.TempDir()
+	socketPath := filepath.Join(dir, "daemon.sock")
+
+	// A stale socket, whose daemon is gone, is replaced.
+	stale, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := Listen(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Fatalf("socket has mode %v, expected a socket with mode 0600", info.Mode())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("%d files in the socket directory, expected only the socket", len(entries))
+	}
+
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if _, err := Listen(socketPath); err == nil {
+		t.Fatal("a second daemon listened on the socket in use")
+	}
+
+	if err := listener.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(socketPath); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("the socket is still there after closing: %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+// Package daemon runs a long-running node that keeps its connections to peers, their catalogs and
+// a queue of downloads alive between commands.
+// This file contains the client of the control API, used by the CLI.
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotRunning is returned by Dial when no daemon listens on the socket.
+var ErrNotRunning = errors.New("daemon is not running")
+
+// Client calls the control API of a daemon.
+type Client struct {
+	http *http.Client
+}
+
+// Dial connects to the daemon listening on a Unix socket.
+//
+// Parameters:
+// - socketPath: The path of the socket.
+//
+// Returns:
+// - *Client: The client.
+// - error: An error wrapping ErrNotRunning if no daemon listens on the socket.
+func Dial(socketPath string) (*Client, error) {
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotRunning, err)
+	}
+	conn.Close()
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		},
+	}
+	return &Client{http: &http.Client{Transport: transport}}, nil
+}
+
+// Status returns the state of the daemon.
+func (c *Client) Status() (Status, error) {
+	var status Status
+	err := c.call(http.MethodGet, "/v1/status", nil, &status)
+	return status, err
+}
+
+// Catalog returns the merged catalog of some peers, or of the daemon's peers if peers is empty.
+// The daemon answers from its catalog cache unless refresh is set.
+func (c *Client) Catalog(peers []string, refresh bool) (Catalog, error) {
+	query := url.Values{}
+	if len(peers) > 0 {
+		query.Set("peers", strings.Join(peers, ","))
+	}
+	if refresh {
+		query.Set("refresh", "true")
+	}
+	var catalog Catalog
+	err := c.call(http.MethodGet, "/v1/catalog?"+query.Encode(), nil, &catalog)
+	return catalog, err
+}
+
+// Peers returns the servers the daemon is connected to and the clients downloading from it.
+func (c *Client) Peers() (Peers, error) {
+	var peers Peers
+	err := c.call(http.MethodGet, "/v1/peers", nil, &peers)
+	return peers, err
+}
+
+// Jobs returns every job.
+func (c *Client) Jobs() ([]Job, error) {
+	var jobs []Job
+	err := c.call(http.MethodGet, "/v1/jobs", nil, &jobs)
+	return jobs, err
+}
+
+// Job returns a job by ID.
+func (c *Client) Job(id int) (Job, error) {
+	var job Job
+	err := c.call(http.MethodGet, "/v1/jobs/"+strconv.Itoa(id), nil, &job)
+	return job, err
+}
+
+// Add queues a download.
+func (c *Client) Add(request JobRequest) (Job, error) {
+	var job Job
+	err := c.call(http.MethodPost, "/v1/jobs", request, &job)
+	return job, err
+}
+
+// Pause pauses a job.
+func (c *Client) Pause(id int) (Job, error) {
+	return c.action(id, "pause")
+}
+
+// Resume resumes a paused or failed job.
+func (c *Client) Resume(id int) (Job, error) {
+	return c.action(id, "resume")
+}
+
+// Cancel cancels a job.
+func (c *Client) Cancel(id int) (Job, error) {
+	return c.action(id, "cancel")
+}
+
+// SetPriority changes the priority of a job.
+func (c *Client) SetPriority(id int, priority string) (Job, error) {
+	var job Job
+	err := c.call(http.MethodPost, "/v1/jobs/"+strconv.Itoa(id)+"/priority", PriorityRequest{Priority: priority}, &job)
+	return job, err
+}
+
+// Clear removes the jobs that are done or cancelled, and returns them.
+func (c *Client) Clear() ([]Job, error) {
+	var jobs []Job
+	err := c.call(http.MethodDelete, "/v1/jobs", nil, &jobs)
+	return jobs, err
+}
+
+// action applies an action to a job.
+func (c *Client) action(id int, action string) (Job, error) {
+	var job Job
+	err := c.call(http.MethodPost, "/v1/jobs/"+strconv.Itoa(id)+"/"+action, nil, &job)
+	return job, err
+}
+
+// call sends a request to the control API and decodes its JSON response into result.
+func (c *Client) call(method string, path string, body any, result any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	request, err := http.NewRequest(method, "http://daemon"+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	response, err := c.http.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to reach the daemon: %w", err)
+	}
+	defer response.Body.Close()
+	if err := responseError(response); err != nil {
+		return err
+	}
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return fmt.Errorf("invalid response from the daemon: %w", err)
+	}
+	return nil
+}
+
+// responseError returns the error reported by an unsuccessful response, or nil.
+func responseError(response *http.Response) error {
+	if response.StatusCode < 300 {
+		return nil
+	}
+	var body apiError
+	if err := json.NewDecoder(io.LimitReader(response.Body, 64*1024)).Decode(&body); err != nil || body.Error == "" {
+		return fmt.Errorf("daemon answered %s", response.Status)
+	}
+	return errors.New(body.Error)
+}
+
+// EventStream is a stream of events from the daemon.
+type EventStream struct {
+	body    io.ReadCloser
+	decoder *json.Decoder
+}
+
+// Events starts streaming the events of the daemon, until ctx is cancelled or the stream is closed.
+func (c *Client) Events(ctx context.Context) (*EventStream, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://daemon/v1/events", nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := c.http.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach the daemon: %w", err)
+	}
+	if err := responseError(response); err != nil {
+		response.Body.Close()
+		return nil, err
+	}
+	return &EventStream{body: response.Body, decoder: json.NewDecoder(bufio.NewReader(response.Body))}, nil
+}
+
+// Next waits for the next event. It returns io.EOF once the daemon ends the stream.
+func (s *EventStream) Next() (Event, error) {
+	var event Event
+	err := s.decoder.Decode(&event)
+	return event, err
+}
+
+// Close stops the stream.
+func (s *EventStream) Close() error {
+	return s.body.Close()
+}
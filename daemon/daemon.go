@@ -0,0 +1,472 @@
+// Package daemon runs a long-running node that keeps its connections to peers, their catalogs and
+// a queue of downloads alive between commands. The CLI talks to it through a control API served
+// on a Unix socket: downloads are queued, paused, resumed, cancelled and inspected there, and run
+// in the background, several at once, by priority. The queue is saved, so it survives restarts.
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-to-peer/file"
+	"go-to-peer/peer"
+	"go-to-peer/util"
+	"sync"
+	"time"
+)
+
+// States of a job.
+const (
+	StateQueued    = "queued"    // Waiting for a free place among the running jobs.
+	StateRunning   = "running"   // Being downloaded.
+	StatePaused    = "paused"    // Stopped until resumed; chunks already downloaded are kept.
+	StateDone      = "done"      // Downloaded.
+	StateFailed    = "failed"    // Stopped by an error; it can be resumed to try again.
+	StateCancelled = "cancelled" // Stopped for good.
+)
+
+// ErrJobNotFound is returned for a job ID the daemon does not know.
+var ErrJobNotFound = errors.New("job not found")
+
+// ErrInvalidState is returned when a job cannot be paused, resumed, cancelled or reprioritized in its current state.
+var ErrInvalidState = errors.New("invalid job state")
+
+// JobRequest asks the daemon to download a file.
+type JobRequest struct {
+	Target    string   `json:"target"`              // Hash of the file, or share link of an encrypted file.
+	Name      string   `json:"name,omitempty"`      // Name of the file in the catalog, if known.
+	Servers   []string `json:"servers,omitempty"`   // Servers to download from, or none for the daemon's peers.
+	Dir       string   `json:"dir,omitempty"`       // Directory receiving the file, or "" for the daemon's downloads directory.
+	Path      string   `json:"path,omitempty"`      // Exact path of the file, overriding Dir.
+	Overwrite bool     `json:"overwrite,omitempty"` // Whether an existing file may be replaced.
+	InPlace   bool     `json:"in_place,omitempty"`  // Whether chunks are written directly into the file.
+	Priority  string   `json:"priority,omitempty"`  // Priority of the job: low, normal or high; normal if "".
+}
+
+// Job is a download queued on the daemon.
+type Job struct {
+	ID        int       `json:"id"`
+	FileHash  string    `json:"file_hash"`
+	Name      string    `json:"name,omitempty"` // Name of the file, once known.
+	ShareLink bool      `json:"share_link"`     // Whether the file is downloaded by share link and decrypted.
+	State     string    `json:"state"`
+	Priority  string    `json:"priority"`
+	Servers   []string  `json:"servers"`
+	Dir       string    `json:"dir,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	Overwrite bool      `json:"overwrite"`
+	InPlace   bool      `json:"in_place"`
+	Bytes     int64     `json:"bytes"`            // Size of the chunks to download, once known.
+	Done      int64     `json:"done"`             // Bytes of the chunks downloaded and verified.
+	Output    string    `json:"output,omitempty"` // Path of the downloaded file.
+	Error     string    `json:"error,omitempty"`  // Why the last attempt failed.
+	Created   time.Time `json:"created"`
+	Started   time.Time `json:"started"`  // Start of the last attempt.
+	Finished  time.Time `json:"finished"` // End of the last attempt.
+
+	shareLink string // The share link, which holds the decryption key and is never sent back.
+}
+
+// Stopped reports whether the job is neither queued nor running, so it will not run again unless resumed.
+func (j *Job) Stopped() bool {
+	switch j.State {
+	case StateDone, StateFailed, StateCancelled, StatePaused:
+		return true
+	}
+	return false
+}
+
+// Options configures a daemon.
+type Options struct {
+	Peers        []string // Peers downloaded from when a job names no servers.
+	DownloadsDir string   // Directory receiving files when a job names no destination.
+	QueueFile    string   // File keeping the queue across restarts, or "" to keep it in memory.
+	MaxJobs      int      // Number of jobs downloaded at once.
+	Slots        int      // Number of chunks downloaded at once, shared by the running jobs.
+	Port         int      // Port the node shares files on, or 0 if it does not.
+}
+
+// Daemon holds the download queue of a long-running node.
+type Daemon struct {
+	mu          sync.Mutex
+	options     Options
+	started     time.Time
+	jobs        []*Job // Every job, by increasing ID.
+	nextID      int
+	running     map[int]context.CancelFunc // Stops each running job.
+	slots       *slotScheduler
+	wake        chan struct{}
+	subscribers map[chan Event]bool
+}
+
+// New creates a daemon, with the queue saved in its queue file if there is one.
+//
+// Parameters:
+// - options: The peers, downloads directory, queue file and limits of the node.
+//
+// Returns:
+// - *Daemon: The daemon, which Serve runs.
+// - error: An error object if the queue file cannot be read.
+func New(options Options) (*Daemon, error) {
+	options.MaxJobs = max(options.MaxJobs, 1)
+	options.Slots = max(options.Slots, 1)
+	d := &Daemon{
+		options:     options,
+		started:     time.Now(),
+		nextID:      1,
+		running:     make(map[int]context.CancelFunc),
+		slots:       newSlotScheduler(options.Slots),
+		wake:        make(chan struct{}, 1),
+		subscribers: make(map[chan Event]bool),
+	}
+	if options.QueueFile != "" {
+		jobs, nextID, err := loadQueue(options.QueueFile)
+		if err != nil {
+			return nil, err
+		}
+		d.jobs, d.nextID = jobs, nextID
+		if len(jobs) > 0 {
+			util.Logger.Printf("Loaded %d jobs from %s", len(jobs), options.QueueFile)
+		}
+	}
+	return d, nil
+}
+
+// Add queues a download.
+//
+// Parameters:
+// - request: The file to download, where to write it and its priority.
+//
+// Returns:
+// - Job: The queued job.
+// - error: An error object if the request names no valid file or priority.
+func (d *Daemon) Add(request JobRequest) (Job, error) {
+	job := &Job{
+		Servers:   request.Servers,
+		Name:      request.Name,
+		Dir:       request.Dir,
+		Path:      request.Path,
+		Overwrite: request.Overwrite,
+		InPlace:   request.InPlace,
+		Priority:  request.Priority,
+		State:     StateQueued,
+		Created:   time.Now(),
+	}
+	switch {
+	case file.IsShareLink(request.Target):
+		fileHash, _, err := file.ParseShareLink(request.Target)
+		if err != nil {
+			return Job{}, err
+		}
+		job.FileHash, job.ShareLink, job.shareLink = fileHash, true, request.Target
+	case file.ValidateFileHash(request.Target) == nil:
+		job.FileHash = request.Target
+	default:
+		return Job{}, fmt.Errorf("%q is neither a file hash nor a share link", request.Target)
+	}
+	if job.Name != "" {
+		if err := file.ValidateFileName(job.Name); err != nil {
+			return Job{}, fmt.Errorf("invalid name: %w", err)
+		}
+	}
+	if job.Priority == "" {
+		job.Priority = PriorityNormal
+	}
+	if err := ValidatePriority(job.Priority); err != nil {
+		return Job{}, err
+	}
+	if len(job.Servers) == 0 {
+		job.Servers = d.options.Peers
+	}
+	if len(job.Servers) == 0 {
+		return Job{}, fmt.Errorf("no peers to download from")
+	}
+	if job.Dir == "" && job.Path == "" {
+		job.Dir = d.options.DownloadsDir
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	job.ID = d.nextID
+	d.nextID++
+	d.jobs = append(d.jobs, job)
+	util.Logger.Printf("Queued job %d for %s with %s priority", job.ID, job.FileHash, job.Priority)
+	d.changed(job)
+	return *job, nil
+}
+
+// Jobs returns every job, by increasing ID.
+func (d *Daemon) Jobs() []Job {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	jobs := make([]Job, len(d.jobs))
+	for i, job := range d.jobs {
+		jobs[i] = *job
+	}
+	return jobs
+}
+
+// Job returns a job by ID, or ErrJobNotFound.
+func (d *Daemon) Job(id int) (Job, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	job, err := d.find(id)
+	if err != nil {
+		return Job{}, err
+	}
+	return *job, nil
+}
+
+// Pause stops a queued or running job until it is resumed. The chunks already downloaded are kept.
+func (d *Daemon) Pause(id int) (Job, error) {
+	return d.transition(id, StatePaused, StateQueued, StateRunning)
+}
+
+// Resume queues a paused or failed job again.
+func (d *Daemon) Resume(id int) (Job, error) {
+	return d.transition(id, StateQueued, StatePaused, StateFailed)
+}
+
+// Cancel stops a job for good.
+func (d *Daemon) Cancel(id int) (Job, error) {
+	return d.transition(id, StateCancelled, StateQueued, StateRunning, StatePaused, StateFailed)
+}
+
+// SetPriority changes the priority of a job that is not done or cancelled. A running job gets its
+// new share of the download slots as soon as slots are freed.
+//
+// Parameters:
+// - id: The ID of the job.
+// - priority: The new priority: low, normal or high.
+//
+// Returns:
+// - Job: The job after the change.
+// - error: An error object if the job is unknown or stopped for good, or the priority is invalid.
+func (d *Daemon) SetPriority(id int, priority string) (Job, error) {
+	if err := ValidatePriority(priority); err != nil {
+		return Job{}, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	job, err := d.find(id)
+	if err != nil {
+		return Job{}, err
+	}
+	if job.State == StateDone || job.State == StateCancelled {
+		return *job, fmt.Errorf("%w: job %d is %s", ErrInvalidState, id, job.State)
+	}
+	job.Priority = priority
+	if _, ok := d.running[id]; ok {
+		d.slots.setWeight(id, priority)
+	}
+	util.Logger.Printf("Job %d now has %s priority", id, priority)
+	d.changed(job)
+	return *job, nil
+}
+
+// Clear removes the jobs that are done or cancelled from the queue.
+//
+// Returns:
+// - []Job: The jobs removed.
+func (d *Daemon) Clear() []Job {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	removed := []Job{}
+	kept := d.jobs[:0]
+	for _, job := range d.jobs {
+		if job.State == StateDone || job.State == StateCancelled {
+			removed = append(removed, *job)
+			continue
+		}
+		kept = append(kept, job)
+	}
+	clear(d.jobs[len(kept):])
+	d.jobs = kept
+	if len(removed) > 0 {
+		util.Logger.Printf("Cleared %d finished jobs", len(removed))
+		d.save()
+	}
+	return removed
+}
+
+// transition moves a job to a new state if it is in one of the given states, stopping it if it runs.
+func (d *Daemon) transition(id int, state string, from ...string) (Job, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	job, err := d.find(id)
+	if err != nil {
+		return Job{}, err
+	}
+	allowed := false
+	for _, s := range from {
+		allowed = allowed || job.State == s
+	}
+	if !allowed {
+		return *job, fmt.Errorf("%w: job %d is %s", ErrInvalidState, id, job.State)
+	}
+	if cancel, ok := d.running[id]; ok {
+		cancel()
+	}
+	job.State = state
+	if state == StateQueued {
+		job.Error = ""
+	}
+	util.Logger.Printf("Job %d is now %s", id, state)
+	d.changed(job)
+	return *job, nil
+}
+
+// find returns a job by ID. The caller must hold d.mu.
+func (d *Daemon) find(id int) (*Job, error) {
+	for _, job := range d.jobs {
+		if job.ID == id {
+			return job, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %d", ErrJobNotFound, id)
+}
+
+// changed saves the queue, publishes the new state of a job and wakes the scheduler. The caller
+// must hold d.mu.
+func (d *Daemon) changed(job *Job) {
+	d.save()
+	snapshot := *job
+	d.publish(Event{Type: EventJob, JobID: job.ID, Job: &snapshot})
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run starts the queued jobs, by priority, whenever fewer than MaxJobs run, until ctx is cancelled.
+// It returns once the running jobs have stopped.
+func (d *Daemon) run(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		d.mu.Lock()
+		for len(d.running) < d.options.MaxJobs {
+			job := d.next()
+			if job == nil {
+				break
+			}
+			jobCtx := d.start(ctx, job)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				d.runJob(ctx, jobCtx, job)
+			}()
+		}
+		d.mu.Unlock()
+
+		select {
+		case <-d.wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// next returns the queued job to start next: the one with the highest priority, and the oldest
+// among those. A job resumed before its last attempt has wound down waits for it. It returns nil
+// if no job can start. The caller must hold d.mu.
+func (d *Daemon) next() *Job {
+	var next *Job
+	for _, job := range d.jobs {
+		if _, ok := d.running[job.ID]; ok {
+			continue
+		}
+		if job.State == StateQueued && (next == nil || priorityWeights[job.Priority] > priorityWeights[next.Priority]) {
+			next = job
+		}
+	}
+	return next
+}
+
+// start marks a job as running and returns the context to download it with, which reports its
+// progress to its subscribers and takes its slots from the scheduler. The caller must hold d.mu.
+func (d *Daemon) start(ctx context.Context, job *Job) context.Context {
+	jobCtx, cancel := context.WithCancel(ctx)
+	d.running[job.ID] = cancel
+	d.slots.setWeight(job.ID, job.Priority)
+	job.State, job.Started, job.Finished = StateRunning, time.Now(), time.Time{}
+	job.Bytes, job.Done, job.Error = 0, 0, ""
+	d.changed(job)
+	jobCtx = peer.WithProgress(jobCtx, &jobReporter{d: d, job: job})
+	return peer.WithSlots(jobCtx, d.slots.forJob(job.ID))
+}
+
+// runJob downloads the file of a running job and records the outcome.
+func (d *Daemon) runJob(ctx context.Context, jobCtx context.Context, job *Job) {
+	d.mu.Lock()
+	dest := file.Destination{Dir: job.Dir, Path: job.Path, Overwrite: job.Overwrite, InPlace: job.InPlace}
+	servers, fileHash, shareLink := job.Servers, job.FileHash, job.shareLink
+	d.mu.Unlock()
+
+	var outputPath string
+	var err error
+	if shareLink != "" {
+		outputPath, err = peer.DownloadSharedFile(jobCtx, shareLink, servers, dest)
+	} else {
+		outputPath, err = peer.DownloadFileFromMultipleServers(jobCtx, fileHash, servers, dest)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.running[job.ID]()
+	delete(d.running, job.ID)
+	d.slots.remove(job.ID)
+	job.Finished = time.Now()
+	switch {
+	case err == nil:
+		job.State, job.Output = StateDone, outputPath
+		util.Logger.Printf("Job %d downloaded %s to %q", job.ID, fileHash, outputPath)
+	case job.State != StateRunning:
+		// Paused or cancelled while running.
+	case ctx.Err() != nil:
+		// The daemon is stopping; the job is interrupted rather than failed.
+		job.State = StateQueued
+	default:
+		job.State, job.Error = StateFailed, err.Error()
+		util.Logger.Printf("Job %d failed: %v", job.ID, err)
+	}
+	d.changed(job)
+}
+
+// jobReporter implements peer.ProgressReporter for a running job.
+type jobReporter struct {
+	d   *Daemon
+	job *Job
+}
+
+// DownloadStarted implements peer.ProgressReporter.
+func (r *jobReporter) DownloadStarted(info peer.DownloadInfo) {
+	r.d.mu.Lock()
+	defer r.d.mu.Unlock()
+	r.job.Bytes += info.Bytes
+	if r.job.Name == "" {
+		r.job.Name = info.Name
+	}
+	r.d.publish(Event{Type: EventStart, JobID: r.job.ID, FileHash: info.FileHash, Name: info.Name, Chunks: info.Chunks, Bytes: info.Bytes})
+}
+
+// Received implements peer.ProgressReporter.
+func (r *jobReporter) Received(server string, chunkID string, n int64) {
+	r.d.mu.Lock()
+	defer r.d.mu.Unlock()
+	r.d.publish(Event{Type: EventReceived, JobID: r.job.ID, FileHash: r.job.FileHash, Server: server, ChunkID: chunkID, Bytes: n})
+}
+
+// ChunkFinished implements peer.ProgressReporter.
+func (r *jobReporter) ChunkFinished(event peer.ChunkEvent) {
+	r.d.mu.Lock()
+	defer r.d.mu.Unlock()
+	e := Event{Type: EventChunk, JobID: r.job.ID, FileHash: event.FileHash, ChunkID: event.ChunkID, Server: event.Server,
+		Bytes: event.Size, DurationMS: event.Duration.Milliseconds()}
+	if event.Err != nil {
+		e.Error = event.Err.Error()
+	} else {
+		r.job.Done += event.Size
+	}
+	r.d.publish(e)
+}
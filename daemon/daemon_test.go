@@ -0,0 +1,156 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestTransitions(t *testing.T) {
+	states := []string{StateQueued, StateRunning, StatePaused, StateDone, StateFailed, StateCancelled}
+	actions := map[string]struct {
+		do func(d *Daemon, id int) (Job, error)
+		to map[string]string // The state reached from each state the action applies to.
+	}{
+		"pause": {
+			do: (*Daemon).Pause,
+			to: map[string]string{StateQueued: StatePaused, StateRunning: StatePaused},
+		},
+		"resume": {
+			do: (*Daemon).Resume,
+			to: map[string]string{StatePaused: StateQueued, StateFailed: StateQueued},
+		},
+		"cancel": {
+			do: (*Daemon).Cancel,
+			to: map[string]string{StateQueued: StateCancelled, StateRunning: StateCancelled, StatePaused: StateCancelled, StateFailed: StateCancelled},
+		},
+	}
+
+	for name, action := range actions {
+		for _, from := range states {
+			t.Run(name+" "+from, func(t *testing.T) {
+				d := newTestDaemon(t, "")
+				job, err := d.Add(JobRequest{Target: testHash('a')})
+				if err != nil {
+					t.Fatal(err)
+				}
+				d.mu.Lock()
+				d.jobs[0].State, d.jobs[0].Error = from, "previous failure"
+				d.mu.Unlock()
+
+				job, err = action.do(d, job.ID)
+				to, allowed := action.to[from]
+				switch {
+				case !allowed && !errors.Is(err, ErrInvalidState):
+					t.Fatalf("got %v, expected ErrInvalidState", err)
+				case !allowed && job.State != from:
+					t.Fatalf("job moved to %s on a refused transition", job.State)
+				case allowed && err != nil:
+					t.Fatal(err)
+				case allowed && job.State != to:
+					t.Fatalf("job moved to %s, expected %s", job.State, to)
+				case allowed && to == StateQueued && job.Error != "":
+					t.Fatalf("requeued job still reports error %q", job.Error)
+				}
+			})
+		}
+	}
+
+	d := newTestDaemon(t, "")
+	for name, action := range actions {
+		if _, err := action.do(d, 1); !errors.Is(err, ErrJobNotFound) {
+			t.Fatalf("%s of a missing job: got %v, expected ErrJobNotFound", name, err)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	d := newTestDaemon(t, "")
+	for _, priority := range []string{PriorityLow, PriorityNormal, PriorityHigh, PriorityHigh} {
+		if _, err := d.Add(JobRequest{Target: testHash('a'), Priority: priority}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var order []int
+	for job := d.next(); job != nil; job = d.next() {
+		order = append(order, job.ID)
+		job.State = StateRunning
+	}
+	if expected := []int{3, 4, 2, 1}; !slices.Equal(order, expected) {
+		t.Fatalf("jobs started in order %v, expected %v", order, expected)
+	}
+}
+
+// TestResumeWhileStopping checks that a job paused and resumed while its last attempt is still
+// stopping waits for that attempt, rather than running twice at once.
+func TestResumeWhileStopping(t *testing.T) {
+	d := newTestDaemon(t, "")
+	if _, err := d.Add(JobRequest{Target: testHash('a'), Dir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	job := d.next()
+	jobCtx := d.start(context.Background(), job)
+	d.mu.Unlock()
+
+	if _, err := d.Pause(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if jobCtx.Err() == nil {
+		t.Fatal("pausing a running job did not stop it")
+	}
+	if _, err := d.Resume(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	if next := d.next(); next != nil {
+		t.Fatalf("job %d started again before its last attempt stopped", next.ID)
+	}
+	d.mu.Unlock()
+
+	// Once the attempt stops, it leaves the job queued and it can start again.
+	d.runJob(context.Background(), jobCtx, job)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if job.State != StateQueued {
+		t.Fatalf("stopped attempt left the job %s, expected queued", job.State)
+	}
+	if next := d.next(); next != job {
+		t.Fatalf("resumed job does not start once its last attempt stopped")
+	}
+}
+
+// TestStopRequeues checks that a job interrupted by the daemon stopping is queued again rather than failed.
+func TestStopRequeues(t *testing.T) {
+	d := newTestDaemon(t, "")
+	if _, err := d.Add(JobRequest{Target: testHash('a'), Dir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d.mu.Lock()
+	job := d.next()
+	jobCtx := d.start(ctx, job)
+	d.mu.Unlock()
+
+	cancel()
+	d.runJob(ctx, jobCtx, job)
+	if job.State != StateQueued || job.Error != "" {
+		t.Fatalf("interrupted job left %s with error %q, expected queued", job.State, job.Error)
+	}
+	if len(d.running) != 0 {
+		t.Fatal("interrupted job is still running")
+	}
+
+	// Without the daemon stopping, the same failure fails the job.
+	d.mu.Lock()
+	jobCtx = d.start(context.Background(), job)
+	d.mu.Unlock()
+	d.runJob(context.Background(), jobCtx, job)
+	if job.State != StateFailed || job.Error == "" {
+		t.Fatalf("job left %s with error %q, expected failed", job.State, job.Error)
+	}
+}
@@ -0,0 +1,64 @@
+// Package daemon runs a long-running node that keeps its connections to peers, their catalogs and
+// a queue of downloads alive between commands.
+// This file publishes what happens on the daemon to the clients watching it: changes to jobs and
+// the progress of the running download.
+package daemon
+
+// Types of events.
+const (
+	EventJob      = "job"      // A job was queued or changed state.
+	EventStart    = "start"    // The chunks of a file are about to be downloaded.
+	EventReceived = "received" // Chunk data arrived from a server, before it is verified.
+	EventChunk    = "chunk"    // An attempt to download a chunk finished.
+)
+
+// subscriberBuffer is the number of events a client may fall behind by.
+const subscriberBuffer = 1024
+
+// Event is something that happened on the daemon.
+type Event struct {
+	Type       string `json:"type"`
+	JobID      int    `json:"job_id"`
+	Job        *Job   `json:"job,omitempty"` // The job after the change, for "job" events.
+	FileHash   string `json:"file_hash,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Chunks     int    `json:"chunks,omitempty"`
+	Bytes      int64  `json:"bytes,omitempty"` // Bytes to download, received, or of the chunk downloaded.
+	ChunkID    string `json:"chunk_id,omitempty"`
+	Server     string `json:"server,omitempty"`
+	DurationMS int64  `json:"duration_ms,omitempty"`
+	Error      string `json:"error,omitempty"` // Why the attempt to download the chunk failed.
+}
+
+// subscribe starts delivering events to a new channel. The channel is closed by the returned
+// function, or by the daemon if the subscriber falls too far behind.
+func (d *Daemon) subscribe() (<-chan Event, func()) {
+	events := make(chan Event, subscriberBuffer)
+	d.mu.Lock()
+	d.subscribers[events] = true
+	d.mu.Unlock()
+	return events, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.subscribers[events] {
+			delete(d.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// publish delivers an event to every subscriber without blocking. A subscriber too far behind
+// misses "received" events, which only refine the progress; missing any other event would leave it
+// with a wrong picture, so it is disconnected instead. The caller must hold d.mu.
+func (d *Daemon) publish(event Event) {
+	for events := range d.subscribers {
+		select {
+		case events <- event:
+		default:
+			if event.Type != EventReceived {
+				delete(d.subscribers, events)
+				close(events)
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Package daemon runs a long-running node that keeps its connections to peers, their catalogs and
+// a queue of downloads alive between commands.
+// This file keeps the queue in a JSON file, so that the jobs survive a restart of the daemon. The
+// file holds the share links of encrypted files, keys included, so only its owner may read it.
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-to-peer/util"
+	"os"
+)
+
+// queueFile is the content of the queue file.
+type queueFile struct {
+	NextID int         `json:"next_id"`
+	Jobs   []storedJob `json:"jobs"`
+}
+
+// storedJob is a job as saved in the queue file.
+type storedJob struct {
+	Job
+	Link string `json:"link,omitempty"` // The share link of the file, if downloaded by share link.
+}
+
+// loadQueue reads the jobs saved in a queue file. A job that was running when the daemon stopped
+// is queued again; its chunks already downloaded are kept, so it picks up where it stopped.
+//
+// Parameters:
+// - path: The queue file. A missing file is an empty queue.
+//
+// Returns:
+// - []*Job: The jobs, by increasing ID.
+// - int: The ID of the next job.
+// - error: An error object if the file cannot be read or parsed.
+func loadQueue(path string) ([]*Job, int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 1, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read queue file: %w", err)
+	}
+	var queue queueFile
+	if err := json.Unmarshal(data, &queue); err != nil {
+		return nil, 0, fmt.Errorf("failed to parse queue file: %w", err)
+	}
+
+	jobs := make([]*Job, 0, len(queue.Jobs))
+	nextID := max(queue.NextID, 1)
+	for _, stored := range queue.Jobs {
+		job := stored.Job
+		job.shareLink = stored.Link
+		if job.State == StateRunning {
+			job.State = StateQueued
+		}
+		if ValidatePriority(job.Priority) != nil {
+			job.Priority = PriorityNormal
+		}
+		jobs = append(jobs, &job)
+		nextID = max(nextID, job.ID+1)
+	}
+	return jobs, nextID, nil
+}
+
+// save writes the queue back to its file, if the daemon has one. The caller must hold d.mu.
+func (d *Daemon) save() {
+	if d.options.QueueFile == "" {
+		return
+	}
+	queue := queueFile{NextID: d.nextID, Jobs: make([]storedJob, len(d.jobs))}
+	for i, job := range d.jobs {
+		queue.Jobs[i] = storedJob{Job: *job, Link: job.shareLink}
+	}
+	data, err := json.MarshalIndent(queue, "", "  ")
+	if err != nil {
+		util.Logger.Printf("Failed to encode the queue: %v", err)
+		return
+	}
+
+	// Write to a temporary file first so that a crash never leaves a truncated queue.
+	tmpPath := d.options.QueueFile + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		util.Logger.Printf("Failed to write queue file: %v", err)
+		return
+	}
+	if err := os.Rename(tmpPath, d.options.QueueFile); err != nil {
+		util.Logger.Printf("Failed to write queue file: %v", err)
+	}
+}
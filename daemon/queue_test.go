@@ -0,0 +1,135 @@
+package daemon
+
+import (
+	"go-to-peer/file"
+	"go-to-peer/util"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testHash returns a valid file hash made of one repeated hex digit.
+func testHash(c byte) string {
+	return strings.Repeat(string(c), 64)
+}
+
+// newTestDaemon creates a daemon keeping its queue in a temporary file, with a peer no job reaches.
+func newTestDaemon(t *testing.T, queueFile string) *Daemon {
+	t.Helper()
+	util.Logger = log.New(io.Discard, "", 0)
+	d, err := New(Options{Peers: []string{"127.0.0.1:1"}, DownloadsDir: t.TempDir(), QueueFile: queueFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestQueueRoundTrip(t *testing.T) {
+	queueFile := filepath.Join(t.TempDir(), "queue.json")
+	d := newTestDaemon(t, queueFile)
+	link := file.FormatShareLink(testHash('b'), make([]byte, file.ShareKeySize))
+	requests := []JobRequest{
+		{Target: testHash('a'), Name: "a.txt", Priority: PriorityHigh},
+		{Target: link, Priority: PriorityLow},
+		{Target: testHash('c'), Path: filepath.Join(t.TempDir(), "c.txt"), Overwrite: true, InPlace: true},
+		{Target: testHash('d')},
+	}
+	for _, request := range requests {
+		if _, err := d.Add(request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.Pause(4); err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	d.jobs[0].State = StateRunning
+	d.jobs[2].State = StateFailed
+	d.jobs[2].Error = "no server has chunk 3"
+	d.save()
+	d.mu.Unlock()
+
+	info, err := os.Stat(queueFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Fatalf("queue file mode is %v, expected 0600 as it holds share keys", mode)
+	}
+
+	jobs, nextID, err := loadQueue(queueFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nextID != 5 {
+		t.Fatalf("next ID %d, expected 5", nextID)
+	}
+	if len(jobs) != len(d.jobs) {
+		t.Fatalf("loaded %d jobs, expected %d", len(jobs), len(d.jobs))
+	}
+	expectedStates := []string{StateQueued, StateQueued, StateFailed, StatePaused}
+	for i, job := range jobs {
+		saved := d.jobs[i]
+		if job.State != expectedStates[i] {
+			t.Errorf("job %d loaded as %s, expected %s", job.ID, job.State, expectedStates[i])
+		}
+		if job.ID != saved.ID || job.FileHash != saved.FileHash || job.Name != saved.Name ||
+			job.Priority != saved.Priority || job.Path != saved.Path || job.Dir != saved.Dir ||
+			job.Overwrite != saved.Overwrite || job.InPlace != saved.InPlace || job.Error != saved.Error ||
+			job.ShareLink != saved.ShareLink || job.shareLink != saved.shareLink ||
+			!job.Created.Equal(saved.Created) {
+			t.Errorf("job loaded as %+v, expected %+v", *job, *saved)
+		}
+	}
+	if jobs[1].shareLink != link {
+		t.Fatalf("share link loaded as %q, expected %q", jobs[1].shareLink, link)
+	}
+
+	// A daemon started on the file picks up the queue and numbers new jobs after it.
+	restarted := newTestDaemon(t, queueFile)
+	job, err := restarted.Add(JobRequest{Target: testHash('e')})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ID != 5 || len(restarted.Jobs()) != 5 {
+		t.Fatalf("new job %d among %d, expected job 5 among 5", job.ID, len(restarted.Jobs()))
+	}
+}
+
+func TestLoadQueue(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	jobs, nextID, err := loadQueue(filepath.Join(dir, "missing.json"))
+	if err != nil || len(jobs) != 0 || nextID != 1 {
+		t.Fatalf("missing file loaded as %d jobs, next ID %d, %v; expected an empty queue", len(jobs), nextID, err)
+	}
+
+	if _, _, err := loadQueue(write("corrupt.json", `{"jobs": [`)); err == nil {
+		t.Fatal("loaded a corrupt queue file")
+	}
+
+	// A stale next ID and an unknown priority are corrected.
+	path := write("stale.json", `{"next_id": 2, "jobs": [
+		{"id": 7, "file_hash": "`+testHash('a')+`", "state": "running", "priority": "urgent"}
+	]}`)
+	jobs, nextID, err = loadQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || nextID != 8 {
+		t.Fatalf("loaded %d jobs, next ID %d; expected 1 job, next ID 8", len(jobs), nextID)
+	}
+	if jobs[0].State != StateQueued || jobs[0].Priority != PriorityNormal {
+		t.Fatalf("job loaded as %s with %s priority, expected queued with normal priority", jobs[0].State, jobs[0].Priority)
+	}
+}
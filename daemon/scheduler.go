@@ -0,0 +1,157 @@
+// Package daemon runs a long-running node that keeps its connections to peers, their catalogs and
+// a queue of downloads alive between commands.
+// This file schedules the jobs by priority. The queued job with the highest priority starts first,
+// and the jobs running at once share the chunk download slots of the node in proportion to the
+// weight of their priority, so a high priority job gets four times the slots, and roughly four
+// times the bandwidth, of a low priority one running beside it. A job alone takes every slot.
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Priorities of jobs.
+const (
+	PriorityLow    = "low"
+	PriorityNormal = "normal"
+	PriorityHigh   = "high"
+)
+
+// priorityWeights is the share of the download slots each priority is entitled to.
+var priorityWeights = map[string]int{
+	PriorityLow:    1,
+	PriorityNormal: 2,
+	PriorityHigh:   4,
+}
+
+// ValidatePriority checks that a priority is low, normal or high.
+func ValidatePriority(priority string) error {
+	if _, ok := priorityWeights[priority]; !ok {
+		return fmt.Errorf("invalid priority %q: expected %s, %s or %s", priority, PriorityLow, PriorityNormal, PriorityHigh)
+	}
+	return nil
+}
+
+// slotScheduler hands out a fixed number of chunk download slots to the running jobs. When slots
+// are short, a freed slot goes to the waiting job holding the fewest slots for its weight, and to
+// the job that asked first among equals.
+type slotScheduler struct {
+	mu      sync.Mutex
+	free    int
+	held    map[int]int // Slots held by each job.
+	weights map[int]int // Weight of each running job.
+	waiting []*slotRequest
+}
+
+// slotRequest is a job waiting for a slot.
+type slotRequest struct {
+	job     int
+	granted chan struct{}
+}
+
+// newSlotScheduler creates a scheduler handing out the given number of slots.
+func newSlotScheduler(slots int) *slotScheduler {
+	return &slotScheduler{free: slots, held: make(map[int]int), weights: make(map[int]int)}
+}
+
+// setWeight sets the weight of a job, from its priority.
+func (s *slotScheduler) setWeight(job int, priority string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.weights[job] = priorityWeights[priority]
+}
+
+// remove forgets the weight of a job that stopped running.
+func (s *slotScheduler) remove(job int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.weights, job)
+}
+
+// forJob returns the scheduler the downloads of a job take their slots from.
+func (s *slotScheduler) forJob(job int) jobSlots {
+	return jobSlots{scheduler: s, job: job}
+}
+
+// jobSlots implements peer.SlotScheduler for one job.
+type jobSlots struct {
+	scheduler *slotScheduler
+	job       int
+}
+
+// Acquire implements peer.SlotScheduler.
+func (j jobSlots) Acquire(ctx context.Context) (func(), error) {
+	s := j.scheduler
+	release := func() { s.release(j.job) }
+
+	s.mu.Lock()
+	request := &slotRequest{job: j.job, granted: make(chan struct{})}
+	s.waiting = append(s.waiting, request)
+	s.grant()
+	s.mu.Unlock()
+
+	select {
+	case <-request.granted:
+		return release, nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, r := range s.waiting {
+		if r == request {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			return nil, ctx.Err()
+		}
+	}
+	// The slot was granted as ctx was cancelled; hand it on.
+	s.put(j.job)
+	return nil, ctx.Err()
+}
+
+// release returns a slot held by a job.
+func (s *slotScheduler) release(job int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(job)
+}
+
+// put returns a slot held by a job and hands it on. The caller must hold s.mu.
+func (s *slotScheduler) put(job int) {
+	if s.held[job]--; s.held[job] <= 0 {
+		delete(s.held, job)
+	}
+	s.free++
+	s.grant()
+}
+
+// grant hands the free slots to the waiting jobs. The caller must hold s.mu.
+func (s *slotScheduler) grant() {
+	for s.free > 0 && len(s.waiting) > 0 {
+		best := 0
+		for i := 1; i < len(s.waiting); i++ {
+			if s.behind(s.waiting[i].job, s.waiting[best].job) {
+				best = i
+			}
+		}
+		request := s.waiting[best]
+		s.waiting = append(s.waiting[:best], s.waiting[best+1:]...)
+		s.free--
+		s.held[request.job]++
+		close(request.granted)
+	}
+}
+
+// behind reports whether job a holds fewer slots than job b for its weight.
+func (s *slotScheduler) behind(a int, b int) bool {
+	return s.held[a]*s.weight(b) < s.held[b]*s.weight(a)
+}
+
+// weight returns the weight of a job. The caller must hold s.mu.
+func (s *slotScheduler) weight(job int) int {
+	if weight, ok := s.weights[job]; ok {
+		return weight
+	}
+	return priorityWeights[PriorityNormal]
+}
@@ -0,0 +1,223 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeJobs drives a slot scheduler with jobs that always have requests waiting, as running jobs
+// with more chunks to download than slots do, and that return their slots in the order they got
+// them, as they would if every chunk took as long to download.
+type fakeJobs struct {
+	s       *slotScheduler
+	waiting []*slotRequest
+	holding []int       // Jobs holding a slot, in the order they got it.
+	grants  map[int]int // Slots granted to each job.
+}
+
+// newFakeJobs creates jobs with the given priorities, by job ID, sharing slots.
+func newFakeJobs(slots int, priorities map[int]string) *fakeJobs {
+	f := &fakeJobs{s: newSlotScheduler(0), grants: make(map[int]int)}
+	for job, priority := range priorities {
+		f.s.setWeight(job, priority)
+	}
+	// Every job asks for more slots than there are, in turn, before any is handed out.
+	for range slots {
+		for job := 1; job <= len(priorities); job++ {
+			f.ask(job)
+		}
+	}
+	f.s.mu.Lock()
+	f.s.free = slots
+	f.s.grant()
+	f.s.mu.Unlock()
+	f.collect()
+	return f
+}
+
+// ask queues a request for a slot by a job.
+func (f *fakeJobs) ask(job int) {
+	request := &slotRequest{job: job, granted: make(chan struct{})}
+	f.s.mu.Lock()
+	f.s.waiting = append(f.s.waiting, request)
+	f.s.grant()
+	f.s.mu.Unlock()
+	f.waiting = append(f.waiting, request)
+}
+
+// collect records the requests granted since the last call, and asks again for each.
+func (f *fakeJobs) collect() {
+	waiting := f.waiting[:0]
+	var granted []int
+	for _, request := range f.waiting {
+		select {
+		case <-request.granted:
+			f.grants[request.job]++
+			f.holding = append(f.holding, request.job)
+			granted = append(granted, request.job)
+		default:
+			waiting = append(waiting, request)
+		}
+	}
+	f.waiting = waiting
+	for _, job := range granted {
+		f.ask(job)
+	}
+}
+
+// held returns the slots held by each job.
+func (f *fakeJobs) held() map[int]int {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	held := make(map[int]int)
+	for job, n := range f.s.held {
+		held[job] = n
+	}
+	return held
+}
+
+// step returns the slot held the longest and records the request it is handed to.
+func (f *fakeJobs) step() {
+	job := f.holding[0]
+	f.holding = f.holding[1:]
+	f.s.release(job)
+	f.collect()
+}
+
+func TestSlotSchedulerWeights(t *testing.T) {
+	const low, normal, high = 1, 2, 3
+	f := newFakeJobs(7, map[int]string{low: PriorityLow, normal: PriorityNormal, high: PriorityHigh})
+	if held := f.held(); held[low] != 1 || held[normal] != 2 || held[high] != 4 {
+		t.Fatalf("slots shared as %v, expected 1:2:4", held)
+	}
+
+	const steps = 7000
+	f.grants = make(map[int]int)
+	for range steps {
+		f.step()
+		if held := f.held(); held[low]+held[normal]+held[high] != 7 {
+			t.Fatalf("%v slots held, expected all 7", held)
+		}
+	}
+	for job, weight := range map[int]int{low: 1, normal: 2, high: 4} {
+		expected := steps * weight / 7
+		if got := f.grants[job]; got < expected*95/100 || got > expected*105/100 {
+			t.Fatalf("job %d got %d slots of %d, expected about %d: %v", job, got, steps, expected, f.grants)
+		}
+	}
+}
+
+// TestSlotSchedulerReweight checks that a job whose priority changes gets its new share as slots are freed.
+func TestSlotSchedulerReweight(t *testing.T) {
+	f := newFakeJobs(6, map[int]string{1: PriorityNormal, 2: PriorityNormal})
+	if held := f.held(); held[1] != 3 || held[2] != 3 {
+		t.Fatalf("slots shared as %v, expected 3:3", held)
+	}
+	f.s.setWeight(1, PriorityHigh)
+	f.s.setWeight(2, PriorityLow)
+	for range 12 {
+		f.step()
+	}
+	if held := f.held(); held[1] < 4 || held[2] < 1 {
+		t.Fatalf("slots shared as %v after changing priorities, expected about 4:1", held)
+	}
+}
+
+func TestSlotSchedulerAlone(t *testing.T) {
+	f := newFakeJobs(5, map[int]string{1: PriorityLow})
+	if held := f.held(); held[1] != 5 {
+		t.Fatalf("a job alone holds %d of 5 slots", held[1])
+	}
+}
+
+func TestSlotSchedulerAcquire(t *testing.T) {
+	s := newSlotScheduler(1)
+	release, err := s.forJob(1).Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The next request waits until the slot is released.
+	acquired := make(chan func())
+	go func() {
+		release, err := s.forJob(2).Acquire(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- release
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired a slot held by another job")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	(<-acquired)()
+
+	if s.free != 1 || len(s.held) != 0 || len(s.waiting) != 0 {
+		t.Fatalf("%d free slots, %v held, %d waiting after releasing every slot", s.free, s.held, len(s.waiting))
+	}
+}
+
+func TestSlotSchedulerCancelWaiting(t *testing.T) {
+	s := newSlotScheduler(1)
+	release, err := s.forJob(1).Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := s.forJob(2).Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, expected the context error", err)
+	}
+	if len(s.waiting) != 0 {
+		t.Fatal("a cancelled request is still waiting")
+	}
+	release()
+	if s.free != 1 {
+		t.Fatalf("%d free slots, expected 1", s.free)
+	}
+}
+
+// TestSlotSchedulerCancelRacingGrant checks that a slot granted to a request whose context was
+// cancelled at the same time is handed on rather than lost.
+func TestSlotSchedulerCancelRacingGrant(t *testing.T) {
+	s := newSlotScheduler(1)
+	if _, err := s.forJob(1).Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() {
+		_, err := s.forJob(2).Acquire(ctx)
+		result <- err
+	}()
+	for {
+		s.mu.Lock()
+		if len(s.waiting) == 1 {
+			break
+		}
+		s.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	// With the scheduler locked, the request sees its context cancelled, then job 1 hands it its
+	// slot before it can withdraw.
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	s.put(1)
+	s.mu.Unlock()
+	if err := <-result; !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, expected context.Canceled", err)
+	}
+
+	if s.free != 1 || len(s.held) != 0 {
+		t.Fatalf("%d free slots and %v held, expected the slot to be handed back", s.free, s.held)
+	}
+	if _, err := s.forJob(3).Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,45 @@
+// Package file contains utilities for file chunking and reconstruction.
+// This file contains the buffer pool shared by chunking, chunk storage and chunk transfers,
+// which keeps memory use flat regardless of chunk sizes and the number of concurrent transfers.
+package file
+
+import (
+	"io"
+	"sync"
+)
+
+// BufferSize is the size of the pooled buffers used to stream chunk data.
+const BufferSize = 256 * 1024
+
+// bufferPool holds reusable BufferSize buffers. Pointers are pooled to avoid an allocation per Put.
+var bufferPool = sync.Pool{
+	New: func() any {
+		buffer := make([]byte, BufferSize)
+		return &buffer
+	},
+}
+
+// getBuffer takes a buffer from the pool. It must be returned with putBuffer.
+func getBuffer() *[]byte {
+	return bufferPool.Get().(*[]byte)
+}
+
+// putBuffer returns a buffer to the pool.
+func putBuffer(buffer *[]byte) {
+	bufferPool.Put(buffer)
+}
+
+// Copy copies from src to dst until EOF or an error, like io.Copy, but through a pooled buffer.
+//
+// Parameters:
+// - dst: The destination of the data.
+// - src: The source of the data.
+//
+// Returns:
+// - int64: The number of bytes copied.
+// - error: The first error encountered while reading or writing, if any.
+func Copy(dst io.Writer, src io.Reader) (int64, error) {
+	buffer := getBuffer()
+	defer putBuffer(buffer)
+	return io.CopyBuffer(dst, src, *buffer)
+}
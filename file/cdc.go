@@ -0,0 +1,243 @@
+// Package file contains utilities for file chunking and reconstruction.
+// This file implements the chunking strategies used by SplitFile: fixed-size chunking and
+// content-defined chunking (FastCDC), which cuts chunks where the content says so, so that an
+// insertion near the start of a file only changes the chunks around it.
+package file
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Chunking modes recorded in file manifests.
+const (
+	ChunkingFixed = "fixed" // Chunks of exactly Size bytes, except the last one.
+	ChunkingCDC   = "cdc"   // Content-defined chunks between MinSize and MaxSize bytes, averaging AvgSize.
+	ChunkingAuto  = "auto"  // Fixed-size chunks sized from the file size. Resolved to ChunkingFixed before splitting.
+)
+
+// Automatic chunk sizing. Chunk sizes are powers of two between the bounds, chosen so that a file
+// has at most autoChunkTarget chunks: small files get small chunks that are cheap to retry, large
+// files get large chunks so their manifests and the number of requests stay small.
+const (
+	MinAutoChunkSize = 256 * 1024
+	MaxAutoChunkSize = 64 * 1024 * 1024
+	autoChunkTarget  = 64
+)
+
+// Default content-defined chunking sizes.
+const (
+	DefaultCDCMinSize = 2 * 1024 * 1024
+	DefaultCDCAvgSize = 8 * 1024 * 1024
+	DefaultCDCMaxSize = 32 * 1024 * 1024
+
+	// minCDCSize is the smallest MinSize accepted, so that the rolling hash has enough data.
+	minCDCSize = 64
+)
+
+// Chunking describes how a file was (or is to be) split into chunks. It is recorded in the manifest.
+type Chunking struct {
+	Mode    string `json:"mode"`               // ChunkingFixed or ChunkingCDC.
+	Size    int64  `json:"size,omitempty"`     // Chunk size for fixed chunking.
+	MinSize int64  `json:"min_size,omitempty"` // Minimum chunk size for content-defined chunking.
+	AvgSize int64  `json:"avg_size,omitempty"` // Target average chunk size for content-defined chunking.
+	MaxSize int64  `json:"max_size,omitempty"` // Maximum chunk size for content-defined chunking.
+
+	// Reed-Solomon erasure coding, applied on top of either mode when DataShards is set:
+	// every group of DataShards chunks gets ParityShards parity chunks, and any DataShards
+	// chunks of a group are enough to recover the others.
+	DataShards   int `json:"data_shards,omitempty"`
+	ParityShards int `json:"parity_shards,omitempty"`
+}
+
+// AutoChunking returns automatic chunking, the default for shared files.
+func AutoChunking() Chunking {
+	return Chunking{Mode: ChunkingAuto}
+}
+
+// FixedChunking returns fixed-size chunking with the given chunk size.
+func FixedChunking(size int64) Chunking {
+	return Chunking{Mode: ChunkingFixed, Size: size}
+}
+
+// CDCChunking returns content-defined chunking with the given sizes.
+func CDCChunking(minSize, avgSize, maxSize int64) Chunking {
+	return Chunking{Mode: ChunkingCDC, MinSize: minSize, AvgSize: avgSize, MaxSize: maxSize}
+}
+
+// AutoChunkSize returns the chunk size automatic chunking uses for a file of the given size.
+func AutoChunkSize(fileSize int64) int64 {
+	size := int64(MinAutoChunkSize)
+	for size < MaxAutoChunkSize && fileSize > size*autoChunkTarget {
+		size *= 2
+	}
+	return size
+}
+
+// Resolve returns the concrete chunking used for a file of the given size.
+// Automatic chunking becomes fixed-size chunking; other modes are returned unchanged.
+func (c Chunking) Resolve(fileSize int64) Chunking {
+	if c.Mode == ChunkingAuto {
+		resolved := FixedChunking(AutoChunkSize(fileSize))
+		resolved.DataShards, resolved.ParityShards = c.DataShards, c.ParityShards
+		return resolved
+	}
+	return c
+}
+
+// Validate checks that the chunking parameters are consistent and that no chunk can exceed MaxChunkSize,
+// the largest chunk peers accept.
+func (c Chunking) Validate() error {
+	if c.DataShards != 0 || c.ParityShards != 0 {
+		if c.DataShards < 1 || c.ParityShards < 1 || c.DataShards+c.ParityShards > maxShards {
+			return fmt.Errorf("erasure coding needs at least 1 data and 1 parity shard, and at most %d shards in total", maxShards)
+		}
+	}
+	switch c.Mode {
+	case ChunkingAuto:
+		if c.Size != 0 || c.MinSize != 0 || c.AvgSize != 0 || c.MaxSize != 0 {
+			return fmt.Errorf("automatic chunking takes no chunk sizes")
+		}
+	case ChunkingFixed:
+		if c.Size <= 0 || c.Size > MaxChunkSize {
+			return fmt.Errorf("fixed chunk size must be between 1 and %d bytes", MaxChunkSize)
+		}
+	case ChunkingCDC:
+		if c.MinSize < minCDCSize || c.MinSize > c.AvgSize || c.AvgSize > c.MaxSize {
+			return fmt.Errorf("content-defined chunk sizes must satisfy %d <= min <= avg <= max", minCDCSize)
+		}
+		if c.MaxSize > MaxChunkSize {
+			return fmt.Errorf("maximum chunk size must not exceed %d bytes", MaxChunkSize)
+		}
+	default:
+		return fmt.Errorf("unknown chunking mode %q", c.Mode)
+	}
+	return nil
+}
+
+// chunker finds the chunk boundaries of a stream and hashes the chunks as it goes.
+// It reads through a single pooled buffer, so its memory use does not depend on the chunk size.
+//
+// Fixed-size chunking cuts every Size bytes. Content-defined chunking uses FastCDC with normalized
+// chunking: a gear rolling hash is computed over the bytes past MinSize, and a chunk ends where the
+// hash matches a mask. Before AvgSize a stricter mask makes cuts less likely, after it a looser mask
+// makes them more likely, which narrows the chunk size distribution around the average.
+type chunker struct {
+	r           io.Reader
+	params      Chunking
+	maskS       uint64  // Mask used below the average size.
+	maskL       uint64  // Mask used above the average size.
+	fingerprint uint64  // Gear hash of the current chunk.
+	buffer      *[]byte // Pooled read buffer.
+	start       int     // Start of unconsumed data in buffer.
+	end         int     // End of unconsumed data in buffer.
+	readErr     error   // Sticky error from the underlying reader.
+}
+
+// newChunker creates the chunker for the given parameters. It must be closed to return its buffer.
+func newChunker(r io.Reader, c Chunking) (*chunker, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if c.Mode == ChunkingAuto {
+		return nil, fmt.Errorf("automatic chunking must be resolved before splitting")
+	}
+
+	k := &chunker{r: r, params: c, buffer: getBuffer()}
+	if c.Mode == ChunkingCDC {
+		avgBits := bits.Len64(uint64(c.AvgSize)) - 1
+		k.maskS = topBitsMask(avgBits + 2)
+		k.maskL = topBitsMask(max(avgBits-2, 1))
+	}
+	return k, nil
+}
+
+// topBitsMask returns a mask selecting the n most significant bits. The gear hash shifts left on
+// every byte, so its top bits depend on the last 64 bytes rather than only the last few.
+func topBitsMask(n int) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+// gearTable holds the random values of the gear rolling hash. It is derived deterministically
+// from SHA-256 so that every node cuts identical content at identical positions.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		sum := sha256.Sum256([]byte{'g', 't', 'p', '-', 'g', 'e', 'a', 'r', byte(i)})
+		table[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+	return table
+}()
+
+// Next consumes the next chunk of the stream and returns its length and SHA-256 hash,
+// or io.EOF once the stream is exhausted.
+func (k *chunker) Next() (int64, string, error) {
+	hasher := sha256.New()
+	var length int64
+	k.fingerprint = 0
+	for {
+		if k.start == k.end {
+			if k.readErr == io.EOF && length > 0 {
+				break
+			}
+			if k.readErr == io.EOF {
+				return 0, "", io.EOF
+			}
+			if k.readErr != nil {
+				return 0, "", fmt.Errorf("error reading file: %w", k.readErr)
+			}
+			n, err := k.r.Read(*k.buffer)
+			k.start, k.end, k.readErr = 0, n, err
+			continue
+		}
+
+		data := (*k.buffer)[k.start:k.end]
+		n, cut := k.scan(data, length)
+		hasher.Write(data[:n])
+		k.start += n
+		length += int64(n)
+		if cut {
+			break
+		}
+	}
+	return length, hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// scan looks for the end of the current chunk in data, given the length of the chunk so far.
+// It returns how many bytes of data belong to the chunk and whether the chunk ends there.
+func (k *chunker) scan(data []byte, length int64) (int, bool) {
+	if k.params.Mode == ChunkingFixed {
+		if remaining := k.params.Size - length; int64(len(data)) >= remaining {
+			return int(remaining), true
+		}
+		return len(data), false
+	}
+
+	for i, b := range data {
+		position := length + int64(i)
+		if position < k.params.MinSize {
+			continue
+		}
+		k.fingerprint = (k.fingerprint << 1) + gearTable[b]
+		mask := k.maskS
+		if position >= k.params.AvgSize {
+			mask = k.maskL
+		}
+		if k.fingerprint&mask == 0 || position+1 >= k.params.MaxSize {
+			return i + 1, true
+		}
+	}
+	return len(data), false
+}
+
+// Close returns the chunker's buffer to the pool.
+func (k *chunker) Close() {
+	if k.buffer != nil {
+		putBuffer(k.buffer)
+		k.buffer = nil
+	}
+}
@@ -0,0 +1,206 @@
+package file
+
+import (
+	"bytes"
+	"io"
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"testing/iotest"
+)
+
+// testCDC is content-defined chunking small enough to cut many chunks out of test data.
+var testCDC = CDCChunking(4*1024, 16*1024, 64*1024)
+
+// pseudoRandom returns n bytes of deterministic pseudo-random data.
+func pseudoRandom(seed byte, n int) []byte {
+	data := make([]byte, n)
+	source := rand.NewChaCha8([32]byte{seed})
+	_, _ = source.Read(data)
+	return data
+}
+
+// split returns the sizes and hashes of the chunks cut out of r.
+func split(t *testing.T, r io.Reader, chunking Chunking) ([]int64, []string) {
+	t.Helper()
+	k, err := newChunker(r, chunking)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	var sizes []int64
+	var hashes []string
+	for {
+		size, hash, err := k.Next()
+		if err == io.EOF {
+			return sizes, hashes
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, size)
+		hashes = append(hashes, hash)
+	}
+}
+
+func TestCDCSizeBounds(t *testing.T) {
+	data := pseudoRandom(1, 8*1024*1024)
+	sizes, _ := split(t, bytes.NewReader(data), testCDC)
+
+	var total int64
+	for i, size := range sizes {
+		total += size
+		if size > testCDC.MaxSize {
+			t.Fatalf("chunk %d has %d bytes, more than the maximum of %d", i, size, testCDC.MaxSize)
+		}
+		if size < testCDC.MinSize && i != len(sizes)-1 {
+			t.Fatalf("chunk %d has %d bytes, less than the minimum of %d", i, size, testCDC.MinSize)
+		}
+	}
+	if total != int64(len(data)) {
+		t.Fatalf("chunks add up to %d bytes instead of %d", total, len(data))
+	}
+	average := total / int64(len(sizes))
+	if average < testCDC.AvgSize/2 || average > testCDC.AvgSize*2 {
+		t.Fatalf("average chunk size is %d bytes, far from the target of %d", average, testCDC.AvgSize)
+	}
+}
+
+// TestCDCMaxSizeCut checks that content never matching the cut mask is cut at the maximum size.
+func TestCDCMaxSizeCut(t *testing.T) {
+	data := make([]byte, 3*testCDC.MaxSize+100)
+	sizes, _ := split(t, bytes.NewReader(data), testCDC)
+	expected := []int64{testCDC.MaxSize, testCDC.MaxSize, testCDC.MaxSize, 100}
+	if !slices.Equal(sizes, expected) {
+		t.Fatalf("cut zeros into %v, expected %v", sizes, expected)
+	}
+}
+
+func TestCDCDeterministic(t *testing.T) {
+	data := pseudoRandom(2, 2*1024*1024)
+	sizes, hashes := split(t, bytes.NewReader(data), testCDC)
+	againSizes, againHashes := split(t, bytes.NewReader(data), testCDC)
+	if !slices.Equal(sizes, againSizes) || !slices.Equal(hashes, againHashes) {
+		t.Fatal("the same data was cut differently twice")
+	}
+
+	// The boundaries depend on the content only, not on how it is read.
+	oneByteSizes, oneByteHashes := split(t, iotest.OneByteReader(bytes.NewReader(data)), testCDC)
+	if !slices.Equal(sizes, oneByteSizes) || !slices.Equal(hashes, oneByteHashes) {
+		t.Fatal("the same data was cut differently when read one byte at a time")
+	}
+}
+
+// TestCDCPrefixInsertion checks the property content-defined chunking exists for: inserting data
+// near the start of a file only changes the chunks around the insertion, where fixed-size chunking
+// changes every chunk after it.
+func TestCDCPrefixInsertion(t *testing.T) {
+	data := pseudoRandom(3, 4*1024*1024)
+	modified := append(pseudoRandom(4, 1000), data...)
+
+	shared := func(chunking Chunking) (int, int) {
+		_, original := split(t, bytes.NewReader(data), chunking)
+		_, changed := split(t, bytes.NewReader(modified), chunking)
+		kept := 0
+		for _, hash := range original {
+			if slices.Contains(changed, hash) {
+				kept++
+			}
+		}
+		return kept, len(original)
+	}
+
+	kept, total := shared(testCDC)
+	if total < 50 {
+		t.Fatalf("only %d chunks, too few to test", total)
+	}
+	if kept < total-2 {
+		t.Fatalf("content-defined chunking kept %d of %d chunks after a prefix insertion", kept, total)
+	}
+	if kept, total := shared(FixedChunking(testCDC.AvgSize)); kept > 1 {
+		t.Fatalf("fixed-size chunking kept %d of %d chunks after a prefix insertion", kept, total)
+	}
+}
+
+func TestFixedChunkingSizes(t *testing.T) {
+	data := pseudoRandom(5, 10*1000+1)
+	sizes, _ := split(t, bytes.NewReader(data), FixedChunking(1000))
+	if len(sizes) != 11 || sizes[10] != 1 {
+		t.Fatalf("cut %d bytes into %v", len(data), sizes)
+	}
+	for _, size := range sizes[:10] {
+		if size != 1000 {
+			t.Fatalf("cut %d bytes into %v", len(data), sizes)
+		}
+	}
+	if sizes, _ := split(t, bytes.NewReader(nil), FixedChunking(1000)); len(sizes) != 0 {
+		t.Fatalf("cut an empty file into %v", sizes)
+	}
+}
+
+func TestChunkingValidate(t *testing.T) {
+	valid := []Chunking{
+		testCDC,
+		CDCChunking(minCDCSize, minCDCSize, minCDCSize),
+		FixedChunking(1),
+		FixedChunking(MaxChunkSize),
+		AutoChunking(),
+		{Mode: ChunkingFixed, Size: 1024, DataShards: 4, ParityShards: 2},
+	}
+	for _, chunking := range valid {
+		if err := chunking.Validate(); err != nil {
+			t.Errorf("%+v: %v", chunking, err)
+		}
+	}
+	invalid := []Chunking{
+		CDCChunking(minCDCSize-1, 1024, 4096),
+		CDCChunking(2048, 1024, 4096),
+		CDCChunking(1024, 8192, 4096),
+		CDCChunking(1024, 4096, MaxChunkSize+1),
+		FixedChunking(0),
+		FixedChunking(MaxChunkSize + 1),
+		{Mode: ChunkingAuto, Size: 1024},
+		{Mode: "other"},
+		{Mode: ChunkingFixed, Size: 1024, DataShards: 4},
+		{Mode: ChunkingFixed, Size: 1024, DataShards: maxShards, ParityShards: 1},
+	}
+	for _, chunking := range invalid {
+		if err := chunking.Validate(); err == nil {
+			t.Errorf("%+v was accepted", chunking)
+		}
+	}
+}
+
+func TestChunkingResolve(t *testing.T) {
+	const KiB, MiB, GiB = 1024, 1024 * 1024, 1024 * 1024 * 1024
+	tests := []struct {
+		name     string
+		chunking Chunking
+		fileSize int64
+		expected Chunking
+	}{
+		{name: "empty file", chunking: AutoChunking(), fileSize: 0, expected: FixedChunking(256 * KiB)},
+		{name: "small file", chunking: AutoChunking(), fileSize: 1 * MiB, expected: FixedChunking(256 * KiB)},
+		{name: "top of the smallest band", chunking: AutoChunking(), fileSize: 16 * MiB, expected: FixedChunking(256 * KiB)},
+		{name: "bottom of the next band", chunking: AutoChunking(), fileSize: 16*MiB + 1, expected: FixedChunking(512 * KiB)},
+		{name: "gigabyte", chunking: AutoChunking(), fileSize: 1 * GiB, expected: FixedChunking(16 * MiB)},
+		{name: "just over a gigabyte", chunking: AutoChunking(), fileSize: 1*GiB + 1, expected: FixedChunking(32 * MiB)},
+		{name: "largest chunks", chunking: AutoChunking(), fileSize: 4*GiB + 1, expected: FixedChunking(MaxAutoChunkSize)},
+		{name: "huge file", chunking: AutoChunking(), fileSize: 1 << 40, expected: FixedChunking(MaxAutoChunkSize)},
+		{
+			name:     "erasure coding kept",
+			chunking: Chunking{Mode: ChunkingAuto, DataShards: 4, ParityShards: 2},
+			fileSize: 1 * MiB,
+			expected: Chunking{Mode: ChunkingFixed, Size: 256 * KiB, DataShards: 4, ParityShards: 2},
+		},
+		{name: "fixed unchanged", chunking: FixedChunking(1000), fileSize: 1 * GiB, expected: FixedChunking(1000)},
+		{name: "cdc unchanged", chunking: testCDC, fileSize: 1 * GiB, expected: testCDC},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.chunking.Resolve(tt.fileSize); got != tt.expected {
+				t.Fatalf("Resolve(%d) = %+v, expected %+v", tt.fileSize, got, tt.expected)
+			}
+		})
+	}
+}
@@ -6,145 +6,320 @@ package file
 // - "io": For general file stream handling.
 // - "fmt": For formatted error messages.
 import (
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt" // Formatted I/O library
 	"io"  // Input/Output utility library
 	"os"  // OS-level file handling functions
-	"path/filepath"
+	"time"
 	//"strings"
 )
 
-// ChunkSize defines the size of each file chunk in bytes (12MB).
-const ChunkSize = 120 * 1024 * 1024
-
-// SplitFile splits a given file into chunks of fixed size.
-// The chunks are stored in the "chunks" directory with a numbered naming scheme.
-// SplitFile splits a given file into chunks of fixed size.
+// MaxChunkSize is the largest chunk, in bytes, that files are split into and that peers accept (120MB).
+const MaxChunkSize = 120 * 1024 * 1024
 
 // FileMetadata represents metadata for a file.
+// It is stored as the file's manifest and lists the content hashes of its chunks in order.
 type FileMetadata struct {
-	Name   string   `json:"name"`   // Original file name
-	Size   int64    `json:"size"`   // File size in bytes
-	Chunks []string `json:"chunks"` // List of chunk IDs
-	Hash   string   `json:"hash"`   // File hash
+	Name       string   `json:"name"`                  // Original file name
+	Size       int64    `json:"size"`                  // File size in bytes
+	Chunks     []string `json:"chunks"`                // List of chunk IDs (the SHA-256 hashes of the chunks)
+	ChunkSizes []int64  `json:"chunk_sizes,omitempty"` // Size of each chunk, in the same order as Chunks
+	Hash       string   `json:"hash"`                  // File hash
+	Chunking   Chunking `json:"chunking"`              // How the file was split into chunks
+
+	// Parity chunks of an erasure-coded file: Chunking.ParityShards for every group of
+	// Chunking.DataShards chunks, each as large as the largest data chunk of its group.
+	ParityChunks []string `json:"parity_chunks,omitempty"`
+	ParitySizes  []int64  `json:"parity_sizes,omitempty"`
+
+	// Local is set on the manifests of files split from this node's own files, such as shared
+	// files, rather than downloaded. Garbage collection forgets them once the file is no longer kept.
+	Local bool `json:"local,omitempty"`
+
+	// Downloading is set on the provisional manifest stored when a download starts, to the time it
+	// started, so that garbage collection keeps the chunks fetched so far however long the download
+	// takes. The manifest stored once every chunk is present replaces it.
+	Downloading *time.Time `json:"downloading,omitempty"`
 }
 
-func SplitFile(filePath string, fileHash string) error {
+// AllChunks returns the data chunks of a file followed by its parity chunks, which the store
+// keeps for the file.
+func (metadata FileMetadata) AllChunks() []string {
+	return append(append([]string{}, metadata.Chunks...), metadata.ParityChunks...)
+}
+
+// SplitFile splits a given file into chunks, either of fixed size or content-defined.
+// The chunks are stored in the chunk store under their content hash, so chunks the store already
+// holds for another file are not written again, and the file's manifest is stored alongside them.
+//
+// Parameters:
+// - store: The store receiving the chunks and manifest.
+// - filePath: The path of the file to split.
+// - fileHash: The hash of the whole file, used as the key of its manifest.
+// - chunking: How to split the file; the parameters are recorded in the manifest.
+//
+// Returns:
+// - FileMetadata: The manifest of the file.
+// - error: An error object if reading the file or storing its chunks fails.
+func SplitFile(store Store, filePath string, fileHash string, chunking Chunking) (FileMetadata, error) {
+	if err := ValidateFileHash(fileHash); err != nil {
+		return FileMetadata{}, err
+	}
+
 	file, err := os.Open(filePath)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+		return FileMetadata{}, fmt.Errorf("failed to open file: %w", err)
 	}
 	defer file.Close()
 
 	fileInfo, err := file.Stat()
 	if err != nil {
-		return fmt.Errorf("failed to get file info: %w", err)
+		return FileMetadata{}, fmt.Errorf("failed to get file info: %w", err)
 	}
 
-	chunksDir := filepath.Join("chunks", fileHash)
-	if err := os.MkdirAll(chunksDir, 0755); err != nil {
-		return fmt.Errorf("failed to create chunks directory: %w", err)
+	// Automatic chunking picks the chunk size from the file size; the manifest records the resolved size.
+	chunking = chunking.Resolve(fileInfo.Size())
+	chunks, err := newChunker(file, chunking)
+	if err != nil {
+		return FileMetadata{}, err
 	}
+	defer chunks.Close()
 
-	var chunkIDs []string
-	buffer := make([]byte, ChunkSize)
-	chunkIndex := 0
+	// The file is streamed twice at most: once to find and hash the chunks, and once more for the
+	// chunks the store does not hold yet, so no chunk is ever held in memory.
+	chunkIDs := []string{}
+	chunkSizes := []int64{}
+	var offset int64
 	for {
-		bytesRead, err := file.Read(buffer)
-		if err != nil && err != io.EOF {
-			return fmt.Errorf("error reading file: %w", err)
-		}
-		if bytesRead == 0 {
+		chunkLength, chunkID, err := chunks.Next()
+		if err == io.EOF {
 			break
 		}
-
-		chunkID := fmt.Sprintf("chunk_%d", chunkIndex)
-		chunkPath := filepath.Join(chunksDir, chunkID)
-		chunkFile, err := os.Create(chunkPath)
 		if err != nil {
-			return fmt.Errorf("failed to create chunk file: %w", err)
+			return FileMetadata{}, err
 		}
 
-		if _, err := chunkFile.Write(buffer[:bytesRead]); err != nil {
-			return fmt.Errorf("error writing chunk file: %w", err)
+		// Identical chunks are stored once, whichever file they belong to.
+		if !store.Has(chunkID) {
+			if _, err := store.Put(chunkID, io.NewSectionReader(file, offset, chunkLength)); err != nil {
+				return FileMetadata{}, err
+			}
 		}
-		chunkFile.Close()
 
 		chunkIDs = append(chunkIDs, chunkID)
-		chunkIndex++
+		chunkSizes = append(chunkSizes, chunkLength)
+		offset += chunkLength
+	}
+
+	var parityIDs []string
+	var paritySizes []int64
+	if chunking.DataShards > 0 {
+		parityIDs, paritySizes, err = encodeParity(store, file, chunkSizes, chunking)
+		if err != nil {
+			return FileMetadata{}, err
+		}
 	}
 
 	// Create metadata.json
 	metadata := FileMetadata{
-		Name:   fileInfo.Name(),
-		Size:   fileInfo.Size(),
-		Chunks: chunkIDs,
-		Hash:   fileHash,
+		Name:         fileInfo.Name(),
+		Size:         fileInfo.Size(),
+		Chunks:       chunkIDs,
+		ChunkSizes:   chunkSizes,
+		Hash:         fileHash,
+		Chunking:     chunking,
+		ParityChunks: parityIDs,
+		ParitySizes:  paritySizes,
+		Local:        true,
+	}
+	if err := store.PutManifest(metadata); err != nil {
+		return FileMetadata{}, err
+	}
+
+	return metadata, nil
+}
+
+// ReconstructFile reconstructs the original file from its chunks.
+// It reads the chunks of the file with the given hash and combines them into a single output file.
+// The reconstructed data is hashed and compared with the file hash to detect any corruption
+// before the file is moved into place. A stream cannot take back what it received, so the
+// chunks are verified before anything is written to a stream destination.
+//
+// Returns:
+// - string: The path of the reconstructed file, or "" if it was written to dest.Writer.
+// - error: An error object if reconstruction fails or the data does not match the file hash.
+func ReconstructFile(store Store, dest Destination, fileHash string) (string, error) {
+	metadata, err := loadMetadata(store, fileHash)
+	if err != nil {
+		return "", err
+	}
+	if dest.Writer != nil {
+		if err := VerifyFile(store, fileHash); err != nil {
+			return "", err
+		}
 	}
 
-	metadataPath := filepath.Join(chunksDir, "metadata.json")
-	metadataFile, err := os.Create(metadataPath)
+	outputFile, err := dest.create(metadata.Name)
 	if err != nil {
-		return fmt.Errorf("failed to create metadata file: %w", err)
+		return "", err
 	}
-	defer metadataFile.Close()
+	defer outputFile.abort()
+
+	// Reconstruct the file from chunks.
+	chunks := newChunkReader(store, metadata.Chunks)
+	defer chunks.Close()
+	hasher := sha256.New()
+	if _, err := Copy(io.MultiWriter(outputFile, hasher), chunks); err != nil {
+		return "", fmt.Errorf("failed to write chunk data to output file: %w", err)
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != fileHash {
+		return "", fmt.Errorf("reconstructed file %s does not match hash %s", metadata.Name, fileHash)
+	}
+	return outputFile.commit()
+}
 
-	if err := json.NewEncoder(metadataFile).Encode(metadata); err != nil {
-		return fmt.Errorf("failed to write metadata file: %w", err)
+// VerifyFile checks that the store holds every chunk of a file and that they add up to the file's
+// hash, reading the chunks without writing the file anywhere.
+//
+// Parameters:
+// - store: The store holding the file.
+// - fileHash: The hash of the file to verify.
+//
+// Returns:
+// - error: An error object if the manifest or a chunk is missing or the data does not match the file hash.
+func VerifyFile(store Store, fileHash string) error {
+	metadata, err := loadMetadata(store, fileHash)
+	if err != nil {
+		return err
 	}
 
+	chunks := newChunkReader(store, metadata.Chunks)
+	defer chunks.Close()
+	hasher := sha256.New()
+	if _, err := Copy(hasher, chunks); err != nil {
+		return fmt.Errorf("failed to read chunks of %s: %w", fileHash, err)
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != fileHash {
+		return fmt.Errorf("chunks of %s do not match its hash", fileHash)
+	}
 	return nil
 }
 
-// ReconstructFile reconstructs the original file from its chunks.
-// It reads chunks from the "chunks" directory and combines them into a single output file.
-// ReconstructFile reconstructs the original file from its chunks.
-// It reads chunks from the "chunks/<file_name>" directory and combines them into a single output file.
-func ReconstructFile(outputDir string, fileHash string) error {
-	chunksDir := filepath.Join("chunks", fileHash)
-	metadataFilePath := filepath.Join(chunksDir, "metadata.json")
+// ReconstructEncryptedFile reconstructs and decrypts an end-to-end encrypted file from its chunks.
+// The chunks hold ciphertext; the plaintext, written to dest under the original file name
+// stored inside the ciphertext unless dest names a path, never touches the chunk store.
+// Every segment is authenticated before it is written, so a stream destination only receives
+// authentic plaintext, although it may be cut short if a later segment fails.
+//
+// Parameters:
+// - store: The chunk store holding the encrypted chunks.
+// - dest: Where to write the decrypted file.
+// - fileHash: The hash of the encrypted file, as advertised in catalogs.
+// - key: The share key of the file.
+//
+// Returns:
+// - string: The path of the decrypted file, or "" if it was written to dest.Writer.
+// - error: An error object if reconstruction or decryption fails.
+func ReconstructEncryptedFile(store Store, dest Destination, fileHash string, key []byte) (string, error) {
+	metadata, err := loadMetadata(store, fileHash)
+	if err != nil {
+		return "", err
+	}
+
+	chunks := newChunkReader(store, metadata.Chunks)
+	defer chunks.Close()
 
-	// Open and parse the metadata file.
-	metadataFile, err := os.Open(metadataFilePath)
+	plaintext, err := NewDecryptReader(chunks, key)
 	if err != nil {
-		return fmt.Errorf("failed to open metadata file: %w", err)
+		return "", err
 	}
-	defer metadataFile.Close()
 
-	var metadata FileMetadata
-	if err := json.NewDecoder(metadataFile).Decode(&metadata); err != nil {
-		return fmt.Errorf("failed to parse metadata file: %w", err)
+	outputFile, err := dest.create(plaintext.Name())
+	if err != nil {
+		return "", err
 	}
+	defer outputFile.abort() // Never leave unauthenticated plaintext behind.
 
-	// Use the original file name from metadata.
-	originalName := metadata.Name
-	if originalName == "" {
-		return fmt.Errorf("original file name is missing in metadata")
+	if _, err := Copy(outputFile, plaintext); err != nil {
+		return "", fmt.Errorf("failed to decrypt file: %w", err)
 	}
+	return outputFile.commit()
+}
 
-	// Set the output file path.
-	outputFilePath := filepath.Join(outputDir, originalName)
-	outputFile, err := os.Create(outputFilePath)
+// loadMetadata reads and validates the manifest of a file.
+func loadMetadata(store ManifestStore, fileHash string) (FileMetadata, error) {
+	metadata, err := store.GetManifest(fileHash)
 	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
+		return FileMetadata{}, err
 	}
-	defer outputFile.Close()
 
-	// Reconstruct the file from chunks.
-	for _, chunkID := range metadata.Chunks {
-		chunkPath := filepath.Join(chunksDir, chunkID)
-		chunkFile, err := os.Open(chunkPath)
-		if err != nil {
-			return fmt.Errorf("failed to open chunk file %s: %w", chunkPath, err)
+	// Use the original file name from metadata.
+	// The metadata comes from a remote peer, so the name and chunk IDs are validated
+	// before they are joined into any path.
+	if metadata.Name == "" {
+		return FileMetadata{}, fmt.Errorf("original file name is missing in metadata")
+	}
+	if err := ValidateFileName(metadata.Name); err != nil {
+		return FileMetadata{}, fmt.Errorf("invalid file name in metadata: %w", err)
+	}
+	for _, chunkID := range metadata.AllChunks() {
+		if err := ValidateChunkID(chunkID); err != nil {
+			return FileMetadata{}, fmt.Errorf("invalid chunk ID in metadata: %w", err)
+		}
+	}
+	if err := ValidateChunkLayout(metadata); err != nil {
+		return FileMetadata{}, fmt.Errorf("invalid chunk layout in metadata: %w", err)
+	}
+	return metadata, nil
+}
+
+// chunkReader reads the chunks of a file in order as a single stream, opening one chunk at a time.
+type chunkReader struct {
+	store   ChunkStore
+	chunks  []string
+	current io.ReadCloser
+}
+
+// newChunkReader creates a reader over the given chunks of a file.
+func newChunkReader(store ChunkStore, chunks []string) *chunkReader {
+	return &chunkReader{store: store, chunks: chunks}
+}
+
+// Read implements io.Reader.
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.current == nil {
+			if len(c.chunks) == 0 {
+				return 0, io.EOF
+			}
+			chunk, err := c.store.Get(c.chunks[0])
+			if err != nil {
+				return 0, err
+			}
+			c.current = chunk
+			c.chunks = c.chunks[1:]
 		}
 
-		// Write the chunk data to the output file.
-		if _, err := io.Copy(outputFile, chunkFile); err != nil {
-			chunkFile.Close()
-			return fmt.Errorf("failed to write chunk data to output file: %w", err)
+		n, err := c.current.Read(p)
+		if err == io.EOF {
+			c.current.Close()
+			c.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
 		}
-		chunkFile.Close()
+		return n, err
 	}
+}
 
-	return nil
+// Close closes the chunk currently being read, if any.
+func (c *chunkReader) Close() error {
+	if c.current == nil {
+		return nil
+	}
+	err := c.current.Close()
+	c.current = nil
+	return err
 }
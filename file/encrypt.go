@@ -0,0 +1,437 @@
+// Package file contains utilities for file chunking and reconstruction.
+// This file implements end-to-end encryption of shared files, so that seeders only ever store and
+// serve ciphertext while recipients holding the share key decrypt during reconstruction.
+package file
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-to-peer/util"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Encrypted files use a STREAM-like construction on top of AES-256-GCM:
+//
+//	header:  magic (8 bytes) | segment size (4 bytes) | nonce prefix (7 bytes)
+//	records: sealed(record 0 = padded JSON header record) | sealed(data segment 1) | ...
+//
+// Each record is sealed with the nonce prefix, a 4-byte big-endian record counter and a
+// final-record flag, and authenticates the file header as additional data. Records cannot be
+// reordered, dropped or truncated without the decryption failing.
+const (
+	encryptedMagic       = "GTPENC01"
+	encryptedHeaderSize  = len(encryptedMagic) + 4 + noncePrefixSize
+	noncePrefixSize      = 7
+	encryptedSegmentSize = 64 * 1024
+	encryptedRecordSize  = 2048 // Fixed plaintext size of the JSON header record.
+
+	// ShareKeySize is the size in bytes of the per-file key used to encrypt a shared file.
+	ShareKeySize = 32
+
+	// EncryptedFileExt is the extension given to encrypted files placed in a shared directory.
+	EncryptedFileExt = ".gtpenc"
+
+	// shareLinkScheme prefixes share links of the form "gtp://<file hash>#<key>".
+	shareLinkScheme = "gtp://"
+)
+
+// ErrFileChanged is returned when a file does not have the size it had when its encryption started.
+var ErrFileChanged = errors.New("file changed while it was being encrypted")
+
+// ErrDecryptionFailed is returned when an encrypted file cannot be authenticated with the given key.
+var ErrDecryptionFailed = errors.New("decryption failed: wrong key or corrupted data")
+
+// encryptedRecord is the first, encrypted record of an encrypted file. It carries the plaintext
+// metadata that must not be visible to seeders.
+type encryptedRecord struct {
+	Name string `json:"name"` // Original file name.
+	Size int64  `json:"size"` // Original file size in bytes.
+}
+
+// GenerateShareKey creates a new random per-file key.
+//
+// Returns:
+// - []byte: A random key of ShareKeySize bytes.
+// - error: An error object if the system random source fails.
+func GenerateShareKey() ([]byte, error) {
+	key := make([]byte, ShareKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("failed to generate share key: %w", err)
+	}
+	return key, nil
+}
+
+// FormatShareLink builds a share link embedding the ciphertext hash and the share key.
+func FormatShareLink(fileHash string, key []byte) string {
+	return shareLinkScheme + fileHash + "#" + base64.RawURLEncoding.EncodeToString(key)
+}
+
+// ParseShareLink extracts the ciphertext hash and share key from a share link.
+//
+// Parameters:
+// - link: A link of the form "gtp://<file hash>#<key>".
+//
+// Returns:
+// - string: The hash of the encrypted file, as advertised in catalogs.
+// - []byte: The share key.
+// - error: An error object if the link is malformed.
+func ParseShareLink(link string) (string, []byte, error) {
+	rest, ok := strings.CutPrefix(link, shareLinkScheme)
+	if !ok {
+		return "", nil, fmt.Errorf("share link must start with %s", shareLinkScheme)
+	}
+	fileHash, encodedKey, ok := strings.Cut(rest, "#")
+	if !ok {
+		return "", nil, fmt.Errorf("share link is missing the key")
+	}
+	if err := ValidateFileHash(fileHash); err != nil {
+		return "", nil, err
+	}
+	key, err := base64.RawURLEncoding.DecodeString(encodedKey)
+	if err != nil || len(key) != ShareKeySize {
+		return "", nil, fmt.Errorf("share link contains an invalid key")
+	}
+	return fileHash, key, nil
+}
+
+// IsShareLink reports whether the given string looks like a share link.
+func IsShareLink(s string) bool {
+	return strings.HasPrefix(s, shareLinkScheme)
+}
+
+// EncryptFile encrypts a file with the given key and writes the ciphertext to outputPath.
+// The original file name and size are stored inside the ciphertext.
+//
+// Parameters:
+// - inputPath: The path of the plaintext file.
+// - outputPath: The path of the encrypted file to create.
+// - key: The per-file share key.
+//
+// Returns:
+// - error: An error object if reading, encrypting or writing fails.
+func EncryptFile(inputPath string, outputPath string, key []byte) error {
+	input, err := os.Open(inputPath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer input.Close()
+
+	info, err := input.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get file info: %w", err)
+	}
+
+	output, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create encrypted file: %w", err)
+	}
+
+	if err := encryptStream(output, input, encryptedRecord{Name: info.Name(), Size: info.Size()}, key); err != nil {
+		output.Close()
+		os.Remove(outputPath)
+		return err
+	}
+	if err := output.Close(); err != nil {
+		os.Remove(outputPath)
+		return fmt.Errorf("failed to write encrypted file: %w", err)
+	}
+	return nil
+}
+
+// EncryptForSharing encrypts a file with a fresh share key into a shared directory.
+// The encrypted copy gets a random name so that seeders learn nothing about the original file.
+//
+// Parameters:
+// - inputPath: The path of the plaintext file to share.
+// - shareDir: The directory served to peers (e.g. "server_files").
+//
+// Returns:
+// - string: The share link to give to recipients.
+// - string: The path of the encrypted copy inside shareDir.
+// - error: An error object if encryption fails.
+func EncryptForSharing(inputPath string, shareDir string) (string, string, error) {
+	key, err := GenerateShareKey()
+	if err != nil {
+		return "", "", err
+	}
+
+	randomName := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, randomName); err != nil {
+		return "", "", fmt.Errorf("failed to generate file name: %w", err)
+	}
+	outputPath := filepath.Join(shareDir, hex.EncodeToString(randomName)+EncryptedFileExt)
+
+	if err := EncryptFile(inputPath, outputPath, key); err != nil {
+		return "", "", err
+	}
+
+	fileHash := util.CalculateFileHash(outputPath)
+	if fileHash == "" {
+		os.Remove(outputPath)
+		return "", "", fmt.Errorf("failed to hash encrypted file")
+	}
+	return FormatShareLink(fileHash, key), outputPath, nil
+}
+
+// encryptStream writes the header and sealed records for the plaintext read from r, which must be
+// exactly record.Size bytes long: decryption rejects files whose plaintext has another size, so a
+// file that changes while it is being encrypted is an error rather than a share nobody can decrypt.
+func encryptStream(w io.Writer, r io.Reader, record encryptedRecord, key []byte) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, encryptedHeaderSize)
+	copy(header, encryptedMagic)
+	binary.BigEndian.PutUint32(header[len(encryptedMagic):], encryptedSegmentSize)
+	if _, err := io.ReadFull(rand.Reader, header[len(encryptedMagic)+4:]); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	if _, err := w.Write(header); err != nil {
+		return fmt.Errorf("failed to write encrypted file: %w", err)
+	}
+	prefix := header[len(encryptedMagic)+4:]
+
+	recordData, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode encrypted header: %w", err)
+	}
+	if len(recordData) > encryptedRecordSize {
+		return fmt.Errorf("file name is too long")
+	}
+	// Pad the header record with spaces so that it does not leak the length of the file name.
+	recordData = append(recordData, bytes.Repeat([]byte{' '}, encryptedRecordSize-len(recordData))...)
+
+	// The header record is final only for empty files, which have no data segments.
+	var counter uint32
+	if _, err := w.Write(aead.Seal(nil, recordNonce(prefix, counter, record.Size == 0), recordData, header)); err != nil {
+		return fmt.Errorf("failed to write encrypted file: %w", err)
+	}
+	if record.Size == 0 {
+		if n, _ := r.Read(make([]byte, 1)); n > 0 {
+			return errFileChanged(int64(n), record.Size)
+		}
+		return nil
+	}
+
+	// Read one segment ahead so that the last segment can be flagged as final.
+	current := make([]byte, encryptedSegmentSize)
+	next := make([]byte, encryptedSegmentSize)
+	n, err := io.ReadFull(r, current)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("error reading file: %w", err)
+	}
+	total := int64(n)
+	sealed := make([]byte, 0, encryptedSegmentSize+aead.Overhead())
+	for {
+		m, readErr := io.ReadFull(r, next)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return fmt.Errorf("error reading file: %w", readErr)
+		}
+		total += int64(m)
+		final := m == 0
+		if total > record.Size || final && total != record.Size {
+			return errFileChanged(total, record.Size)
+		}
+
+		counter++
+		if counter == 0 {
+			return fmt.Errorf("file is too large to encrypt")
+		}
+		sealed = aead.Seal(sealed[:0], recordNonce(prefix, counter, final), current[:n], header)
+		if _, err := w.Write(sealed); err != nil {
+			return fmt.Errorf("failed to write encrypted file: %w", err)
+		}
+		if final {
+			return nil
+		}
+		current, next = next, current
+		n = m
+	}
+}
+
+// errFileChanged reports a file whose size changed while it was being encrypted.
+func errFileChanged(read int64, size int64) error {
+	if read > size {
+		return fmt.Errorf("%w: read more than its %d bytes", ErrFileChanged, size)
+	}
+	return fmt.Errorf("%w: read %d of its %d bytes", ErrFileChanged, read, size)
+}
+
+// DecryptReader decrypts an encrypted file while it is being read.
+type DecryptReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	header  []byte
+	counter uint32
+	record  encryptedRecord
+	buf     []byte // Decrypted but not yet returned plaintext.
+	sealed  []byte
+	opened  int64 // Plaintext bytes decrypted so far.
+	done    bool
+}
+
+// NewDecryptReader reads and authenticates the header of an encrypted stream.
+//
+// Parameters:
+// - r: The encrypted stream, typically the concatenated chunks of an encrypted file.
+// - key: The share key of the file.
+//
+// Returns:
+// - *DecryptReader: A reader yielding the plaintext, with the original name available via Name.
+// - error: ErrDecryptionFailed if the key does not match, or another error for malformed input.
+func NewDecryptReader(r io.Reader, key []byte) (*DecryptReader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, encryptedHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read encrypted header: %w", err)
+	}
+	if !bytes.Equal(header[:len(encryptedMagic)], []byte(encryptedMagic)) {
+		return nil, fmt.Errorf("file is not an encrypted share")
+	}
+	if segmentSize := binary.BigEndian.Uint32(header[len(encryptedMagic):]); segmentSize != encryptedSegmentSize {
+		return nil, fmt.Errorf("unsupported encrypted segment size %d", segmentSize)
+	}
+
+	d := &DecryptReader{
+		r:      r,
+		aead:   aead,
+		header: header,
+		sealed: make([]byte, encryptedSegmentSize+aead.Overhead()),
+	}
+
+	sealedRecord := d.sealed[:encryptedRecordSize+aead.Overhead()]
+	if _, err := io.ReadFull(r, sealedRecord); err != nil {
+		return nil, fmt.Errorf("failed to read encrypted header: %w", err)
+	}
+	recordData, final, err := d.open(sealedRecord)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(recordData, &d.record); err != nil {
+		return nil, fmt.Errorf("failed to parse encrypted header: %w", err)
+	}
+	if err := ValidateFileName(d.record.Name); err != nil {
+		return nil, fmt.Errorf("invalid file name in encrypted header: %w", err)
+	}
+	if final {
+		if err := d.finish(); err != nil {
+			return nil, err
+		}
+	}
+	d.done = final
+	return d, nil
+}
+
+// Name returns the original name of the encrypted file.
+func (d *DecryptReader) Name() string {
+	return d.record.Name
+}
+
+// Size returns the original size of the encrypted file.
+func (d *DecryptReader) Size() int64 {
+	return d.record.Size
+}
+
+// Read implements io.Reader, returning decrypted plaintext.
+func (d *DecryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(d.r, d.sealed)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			if err == io.EOF {
+				return 0, fmt.Errorf("encrypted file is truncated: %w", ErrDecryptionFailed)
+			}
+			return 0, err
+		}
+		plaintext, final, openErr := d.open(d.sealed[:n])
+		if openErr != nil {
+			return 0, openErr
+		}
+		d.opened += int64(len(plaintext))
+		if final {
+			if err := d.finish(); err != nil {
+				return 0, err
+			}
+		}
+		d.buf = plaintext
+		d.done = final
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// finish checks, once the final record is decrypted, that the plaintext has the size recorded in
+// the header and that no ciphertext follows the final record.
+func (d *DecryptReader) finish() error {
+	if d.opened != d.record.Size {
+		return fmt.Errorf("decrypted %d bytes instead of %d: %w", d.opened, d.record.Size, ErrDecryptionFailed)
+	}
+	var trailing [1]byte
+	switch _, err := io.ReadFull(d.r, trailing[:]); err {
+	case io.EOF:
+		return nil
+	case nil:
+		return fmt.Errorf("data follows the end of the encrypted file: %w", ErrDecryptionFailed)
+	default:
+		return err
+	}
+}
+
+// open authenticates and decrypts the next record, trying the final flag when it is ambiguous.
+func (d *DecryptReader) open(sealed []byte) ([]byte, bool, error) {
+	prefix := d.header[len(encryptedMagic)+4:]
+	counter := d.counter
+	d.counter++
+
+	if plaintext, err := d.aead.Open(nil, recordNonce(prefix, counter, false), sealed, d.header); err == nil {
+		return plaintext, false, nil
+	}
+	plaintext, err := d.aead.Open(nil, recordNonce(prefix, counter, true), sealed, d.header)
+	if err != nil {
+		return nil, false, ErrDecryptionFailed
+	}
+	return plaintext, true, nil
+}
+
+// newAEAD creates the AES-256-GCM cipher for a share key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != ShareKeySize {
+		return nil, fmt.Errorf("share key must be %d bytes", ShareKeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// recordNonce derives the nonce of a record from the nonce prefix, the record counter and the final flag.
+func recordNonce(prefix []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
@@ -0,0 +1,289 @@
+package file
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// sealedSegmentSize is the size of a sealed full data segment.
+const sealedSegmentSize = encryptedSegmentSize + 16
+
+// dataOffset is the offset of the first sealed data segment in an encrypted stream.
+const dataOffset = encryptedHeaderSize + encryptedRecordSize + 16
+
+// encrypt encrypts plaintext with a new key and returns the ciphertext and the key.
+func encrypt(t *testing.T, plaintext []byte) ([]byte, []byte) {
+	t.Helper()
+	key, err := GenerateShareKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ciphertext bytes.Buffer
+	record := encryptedRecord{Name: "secret.bin", Size: int64(len(plaintext))}
+	if err := encryptStream(&ciphertext, bytes.NewReader(plaintext), record, key); err != nil {
+		t.Fatal(err)
+	}
+	return ciphertext.Bytes(), key
+}
+
+// decrypt decrypts a whole encrypted stream.
+func decrypt(ciphertext []byte, key []byte) ([]byte, error) {
+	reader, err := NewDecryptReader(bytes.NewReader(ciphertext), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+// randomBytes returns n random bytes.
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	for _, size := range []int{
+		0, 1, 1000,
+		encryptedSegmentSize - 1, encryptedSegmentSize, encryptedSegmentSize + 1,
+		3 * encryptedSegmentSize, 3*encryptedSegmentSize + 7,
+	} {
+		plaintext := randomBytes(t, size)
+		ciphertext, key := encrypt(t, plaintext)
+
+		reader, err := NewDecryptReader(bytes.NewReader(ciphertext), key)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if reader.Name() != "secret.bin" || reader.Size() != int64(size) {
+			t.Fatalf("%d bytes: decrypted header %q of %d bytes", size, reader.Name(), reader.Size())
+		}
+		decrypted, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Fatalf("%d bytes: decrypted data differs", size)
+		}
+	}
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	ciphertext, _ := encrypt(t, randomBytes(t, 1000))
+	otherKey, err := GenerateShareKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decrypt(ciphertext, otherKey); !errors.Is(err, ErrDecryptionFailed) {
+		t.Fatalf("decrypting with another key: got %v, expected ErrDecryptionFailed", err)
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	plaintext := randomBytes(t, 3*encryptedSegmentSize+100)
+	ciphertext, key := encrypt(t, plaintext)
+	segment := func(i int) []byte {
+		start := dataOffset + i*sealedSegmentSize
+		return ciphertext[start:min(start+sealedSegmentSize, len(ciphertext))]
+	}
+
+	tests := []struct {
+		name   string
+		tamper func() []byte
+	}{
+		{"flipped header byte", func() []byte {
+			tampered := bytes.Clone(ciphertext)
+			tampered[encryptedHeaderSize-1] ^= 1
+			return tampered
+		}},
+		{"flipped record byte", func() []byte {
+			tampered := bytes.Clone(ciphertext)
+			tampered[encryptedHeaderSize+10] ^= 1
+			return tampered
+		}},
+		{"flipped data byte", func() []byte {
+			tampered := bytes.Clone(ciphertext)
+			tampered[dataOffset+sealedSegmentSize+123] ^= 0x80
+			return tampered
+		}},
+		{"reordered segments", func() []byte {
+			tampered := bytes.Clone(ciphertext[:dataOffset])
+			tampered = append(tampered, segment(1)...)
+			tampered = append(tampered, segment(0)...)
+			tampered = append(tampered, segment(2)...)
+			return append(tampered, segment(3)...)
+		}},
+		{"dropped segment", func() []byte {
+			tampered := bytes.Clone(ciphertext[:dataOffset])
+			tampered = append(tampered, segment(0)...)
+			tampered = append(tampered, segment(2)...)
+			return append(tampered, segment(3)...)
+		}},
+		{"truncated at a segment boundary", func() []byte {
+			return bytes.Clone(ciphertext[:dataOffset+3*sealedSegmentSize])
+		}},
+		{"truncated after the header record", func() []byte {
+			return bytes.Clone(ciphertext[:dataOffset])
+		}},
+		{"truncated inside a segment", func() []byte {
+			return bytes.Clone(ciphertext[:len(ciphertext)-1])
+		}},
+		{"trailing byte", func() []byte {
+			return append(bytes.Clone(ciphertext), 0)
+		}},
+		{"repeated final segment", func() []byte {
+			return append(bytes.Clone(ciphertext), segment(3)...)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decrypted, err := decrypt(test.tamper(), key)
+			if err == nil {
+				t.Fatalf("decrypted %d bytes of tampered data", len(decrypted))
+			}
+			if !errors.Is(err, ErrDecryptionFailed) {
+				t.Fatalf("got %v, expected ErrDecryptionFailed", err)
+			}
+		})
+	}
+}
+
+// TestDecryptTruncatedAtSegmentMultiple checks that a file whose size is a multiple of the segment
+// size, and so ends on a full segment, cannot be passed off as a shorter one by dropping segments.
+func TestDecryptTruncatedAtSegmentMultiple(t *testing.T) {
+	ciphertext, key := encrypt(t, randomBytes(t, 2*encryptedSegmentSize))
+	if len(ciphertext) != dataOffset+2*sealedSegmentSize {
+		t.Fatalf("unexpected ciphertext size %d", len(ciphertext))
+	}
+	if _, err := decrypt(ciphertext[:dataOffset+sealedSegmentSize], key); !errors.Is(err, ErrDecryptionFailed) {
+		t.Fatalf("got %v, expected ErrDecryptionFailed", err)
+	}
+}
+
+// TestDecryptTrailingData checks that nothing may follow the final segment, including when it is
+// a full segment or the header record itself.
+func TestDecryptTrailingData(t *testing.T) {
+	for _, size := range []int{0, encryptedSegmentSize} {
+		ciphertext, key := encrypt(t, randomBytes(t, size))
+		tampered := append(bytes.Clone(ciphertext), "trailing"...)
+		if _, err := decrypt(tampered, key); !errors.Is(err, ErrDecryptionFailed) {
+			t.Fatalf("%d bytes: got %v, expected ErrDecryptionFailed", size, err)
+		}
+	}
+}
+
+// TestDecryptSizeMismatch checks that the plaintext must have the size recorded in the header.
+// withRecordedSize seals the header record of a non-empty encrypted stream again with another
+// recorded size, as the key holder could.
+func withRecordedSize(t *testing.T, ciphertext []byte, key []byte, size int64) []byte {
+	t.Helper()
+	aead, err := newAEAD(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := ciphertext[:encryptedHeaderSize]
+	recordData, err := json.Marshal(encryptedRecord{Name: "secret.bin", Size: size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordData = append(recordData, bytes.Repeat([]byte{' '}, encryptedRecordSize-len(recordData))...)
+	sealed := aead.Seal(nil, recordNonce(header[len(encryptedMagic)+4:], 0, false), recordData, header)
+	return append(append(append([]byte{}, header...), sealed...), ciphertext[dataOffset:]...)
+}
+
+func TestDecryptSizeMismatch(t *testing.T) {
+	ciphertext, key := encrypt(t, randomBytes(t, 1000))
+	if _, err := decrypt(withRecordedSize(t, ciphertext, key, 1000), key); err != nil {
+		t.Fatalf("the resealed stream with the right size failed: %v", err)
+	}
+	for _, recorded := range []int64{1, 999, 1001, 2 * encryptedSegmentSize} {
+		if _, err := decrypt(withRecordedSize(t, ciphertext, key, recorded), key); !errors.Is(err, ErrDecryptionFailed) {
+			t.Fatalf("recorded size %d: got %v, expected ErrDecryptionFailed", recorded, err)
+		}
+	}
+}
+
+// TestEncryptFileChanged checks that a file whose size no longer matches the recorded size, as
+// when it changes while it is being encrypted, is not encrypted into a share that cannot be decrypted.
+func TestEncryptFileChanged(t *testing.T) {
+	key, err := GenerateShareKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct{ recorded, actual int }{
+		{0, 1},
+		{1, 0},
+		{1000, 999},
+		{1000, 1001},
+		{encryptedSegmentSize, encryptedSegmentSize + 1},
+		{2 * encryptedSegmentSize, encryptedSegmentSize},
+		{encryptedSegmentSize, 3 * encryptedSegmentSize},
+	} {
+		record := encryptedRecord{Name: "secret.bin", Size: int64(test.recorded)}
+		err := encryptStream(io.Discard, bytes.NewReader(randomBytes(t, test.actual)), record, key)
+		if !errors.Is(err, ErrFileChanged) {
+			t.Errorf("recorded size %d, read %d bytes: got %v, expected ErrFileChanged", test.recorded, test.actual, err)
+		}
+	}
+}
+
+// TestDecryptTruncatedEmptyFile checks that a non-empty file cannot be passed off as an empty one.
+func TestDecryptTruncatedEmptyFile(t *testing.T) {
+	ciphertext, key := encrypt(t, []byte("not empty"))
+	if _, err := decrypt(ciphertext[:dataOffset], key); !errors.Is(err, ErrDecryptionFailed) {
+		t.Fatalf("got %v, expected ErrDecryptionFailed", err)
+	}
+}
+
+func TestShareLink(t *testing.T) {
+	key, err := GenerateShareKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := strings.Repeat("ab", 32)
+	link := FormatShareLink(hash, key)
+	if !IsShareLink(link) {
+		t.Fatalf("%q is not recognized as a share link", link)
+	}
+	parsedHash, parsedKey, err := ParseShareLink(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsedHash != hash || !bytes.Equal(parsedKey, key) {
+		t.Fatalf("parsed %s and %x from %q", parsedHash, parsedKey, link)
+	}
+}
+
+func TestParseShareLinkErrors(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	key := base64.RawURLEncoding.EncodeToString(make([]byte, ShareKeySize))
+	for _, link := range []string{
+		"",
+		hash + "#" + key,
+		"http://" + hash + "#" + key,
+		"gtp://" + hash,
+		"gtp://" + hash + "#",
+		"gtp://#" + key,
+		"gtp://" + strings.ToUpper(hash) + "#" + key,
+		"gtp://" + hash[:62] + "#" + key,
+		"gtp://../" + hash[3:] + "#" + key,
+		"gtp://" + hash + "#" + key + "=",
+		"gtp://" + hash + "#" + key + "!",
+		"gtp://" + hash + "#" + base64.RawURLEncoding.EncodeToString(make([]byte, ShareKeySize-1)),
+		"gtp://" + hash + "#" + base64.RawURLEncoding.EncodeToString(make([]byte, ShareKeySize+1)),
+		"gtp://" + hash + "#" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0xff}, ShareKeySize)),
+	} {
+		if _, _, err := ParseShareLink(link); err == nil {
+			t.Errorf("ParseShareLink(%q) succeeded", link)
+		}
+	}
+}
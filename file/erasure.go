@@ -0,0 +1,336 @@
+// Package file contains utilities for file chunking and reconstruction.
+// This file contains the Reed-Solomon erasure coding of chunk sets: the chunks of a file are taken
+// in groups of k data shards, each group gets m parity chunks, and any k of the k+m chunks of a
+// group are enough to recover the rest, so a file stays downloadable when some chunks are lost.
+package file
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxShards is the largest number of data and parity shards in a group: the Cauchy matrix used
+// for encoding needs a distinct field element for every shard.
+const maxShards = 256
+
+// ErrNotEnoughShards is returned when fewer than k chunks of a group are available to recover it.
+var ErrNotEnoughShards = errors.New("not enough chunks to recover the file")
+
+// ShardSource provides the chunks available to erasure decoding.
+type ShardSource interface {
+	Has(chunkHash string) bool
+	Get(chunkHash string) (io.ReadCloser, error)
+}
+
+// erasureGroups returns the number of groups the data chunks of a manifest fall into.
+func erasureGroups(metadata FileMetadata) int {
+	k := metadata.Chunking.DataShards
+	if k == 0 {
+		return 0
+	}
+	return (len(metadata.Chunks) + k - 1) / k
+}
+
+// shardSize returns the size of the shards of a group: the size of its largest data chunk.
+// Shorter data chunks are zero-padded to it when computing parity.
+func shardSize(chunkSizes []int64, k int, group int) int64 {
+	var size int64
+	for j := group * k; j < len(chunkSizes) && j < (group+1)*k; j++ {
+		size = max(size, chunkSizes[j])
+	}
+	return size
+}
+
+// parityCoefficient is the coefficient of data shard j in parity shard p of a code with k data
+// shards, taken from a Cauchy matrix, every square submatrix of which is invertible.
+func parityCoefficient(k int, p int, j int) byte {
+	return gfInv(byte(k+p) ^ byte(j))
+}
+
+// encodingRow returns the row of the encoding matrix producing shard i of a group from its data
+// shards: shards below k are the data shards themselves, the following ones are parity shards.
+func encodingRow(k int, i int) []byte {
+	row := make([]byte, k)
+	if i < k {
+		row[i] = 1
+		return row
+	}
+	for j := range row {
+		row[j] = parityCoefficient(k, i-k, j)
+	}
+	return row
+}
+
+// encodeParity computes the parity chunks of a file split into the given chunks and stores the
+// ones the store does not hold yet. Every parity chunk is streamed twice, once to hash it and once
+// to store it, so no shard is ever held in memory.
+func encodeParity(store ChunkStore, file io.ReaderAt, chunkSizes []int64, chunking Chunking) ([]string, []int64, error) {
+	k, m := chunking.DataShards, chunking.ParityShards
+	offsets := make([]int64, len(chunkSizes))
+	var offset int64
+	for i, size := range chunkSizes {
+		offsets[i] = offset
+		offset += size
+	}
+
+	// The data shards of a group, or nil for the zero shards padding the last group.
+	sources := func(group int) []io.ReadCloser {
+		shards := make([]io.ReadCloser, k)
+		for j := range shards {
+			if index := group*k + j; index < len(chunkSizes) {
+				shards[j] = io.NopCloser(io.NewSectionReader(file, offsets[index], chunkSizes[index]))
+			}
+		}
+		return shards
+	}
+
+	parityIDs := []string{}
+	paritySizes := []int64{}
+	groups := (len(chunkSizes) + k - 1) / k
+	for group := 0; group < groups; group++ {
+		size := shardSize(chunkSizes, k, group)
+		for p := 0; p < m; p++ {
+			row := encodingRow(k, k+p)
+
+			hasher := sha256.New()
+			parity := newShardCombiner(sources(group), row, size)
+			_, err := Copy(hasher, parity)
+			parity.Close()
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to compute parity: %w", err)
+			}
+			parityID := hex.EncodeToString(hasher.Sum(nil))
+
+			if !store.Has(parityID) {
+				parity := newShardCombiner(sources(group), row, size)
+				_, err := store.Put(parityID, parity)
+				parity.Close()
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+			parityIDs = append(parityIDs, parityID)
+			paritySizes = append(paritySizes, size)
+		}
+	}
+	return parityIDs, paritySizes, nil
+}
+
+// MissingParity returns the distinct parity chunks, in order, that the source does not hold in the
+// groups of a file missing data chunks: the parity chunks worth fetching before RecoverChunks.
+//
+// Parameters:
+// - metadata: The manifest of the file.
+// - source: The chunks available locally.
+//
+// Returns:
+// - []string: The missing parity chunk IDs.
+func MissingParity(metadata FileMetadata, source ShardSource) []string {
+	k, m := metadata.Chunking.DataShards, metadata.Chunking.ParityShards
+	missing := []string{}
+	seen := make(map[string]bool)
+	for group := 0; group < erasureGroups(metadata); group++ {
+		complete := true
+		for _, chunkID := range metadata.Chunks[group*k : min((group+1)*k, len(metadata.Chunks))] {
+			complete = complete && source.Has(chunkID)
+		}
+		if complete || (group+1)*m > len(metadata.ParityChunks) {
+			continue
+		}
+		for _, chunkID := range metadata.ParityChunks[group*m : (group+1)*m] {
+			if seen[chunkID] || source.Has(chunkID) {
+				continue
+			}
+			seen[chunkID] = true
+			missing = append(missing, chunkID)
+		}
+	}
+	return missing
+}
+
+// RecoverChunks rebuilds the missing data chunks of an erasure-coded file from any k available
+// chunks of each group, data chunks preferred, and hands each rebuilt chunk to save, which must
+// verify it against its chunk ID as ChunkStore.Put does.
+//
+// Parameters:
+// - metadata: The manifest of the file, which must declare its chunk sizes.
+// - source: The data and parity chunks available locally.
+// - save: Receives the data of every recovered chunk.
+//
+// Returns:
+// - error: An error wrapping ErrNotEnoughShards if a group has fewer than k chunks available,
+// or the first error returned by the source or save.
+func RecoverChunks(metadata FileMetadata, source ShardSource, save func(chunkID string, r io.Reader) (int64, error)) error {
+	k, m := metadata.Chunking.DataShards, metadata.Chunking.ParityShards
+	if k == 0 {
+		return fmt.Errorf("file %s is not erasure coded", metadata.Hash)
+	}
+	if err := ValidateChunkLayout(metadata); err != nil {
+		return fmt.Errorf("invalid chunk layout in metadata: %w", err)
+	}
+
+	for group := 0; group < erasureGroups(metadata); group++ {
+		// Shard i of the group is data chunk group*k+i for i < k, then parity chunk group*m+i-k.
+		// Data shards past the end of the file are zero shards, always available.
+		shardID := func(i int) (string, bool) {
+			if i < k {
+				if index := group*k + i; index < len(metadata.Chunks) {
+					return metadata.Chunks[index], true
+				}
+				return "", false
+			}
+			return metadata.ParityChunks[group*m+i-k], true
+		}
+
+		missing := []int{}
+		available := []int{}
+		for i := 0; i < k+m; i++ {
+			chunkID, real := shardID(i)
+			switch {
+			case !real || source.Has(chunkID):
+				if len(available) < k {
+					available = append(available, i)
+				}
+			case i < k:
+				missing = append(missing, i)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		if len(available) < k {
+			return fmt.Errorf("%w: group %d of %s has %d of the %d chunks needed", ErrNotEnoughShards, group, metadata.Hash, len(available), k)
+		}
+
+		// Decoding multiplies the available shards by the inverse of their rows of the encoding matrix.
+		matrix := make([][]byte, k)
+		for r, i := range available {
+			matrix[r] = encodingRow(k, i)
+		}
+		decoding, err := gfInvert(matrix)
+		if err != nil {
+			return fmt.Errorf("failed to decode group %d of %s: %w", group, metadata.Hash, err)
+		}
+
+		size := shardSize(metadata.ChunkSizes, k, group)
+		for _, i := range missing {
+			chunkID, _ := shardID(i)
+			if source.Has(chunkID) {
+				continue // The same chunk appeared earlier in the file and was recovered already.
+			}
+
+			shards := make([]io.ReadCloser, k)
+			for r, a := range available {
+				if decoding[i][r] == 0 {
+					continue
+				}
+				if availableID, real := shardID(a); real {
+					shard, err := source.Get(availableID)
+					if err != nil {
+						closeShards(shards)
+						return err
+					}
+					shards[r] = shard
+				}
+			}
+			chunk := newShardCombiner(shards, decoding[i], size)
+			_, err := save(chunkID, io.LimitReader(chunk, metadata.ChunkSizes[group*k+i]))
+			chunk.Close()
+			if err != nil {
+				return fmt.Errorf("failed to recover chunk %s: %w", chunkID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// shardCombiner streams a linear combination of shards: every output byte is the sum of the
+// corresponding shard bytes multiplied by their coefficients. Shards shorter than the output are
+// zero-padded, and nil shards are all zeros.
+type shardCombiner struct {
+	shards    []io.ReadCloser
+	tables    []*[256]byte
+	remaining int64   // Output bytes not computed yet.
+	in        *[]byte // Pooled buffer receiving a block of a shard.
+	out       *[]byte // Pooled buffer holding the current output block.
+	pending   []byte  // Part of the current output block not read yet.
+}
+
+// newShardCombiner creates a reader of size bytes combining the shards with the given coefficients.
+// The combiner owns the shards and closes them when it is closed.
+func newShardCombiner(shards []io.ReadCloser, coefficients []byte, size int64) *shardCombiner {
+	c := &shardCombiner{
+		shards:    shards,
+		tables:    make([]*[256]byte, len(shards)),
+		remaining: size,
+		in:        getBuffer(),
+		out:       getBuffer(),
+	}
+	for i, coefficient := range coefficients {
+		if coefficient != 0 {
+			c.tables[i] = gfMulTable(coefficient)
+		}
+	}
+	return c
+}
+
+// Read implements io.Reader.
+func (c *shardCombiner) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		if c.remaining == 0 {
+			return 0, io.EOF
+		}
+		if err := c.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// fill computes the next output block.
+func (c *shardCombiner) fill() error {
+	block := int(min(c.remaining, int64(BufferSize)))
+	out := (*c.out)[:block]
+	clear(out)
+	in := (*c.in)[:block]
+	for i, shard := range c.shards {
+		if shard == nil || c.tables[i] == nil {
+			continue
+		}
+		n, err := io.ReadFull(shard, in)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		clear(in[n:])
+		gfMulAdd(c.tables[i], in, out)
+	}
+	c.remaining -= int64(block)
+	c.pending = out
+	return nil
+}
+
+// Close closes the shards and returns the buffers to the pool.
+func (c *shardCombiner) Close() error {
+	closeShards(c.shards)
+	c.shards = nil
+	if c.in != nil {
+		putBuffer(c.in)
+		putBuffer(c.out)
+		c.in, c.out, c.pending = nil, nil, nil
+	}
+	return nil
+}
+
+// closeShards closes the non-nil shards.
+func closeShards(shards []io.ReadCloser) {
+	for _, shard := range shards {
+		if shard != nil {
+			shard.Close()
+		}
+	}
+}
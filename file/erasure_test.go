@@ -0,0 +1,189 @@
+package file
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go-to-peer/util"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// lossySource is a store that has lost some of its chunks.
+type lossySource struct {
+	store Store
+	lost  map[string]bool
+}
+
+func (s lossySource) Has(chunkHash string) bool {
+	return !s.lost[chunkHash] && s.store.Has(chunkHash)
+}
+
+func (s lossySource) Get(chunkHash string) (io.ReadCloser, error) {
+	if s.lost[chunkHash] {
+		return nil, ErrChunkNotFound
+	}
+	return s.store.Get(chunkHash)
+}
+
+// splitErasureCoded splits content into erasure-coded chunks of the given size and returns the
+// store holding them with the manifest.
+func splitErasureCoded(t *testing.T, content []byte, size int64, k int, m int) (Store, FileMetadata) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "file.bin")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryStore()
+	chunking := Chunking{Mode: ChunkingFixed, Size: size, DataShards: k, ParityShards: m}
+	metadata, err := SplitFile(store, path, util.CalculateHash(content), chunking)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := (len(metadata.Chunks) + k - 1) / k
+	if len(metadata.ParityChunks) != groups*m || len(metadata.ParitySizes) != groups*m {
+		t.Fatalf("%d parity chunks for %d groups of %d", len(metadata.ParityChunks), groups, m)
+	}
+	return store, metadata
+}
+
+// recoverLost recovers the data chunks lost from store and returns them by chunk ID.
+func recoverLost(metadata FileMetadata, store Store, lost map[string]bool) (map[string][]byte, error) {
+	recovered := make(map[string][]byte)
+	err := RecoverChunks(metadata, lossySource{store, lost}, func(chunkID string, r io.Reader) (int64, error) {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return 0, err
+		}
+		if util.CalculateHash(data) != chunkID {
+			return 0, ErrChunkHashMismatch
+		}
+		recovered[chunkID] = data
+		return int64(len(data)), nil
+	})
+	return recovered, err
+}
+
+// combinations calls f with every subset of at most limit of the integers below n.
+func combinations(n int, limit int, f func([]int)) {
+	var walk func(start int, subset []int)
+	walk = func(start int, subset []int) {
+		f(subset)
+		if len(subset) == limit {
+			return
+		}
+		for i := start; i < n; i++ {
+			walk(i+1, append(subset, i))
+		}
+	}
+	walk(0, nil)
+}
+
+// groupShard returns the chunk ID of shard i of a group, data shards first, and false for the
+// zero shards padding the last group.
+func groupShard(metadata FileMetadata, group int, i int) (string, bool) {
+	k, m := metadata.Chunking.DataShards, metadata.Chunking.ParityShards
+	if i >= k {
+		return metadata.ParityChunks[group*m+i-k], true
+	}
+	if index := group*k + i; index < len(metadata.Chunks) {
+		return metadata.Chunks[index], true
+	}
+	return "", false
+}
+
+// TestRecoverChunks loses every combination of up to m shards of every group at once and checks
+// that the lost data chunks are recovered byte for byte.
+func TestRecoverChunks(t *testing.T) {
+	for _, code := range []struct{ k, m int }{{2, 1}, {4, 2}, {5, 3}} {
+		t.Run(fmt.Sprintf("%d+%d", code.k, code.m), func(t *testing.T) {
+			// The last chunk is short and the last group incomplete.
+			const size = 1000
+			content := pseudoRandom(8, (3*code.k-1)*size+123)
+			store, metadata := splitErasureCoded(t, content, size, code.k, code.m)
+			groups := erasureGroups(metadata)
+
+			combinations(code.k+code.m, code.m, func(shards []int) {
+				lost := make(map[string]bool)
+				var expected []string
+				for group := 0; group < groups; group++ {
+					for _, i := range shards {
+						if chunkID, real := groupShard(metadata, group, i); real {
+							lost[chunkID] = true
+							if i < code.k {
+								expected = append(expected, chunkID)
+							}
+						}
+					}
+				}
+
+				recovered, err := recoverLost(metadata, store, lost)
+				if err != nil {
+					t.Fatalf("losing shards %v: %v", shards, err)
+				}
+				if len(recovered) != len(expected) {
+					t.Fatalf("losing shards %v recovered %d chunks, expected %d", shards, len(recovered), len(expected))
+				}
+				for _, chunkID := range expected {
+					index := slices.Index(metadata.Chunks, chunkID)
+					start := int64(index) * size
+					if !bytes.Equal(recovered[chunkID], content[start:start+metadata.ChunkSizes[index]]) {
+						t.Fatalf("losing shards %v: chunk %d was recovered wrong", shards, index)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestRecoverChunksNotEnoughShards(t *testing.T) {
+	const k, m = 4, 2
+	content := pseudoRandom(9, 3*k*1000)
+	store, metadata := splitErasureCoded(t, content, 1000, k, m)
+
+	// Losing m+1 shards of a single group is enough to make the file unrecoverable.
+	combinations(k+m, m+1, func(shards []int) {
+		if len(shards) != m+1 {
+			return
+		}
+		lost := make(map[string]bool)
+		for _, i := range shards {
+			chunkID, _ := groupShard(metadata, 1, i)
+			lost[chunkID] = true
+		}
+		if _, err := recoverLost(metadata, store, lost); !errors.Is(err, ErrNotEnoughShards) {
+			t.Fatalf("losing shards %v: got %v, expected ErrNotEnoughShards", shards, err)
+		}
+	})
+}
+
+func TestMissingParity(t *testing.T) {
+	const k, m = 4, 2
+	content := pseudoRandom(10, 3*k*1000)
+	store, metadata := splitErasureCoded(t, content, 1000, k, m)
+
+	// Parity is only worth fetching for the groups missing data chunks.
+	lost := map[string]bool{metadata.Chunks[k]: true}
+	for _, chunkID := range metadata.ParityChunks {
+		lost[chunkID] = true
+	}
+	missing := MissingParity(metadata, lossySource{store, lost})
+	if !slices.Equal(missing, metadata.ParityChunks[m:2*m]) {
+		t.Fatalf("MissingParity returned %v, expected the parity of group 1", missing)
+	}
+	if missing := MissingParity(metadata, store); len(missing) != 0 {
+		t.Fatalf("MissingParity returned %v for a complete file", missing)
+	}
+}
+
+func TestRecoverChunksNotErasureCoded(t *testing.T) {
+	store := NewMemoryStore()
+	metadata := partialMetadata("file.bin", pseudoRandom(11, 5000))
+	metadata.Chunking = FixedChunking(partialChunkSize)
+	if _, err := recoverLost(metadata, store, nil); err == nil {
+		t.Fatal("recovered chunks of a file without parity")
+	}
+}
@@ -0,0 +1,195 @@
+// Package file contains utilities for file chunking and reconstruction.
+// This file contains the garbage collector of the chunk store, which forgets local files that are
+// no longer kept, removes chunks no file references any more and evicts the least recently used
+// cached files to honor a size quota.
+package file
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// GCOptions configures a garbage collection run.
+type GCOptions struct {
+	// DryRun reports what would be removed without removing anything.
+	DryRun bool
+	// MaxBytes is the quota on the total size of the stored chunks, or 0 for no quota. When the
+	// store exceeds it, cached files are evicted, least recently used first, until it fits.
+	MaxBytes int64
+	// Keep holds the hashes of the files that must never be evicted: shared and pinned files.
+	// Local files not kept, such as previous versions of edited shared files, are forgotten; every
+	// other file with a manifest is cached content.
+	Keep map[string]bool
+	// GracePeriod protects unreferenced chunks written or read more recently, such as the chunks
+	// of a download by an older version, which stored no provisional manifest, and local files split
+	// more recently, which may be shared files the caller did not see yet. Downloads whose
+	// provisional manifest was stored and whose chunks were all written longer ago are considered
+	// abandoned and forgotten.
+	GracePeriod time.Duration
+}
+
+// GCReport describes the outcome of a garbage collection run.
+type GCReport struct {
+	RemovedChunks  []string // Chunks removed (or, in a dry run, that would be removed).
+	ForgottenFiles []string // Local files no longer kept whose manifests were removed.
+	EvictedFiles   []string // Cached files whose manifests were evicted to honor the quota.
+	FreedBytes     int64    // Total size of the removed chunks.
+	RemainingBytes int64    // Total size of the chunks left in the store.
+	OverQuota      bool     // Whether the store still exceeds the quota, because only kept files remain.
+}
+
+// gcFile is a file with a manifest in the store, as seen by the garbage collector.
+type gcFile struct {
+	hash        string
+	chunks      []string
+	local       bool      // Whether the file was split from a local file rather than downloaded.
+	downloading bool      // Whether the manifest is the provisional manifest of a download in progress.
+	lastUsed    time.Time // Most recent access to any of the file's chunks, or start of its download.
+}
+
+// CollectGarbage forgets the local files that are no longer kept, removing their manifests, then
+// removes the chunks no stored manifest references, then, if the store exceeds its quota, evicts
+// cached files in least recently used order, removing their manifests and the chunks no other file
+// shares.
+//
+// Parameters:
+// - store: The store to collect.
+// - opts: The garbage collection options.
+//
+// Returns:
+// - GCReport: What was (or would be) removed.
+// - error: An error object if the store cannot be listed or a chunk cannot be removed.
+func CollectGarbage(store Store, opts GCOptions) (GCReport, error) {
+	var report GCReport
+
+	chunkHashes, err := store.List()
+	if err != nil {
+		return report, err
+	}
+	chunks := make(map[string]ChunkInfo, len(chunkHashes))
+	for _, chunkHash := range chunkHashes {
+		info, err := store.Stat(chunkHash)
+		if errors.Is(err, ErrChunkNotFound) {
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+		chunks[chunkHash] = info
+		report.RemainingBytes += info.Size
+	}
+
+	fileHashes, err := store.ListManifests()
+	if err != nil {
+		return report, err
+	}
+	refs := make(map[string]int)
+	files := []gcFile{}
+	for _, fileHash := range fileHashes {
+		metadata, err := store.GetManifest(fileHash)
+		if errors.Is(err, ErrManifestNotFound) {
+			continue // Forgotten since it was listed.
+		}
+		if err != nil {
+			return report, err
+		}
+		f := gcFile{hash: fileHash, chunks: metadata.AllChunks(), local: metadata.Local}
+		if metadata.Downloading != nil {
+			f.downloading, f.lastUsed = true, *metadata.Downloading
+		}
+		for _, chunkHash := range f.chunks {
+			refs[chunkHash]++
+			if info, ok := chunks[chunkHash]; ok && info.ModTime.After(f.lastUsed) {
+				f.lastUsed = info.ModTime
+			}
+		}
+		files = append(files, f)
+	}
+
+	remove := func(chunkHash string) error {
+		info, ok := chunks[chunkHash]
+		if !ok {
+			return nil
+		}
+		if !opts.DryRun {
+			if err := store.Delete(chunkHash); err != nil {
+				return err
+			}
+		}
+		delete(chunks, chunkHash)
+		report.RemovedChunks = append(report.RemovedChunks, chunkHash)
+		report.FreedBytes += info.Size
+		report.RemainingBytes -= info.Size
+		return nil
+	}
+
+	// Forget the local files no longer kept, such as shared files that were edited or removed, and
+	// abandoned downloads, so that their chunks are removed below unless another file shares them.
+	cutoff := time.Now().Add(-opts.GracePeriod)
+	cached := files[:0]
+	for _, f := range files {
+		stale := f.downloading || f.local && !opts.Keep[f.hash]
+		if !stale || f.lastUsed.After(cutoff) {
+			cached = append(cached, f)
+			continue
+		}
+		if !opts.DryRun {
+			if err := store.DeleteManifest(f.hash); err != nil {
+				return report, err
+			}
+		}
+		report.ForgottenFiles = append(report.ForgottenFiles, f.hash)
+		for _, chunkHash := range f.chunks {
+			refs[chunkHash]--
+		}
+	}
+	files = cached
+
+	// Remove unreferenced chunks, sparing recent ones that may belong to a download in progress.
+	for _, chunkHash := range chunkHashes {
+		if refs[chunkHash] > 0 {
+			continue
+		}
+		if info, ok := chunks[chunkHash]; ok && info.ModTime.After(cutoff) {
+			continue
+		}
+		if err := remove(chunkHash); err != nil {
+			return report, err
+		}
+	}
+
+	if opts.MaxBytes <= 0 || report.RemainingBytes <= opts.MaxBytes {
+		return report, nil
+	}
+
+	// Evict cached files, least recently used first, until the store fits its quota.
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].lastUsed.Before(files[j].lastUsed)
+	})
+	for _, f := range files {
+		if report.RemainingBytes <= opts.MaxBytes {
+			break
+		}
+		if opts.Keep[f.hash] || f.downloading {
+			continue
+		}
+		if !opts.DryRun {
+			if err := store.DeleteManifest(f.hash); err != nil {
+				return report, err
+			}
+		}
+		report.EvictedFiles = append(report.EvictedFiles, f.hash)
+		for _, chunkHash := range f.chunks {
+			refs[chunkHash]--
+			if refs[chunkHash] > 0 {
+				continue
+			}
+			if err := remove(chunkHash); err != nil {
+				return report, err
+			}
+		}
+	}
+	report.OverQuota = report.RemainingBytes > opts.MaxBytes
+	return report, nil
+}
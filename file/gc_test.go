@@ -0,0 +1,229 @@
+package file
+
+import (
+	"errors"
+	"go-to-peer/util"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storeGCFile stores a file made of the given chunks, last used age ago, and returns its hash.
+func storeGCFile(t *testing.T, store *MemoryStore, chunks []string, local bool, age time.Duration) string {
+	t.Helper()
+	metadata := FileMetadata{Name: "file.bin", Hash: util.CalculateHash([]byte(strings.Join(chunks, "|"))), Local: local}
+	for _, data := range chunks {
+		chunkHash := storeGCChunk(t, store, data, age)
+		metadata.Chunks = append(metadata.Chunks, chunkHash)
+		metadata.ChunkSizes = append(metadata.ChunkSizes, int64(len(data)))
+		metadata.Size += int64(len(data))
+	}
+	if err := store.PutManifest(metadata); err != nil {
+		t.Fatal(err)
+	}
+	return metadata.Hash
+}
+
+// storeGCChunk stores a chunk last used age ago and returns its hash.
+func storeGCChunk(t *testing.T, store *MemoryStore, data string, age time.Duration) string {
+	t.Helper()
+	chunkHash := putChunk(t, store, data)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	chunk := store.chunks[chunkHash]
+	chunk.modTime = time.Now().Add(-age)
+	store.chunks[chunkHash] = chunk
+	return chunkHash
+}
+
+// hasManifest reports whether the store holds the manifest of a file.
+func hasManifest(t *testing.T, store Store, fileHash string) bool {
+	t.Helper()
+	_, err := store.GetManifest(fileHash)
+	if err != nil && !errors.Is(err, ErrManifestNotFound) {
+		t.Fatal(err)
+	}
+	return err == nil
+}
+
+func TestCollectGarbageUnreferenced(t *testing.T) {
+	store := NewMemoryStore()
+	storeGCFile(t, store, []string{"referenced"}, false, 2*time.Hour)
+	old := storeGCChunk(t, store, "old orphan", 2*time.Hour)
+	young := storeGCChunk(t, store, "young orphan", time.Minute)
+
+	report, err := CollectGarbage(store, GCOptions{GracePeriod: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.RemovedChunks, []string{old}) || report.FreedBytes != int64(len("old orphan")) {
+		t.Fatalf("removed %v (%d bytes), expected only the old orphan", report.RemovedChunks, report.FreedBytes)
+	}
+	if store.Has(old) || !store.Has(young) {
+		t.Fatal("the grace period was not applied")
+	}
+	if report.RemainingBytes != int64(len("referenced")+len("young orphan")) {
+		t.Fatalf("%d bytes remain", report.RemainingBytes)
+	}
+}
+
+// TestCollectGarbageForgetsLocalFiles checks that local files no longer kept, such as previous
+// versions of shared files, are forgotten on every run even without a quota, while downloaded files
+// stay cached.
+func TestCollectGarbageForgetsLocalFiles(t *testing.T) {
+	for _, dryRun := range []bool{false, true} {
+		store := NewMemoryStore()
+		stale := storeGCFile(t, store, []string{"stale only", "common"}, true, 2*time.Hour)
+		shared := storeGCFile(t, store, []string{"shared only", "common"}, true, 2*time.Hour)
+		downloaded := storeGCFile(t, store, []string{"downloaded"}, false, 2*time.Hour)
+		recent := storeGCFile(t, store, []string{"recently split"}, true, time.Minute)
+		staleOnly := util.CalculateHash([]byte("stale only"))
+
+		opts := GCOptions{DryRun: dryRun, GracePeriod: time.Hour, Keep: map[string]bool{shared: true}}
+		report, err := CollectGarbage(store, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(report.ForgottenFiles, []string{stale}) {
+			t.Fatalf("dry run %t: forgot %v, expected only the stale file", dryRun, report.ForgottenFiles)
+		}
+		if !slices.Equal(report.RemovedChunks, []string{staleOnly}) {
+			t.Fatalf("dry run %t: removed chunks %v, expected only the chunk of the stale file", dryRun, report.RemovedChunks)
+		}
+		if len(report.EvictedFiles) != 0 {
+			t.Fatalf("dry run %t: evicted %v without a quota", dryRun, report.EvictedFiles)
+		}
+
+		if removed := !hasManifest(t, store, stale) && !store.Has(staleOnly); removed == dryRun {
+			t.Fatalf("dry run %t: the stale file was removed: %t", dryRun, removed)
+		}
+		for _, fileHash := range []string{shared, downloaded, recent} {
+			if !hasManifest(t, store, fileHash) {
+				t.Fatalf("dry run %t: file %s was removed", dryRun, fileHash)
+			}
+		}
+		if !store.Has(util.CalculateHash([]byte("common"))) {
+			t.Fatalf("dry run %t: a chunk shared with a kept file was removed", dryRun)
+		}
+	}
+}
+
+func TestCollectGarbageQuota(t *testing.T) {
+	store := NewMemoryStore()
+	kept := storeGCFile(t, store, []string{strings.Repeat("k", 100)}, false, 4*time.Hour)
+	oldest := storeGCFile(t, store, []string{strings.Repeat("o", 100)}, false, 3*time.Hour)
+	middle := storeGCFile(t, store, []string{strings.Repeat("m", 100)}, false, 2*time.Hour)
+	newest := storeGCFile(t, store, []string{strings.Repeat("n", 100)}, false, time.Hour)
+	keep := map[string]bool{kept: true}
+
+	// Cached files are evicted least recently used first, never the kept one.
+	report, err := CollectGarbage(store, GCOptions{MaxBytes: 250, Keep: keep})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.EvictedFiles, []string{oldest, middle}) {
+		t.Fatalf("evicted %v, expected the two least recently used cached files", report.EvictedFiles)
+	}
+	if report.RemainingBytes != 200 || report.OverQuota {
+		t.Fatalf("%d bytes remain, over quota: %t", report.RemainingBytes, report.OverQuota)
+	}
+	if !hasManifest(t, store, kept) || !hasManifest(t, store, newest) || hasManifest(t, store, oldest) {
+		t.Fatal("the wrong manifests were evicted")
+	}
+
+	// A quota only kept files exceed cannot be met.
+	report, err = CollectGarbage(store, GCOptions{MaxBytes: 50, Keep: keep})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.EvictedFiles, []string{newest}) || !report.OverQuota || report.RemainingBytes != 100 {
+		t.Fatalf("evicted %v, %d bytes remain, over quota: %t", report.EvictedFiles, report.RemainingBytes, report.OverQuota)
+	}
+}
+
+// TestCollectGarbageDownloads checks that the chunks of a download in progress are kept however
+// long ago they were fetched, and that abandoned downloads are forgotten.
+func TestCollectGarbageDownloads(t *testing.T) {
+	store := NewMemoryStore()
+	started := time.Now().Add(-3 * time.Hour)
+	fetched := storeGCChunk(t, store, "fetched long ago", 3*time.Hour)
+	active := FileMetadata{
+		Name:        "active.bin",
+		Hash:        util.CalculateHash([]byte("active")),
+		Chunks:      []string{fetched, util.CalculateHash([]byte("not fetched yet"))},
+		Downloading: &started,
+	}
+	latest := storeGCChunk(t, store, "fetched a minute ago", time.Minute)
+	active.Chunks = append(active.Chunks, latest)
+	abandonedChunk := storeGCChunk(t, store, "abandoned", 2*time.Hour)
+	abandoned := FileMetadata{
+		Name:        "abandoned.bin",
+		Hash:        util.CalculateHash([]byte("abandoned")),
+		Chunks:      []string{abandonedChunk},
+		Downloading: &started,
+	}
+	for _, metadata := range []FileMetadata{active, abandoned} {
+		if err := store.PutManifest(metadata); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := CollectGarbage(store, GCOptions{GracePeriod: time.Hour, MaxBytes: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.ForgottenFiles, []string{abandoned.Hash}) || len(report.EvictedFiles) != 0 {
+		t.Fatalf("forgot %v and evicted %v, expected only the abandoned download to be forgotten", report.ForgottenFiles, report.EvictedFiles)
+	}
+	if !store.Has(fetched) || !store.Has(latest) || store.Has(abandonedChunk) {
+		t.Fatal("the chunks of the wrong download were removed")
+	}
+
+	// A download in progress is not a stored file, and the chunks it did not fetch yet are not missing.
+	if files, err := StoredFiles(store); err != nil || len(files) != 0 {
+		t.Fatalf("got stored files %v, %v, expected none", files, err)
+	}
+	scrub, err := Scrub(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scrub.Missing) != 0 {
+		t.Fatalf("scrub reported %v missing", scrub.Missing)
+	}
+}
+
+// forgettingStore is a MemoryStore whose manifest of a file is deleted right after the manifests
+// are listed, as by a concurrent run of garbage collection.
+type forgettingStore struct {
+	*MemoryStore
+	forget string
+}
+
+// ListManifests implements ManifestStore.
+func (s forgettingStore) ListManifests() ([]string, error) {
+	fileHashes, err := s.MemoryStore.ListManifests()
+	if err != nil {
+		return nil, err
+	}
+	return fileHashes, s.MemoryStore.DeleteManifest(s.forget)
+}
+
+// TestCollectGarbageManifestDeleted checks that a manifest deleted while garbage collection runs
+// is skipped, and its chunks collected as unreferenced.
+func TestCollectGarbageManifestDeleted(t *testing.T) {
+	store := NewMemoryStore()
+	kept := storeGCFile(t, store, []string{"kept"}, false, 2*time.Hour)
+	forgotten := storeGCFile(t, store, []string{"forgotten"}, false, 2*time.Hour)
+
+	report, err := CollectGarbage(forgettingStore{MemoryStore: store, forget: forgotten}, GCOptions{GracePeriod: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.RemovedChunks) != 1 || report.FreedBytes != int64(len("forgotten")) {
+		t.Fatalf("removed %v (%d bytes), expected the chunk of the deleted manifest", report.RemovedChunks, report.FreedBytes)
+	}
+	if !hasManifest(t, store, kept) || hasManifest(t, store, forgotten) {
+		t.Fatal("the wrong manifest was removed")
+	}
+}
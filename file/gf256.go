@@ -0,0 +1,99 @@
+// Package file contains utilities for file chunking and reconstruction.
+// This file implements arithmetic in GF(2^8), the field over which erasure codes are computed.
+package file
+
+import "fmt"
+
+// gfPolynomial is the irreducible polynomial x^8 + x^4 + x^3 + x^2 + 1 generating the field.
+const gfPolynomial = 0x11d
+
+// gfExp and gfLog are the exponent and logarithm tables of the generator 2.
+// gfExp is doubled so that gfExp[gfLog[a]+gfLog[b]] needs no modulo.
+var gfExp, gfLog = func() ([512]byte, [256]byte) {
+	var exp [512]byte
+	var log [256]byte
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= gfPolynomial
+		}
+	}
+	for i := 255; i < len(exp); i++ {
+		exp[i] = exp[i-255]
+	}
+	return exp, log
+}()
+
+// gfMul multiplies two field elements.
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// gfInv returns the multiplicative inverse of a non-zero field element.
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfMulTable returns the products of c with every field element, to multiply whole blocks by c.
+func gfMulTable(c byte) *[256]byte {
+	var table [256]byte
+	for i := range table {
+		table[i] = gfMul(c, byte(i))
+	}
+	return &table
+}
+
+// gfMulAdd adds c*in to out, element by element, where table is gfMulTable(c).
+// Addition in GF(2^8) is XOR.
+func gfMulAdd(table *[256]byte, in, out []byte) {
+	for i, b := range in {
+		out[i] ^= table[b]
+	}
+}
+
+// gfInvert inverts a square matrix with Gauss-Jordan elimination.
+func gfInvert(matrix [][]byte) ([][]byte, error) {
+	n := len(matrix)
+	work := make([][]byte, n)
+	inverse := make([][]byte, n)
+	for i := range matrix {
+		work[i] = append([]byte(nil), matrix[i]...)
+		inverse[i] = make([]byte, n)
+		inverse[i][i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, fmt.Errorf("singular matrix")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		inverse[col], inverse[pivot] = inverse[pivot], inverse[col]
+
+		scale := gfInv(work[col][col])
+		for j := 0; j < n; j++ {
+			work[col][j] = gfMul(work[col][j], scale)
+			inverse[col][j] = gfMul(inverse[col][j], scale)
+		}
+		for row := 0; row < n; row++ {
+			if row == col || work[row][col] == 0 {
+				continue
+			}
+			factor := work[row][col]
+			for j := 0; j < n; j++ {
+				work[row][j] ^= gfMul(factor, work[col][j])
+				inverse[row][j] ^= gfMul(factor, inverse[col][j])
+			}
+		}
+	}
+	return inverse, nil
+}
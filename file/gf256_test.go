@@ -0,0 +1,141 @@
+package file
+
+import (
+	"math/rand/v2"
+	"testing"
+)
+
+func TestGFMul(t *testing.T) {
+	for a := 0; a < 256; a++ {
+		x := byte(a)
+		if gfMul(x, 0) != 0 || gfMul(0, x) != 0 {
+			t.Fatalf("%d * 0 is not 0", x)
+		}
+		if gfMul(x, 1) != x {
+			t.Fatalf("%d * 1 = %d", x, gfMul(x, 1))
+		}
+		if x != 0 && gfMul(x, gfInv(x)) != 1 {
+			t.Fatalf("%d * %d = %d, expected 1", x, gfInv(x), gfMul(x, gfInv(x)))
+		}
+		table := gfMulTable(x)
+		for b := 0; b < 256; b++ {
+			y := byte(b)
+			if gfMul(x, y) != gfMul(y, x) {
+				t.Fatalf("%d * %d is not commutative", x, y)
+			}
+			if table[y] != gfMul(x, y) {
+				t.Fatalf("multiplication table of %d differs at %d", x, y)
+			}
+			for _, z := range []byte{1, 2, 3, 0x1d, 0x80, 0xff, byte(a + b)} {
+				if gfMul(gfMul(x, y), z) != gfMul(x, gfMul(y, z)) {
+					t.Fatalf("(%d * %d) * %d is not associative", x, y, z)
+				}
+				if gfMul(x, y^z) != gfMul(x, y)^gfMul(x, z) {
+					t.Fatalf("%d * (%d + %d) is not distributive", x, y, z)
+				}
+			}
+		}
+	}
+}
+
+// TestGFMulPolynomial checks multiplication against carry-less multiplication reduced by the
+// field polynomial.
+func TestGFMulPolynomial(t *testing.T) {
+	for a := 0; a < 256; a++ {
+		for b := 0; b < 256; b++ {
+			product := 0
+			for i := 0; i < 8; i++ {
+				if b&(1<<i) != 0 {
+					product ^= a << i
+				}
+			}
+			for i := 15; i >= 8; i-- {
+				if product&(1<<i) != 0 {
+					product ^= gfPolynomial << (i - 8)
+				}
+			}
+			if gfMul(byte(a), byte(b)) != byte(product) {
+				t.Fatalf("%d * %d = %d, expected %d", a, b, gfMul(byte(a), byte(b)), product)
+			}
+		}
+	}
+}
+
+func TestGFMulAdd(t *testing.T) {
+	in := []byte{0, 1, 2, 0x80, 0xff}
+	out := []byte{7, 7, 7, 7, 7}
+	gfMulAdd(gfMulTable(3), in, out)
+	for i := range in {
+		if expected := 7 ^ gfMul(3, in[i]); out[i] != expected {
+			t.Fatalf("byte %d is %d, expected %d", i, out[i], expected)
+		}
+	}
+}
+
+// multiply returns the product of two square matrices.
+func multiply(a, b [][]byte) [][]byte {
+	product := make([][]byte, len(a))
+	for i := range a {
+		product[i] = make([]byte, len(b[0]))
+		for j := range b[0] {
+			for k := range b {
+				product[i][j] ^= gfMul(a[i][k], b[k][j])
+			}
+		}
+	}
+	return product
+}
+
+func TestGFInvert(t *testing.T) {
+	random := rand.New(rand.NewPCG(1, 2))
+	for n := 1; n <= 12; n++ {
+		// Rows of the encoding matrix of a code with n data shards, in random order, always
+		// make an invertible matrix.
+		matrix := make([][]byte, n)
+		for r, i := range random.Perm(2 * n)[:n] {
+			matrix[r] = encodingRow(n, i)
+		}
+		original := make([][]byte, n)
+		for r := range matrix {
+			original[r] = append([]byte(nil), matrix[r]...)
+		}
+
+		inverse, err := gfInvert(matrix)
+		if err != nil {
+			t.Fatalf("%dx%d: %v", n, n, err)
+		}
+		for r := range matrix {
+			for c := range matrix[r] {
+				if matrix[r][c] != original[r][c] {
+					t.Fatalf("%dx%d: gfInvert modified its input", n, n)
+				}
+			}
+		}
+		for _, product := range [][][]byte{multiply(inverse, matrix), multiply(matrix, inverse)} {
+			for r := range product {
+				for c := range product[r] {
+					expected := byte(0)
+					if r == c {
+						expected = 1
+					}
+					if product[r][c] != expected {
+						t.Fatalf("%dx%d: the product with the inverse is not the identity", n, n)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestGFInvertSingular(t *testing.T) {
+	for _, matrix := range [][][]byte{
+		{{0}},
+		{{1, 2}, {1, 2}},
+		{{1, 0, 0}, {0, 1, 0}, {1, 1, 0}},
+		{{2, 4}, {1, 2}},
+	} {
+		if _, err := gfInvert(matrix); err == nil {
+			t.Errorf("inverted the singular matrix %v", matrix)
+		}
+	}
+}
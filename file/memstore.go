@@ -0,0 +1,207 @@
+// Package file contains utilities for file chunking and reconstruction.
+// This file contains an in-memory Store, intended for tests and short-lived nodes.
+package file
+
+import (
+	"bytes"
+	"fmt"
+	"go-to-peer/util"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryChunk is a chunk held by a MemoryStore.
+type memoryChunk struct {
+	data    []byte
+	modTime time.Time
+}
+
+// MemoryStore is a Store keeping all chunks and manifests in memory.
+type MemoryStore struct {
+	mu          sync.RWMutex
+	chunks      map[string]memoryChunk  // chunk hash -> chunk
+	quarantined map[string]memoryChunk  // chunk hash -> quarantined chunk
+	manifests   map[string]FileMetadata // file hash -> manifest
+}
+
+// NewMemoryStore creates an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		chunks:      make(map[string]memoryChunk),
+		quarantined: make(map[string]memoryChunk),
+		manifests:   make(map[string]FileMetadata),
+	}
+}
+
+// Put implements ChunkStore.
+func (s *MemoryStore) Put(chunkHash string, r io.Reader) (int64, error) {
+	if err := ValidateChunkID(chunkHash); err != nil {
+		return 0, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, fmt.Errorf("error reading chunk data: %w", err)
+	}
+	if util.CalculateHash(data) != chunkHash {
+		return 0, fmt.Errorf("%w: %s", ErrChunkHashMismatch, chunkHash)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chunks[chunkHash] = memoryChunk{data: data, modTime: time.Now()}
+	return int64(len(data)), nil
+}
+
+// Get implements ChunkStore.
+func (s *MemoryStore) Get(chunkHash string) (io.ReadCloser, error) {
+	if err := ValidateChunkID(chunkHash); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	chunk, ok := s.chunks[chunkHash]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrChunkNotFound, chunkHash)
+	}
+	chunk.modTime = time.Now() // Record the access for LRU eviction.
+	s.chunks[chunkHash] = chunk
+	return io.NopCloser(bytes.NewReader(chunk.data)), nil
+}
+
+// Has implements ChunkStore.
+func (s *MemoryStore) Has(chunkHash string) bool {
+	_, err := s.lookup(chunkHash)
+	return err == nil
+}
+
+// Delete implements ChunkStore.
+func (s *MemoryStore) Delete(chunkHash string) error {
+	if err := ValidateChunkID(chunkHash); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.chunks, chunkHash)
+	return nil
+}
+
+// List implements ChunkStore.
+func (s *MemoryStore) List() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	chunks := make([]string, 0, len(s.chunks))
+	for chunkHash := range s.chunks {
+		chunks = append(chunks, chunkHash)
+	}
+	sort.Strings(chunks)
+	return chunks, nil
+}
+
+// Stat implements ChunkStore.
+func (s *MemoryStore) Stat(chunkHash string) (ChunkInfo, error) {
+	chunk, err := s.lookup(chunkHash)
+	if err != nil {
+		return ChunkInfo{}, err
+	}
+	return ChunkInfo{Size: int64(len(chunk.data)), ModTime: chunk.modTime}, nil
+}
+
+// Verify implements ChunkStore.
+func (s *MemoryStore) Verify(chunkHash string) error {
+	chunk, err := s.lookup(chunkHash)
+	if err != nil {
+		return err
+	}
+	if util.CalculateHash(chunk.data) != chunkHash {
+		return fmt.Errorf("%w: %s", ErrChunkHashMismatch, chunkHash)
+	}
+	return nil
+}
+
+// Quarantine implements ChunkStore.
+func (s *MemoryStore) Quarantine(chunkHash string) error {
+	if err := ValidateChunkID(chunkHash); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	chunk, ok := s.chunks[chunkHash]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrChunkNotFound, chunkHash)
+	}
+	delete(s.chunks, chunkHash)
+	s.quarantined[chunkHash] = chunk
+	return nil
+}
+
+// lookup returns a stored chunk after validating its hash.
+func (s *MemoryStore) lookup(chunkHash string) (memoryChunk, error) {
+	if err := ValidateChunkID(chunkHash); err != nil {
+		return memoryChunk{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	chunk, ok := s.chunks[chunkHash]
+	if !ok {
+		return memoryChunk{}, fmt.Errorf("%w: %s", ErrChunkNotFound, chunkHash)
+	}
+	return chunk, nil
+}
+
+// PutManifest implements ManifestStore.
+func (s *MemoryStore) PutManifest(metadata FileMetadata) error {
+	if err := ValidateFileHash(metadata.Hash); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metadata.Chunks = append([]string(nil), metadata.Chunks...)
+	metadata.ChunkSizes = append([]int64(nil), metadata.ChunkSizes...)
+	metadata.ParityChunks = append([]string(nil), metadata.ParityChunks...)
+	metadata.ParitySizes = append([]int64(nil), metadata.ParitySizes...)
+	s.manifests[metadata.Hash] = metadata
+	return nil
+}
+
+// GetManifest implements ManifestStore.
+func (s *MemoryStore) GetManifest(fileHash string) (FileMetadata, error) {
+	if err := ValidateFileHash(fileHash); err != nil {
+		return FileMetadata{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	metadata, ok := s.manifests[fileHash]
+	if !ok {
+		return FileMetadata{}, fmt.Errorf("%w: %s", ErrManifestNotFound, fileHash)
+	}
+	metadata.Chunks = append([]string(nil), metadata.Chunks...)
+	metadata.ChunkSizes = append([]int64(nil), metadata.ChunkSizes...)
+	metadata.ParityChunks = append([]string(nil), metadata.ParityChunks...)
+	metadata.ParitySizes = append([]int64(nil), metadata.ParitySizes...)
+	return metadata, nil
+}
+
+// DeleteManifest implements ManifestStore.
+func (s *MemoryStore) DeleteManifest(fileHash string) error {
+	if err := ValidateFileHash(fileHash); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.manifests, fileHash)
+	return nil
+}
+
+// ListManifests implements ManifestStore.
+func (s *MemoryStore) ListManifests() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fileHashes := make([]string, 0, len(s.manifests))
+	for fileHash := range s.manifests {
+		fileHashes = append(fileHashes, fileHash)
+	}
+	sort.Strings(fileHashes)
+	return fileHashes, nil
+}
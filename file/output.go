@@ -0,0 +1,169 @@
+// Package file contains utilities for file chunking and reconstruction.
+// This file contains the destinations of reconstructed files: a directory, in which the file keeps
+// the name recorded in its manifest, an exact path, or a stream such as stdout. Files are written
+// under a temporary name and renamed into place once complete, so a failed download never leaves
+// a partial file or replaces an existing one.
+package file
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ErrOutputExists is returned when writing a file would replace an existing one without Destination.Overwrite.
+var ErrOutputExists = errors.New("output file already exists")
+
+// Destination says where a reconstructed file is written.
+type Destination struct {
+	Dir       string    // Directory receiving the file under the name from its manifest, if Path is "".
+	Path      string    // Path of the file, overriding Dir and the name from the manifest.
+	Writer    io.Writer // Stream receiving the file instead of a file on disk, if not nil.
+	Overwrite bool      // Whether an existing file may be replaced.
+	InPlace   bool      // Whether downloaded chunks are written straight into the file rather than through the chunk store.
+}
+
+// Target returns the path a file with the given name is written to, checking that it does not
+// exist unless d.Overwrite is set.
+//
+// Parameters:
+// - name: The name of the file, from its manifest.
+//
+// Returns:
+// - string: The path of the file, or "" if it is written to d.Writer.
+// - error: An error wrapping ErrOutputExists if the file exists and may not be replaced.
+func (d Destination) Target(name string) (string, error) {
+	if d.Writer != nil {
+		return "", nil
+	}
+	path := d.Path
+	if path == "" {
+		path = filepath.Join(d.Dir, name)
+	}
+	if !d.Overwrite {
+		if _, err := os.Lstat(path); err == nil {
+			return "", fmt.Errorf("%w: %s", ErrOutputExists, path)
+		}
+	}
+	return path, nil
+}
+
+// create opens the output of a file with the given name, creating its directory as needed.
+func (d Destination) create(name string) (*outputFile, error) {
+	if d.Writer != nil {
+		return &outputFile{w: d.Writer}, nil
+	}
+	path, err := d.Target(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output file: %w", err)
+	}
+	return &outputFile{w: f, file: f, path: path, overwrite: d.Overwrite}, nil
+}
+
+// outputFile is a file being written to its destination.
+type outputFile struct {
+	w         io.Writer
+	file      *os.File // The temporary file, or nil when writing to a stream.
+	path      string   // Final path of the file.
+	overwrite bool
+}
+
+// Write implements io.Writer.
+func (o *outputFile) Write(p []byte) (int, error) {
+	return o.w.Write(p)
+}
+
+// commit moves the complete file into place and returns its path, or "" for a stream.
+func (o *outputFile) commit() (string, error) {
+	if o.file == nil {
+		return "", nil
+	}
+	tmpPath := o.file.Name()
+	if err := o.file.Chmod(0644); err != nil {
+		o.abort()
+		return "", fmt.Errorf("failed to write output file: %w", err)
+	}
+	if err := o.file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("failed to write output file: %w", err)
+	}
+	o.file = nil
+	if err := moveIntoPlace(tmpPath, o.path, o.overwrite); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return o.path, nil
+}
+
+// linkFile creates a hard link; tests replace it to simulate file systems without hard links.
+var linkFile = os.Link
+
+// moveIntoPlace moves a complete file from its temporary path to its final path. Unless overwrite
+// is set, the file is linked to its final path, which fails atomically if a file appeared there
+// while this one was being written, and only then unlinked from its temporary path; checking for
+// the file before renaming would let a concurrent download slip in between. On file systems
+// without hard links, the file is copied to its final path, created exclusively instead.
+func moveIntoPlace(tmpPath string, path string, overwrite bool) error {
+	if overwrite {
+		if err := os.Rename(tmpPath, path); err != nil {
+			return fmt.Errorf("failed to move output file into place: %w", err)
+		}
+		return nil
+	}
+	err := linkFile(tmpPath, path)
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		err = copyExclusive(tmpPath, path)
+	}
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("%w: %s", ErrOutputExists, path)
+		}
+		return fmt.Errorf("failed to move output file into place: %w", err)
+	}
+	if err := os.Remove(tmpPath); err != nil {
+		return fmt.Errorf("failed to remove temporary output file: %w", err)
+	}
+	return nil
+}
+
+// copyExclusive copies a file to a path that must not exist yet, removing the copy if it fails.
+func copyExclusive(srcPath string, path string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// abort discards the file being written.
+func (o *outputFile) abort() {
+	if o.file == nil {
+		return
+	}
+	o.file.Close()
+	os.Remove(o.file.Name())
+	o.file = nil
+}
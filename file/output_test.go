@@ -0,0 +1,129 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// writeOutput writes content to a destination and commits it.
+func writeOutput(dest Destination, name string, content string) (string, error) {
+	output, err := dest.create(name)
+	if err != nil {
+		return "", err
+	}
+	defer output.abort()
+	if _, err := output.Write([]byte(content)); err != nil {
+		return "", err
+	}
+	return output.commit()
+}
+
+// TestOutputFileCommitConcurrent checks that of several downloads racing to the same path, exactly
+// one creates the file.
+func TestOutputFileCommitConcurrent(t *testing.T) {
+	testCommitConcurrent(t)
+}
+
+// TestOutputFileCommitWithoutHardLinks checks that on file systems without hard links, files are
+// still committed without replacing existing ones.
+func TestOutputFileCommitWithoutHardLinks(t *testing.T) {
+	linkFile = func(oldname, newname string) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EPERM}
+	}
+	defer func() { linkFile = os.Link }()
+
+	path := filepath.Join(t.TempDir(), "file.txt")
+	if _, err := writeOutput(Destination{Path: path}, "file.txt", "content"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0644 {
+		t.Fatalf("got %v, %v, expected a file with mode 0644", info, err)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "content" {
+		t.Fatalf("file holds %q", content)
+	}
+	if _, err := writeOutput(Destination{Path: path}, "file.txt", "new"); !errors.Is(err, ErrOutputExists) {
+		t.Fatalf("got %v, expected ErrOutputExists", err)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "content" {
+		t.Fatalf("file replaced with %q", content)
+	}
+	testCommitConcurrent(t)
+}
+
+// testCommitConcurrent checks that of several downloads racing to the same path, exactly one
+// creates the file and the others fail with ErrOutputExists, leaving no temporary file behind.
+func testCommitConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.txt")
+
+	const writers = 64
+	// Every writer passes the check on creation before any of them commits.
+	outputs := make([]*outputFile, writers)
+	for i := range outputs {
+		output, err := Destination{Path: path}.create("file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fmt.Fprintf(output, "writer %d", i); err != nil {
+			t.Fatal(err)
+		}
+		outputs[i] = output
+	}
+
+	errs := make([]error, writers)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, output := range outputs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, errs[i] = output.commit()
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	winner := -1
+	for i, err := range errs {
+		switch {
+		case err == nil && winner < 0:
+			winner = i
+		case err == nil:
+			t.Fatalf("writers %d and %d both committed", winner, i)
+		case !errors.Is(err, ErrOutputExists):
+			t.Fatalf("writer %d: got %v, expected ErrOutputExists", i, err)
+		}
+	}
+	if winner < 0 {
+		t.Fatal("no writer committed")
+	}
+	if content, _ := os.ReadFile(path); string(content) != fmt.Sprintf("writer %d", winner) {
+		t.Fatalf("file holds %q, written by another writer than %d", content, winner)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("%d files left in the output directory", len(entries))
+	}
+}
+
+func TestOutputFileOverwrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(path, []byte("existing"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writeOutput(Destination{Path: path}, "file.txt", "new"); !errors.Is(err, ErrOutputExists) {
+		t.Fatalf("got %v, expected ErrOutputExists", err)
+	}
+	if _, err := writeOutput(Destination{Path: path, Overwrite: true}, "file.txt", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "new" {
+		t.Fatalf("file holds %q", content)
+	}
+}
@@ -0,0 +1,311 @@
+// Package file contains utilities for file chunking and reconstruction.
+// This file contains partial files, which are downloaded in place: the target file is
+// preallocated and every chunk is written directly at its offset once verified, so no copy
+// of the chunks is kept in the chunk store and no reconstruction pass is needed.
+package file
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Suffixes of the files kept next to the target while a partial file is being downloaded.
+const (
+	PartialFileExt  = ".part"      // The preallocated file receiving the chunks.
+	PartialStateExt = ".part.json" // The sidecar completion map.
+)
+
+// partialState is the sidecar completion map of a partial file. It lets an interrupted
+// download resume without re-downloading the chunks already written.
+type partialState struct {
+	Hash   string   `json:"hash"`   // Hash of the file being downloaded.
+	Size   int64    `json:"size"`   // Size of the file in bytes.
+	Chunks []string `json:"chunks"` // Chunk IDs of the file, in order.
+	Done   []bool   `json:"done"`   // Whether each chunk has been written and synced.
+}
+
+// PartialFile is a file being downloaded in place.
+type PartialFile struct {
+	mu         sync.Mutex
+	file       *os.File
+	outputPath string // Final path of the file.
+	overwrite  bool   // Whether a file appearing at outputPath during the download may be replaced.
+	partPath   string // Path of the preallocated file.
+	statePath  string // Path of the sidecar completion map.
+	metadata   FileMetadata
+	offsets    []int64 // Offset of each chunk in the file.
+	state      partialState
+}
+
+// OpenPartialFile creates or resumes the in-place download of a file to outputPath.
+// The manifest must declare the size of every chunk, so that each chunk's offset is known.
+//
+// Parameters:
+// - outputPath: The final path of the file, as returned by Destination.Target.
+// - metadata: The manifest of the file to download.
+// - overwrite: Whether a file at outputPath may be replaced, as in Destination.Overwrite.
+//
+// Returns:
+// - *PartialFile: The partial file, ready to receive chunks.
+// - error: An error object if the manifest is unusable or the file cannot be created.
+func OpenPartialFile(outputPath string, metadata FileMetadata, overwrite bool) (*PartialFile, error) {
+	if err := ValidateFileHash(metadata.Hash); err != nil {
+		return nil, err
+	}
+	if err := ValidateFileName(metadata.Name); err != nil {
+		return nil, fmt.Errorf("invalid file name in metadata: %w", err)
+	}
+	if len(metadata.ChunkSizes) != len(metadata.Chunks) {
+		return nil, fmt.Errorf("manifest of %s does not declare its chunk sizes", metadata.Hash)
+	}
+	if err := ValidateChunkLayout(metadata); err != nil {
+		return nil, fmt.Errorf("invalid chunk layout in metadata: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	p := &PartialFile{
+		outputPath: outputPath,
+		overwrite:  overwrite,
+		partPath:   outputPath + PartialFileExt,
+		statePath:  outputPath + PartialStateExt,
+		metadata:   metadata,
+		offsets:    make([]int64, len(metadata.Chunks)),
+	}
+	var offset int64
+	for i, size := range metadata.ChunkSizes {
+		p.offsets[i] = offset
+		offset += size
+	}
+
+	// Resume from the completion map if it describes the same file; start over otherwise.
+	p.state = partialState{
+		Hash:   metadata.Hash,
+		Size:   metadata.Size,
+		Chunks: metadata.Chunks,
+		Done:   make([]bool, len(metadata.Chunks)),
+	}
+	if previous, err := readPartialState(p.statePath); err == nil && previous.matches(p.state) {
+		p.state.Done = previous.Done
+	}
+
+	partFile, err := os.OpenFile(p.partPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output file: %w", err)
+	}
+	// Preallocate the whole file so that chunks can be written at their offsets in any order.
+	if err := partFile.Truncate(metadata.Size); err != nil {
+		partFile.Close()
+		return nil, fmt.Errorf("failed to preallocate output file: %w", err)
+	}
+	p.file = partFile
+
+	if err := p.saveState(); err != nil {
+		partFile.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// readPartialState reads a sidecar completion map.
+func readPartialState(statePath string) (partialState, error) {
+	var state partialState
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+// matches reports whether a completion map read from disk describes the given download.
+func (s partialState) matches(other partialState) bool {
+	if s.Hash != other.Hash || s.Size != other.Size || len(s.Chunks) != len(other.Chunks) || len(s.Done) != len(other.Chunks) {
+		return false
+	}
+	for i := range s.Chunks {
+		if s.Chunks[i] != other.Chunks[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// saveState writes the completion map atomically. The caller must hold p.mu or own p exclusively.
+func (p *PartialFile) saveState() error {
+	data, err := json.Marshal(p.state)
+	if err != nil {
+		return fmt.Errorf("failed to encode completion map: %w", err)
+	}
+	tmpPath := p.statePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write completion map: %w", err)
+	}
+	return os.Rename(tmpPath, p.statePath)
+}
+
+// Missing returns the distinct chunk IDs, in order, that have not been written yet.
+func (p *PartialFile) Missing() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	missing := []string{}
+	seen := make(map[string]bool)
+	for i, chunkID := range p.metadata.Chunks {
+		if p.state.Done[i] || seen[chunkID] {
+			continue
+		}
+		seen[chunkID] = true
+		missing = append(missing, chunkID)
+	}
+	return missing
+}
+
+// WriteChunk streams a chunk into the file at its offset, verifying its hash on the way.
+// A chunk appearing several times in the file is copied to each of its offsets. The chunk is
+// recorded in the completion map only once it has been verified and synced to disk.
+//
+// Parameters:
+// - chunkID: The ID of the chunk.
+// - r: A reader providing exactly the chunk data.
+//
+// Returns:
+// - int64: The number of bytes read from r.
+// - error: An error wrapping ErrChunkHashMismatch if the data does not match the chunk ID, or another error.
+func (p *PartialFile) WriteChunk(chunkID string, r io.Reader) (int64, error) {
+	indexes := p.indexesOf(chunkID)
+	if len(indexes) == 0 {
+		return 0, fmt.Errorf("chunk %s is not part of file %s", chunkID, p.metadata.Hash)
+	}
+	first := indexes[0]
+	size := p.metadata.ChunkSizes[first]
+
+	hasher := sha256.New()
+	writer := io.NewOffsetWriter(p.file, p.offsets[first])
+	n, err := Copy(io.MultiWriter(writer, hasher), io.LimitReader(r, size))
+	if err != nil {
+		return n, fmt.Errorf("failed to write chunk %s: %w", chunkID, err)
+	}
+	if n != size || hex.EncodeToString(hasher.Sum(nil)) != chunkID {
+		return n, fmt.Errorf("%w: %s", ErrChunkHashMismatch, chunkID)
+	}
+
+	// Copy the chunk to the other offsets it appears at.
+	for _, index := range indexes[1:] {
+		source := io.NewSectionReader(p.file, p.offsets[first], size)
+		if _, err := Copy(io.NewOffsetWriter(p.file, p.offsets[index]), source); err != nil {
+			return n, fmt.Errorf("failed to write chunk %s: %w", chunkID, err)
+		}
+	}
+
+	// Only mark the chunk done once its data is durable, so a crash never leaves a hole marked complete.
+	if err := p.file.Sync(); err != nil {
+		return n, fmt.Errorf("failed to sync output file: %w", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, index := range indexes {
+		p.state.Done[index] = true
+	}
+	return n, p.saveState()
+}
+
+// Has reports whether a chunk has been written to the file, so that PartialFile can serve as the
+// ShardSource of erasure decoding.
+func (p *PartialFile) Has(chunkID string) bool {
+	_, ok := p.writtenIndex(chunkID)
+	return ok
+}
+
+// Get returns a reader over a chunk already written to the file.
+func (p *PartialFile) Get(chunkID string) (io.ReadCloser, error) {
+	index, ok := p.writtenIndex(chunkID)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrChunkNotFound, chunkID)
+	}
+	return io.NopCloser(io.NewSectionReader(p.file, p.offsets[index], p.metadata.ChunkSizes[index])), nil
+}
+
+// writtenIndex returns a position of a chunk in the file at which it has been written.
+func (p *PartialFile) writtenIndex(chunkID string) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, id := range p.metadata.Chunks {
+		if id == chunkID && p.state.Done[i] {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// indexesOf returns the positions of a chunk in the file.
+func (p *PartialFile) indexesOf(chunkID string) []int {
+	indexes := []int{}
+	for i, id := range p.metadata.Chunks {
+		if id == chunkID {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// Complete verifies the whole file against its hash once every chunk has been written,
+// then moves it to its final path and removes the completion map. If a file appeared at the final
+// path during the download and may not be replaced, the complete partial file is kept, so that the
+// download can be completed again with overwrite set without downloading anything.
+//
+// Returns:
+// - string: The final path of the file.
+// - error: An error wrapping ErrOutputExists if a file appeared at the final path, or an error
+// object if chunks are missing or the file does not match its hash.
+func (p *PartialFile) Complete() (string, error) {
+	if missing := p.Missing(); len(missing) > 0 {
+		return "", fmt.Errorf("%d chunks of %s are still missing", len(missing), p.metadata.Hash)
+	}
+
+	// Each chunk was verified, but the chunk list itself came from a peer, so check the whole file.
+	hasher := sha256.New()
+	if _, err := Copy(hasher, io.NewSectionReader(p.file, 0, p.metadata.Size)); err != nil {
+		return "", fmt.Errorf("failed to verify output file: %w", err)
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != p.metadata.Hash {
+		p.abandon()
+		return "", fmt.Errorf("downloaded file %s does not match hash %s", p.outputPath, p.metadata.Hash)
+	}
+
+	if err := p.file.Close(); err != nil {
+		return "", fmt.Errorf("failed to write output file: %w", err)
+	}
+	p.file = nil
+	if err := moveIntoPlace(p.partPath, p.outputPath, p.overwrite); err != nil {
+		return "", err
+	}
+	if err := os.Remove(p.statePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("failed to remove completion map: %w", err)
+	}
+	return p.outputPath, nil
+}
+
+// abandon discards a partial file whose chunks do not add up to the expected file.
+func (p *PartialFile) abandon() {
+	p.Close()
+	os.Remove(p.partPath)
+	os.Remove(p.statePath)
+}
+
+// Close closes the partial file, keeping it and its completion map so the download can be resumed.
+func (p *PartialFile) Close() error {
+	if p.file == nil {
+		return nil
+	}
+	err := p.file.Close()
+	p.file = nil
+	return err
+}
@@ -0,0 +1,92 @@
+package file
+
+import (
+	"bytes"
+	"errors"
+	"go-to-peer/util"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// partialChunkSize is the chunk size of the files downloaded in place by the tests.
+const partialChunkSize = 4096
+
+// partialMetadata returns the manifest of a file named name made of content.
+func partialMetadata(name string, content []byte) FileMetadata {
+	metadata := FileMetadata{Name: name, Size: int64(len(content)), Hash: util.CalculateHash(content)}
+	for start := 0; start < len(content); start += partialChunkSize {
+		chunk := content[start:min(start+partialChunkSize, len(content))]
+		metadata.Chunks = append(metadata.Chunks, util.CalculateHash(chunk))
+		metadata.ChunkSizes = append(metadata.ChunkSizes, int64(len(chunk)))
+	}
+	return metadata
+}
+
+// partialDownload opens the in-place download of content to outputPath and writes all of its chunks.
+func partialDownload(t *testing.T, outputPath string, content []byte, overwrite bool) *PartialFile {
+	t.Helper()
+	partial, err := OpenPartialFile(outputPath, partialMetadata(filepath.Base(outputPath), content), overwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { partial.Close() })
+	for start := 0; start < len(content); start += partialChunkSize {
+		chunk := content[start:min(start+partialChunkSize, len(content))]
+		if _, err := partial.WriteChunk(util.CalculateHash(chunk), bytes.NewReader(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return partial
+}
+
+func TestPartialFileComplete(t *testing.T) {
+	content := pseudoRandom(6, 10000)
+	outputPath := filepath.Join(t.TempDir(), "file.bin")
+	path, err := partialDownload(t, outputPath, content, false).Complete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written, _ := os.ReadFile(path); !bytes.Equal(written, content) {
+		t.Fatal("completed file differs")
+	}
+	for _, leftover := range []string{outputPath + PartialFileExt, outputPath + PartialStateExt} {
+		if _, err := os.Stat(leftover); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("%s was left behind", leftover)
+		}
+	}
+}
+
+// TestPartialFileCompleteExisting checks that a file created at the destination during an
+// in-place download is only replaced when overwriting is allowed.
+func TestPartialFileCompleteExisting(t *testing.T) {
+	content := pseudoRandom(7, 10000)
+	outputPath := filepath.Join(t.TempDir(), "file.bin")
+	partial := partialDownload(t, outputPath, content, false)
+	if err := os.WriteFile(outputPath, []byte("created meanwhile"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := partial.Complete(); !errors.Is(err, ErrOutputExists) {
+		t.Fatalf("got %v, expected ErrOutputExists", err)
+	}
+	if existing, _ := os.ReadFile(outputPath); string(existing) != "created meanwhile" {
+		t.Fatal("the existing file was replaced")
+	}
+
+	// The complete partial file is kept, so completing the download again with overwriting
+	// allowed needs no chunk.
+	resumed, err := OpenPartialFile(outputPath, partialMetadata("file.bin", content), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+	if missing := resumed.Missing(); len(missing) != 0 {
+		t.Fatalf("%d chunks missing after resuming a complete download", len(missing))
+	}
+	if _, err := resumed.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	if written, _ := os.ReadFile(outputPath); !bytes.Equal(written, content) {
+		t.Fatal("the existing file was not replaced")
+	}
+}
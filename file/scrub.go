@@ -0,0 +1,91 @@
+// Package file contains utilities for file chunking and reconstruction.
+// This file contains the scrubber of the chunk store, which detects bit rot before a peer does.
+package file
+
+import (
+	"errors"
+	"sort"
+)
+
+// ScrubReport describes the outcome of a scrub of the chunk store.
+type ScrubReport struct {
+	Checked      int      // Number of chunks re-hashed.
+	CheckedBytes int64    // Total size of the chunks re-hashed.
+	Corrupt      []string // Chunks whose data no longer matched their hash, now quarantined.
+	Missing      []string // Chunks referenced by a manifest but absent from the store, excluding Corrupt.
+	Unreadable   []string // Chunks that could not be read to be checked, left in place.
+	Repaired     []string // Damaged chunks restored since, filled in by the caller's repair step.
+}
+
+// Damaged returns the corrupt and missing chunks, which files need restored.
+func (r ScrubReport) Damaged() []string {
+	damaged := append(append([]string{}, r.Corrupt...), r.Missing...)
+	sort.Strings(damaged)
+	return damaged
+}
+
+// Scrub re-hashes every stored chunk, quarantines the chunks whose data no longer matches their
+// hash, and lists the chunks referenced by a manifest that the store does not hold. Chunks that
+// cannot be read are only reported: the error may be transient, and their data may well be intact.
+//
+// Parameters:
+// - store: The store to scrub.
+//
+// Returns:
+// - ScrubReport: The chunks checked and found damaged.
+// - error: An error object if the store cannot be listed or a corrupt chunk cannot be quarantined.
+func Scrub(store Store) (ScrubReport, error) {
+	var report ScrubReport
+
+	chunkHashes, err := store.List()
+	if err != nil {
+		return report, err
+	}
+	corrupt := make(map[string]bool)
+	for _, chunkHash := range chunkHashes {
+		info, err := store.Stat(chunkHash)
+		if errors.Is(err, ErrChunkNotFound) {
+			continue // Deleted since it was listed.
+		}
+		if err != nil {
+			return report, err
+		}
+
+		err = store.Verify(chunkHash)
+		if errors.Is(err, ErrChunkNotFound) {
+			continue
+		}
+		if err != nil && !errors.Is(err, ErrChunkHashMismatch) {
+			report.Unreadable = append(report.Unreadable, chunkHash)
+			continue
+		}
+		report.Checked++
+		report.CheckedBytes += info.Size
+		if err == nil {
+			continue
+		}
+
+		if err := store.Quarantine(chunkHash); err != nil && !errors.Is(err, ErrChunkNotFound) {
+			return report, err
+		}
+		corrupt[chunkHash] = true
+		report.Corrupt = append(report.Corrupt, chunkHash)
+	}
+
+	// The chunks of downloads in progress are not missing, only not fetched yet.
+	files, err := StoredFiles(store)
+	if err != nil {
+		return report, err
+	}
+	missing := make(map[string]bool)
+	for _, metadata := range files {
+		for _, chunkHash := range metadata.AllChunks() {
+			if !corrupt[chunkHash] && !missing[chunkHash] && !store.Has(chunkHash) {
+				missing[chunkHash] = true
+				report.Missing = append(report.Missing, chunkHash)
+			}
+		}
+	}
+	sort.Strings(report.Missing)
+	return report, nil
+}
@@ -0,0 +1,134 @@
+package file
+
+import (
+	"errors"
+	"go-to-peer/util"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// corruptChunk replaces the data of a stored chunk, as bit rot would.
+func corruptChunk(t *testing.T, store Store, chunkHash string) {
+	t.Helper()
+	switch s := store.(type) {
+	case *FSStore:
+		chunkPath, err := s.chunkPath(chunkHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(chunkPath, []byte("rotten"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	case *MemoryStore:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		chunk := s.chunks[chunkHash]
+		chunk.data = []byte("rotten")
+		s.chunks[chunkHash] = chunk
+	default:
+		t.Fatalf("cannot corrupt chunks of a %T", store)
+	}
+}
+
+// quarantined reports whether a chunk was moved to the quarantine of a store.
+func quarantined(t *testing.T, store Store, chunkHash string) bool {
+	t.Helper()
+	switch s := store.(type) {
+	case *FSStore:
+		_, err := os.Stat(filepath.Join(s.root, "quarantine", chunkHash))
+		return err == nil
+	case *MemoryStore:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		_, ok := s.quarantined[chunkHash]
+		return ok
+	default:
+		t.Fatalf("cannot inspect the quarantine of a %T", store)
+		return false
+	}
+}
+
+// unreadableStore is a Store failing to read one of its chunks.
+type unreadableStore struct {
+	Store
+	unreadable string
+}
+
+// Verify implements ChunkStore.
+func (s unreadableStore) Verify(chunkHash string) error {
+	if chunkHash == s.unreadable {
+		return errors.New("input/output error")
+	}
+	return s.Store.Verify(chunkHash)
+}
+
+// storeScrubFile stores a file made of the given chunks and returns their hashes.
+func storeScrubFile(t *testing.T, store Store, chunks ...string) []string {
+	t.Helper()
+	metadata := FileMetadata{Name: "scrubbed.bin"}
+	for _, data := range chunks {
+		metadata.Chunks = append(metadata.Chunks, putChunk(t, store, data))
+		metadata.ChunkSizes = append(metadata.ChunkSizes, int64(len(data)))
+		metadata.Size += int64(len(data))
+	}
+	metadata.Hash = util.CalculateHash([]byte(strings.Join(chunks, "|")))
+	if err := store.PutManifest(metadata); err != nil {
+		t.Fatal(err)
+	}
+	return metadata.Chunks
+}
+
+func TestScrub(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		chunks := storeScrubFile(t, store, "healthy", "rotting", "deleted")
+		corruptChunk(t, store, chunks[1])
+		if err := store.Delete(chunks[2]); err != nil {
+			t.Fatal(err)
+		}
+
+		report, err := Scrub(store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Checked != 2 || report.CheckedBytes != int64(len("healthy")+len("rotten")) {
+			t.Fatalf("checked %d chunks (%d bytes), expected 2", report.Checked, report.CheckedBytes)
+		}
+		if !slices.Equal(report.Corrupt, chunks[1:2]) || !slices.Equal(report.Missing, chunks[2:3]) || len(report.Unreadable) != 0 {
+			t.Fatalf("got corrupt %v, missing %v and unreadable %v", report.Corrupt, report.Missing, report.Unreadable)
+		}
+		if store.Has(chunks[1]) || !quarantined(t, store, chunks[1]) {
+			t.Fatal("the corrupt chunk was not quarantined")
+		}
+		if !store.Has(chunks[0]) || quarantined(t, store, chunks[0]) {
+			t.Fatal("the healthy chunk was quarantined")
+		}
+		if damaged := report.Damaged(); len(damaged) != 2 {
+			t.Fatalf("got damaged chunks %v, expected the corrupt and missing ones", damaged)
+		}
+	})
+}
+
+// TestScrubUnreadable checks that a chunk that cannot be read is reported, but not quarantined
+// as if its data were corrupt.
+func TestScrubUnreadable(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		chunks := storeScrubFile(t, store, "healthy", "unreadable")
+
+		report, err := Scrub(unreadableStore{Store: store, unreadable: chunks[1]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(report.Unreadable, chunks[1:]) || len(report.Corrupt) != 0 || len(report.Missing) != 0 {
+			t.Fatalf("got corrupt %v, missing %v and unreadable %v", report.Corrupt, report.Missing, report.Unreadable)
+		}
+		if report.Checked != 1 {
+			t.Fatalf("checked %d chunks, expected 1", report.Checked)
+		}
+		if !store.Has(chunks[1]) || quarantined(t, store, chunks[1]) {
+			t.Fatal("the unreadable chunk was quarantined")
+		}
+	})
+}
@@ -0,0 +1,448 @@
+// Package file contains utilities for file chunking and reconstruction.
+// This file defines the content-addressed ChunkStore and ManifestStore interfaces through which
+// chunks and file manifests are stored, and their file system implementation.
+package file
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrChunkNotFound is returned by a ChunkStore when the requested chunk does not exist.
+var ErrChunkNotFound = errors.New("chunk not found")
+
+// ErrManifestNotFound is returned by a ManifestStore when the requested manifest does not exist.
+var ErrManifestNotFound = errors.New("manifest not found")
+
+// ErrChunkHashMismatch is returned by ChunkStore.Put when the data does not hash to the chunk's key.
+var ErrChunkHashMismatch = errors.New("chunk data does not match its hash")
+
+// ChunkInfo describes a stored chunk.
+type ChunkInfo struct {
+	Size    int64     // Size of the chunk in bytes.
+	ModTime time.Time // Time the chunk was last written or read, used for LRU eviction.
+}
+
+// ChunkStore stores chunks keyed by the SHA-256 hash of their content, so that a chunk shared by
+// several files (or several versions of a file) is stored only once.
+// Implementations must be safe for concurrent use and must validate the hashes they receive.
+type ChunkStore interface {
+	// Put stores the data read from r under the given chunk hash and returns the number of bytes
+	// written. It returns ErrChunkHashMismatch, and stores nothing, if the data has a different hash.
+	Put(chunkHash string, r io.Reader) (int64, error)
+	// Get opens a chunk for reading and records the access in its ModTime.
+	// It returns ErrChunkNotFound if the chunk does not exist.
+	Get(chunkHash string) (io.ReadCloser, error)
+	// Has reports whether a chunk exists.
+	Has(chunkHash string) bool
+	// Delete removes a chunk. Deleting a missing chunk is not an error.
+	Delete(chunkHash string) error
+	// List returns the hashes of all stored chunks.
+	List() ([]string, error)
+	// Stat returns information about a chunk. It returns ErrChunkNotFound if the chunk does not exist.
+	Stat(chunkHash string) (ChunkInfo, error)
+	// Verify re-hashes a stored chunk without recording an access. It returns ErrChunkHashMismatch
+	// if the stored data no longer matches its hash, and ErrChunkNotFound if the chunk does not exist.
+	Verify(chunkHash string) error
+	// Quarantine moves a chunk out of the store, so it is no longer served, while keeping it for inspection.
+	Quarantine(chunkHash string) error
+}
+
+// ManifestStore stores the manifests (metadata.json) describing which chunks make up each file.
+type ManifestStore interface {
+	// PutManifest stores the manifest of a file, keyed by its file hash.
+	PutManifest(metadata FileMetadata) error
+	// GetManifest returns the manifest of a file. It returns ErrManifestNotFound if it does not exist.
+	GetManifest(fileHash string) (FileMetadata, error)
+	// DeleteManifest removes the manifest of a file. Deleting a missing manifest is not an error.
+	DeleteManifest(fileHash string) error
+	// ListManifests returns the file hashes of all stored manifests.
+	ListManifests() ([]string, error)
+}
+
+// Store combines chunk and manifest storage, as needed to split and reconstruct files.
+type Store interface {
+	ChunkStore
+	ManifestStore
+}
+
+// StoredFiles returns the manifests of the files the store holds, leaving out the provisional
+// manifests of downloads in progress, whose chunks are not all present yet.
+//
+// Parameters:
+// - store: The store whose manifests are listed.
+//
+// Returns:
+// - []FileMetadata: The manifests of the stored files.
+// - error: An error object if a manifest cannot be read.
+func StoredFiles(store ManifestStore) ([]FileMetadata, error) {
+	fileHashes, err := store.ListManifests()
+	if err != nil {
+		return nil, err
+	}
+	files := []FileMetadata{}
+	for _, fileHash := range fileHashes {
+		metadata, err := store.GetManifest(fileHash)
+		if errors.Is(err, ErrManifestNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if metadata.Downloading == nil {
+			files = append(files, metadata)
+		}
+	}
+	return files, nil
+}
+
+// ReferenceCounts counts, for every chunk, how many stored manifests reference it.
+// A chunk referenced twice by the same manifest is counted twice, and parity chunks count as references.
+//
+// Parameters:
+// - store: The store whose manifests are counted.
+//
+// Returns:
+// - map[string]int: The number of references to each chunk hash.
+// - error: An error object if a manifest cannot be read.
+func ReferenceCounts(store ManifestStore) (map[string]int, error) {
+	fileHashes, err := store.ListManifests()
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]int)
+	for _, fileHash := range fileHashes {
+		metadata, err := store.GetManifest(fileHash)
+		if err != nil {
+			return nil, err
+		}
+		for _, chunkHash := range metadata.AllChunks() {
+			refs[chunkHash]++
+		}
+	}
+	return refs, nil
+}
+
+// RemoveFile deletes the manifest of a file and every chunk no other manifest still references.
+//
+// Parameters:
+// - store: The store holding the file.
+// - fileHash: The hash of the file to remove.
+//
+// Returns:
+// - error: An error object if the manifest or chunks cannot be deleted.
+func RemoveFile(store Store, fileHash string) error {
+	metadata, err := store.GetManifest(fileHash)
+	if err != nil {
+		return err
+	}
+	if err := store.DeleteManifest(fileHash); err != nil {
+		return err
+	}
+
+	refs, err := ReferenceCounts(store)
+	if err != nil {
+		return err
+	}
+	for _, chunkHash := range metadata.AllChunks() {
+		if refs[chunkHash] > 0 {
+			continue
+		}
+		if err := store.Delete(chunkHash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FSStore is a Store keeping chunks on disk in a "<root>/objects/<ab>/<chunk hash>" layout,
+// where <ab> are the first two characters of the hash, and manifests in "<root>/manifests/<file hash>.json".
+// Quarantined chunks are moved to "<root>/quarantine/<chunk hash>".
+type FSStore struct {
+	root string
+}
+
+// NewFSStore creates a file system store rooted at the given directory.
+// The directories are created when the first chunk or manifest is stored.
+func NewFSStore(root string) *FSStore {
+	return &FSStore{root: root}
+}
+
+// Root returns the directory in which the store keeps its chunks and manifests.
+func (s *FSStore) Root() string {
+	return s.root
+}
+
+// chunkPath returns the path of a chunk after validating its hash.
+func (s *FSStore) chunkPath(chunkHash string) (string, error) {
+	if err := ValidateChunkID(chunkHash); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, "objects", chunkHash[:2], chunkHash), nil
+}
+
+// manifestPath returns the path of a manifest after validating the file hash.
+func (s *FSStore) manifestPath(fileHash string) (string, error) {
+	if err := ValidateFileHash(fileHash); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, "manifests", fileHash+".json"), nil
+}
+
+// Put implements ChunkStore. The chunk is hashed while it is written to a temporary file and
+// only renamed into place if the hash matches, so readers never observe partial or corrupt chunks.
+func (s *FSStore) Put(chunkHash string, r io.Reader) (int64, error) {
+	chunkPath, err := s.chunkPath(chunkHash)
+	if err != nil {
+		return 0, err
+	}
+
+	hasher := sha256.New()
+	n, tmpPath, err := writeTemp(filepath.Dir(chunkPath), io.TeeReader(r, hasher))
+	if err != nil {
+		return 0, err
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != chunkHash {
+		os.Remove(tmpPath)
+		return 0, fmt.Errorf("%w: %s", ErrChunkHashMismatch, chunkHash)
+	}
+	if err := os.Rename(tmpPath, chunkPath); err != nil {
+		os.Remove(tmpPath)
+		return 0, fmt.Errorf("error writing chunk file: %w", err)
+	}
+	return n, nil
+}
+
+// Get implements ChunkStore.
+func (s *FSStore) Get(chunkHash string) (io.ReadCloser, error) {
+	chunkPath, err := s.chunkPath(chunkHash)
+	if err != nil {
+		return nil, err
+	}
+	chunkFile, err := os.Open(chunkPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrChunkNotFound, chunkHash)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open chunk file %s: %w", chunkPath, err)
+	}
+	// The modification time doubles as the last access time, as access times are often disabled.
+	now := time.Now()
+	_ = os.Chtimes(chunkPath, now, now)
+	return chunkFile, nil
+}
+
+// Has implements ChunkStore.
+func (s *FSStore) Has(chunkHash string) bool {
+	_, err := s.Stat(chunkHash)
+	return err == nil
+}
+
+// Delete implements ChunkStore. Fan-out directories are never removed, even once empty: a
+// concurrent Put may have just created the directory it is about to write its chunk to.
+func (s *FSStore) Delete(chunkHash string) error {
+	chunkPath, err := s.chunkPath(chunkHash)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(chunkPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete chunk %s: %w", chunkHash, err)
+	}
+	return nil
+}
+
+// List implements ChunkStore.
+func (s *FSStore) List() ([]string, error) {
+	fanouts, err := os.ReadDir(filepath.Join(s.root, "objects"))
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunks directory: %w", err)
+	}
+
+	chunks := []string{}
+	for _, fanout := range fanouts {
+		if !fanout.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(s.root, "objects", fanout.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read chunks directory: %w", err)
+		}
+		for _, entry := range entries {
+			// Skip directories and temporary files of chunks being written.
+			if entry.IsDir() || ValidateChunkID(entry.Name()) != nil {
+				continue
+			}
+			chunks = append(chunks, entry.Name())
+		}
+	}
+	return chunks, nil
+}
+
+// Stat implements ChunkStore.
+func (s *FSStore) Stat(chunkHash string) (ChunkInfo, error) {
+	chunkPath, err := s.chunkPath(chunkHash)
+	if err != nil {
+		return ChunkInfo{}, err
+	}
+	info, err := os.Stat(chunkPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return ChunkInfo{}, fmt.Errorf("%w: %s", ErrChunkNotFound, chunkHash)
+	}
+	if err != nil {
+		return ChunkInfo{}, err
+	}
+	return ChunkInfo{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Verify implements ChunkStore.
+func (s *FSStore) Verify(chunkHash string) error {
+	chunkPath, err := s.chunkPath(chunkHash)
+	if err != nil {
+		return err
+	}
+	// Open the file directly rather than through Get, so scrubbing does not count as a use.
+	chunkFile, err := os.Open(chunkPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrChunkNotFound, chunkHash)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open chunk file %s: %w", chunkPath, err)
+	}
+	defer chunkFile.Close()
+
+	hasher := sha256.New()
+	if _, err := Copy(hasher, chunkFile); err != nil {
+		return fmt.Errorf("failed to read chunk file %s: %w", chunkPath, err)
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != chunkHash {
+		return fmt.Errorf("%w: %s", ErrChunkHashMismatch, chunkHash)
+	}
+	return nil
+}
+
+// Quarantine implements ChunkStore.
+func (s *FSStore) Quarantine(chunkHash string) error {
+	chunkPath, err := s.chunkPath(chunkHash)
+	if err != nil {
+		return err
+	}
+	quarantineDir := filepath.Join(s.root, "quarantine")
+	if err := os.MkdirAll(quarantineDir, 0755); err != nil {
+		return fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+	if err := os.Rename(chunkPath, filepath.Join(quarantineDir, chunkHash)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%w: %s", ErrChunkNotFound, chunkHash)
+		}
+		return fmt.Errorf("failed to quarantine chunk %s: %w", chunkHash, err)
+	}
+	return nil
+}
+
+// PutManifest implements ManifestStore.
+func (s *FSStore) PutManifest(metadata FileMetadata) error {
+	manifestPath, err := s.manifestPath(metadata.Hash)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata file: %w", err)
+	}
+	_, tmpPath, err := writeTemp(filepath.Dir(manifestPath), bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to write metadata file: %w", err)
+	}
+	if err := os.Rename(tmpPath, manifestPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write metadata file: %w", err)
+	}
+	return nil
+}
+
+// GetManifest implements ManifestStore.
+func (s *FSStore) GetManifest(fileHash string) (FileMetadata, error) {
+	manifestPath, err := s.manifestPath(fileHash)
+	if err != nil {
+		return FileMetadata{}, err
+	}
+	data, err := os.ReadFile(manifestPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return FileMetadata{}, fmt.Errorf("%w: %s", ErrManifestNotFound, fileHash)
+	}
+	if err != nil {
+		return FileMetadata{}, fmt.Errorf("failed to open metadata file: %w", err)
+	}
+
+	var metadata FileMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return FileMetadata{}, fmt.Errorf("failed to parse metadata file: %w", err)
+	}
+	return metadata, nil
+}
+
+// DeleteManifest implements ManifestStore.
+func (s *FSStore) DeleteManifest(fileHash string) error {
+	manifestPath, err := s.manifestPath(fileHash)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(manifestPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete metadata file: %w", err)
+	}
+	return nil
+}
+
+// ListManifests implements ManifestStore.
+func (s *FSStore) ListManifests() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.root, "manifests"))
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifests directory: %w", err)
+	}
+
+	fileHashes := []string{}
+	for _, entry := range entries {
+		fileHash, ok := strings.CutSuffix(entry.Name(), ".json")
+		if entry.IsDir() || !ok || ValidateFileHash(fileHash) != nil {
+			continue
+		}
+		fileHashes = append(fileHashes, fileHash)
+	}
+	return fileHashes, nil
+}
+
+// writeTemp writes the data read from r to a new temporary file in dir, creating dir if needed.
+// It returns the number of bytes written and the path of the temporary file.
+func writeTemp(dir string, r io.Reader) (int64, string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, "", fmt.Errorf("failed to create chunks directory: %w", err)
+	}
+	tmpFile, err := os.CreateTemp(dir, ".tmp*")
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to create chunk file: %w", err)
+	}
+	n, err := Copy(tmpFile, r)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return 0, "", fmt.Errorf("error writing chunk file: %w", err)
+	}
+	return n, tmpFile.Name(), nil
+}
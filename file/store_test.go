@@ -0,0 +1,329 @@
+package file
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go-to-peer/util"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// stores returns a constructor for every Store implementation, which the conformance tests run against.
+func stores() map[string]func(t *testing.T) Store {
+	return map[string]func(t *testing.T) Store{
+		"FSStore":     func(t *testing.T) Store { return NewFSStore(t.TempDir()) },
+		"MemoryStore": func(t *testing.T) Store { return NewMemoryStore() },
+	}
+}
+
+// forEachStore runs a test against every Store implementation.
+func forEachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	for name, newStore := range stores() {
+		t.Run(name, func(t *testing.T) {
+			test(t, newStore(t))
+		})
+	}
+}
+
+// putChunk stores data and returns its chunk hash.
+func putChunk(t *testing.T, store Store, data string) string {
+	t.Helper()
+	chunkHash := util.CalculateHash([]byte(data))
+	n, err := store.Put(chunkHash, strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) {
+		t.Fatalf("Put wrote %d bytes of %d", n, len(data))
+	}
+	return chunkHash
+}
+
+// readChunk returns the data of a stored chunk.
+func readChunk(t *testing.T, store Store, chunkHash string) string {
+	t.Helper()
+	r, err := store.Get(chunkHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestStoreChunks(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		first := putChunk(t, store, "first chunk")
+		second := putChunk(t, store, "second chunk")
+		putChunk(t, store, "first chunk") // Storing a chunk twice is harmless.
+
+		if got := readChunk(t, store, first); got != "first chunk" {
+			t.Fatalf("Get returned %q", got)
+		}
+		if !store.Has(first) || !store.Has(second) {
+			t.Fatal("Has does not report stored chunks")
+		}
+		info, err := store.Stat(second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size != int64(len("second chunk")) || info.ModTime.IsZero() {
+			t.Fatalf("Stat returned %+v", info)
+		}
+		if err := store.Verify(first); err != nil {
+			t.Fatal(err)
+		}
+
+		list, err := store.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(list)
+		expected := []string{first, second}
+		slices.Sort(expected)
+		if !slices.Equal(list, expected) {
+			t.Fatalf("List returned %v, expected %v", list, expected)
+		}
+
+		if err := store.Delete(first); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Delete(first); err != nil {
+			t.Fatalf("deleting a missing chunk: %v", err)
+		}
+		if store.Has(first) {
+			t.Fatal("Has reports a deleted chunk")
+		}
+		if list, _ := store.List(); !slices.Equal(list, []string{second}) {
+			t.Fatalf("List returned %v after Delete", list)
+		}
+	})
+}
+
+func TestStoreMissingChunk(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		missing := util.CalculateHash([]byte("missing"))
+		if store.Has(missing) {
+			t.Fatal("Has reports a missing chunk")
+		}
+		if _, err := store.Get(missing); !errors.Is(err, ErrChunkNotFound) {
+			t.Fatalf("Get: got %v, expected ErrChunkNotFound", err)
+		}
+		if _, err := store.Stat(missing); !errors.Is(err, ErrChunkNotFound) {
+			t.Fatalf("Stat: got %v, expected ErrChunkNotFound", err)
+		}
+		if err := store.Verify(missing); !errors.Is(err, ErrChunkNotFound) {
+			t.Fatalf("Verify: got %v, expected ErrChunkNotFound", err)
+		}
+		if err := store.Quarantine(missing); !errors.Is(err, ErrChunkNotFound) {
+			t.Fatalf("Quarantine: got %v, expected ErrChunkNotFound", err)
+		}
+		if list, err := store.List(); err != nil || len(list) != 0 {
+			t.Fatalf("List of an empty store returned %v, %v", list, err)
+		}
+	})
+}
+
+func TestStorePutHashMismatch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		chunkHash := util.CalculateHash([]byte("expected data"))
+		if _, err := store.Put(chunkHash, strings.NewReader("other data")); !errors.Is(err, ErrChunkHashMismatch) {
+			t.Fatalf("got %v, expected ErrChunkHashMismatch", err)
+		}
+		if store.Has(chunkHash) {
+			t.Fatal("a chunk not matching its hash was stored")
+		}
+		if list, _ := store.List(); len(list) != 0 {
+			t.Fatalf("List returned %v", list)
+		}
+	})
+}
+
+func TestStoreInvalidHashes(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		for _, hash := range []string{"", "../../etc/passwd", strings.Repeat("A", 64), strings.Repeat("0", 63) + "/"} {
+			if _, err := store.Put(hash, strings.NewReader("data")); err == nil {
+				t.Errorf("Put accepted %q", hash)
+			}
+			if _, err := store.Get(hash); err == nil {
+				t.Errorf("Get accepted %q", hash)
+			}
+			if store.Has(hash) {
+				t.Errorf("Has accepted %q", hash)
+			}
+			if err := store.Delete(hash); err == nil {
+				t.Errorf("Delete accepted %q", hash)
+			}
+			if err := store.PutManifest(FileMetadata{Hash: hash}); err == nil {
+				t.Errorf("PutManifest accepted %q", hash)
+			}
+			if _, err := store.GetManifest(hash); err == nil {
+				t.Errorf("GetManifest accepted %q", hash)
+			}
+		}
+	})
+}
+
+func TestStoreQuarantine(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		chunkHash := putChunk(t, store, "damaged chunk")
+		if err := store.Quarantine(chunkHash); err != nil {
+			t.Fatal(err)
+		}
+		if store.Has(chunkHash) {
+			t.Fatal("a quarantined chunk is still served")
+		}
+		if list, _ := store.List(); len(list) != 0 {
+			t.Fatalf("List returned %v", list)
+		}
+		// The chunk can be stored again, for instance when it is downloaded anew.
+		putChunk(t, store, "damaged chunk")
+		if got := readChunk(t, store, chunkHash); got != "damaged chunk" {
+			t.Fatalf("Get returned %q", got)
+		}
+	})
+}
+
+// TestStoreConcurrentPutDelete checks that deleting and quarantining chunks never makes a concurrent
+// Put of another chunk in the same fan-out directory fail, as garbage collection and scrubbing run
+// alongside downloads.
+func TestStoreConcurrentPutDelete(t *testing.T) {
+	// Find chunks whose hashes share their first two characters.
+	byPrefix := make(map[string][]string)
+	var chunks []string
+	for i := 0; chunks == nil; i++ {
+		data := fmt.Sprintf("chunk %d", i)
+		prefix := util.CalculateHash([]byte(data))[:2]
+		byPrefix[prefix] = append(byPrefix[prefix], data)
+		if len(byPrefix[prefix]) == 3 {
+			chunks = byPrefix[prefix]
+		}
+	}
+
+	forEachStore(t, func(t *testing.T, store Store) {
+		const rounds = 300
+		var wg sync.WaitGroup
+		for i, data := range chunks {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				chunkHash := util.CalculateHash([]byte(data))
+				for range rounds {
+					if _, err := store.Put(chunkHash, strings.NewReader(data)); err != nil {
+						t.Error(err)
+						return
+					}
+					remove := store.Delete
+					if i == 1 {
+						remove = store.Quarantine
+					}
+					if err := remove(chunkHash); err != nil && !errors.Is(err, ErrChunkNotFound) {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+func TestStoreManifests(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		chunk := putChunk(t, store, "chunk")
+		metadata := FileMetadata{
+			Name:       "file.txt",
+			Size:       5,
+			Hash:       util.CalculateHash([]byte("chunk")),
+			Chunks:     []string{chunk},
+			ChunkSizes: []int64{5},
+			Chunking:   FixedChunking(1024),
+		}
+		if err := store.PutManifest(metadata); err != nil {
+			t.Fatal(err)
+		}
+
+		loaded, err := store.GetManifest(metadata.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.Name != metadata.Name || loaded.Size != metadata.Size || loaded.Chunking != metadata.Chunking ||
+			!slices.Equal(loaded.Chunks, metadata.Chunks) || !slices.Equal(loaded.ChunkSizes, metadata.ChunkSizes) {
+			t.Fatalf("GetManifest returned %+v, expected %+v", loaded, metadata)
+		}
+		// The returned manifest is a copy.
+		loaded.Chunks[0] = "changed"
+		if again, _ := store.GetManifest(metadata.Hash); again.Chunks[0] != chunk {
+			t.Fatal("changing a returned manifest changed the stored one")
+		}
+
+		counts, err := ReferenceCounts(store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if counts[chunk] != 1 {
+			t.Fatalf("ReferenceCounts returned %v", counts)
+		}
+
+		if list, err := store.ListManifests(); err != nil || !slices.Equal(list, []string{metadata.Hash}) {
+			t.Fatalf("ListManifests returned %v, %v", list, err)
+		}
+		if err := store.DeleteManifest(metadata.Hash); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.DeleteManifest(metadata.Hash); err != nil {
+			t.Fatalf("deleting a missing manifest: %v", err)
+		}
+		if _, err := store.GetManifest(metadata.Hash); !errors.Is(err, ErrManifestNotFound) {
+			t.Fatalf("got %v, expected ErrManifestNotFound", err)
+		}
+		if list, err := store.ListManifests(); err != nil || len(list) != 0 {
+			t.Fatalf("ListManifests returned %v, %v", list, err)
+		}
+	})
+}
+
+func TestStoreSplitAndReconstruct(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		content := bytes.Repeat([]byte("0123456789"), 1000)
+		path := filepath.Join(t.TempDir(), "file.txt")
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		fileHash := util.CalculateHash(content)
+		metadata, err := SplitFile(store, path, fileHash, FixedChunking(4096))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(metadata.Chunks) != 3 {
+			t.Fatalf("split into %d chunks, expected 3", len(metadata.Chunks))
+		}
+		if err := VerifyFile(store, fileHash); err != nil {
+			t.Fatal(err)
+		}
+
+		var output bytes.Buffer
+		if _, err := ReconstructFile(store, Destination{Writer: &output}, fileHash); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(output.Bytes(), content) {
+			t.Fatal("reconstructed file differs")
+		}
+
+		if err := store.Delete(metadata.Chunks[1]); err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyFile(store, fileHash); err == nil {
+			t.Fatal("VerifyFile accepted a file with a missing chunk")
+		}
+	})
+}
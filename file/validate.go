@@ -0,0 +1,159 @@
+// Package file contains utilities for file chunking and reconstruction.
+// This file contains validation helpers for identifiers that are received from peers
+// and later used to build paths inside the chunk store or the downloads directory.
+package file
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxFileNameLength is the longest file name accepted from a peer, matching common file system limits.
+const maxFileNameLength = 255
+
+// ValidateFileHash checks that a file hash is a lowercase hex-encoded SHA-256 digest.
+//
+// Parameters:
+// - hash: The file hash to validate.
+//
+// Returns:
+// - error: An error describing why the hash is invalid, or nil.
+func ValidateFileHash(hash string) error {
+	if !isHexDigest(hash) {
+		return fmt.Errorf("invalid file hash %q: expected 64 lowercase hex characters", hash)
+	}
+	return nil
+}
+
+// isHexDigest reports whether s is a lowercase hex-encoded SHA-256 digest.
+func isHexDigest(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateChunkID checks that a chunk ID is valid. Chunks are content-addressed,
+// so a chunk ID is the lowercase hex-encoded SHA-256 digest of the chunk's data.
+//
+// Parameters:
+// - chunkID: The chunk ID to validate.
+//
+// Returns:
+// - error: An error describing why the chunk ID is invalid, or nil.
+func ValidateChunkID(chunkID string) error {
+	if !isHexDigest(chunkID) {
+		return fmt.Errorf("invalid chunk ID %q: expected 64 lowercase hex characters", chunkID)
+	}
+	return nil
+}
+
+// ValidateFileName checks that a file name is a single, plain path element.
+// Names containing separators, control characters or relative components are rejected
+// so that they can never escape the directory they are joined with.
+//
+// Parameters:
+// - name: The file name to validate.
+//
+// Returns:
+// - error: An error describing why the file name is invalid, or nil.
+func ValidateFileName(name string) error {
+	if name == "" {
+		return fmt.Errorf("file name is empty")
+	}
+	if len(name) > maxFileNameLength {
+		return fmt.Errorf("file name is longer than %d bytes", maxFileNameLength)
+	}
+	if name == "." || name == ".." {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	if strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid file name %q: contains a path separator", name)
+	}
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("invalid file name %q: not valid UTF-8", name)
+	}
+	for _, c := range name {
+		if unicode.IsControl(c) {
+			return fmt.Errorf("invalid file name %q: contains a control character", name)
+		}
+	}
+	if filepath.Base(name) != name || filepath.VolumeName(name) != "" {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	return nil
+}
+
+// ValidateChunkLayout checks that the chunking parameters and chunk sizes declared by a manifest
+// are consistent with each other and with the file size, and that an erasure-coded file lists one
+// parity chunk per parity shard of every group, sized like the group's largest data chunk.
+// Manifests written before chunk sizes were recorded declare neither, and are accepted.
+//
+// Parameters:
+// - metadata: The manifest to validate.
+//
+// Returns:
+// - error: An error describing the inconsistency, or nil.
+func ValidateChunkLayout(metadata FileMetadata) error {
+	limit := int64(MaxChunkSize)
+	if metadata.Chunking.Mode != "" {
+		if metadata.Chunking.Mode == ChunkingAuto {
+			return fmt.Errorf("unresolved automatic chunking")
+		}
+		if err := metadata.Chunking.Validate(); err != nil {
+			return err
+		}
+		if metadata.Chunking.Mode == ChunkingCDC {
+			limit = metadata.Chunking.MaxSize
+		} else {
+			limit = metadata.Chunking.Size
+		}
+	}
+
+	if metadata.Chunking.DataShards == 0 && (len(metadata.ParityChunks) > 0 || len(metadata.ParitySizes) > 0) {
+		return fmt.Errorf("parity chunks without erasure coding")
+	}
+	if len(metadata.ChunkSizes) == 0 {
+		if metadata.Chunking.DataShards > 0 && len(metadata.Chunks) > 0 {
+			return fmt.Errorf("erasure-coded file without chunk sizes")
+		}
+		return nil
+	}
+	if len(metadata.ChunkSizes) != len(metadata.Chunks) {
+		return fmt.Errorf("%d chunk sizes for %d chunks", len(metadata.ChunkSizes), len(metadata.Chunks))
+	}
+	var total int64
+	for i, size := range metadata.ChunkSizes {
+		if size <= 0 || size > limit {
+			return fmt.Errorf("chunk %d has invalid size %d", i, size)
+		}
+		total += size
+	}
+	if total != metadata.Size {
+		return fmt.Errorf("chunk sizes add up to %d bytes instead of %d", total, metadata.Size)
+	}
+
+	if metadata.Chunking.DataShards == 0 {
+		return nil
+	}
+	k, m := metadata.Chunking.DataShards, metadata.Chunking.ParityShards
+	groups := erasureGroups(metadata)
+	if len(metadata.ParityChunks) != groups*m || len(metadata.ParitySizes) != groups*m {
+		return fmt.Errorf("%d parity chunks and %d parity sizes for %d groups of %d parity shards",
+			len(metadata.ParityChunks), len(metadata.ParitySizes), groups, m)
+	}
+	for i, size := range metadata.ParitySizes {
+		if size != shardSize(metadata.ChunkSizes, k, i/m) {
+			return fmt.Errorf("parity chunk %d has invalid size %d", i, size)
+		}
+	}
+	return nil
+}
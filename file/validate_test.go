@@ -0,0 +1,108 @@
+package file
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// FuzzValidateFileHash checks that accepted file hashes and chunk IDs are plain digests, which
+// stay inside the directory they are joined with.
+func FuzzValidateFileHash(f *testing.F) {
+	for _, seed := range []string{
+		strings.Repeat("a", 64),
+		strings.Repeat("A", 64),
+		strings.Repeat("0", 63),
+		"../" + strings.Repeat("0", 61),
+		strings.Repeat("0", 62) + "/.",
+		"",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, hash string) {
+		hashErr, chunkErr := ValidateFileHash(hash), ValidateChunkID(hash)
+		if (hashErr == nil) != (chunkErr == nil) {
+			t.Fatalf("file hash and chunk ID validation disagree on %q: %v, %v", hash, hashErr, chunkErr)
+		}
+		if hashErr != nil {
+			return
+		}
+		if len(hash) != 64 || strings.Trim(hash, "0123456789abcdef") != "" {
+			t.Fatalf("accepted %q", hash)
+		}
+		if filepath.Dir(filepath.Join("store", hash)) != "store" {
+			t.Fatalf("%q escapes the directory it is joined with", hash)
+		}
+	})
+}
+
+// FuzzValidateFileName checks that accepted file names are a single path element, which stays
+// inside the directory it is joined with.
+func FuzzValidateFileName(f *testing.F) {
+	for _, seed := range []string{
+		"report.pdf", ".hidden", "..", ".", "", "a/b", `a\b`, "../etc/passwd", "/etc/passwd",
+		"name\x00", "tab\there", "\xff\xfe", strings.Repeat("x", 256), "C:name",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		if ValidateFileName(name) != nil {
+			return
+		}
+		if name == "" || name == "." || name == ".." || len(name) > maxFileNameLength {
+			t.Fatalf("accepted %q", name)
+		}
+		if strings.ContainsAny(name, `/\`) || !utf8.ValidString(name) || strings.ContainsRune(name, 0) {
+			t.Fatalf("accepted %q", name)
+		}
+		joined := filepath.Join("downloads", name)
+		if filepath.Dir(joined) != "downloads" || filepath.Base(joined) != name {
+			t.Fatalf("%q escapes the directory it is joined with", name)
+		}
+	})
+}
+
+// FuzzValidateChunkLayout checks that an accepted manifest declares chunk sizes within the chunk
+// size limit that add up to the file size. The fuzzed sizes are read as 16-bit signed integers.
+func FuzzValidateChunkLayout(f *testing.F) {
+	f.Add(int64(300), int64(100), false, []byte{100, 0, 100, 0, 100, 0})
+	f.Add(int64(250), int64(100), false, []byte{100, 0, 100, 0, 50, 0})
+	f.Add(int64(300), int64(100), false, []byte{200, 0, 100, 0})
+	f.Add(int64(0), int64(100), false, []byte{0, 0})
+	f.Add(int64(-1), int64(100), true, []byte{0xff, 0xff})
+	f.Add(int64(10), int64(0), false, []byte{10, 0})
+	f.Add(int64(5), int64(100), true, []byte{})
+	f.Fuzz(func(t *testing.T, size int64, chunkSize int64, legacy bool, sizes []byte) {
+		metadata := FileMetadata{Size: size}
+		if !legacy {
+			metadata.Chunking = FixedChunking(chunkSize)
+		}
+		for i := 0; i+1 < len(sizes); i += 2 {
+			metadata.ChunkSizes = append(metadata.ChunkSizes, int64(int16(binary.LittleEndian.Uint16(sizes[i:]))))
+			metadata.Chunks = append(metadata.Chunks, strings.Repeat("0", 64))
+		}
+
+		if ValidateChunkLayout(metadata) != nil || len(metadata.ChunkSizes) == 0 {
+			return
+		}
+		limit := int64(MaxChunkSize)
+		if !legacy {
+			if chunkSize <= 0 || chunkSize > MaxChunkSize {
+				t.Fatalf("accepted chunk size %d", chunkSize)
+			}
+			limit = chunkSize
+		}
+		var total int64
+		for _, chunk := range metadata.ChunkSizes {
+			if chunk <= 0 || chunk > limit {
+				t.Fatalf("accepted chunk of %d bytes with a limit of %d", chunk, limit)
+			}
+			total += chunk
+		}
+		if total != size {
+			t.Fatalf("accepted chunks of %d bytes for a file of %d", total, size)
+		}
+	})
+}
@@ -2,109 +2,292 @@
 package main
 
 import (
+	"errors"
 	"flag" // Command-line flag parsing library
 	"fmt"  // Formatted I/O library
+	"go-to-peer/config"
+	"go-to-peer/file"
 	"go-to-peer/peer"
 	"go-to-peer/util" // Local utility package for logging and other reusable components
-	"runtime"         // For performance monitoring (CPU usage)
-	//"runtime/debug"   // To collect garbage before measuring performance
+	"io"
+	"os"
+	"runtime" // For performance monitoring (CPU usage)
 	"strings"
 	"time" // For measuring execution time
 )
 
+// programName is the name of the command in usage messages.
+const programName = "go-to-peer"
+
+// Exit codes of the program.
+const (
+	exitOK      = 0 // The command succeeded.
+	exitFailure = 1 // The command failed.
+	exitUsage   = 2 // The command line was invalid.
+)
+
+// command is a subcommand of the CLI.
+type command struct {
+	name    string
+	aliases []string
+	args    string // Synopsis of the positional arguments.
+	summary string
+	run     func(args []string) int
+}
+
+// commands lists the subcommands in the order they are shown in the help.
+var commands []command
+
+// settings are the settings of the node loaded at startup, which provide the defaults of the flags.
+var settings = config.Default()
+
+// settingsPath is the configuration file the settings were read from, or "" if none was.
+var settingsPath string
+
+func init() {
+	commands = []command{
+		{name: "serve", summary: "Share the files in server_files with other peers", run: runServe},
+		{name: "ls", aliases: []string{"catalog"}, summary: "List the files shared by the -connect peers", run: runList},
+		{name: "get", args: "<hash|name|pattern|share link>...", summary: "Download files by hash, name or glob pattern, or encrypted files by share link", run: runGet},
+		{name: "batch", args: "<list file|->", summary: "Download the files listed in a file, several at once, and report the outcome", run: runBatch},
+		{name: "share", args: "<path>", summary: "Encrypt a file into server_files and print its share link", run: runShare},
+		{name: "verify", args: "[hash...]", summary: "Check that stored files are complete and match their hashes", run: runVerify},
+		{name: "status", summary: "Show the state of the local node", run: runStatus},
+		{name: "gc", summary: "Remove unreferenced chunks and evict cached files over the quota", run: runGC},
+		{name: "scrub", summary: "Re-hash the chunk store and repair damaged chunks", run: runScrub},
+		{name: "pin", args: "<hash>...", summary: "Pin files so garbage collection never evicts them", run: runPin},
+		{name: "unpin", args: "<hash>...", summary: "Unpin files", run: runUnpin},
+		{name: "daemon", summary: "Run a long-running node that queues downloads for the other commands", run: runDaemon},
+		{name: "queue", args: "[list | pause|resume|cancel <id>... | priority <level> <id>... | clear]", summary: "List, pause, resume, cancel or reprioritize the downloads of the daemon", run: runQueue},
+		{name: "tui", summary: "Browse the catalogs and manage the transfers of the daemon in a full-screen view", run: runTUI},
+		{name: "config", summary: "Validate the configuration and print the settings in effect", run: runConfig},
+	}
+}
+
 // main is the application's entry point.
-// It initializes the logger, parses CLI arguments, and directs the user to appropriate functionality.
+// It dispatches the command line to a subcommand.
 func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run loads the configuration, initializes the logger and runs the subcommand named by the first
+// argument, returning the exit code.
+func run(args []string) int {
+	configPath := ""
+	if len(args) > 0 && (args[0] == "-config" || args[0] == "--config") {
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "Error: -config requires a file\n\n")
+			printUsage(os.Stderr)
+			return exitUsage
+		}
+		configPath, args = args[1], args[2:]
+	} else if len(args) > 0 && (strings.HasPrefix(args[0], "-config=") || strings.HasPrefix(args[0], "--config=")) {
+		_, configPath, _ = strings.Cut(args[0], "=")
+		args = args[1:]
+	}
+
+	// Invalid settings stop every command before it does anything.
+	loaded, path, err := config.Load(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailure
+	}
+	settings, settingsPath = loaded, path
+	peer.SharedDir = settings.Node.SharedDir
+	peer.DownloadWorkers = settings.Client.Workers
+
 	// Initialize the logger to ensure all events are logged with timestamps and file references.
-	util.InitLogger()
+	util.InitLogger(settings.LogFile)
 	util.Logger.Println("Application started") // Log application start.
+	if settingsPath != "" {
+		util.Logger.Printf("Loaded configuration from %s", settingsPath)
+	}
 
-	// Define CLI commands:
-	serverPort := flag.String("server", "", "Start a server on the specified port")
-	peerAddresses := flag.String("connect", "", "Comma-separated list of peer addresses to connect to")
-	listCatalog := flag.Bool("catalog", false, "List available files on all connected servers")
-	fileHash := flag.String("download", "", "Download a file by its hash")
-	fileName := flag.String("name", "", "Specify the original file name for the downloaded file")
-
-	// Parse the command-line arguments provided by the user.
-	flag.Parse()
-
-	// Collect start time and memory stats for performance measurement.
-	startTime := time.Now()
-	var startMemStats runtime.MemStats
-	runtime.ReadMemStats(&startMemStats)
-
-	// Start the server if the "server" flag is provided.
-	if *serverPort != "" {
-		peer.StartServer(*serverPort)
-		measurePerformance(startTime, startMemStats)
-		return
-	}
-
-	// Connect to peers if the "connect" flag is provided.
-	if *peerAddresses != "" {
-		addresses := splitCommaSeparated(*peerAddresses)
-
-		if *listCatalog {
-			// List files available on all connected servers.
-			fmt.Println("Requesting file catalogs from all servers...")
-			fileSources, err := peer.FetchFileCatalogs(addresses)
-			if err != nil {
-				fmt.Printf("Error fetching file catalogs: %v\n", err)
-				util.Logger.Printf("Error fetching file catalogs: %v", err)
-				measurePerformance(startTime, startMemStats)
-				return
-			}
+	if len(args) == 0 {
+		printUsage(os.Stderr)
+		return exitUsage
+	}
+	name := args[0]
+	if name == "help" || name == "-h" || name == "-help" || name == "--help" {
+		if len(args) < 2 {
+			printUsage(os.Stdout)
+			return exitOK
+		}
+		name, args = args[1], []string{args[1], "-h"}
+	}
+
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+		printUsage(os.Stderr)
+		return exitUsage
+	}
+	return cmd.run(args[1:])
+}
 
-			// Display the combined catalog from all servers.
-			fmt.Println("Combined File Catalog:")
-			for hash, servers := range fileSources {
-				fmt.Printf("- Hash: %s\n", hash)
-				for _, server := range servers {
-					fmt.Printf("  Available on server: %s\n", server)
-				}
+// findCommand returns the subcommand with the given name or alias, or nil.
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+		for _, alias := range commands[i].aliases {
+			if alias == name {
+				return &commands[i]
 			}
-			measurePerformance(startTime, startMemStats)
-			return
 		}
+	}
+	return nil
+}
 
-		if *fileHash != "" {
-			// Download the specified file by its hash.
-			if *fileName == "" {
-				fmt.Println("Error: Please specify the original file name using the -name flag.")
-				measurePerformance(startTime, startMemStats)
-				return
-			}
+// printUsage prints the list of subcommands.
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s [-config <file>] <command> [flags] [arguments]\n\nCommands:\n", programName)
+	for _, cmd := range commands {
+		name := cmd.name
+		if len(cmd.aliases) > 0 {
+			name += ", " + strings.Join(cmd.aliases, ", ")
+		}
+		fmt.Fprintf(w, "  %-14s %s\n", name, cmd.summary)
+	}
+	fmt.Fprintf(w, "\nSettings are read from %s, or the file named by -config or $%s.\n", config.DefaultPath, config.PathEnv)
+	fmt.Fprintf(w, "Run '%s help <command>' for the flags of a command.\n", programName)
+}
 
-			fmt.Printf("Downloading file with hash: %s\n", *fileHash)
-			err := peer.DownloadFileFromMultipleServers(*fileHash, *fileName, addresses)
-			if err != nil {
-				fmt.Printf("Error downloading file with hash %s: %v\n", *fileHash, err)
-				util.Logger.Printf("Error downloading file with hash %s: %v", *fileHash, err)
-			} else {
-				fmt.Printf("Successfully downloaded file: %s\n", *fileName)
-			}
-			measurePerformance(startTime, startMemStats)
+// newFlagSet creates the flag set of a subcommand, with a usage message listing its arguments and flags.
+func newFlagSet(name string) *flag.FlagSet {
+	cmd := findCommand(name)
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		out := fs.Output()
+		synopsis := strings.TrimSpace(fmt.Sprintf("%s %s [flags] %s", programName, cmd.name, cmd.args))
+		fmt.Fprintf(out, "Usage: %s\n\n%s.\n\nFlags:\n", synopsis, cmd.summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags parses the arguments of a subcommand. It returns false, with the exit code to use,
+// when the command must stop: after printing the help, or on an invalid command line.
+func parseFlags(fs *flag.FlagSet, args []string) (int, bool) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK, false
+		}
+		return exitUsage, false
+	}
+	return exitOK, true
+}
+
+// usageError reports an invalid command line and returns exitUsage.
+func usageError(fs *flag.FlagSet, format string, args ...any) int {
+	fmt.Fprintf(fs.Output(), "Error: "+format+"\n\n", args...)
+	fs.Usage()
+	return exitUsage
+}
+
+// fail reports a failed command on stderr and in the log and returns exitFailure.
+func fail(format string, args ...any) int {
+	message := fmt.Sprintf(format, args...)
+	fmt.Fprintf(os.Stderr, "Error: %s\n", message)
+	util.Logger.Printf("Error: %s", message)
+	return exitFailure
+}
+
+// reportBans prints the servers banned while downloading, on the progress display if there is
+// one so that the bar stays intact, or on stderr.
+func reportBans(display *progressDisplay) {
+	peer.OnBan = func(server string, until time.Time, reason string) {
+		message := fmt.Sprintf("Banned server %s until %s: %s", server, until.Format(time.RFC3339), reason)
+		if display != nil {
+			display.message(message)
 			return
 		}
+		fmt.Fprintln(os.Stderr, message)
+	}
+}
+
+// nodeOptions holds the flags shared by every subcommand that uses the local node.
+type nodeOptions struct {
+	chunksDir      string
+	peerID         string
+	compression    string
+	reputationPath string
+	pinsPath       string
+	tlsCert        string
+	tlsKey         string
+	tlsCA          string
+}
+
+// addNodeFlags registers the flags shared by every subcommand that uses the local node.
+func addNodeFlags(fs *flag.FlagSet) *nodeOptions {
+	o := &nodeOptions{}
+	node := settings.Node
+	fs.StringVar(&o.chunksDir, "chunks", node.ChunksDir, "Root directory of the chunk store")
+	fs.StringVar(&o.peerID, "peer-id", node.PeerID, "Peer ID announced to other peers")
+	fs.StringVar(&o.compression, "compression", node.Compression, "Chunk compression offered to and accepted from other peers: gzip or none")
+	fs.StringVar(&o.reputationPath, "reputation", node.ReputationFile, "Path to the file recording peer reputation and bans")
+	fs.StringVar(&o.pinsPath, "pins", node.PinsFile, "Path to the file listing pinned files, which garbage collection never evicts")
+	fs.StringVar(&o.tlsCert, "tls-cert", node.TLSCert, "PEM certificate to serve over TLS and present to other peers")
+	fs.StringVar(&o.tlsKey, "tls-key", node.TLSKey, "PEM private key of -tls-cert")
+	fs.StringVar(&o.tlsCA, "tls-ca", node.TLSCA, "PEM certificates of the CAs signing the certificates of peers; connects over TLS even without -tls-cert")
+	return o
+}
+
+// apply validates the shared flags and configures the peer package with them.
+func (o *nodeOptions) apply() error {
+	if err := peer.ValidatePeerID(o.peerID); err != nil {
+		return err
+	}
+	peer.LocalPeerID = o.peerID
+	compression := o.compression
+	if compression == "none" {
+		compression = ""
+	}
+	if err := peer.ValidateCompression(compression); err != nil {
+		return err
+	}
+	peer.Compression = compression
+	if err := peer.ConfigureTLS(o.tlsCert, o.tlsKey, o.tlsCA); err != nil {
+		return err
+	}
+	peer.Store = file.NewFSStore(o.chunksDir)
+
+	// Load the reputation of known servers so that banned servers are skipped.
+	reputation, err := peer.LoadReputation(o.reputationPath)
+	if err != nil {
+		return fmt.Errorf("failed to load peer reputation: %w", err)
+	}
+	peer.PeerReputation = reputation
+	return nil
+}
+
+// loadServerACL loads the access control list enforced when serving files. Rules naming client
+// certificates need a server authenticating them.
+func loadServerACL(aclPath string) error {
+	acl, err := peer.LoadACL(aclPath)
+	if err != nil {
+		return fmt.Errorf("failed to load ACL: %w", err)
+	}
+	if acl.NamesCertificates() && (peer.ServerTLS == nil || peer.ServerTLS.ClientCAs == nil) {
+		return errors.New("the ACL names client certificates, which requires -tls-cert, -tls-key and -tls-ca")
+	}
+	peer.ServerACL = acl
+	return nil
+}
 
-		// If no valid action is provided, show usage.
-		fmt.Println("Usage:")
-		fmt.Println("  -catalog         : List available files on the servers")
-		fmt.Println("  -download <hash> : Download a file by its hash (requires -name flag)")
-		fmt.Println("  -name <name>     : Specify the original file name for the downloaded file")
-		measurePerformance(startTime, startMemStats)
-		return
+// loadPins loads the pinned files, which garbage collection keeps.
+func (o *nodeOptions) loadPins() (*peer.Pins, error) {
+	pins, err := peer.LoadPins(o.pinsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load pins: %w", err)
 	}
+	return pins, nil
+}
 
-	// If no arguments are provided, show usage.
-	fmt.Println("Usage:")
-	fmt.Println("  -server <port>   : Start a server on the specified port")
-	fmt.Println("  -connect <addrs> : Connect to peer addresses (comma-separated)")
-	fmt.Println("  -catalog         : List available files on the servers")
-	fmt.Println("  -download <hash> : Download a file by its hash (requires -name flag)")
-	fmt.Println("  -name <name>     : Specify the original file name for the downloaded file")
-	measurePerformance(startTime, startMemStats)
+// addPeersFlag registers the -connect flag, which defaults to the peers of the configuration.
+func addPeersFlag(fs *flag.FlagSet, usage string) *string {
+	return fs.String("connect", strings.Join(settings.Node.Peers, ","), usage)
 }
 
 // splitCommaSeparated splits a comma-separated string into a slice of strings.
@@ -115,8 +298,15 @@ func splitCommaSeparated(input string) []string {
 	return strings.Split(input, ",")
 }
 
-// measurePerformance calculates and prints the performance metrics of the program.
-func measurePerformance(startTime time.Time, startMemStats runtime.MemStats) {
+// performanceMetrics are the performance metrics of a command.
+type performanceMetrics struct {
+	ElapsedTime   time.Duration
+	MemoryUsage   int64 // Growth of the heap, in bytes.
+	CPUPercentage float64
+}
+
+// measurePerformance calculates the performance metrics of the program.
+func measurePerformance(startTime time.Time, startMemStats runtime.MemStats) performanceMetrics {
 	// Collect end time and memory stats.
 	endTime := time.Now()
 	var endMemStats runtime.MemStats
@@ -128,12 +318,57 @@ func measurePerformance(startTime time.Time, startMemStats runtime.MemStats) {
 	// Calculate CPU usage (this is an approximation; for detailed stats, use profiling tools like pprof).
 	cpuPercentage := 100.0 * float64(runtime.NumGoroutine()) / float64(runtime.NumCPU())
 
-	// Calculate memory usage.
-	usedMemory := endMemStats.Alloc - startMemStats.Alloc
+	// Calculate memory usage; the heap may have shrunk after a garbage collection.
+	usedMemory := max(int64(endMemStats.Alloc)-int64(startMemStats.Alloc), 0)
+
+	return performanceMetrics{ElapsedTime: elapsedTime, MemoryUsage: usedMemory, CPUPercentage: cpuPercentage}
+}
+
+// print prints the performance metrics.
+func (m performanceMetrics) print(w io.Writer) {
+	fmt.Fprintf(w, "\nPerformance Metrics:\n")
+	fmt.Fprintf(w, "Execution Time: %v\n", m.ElapsedTime)
+	fmt.Fprintf(w, "Memory Usage: %d bytes\n", m.MemoryUsage)
+	fmt.Fprintf(w, "Approximate CPU Usage: %.2f%%\n", m.CPUPercentage)
+}
+
+// printGCReport prints the outcome of a garbage collection run.
+func printGCReport(report file.GCReport, opts file.GCOptions) {
+	verb := "Removed"
+	if opts.DryRun {
+		verb = "Would remove"
+	}
+	for _, fileHash := range report.ForgottenFiles {
+		fmt.Printf("%s file %s, which is no longer shared\n", verb, fileHash)
+	}
+	for _, fileHash := range report.EvictedFiles {
+		fmt.Printf("%s cached file %s\n", verb, fileHash)
+	}
+	fmt.Printf("%s %d chunks (%d bytes); %d bytes remain\n", verb, len(report.RemovedChunks), report.FreedBytes, report.RemainingBytes)
+	if report.OverQuota {
+		fmt.Printf("Warning: the chunk store still exceeds its quota of %d bytes with only shared and pinned files left\n", opts.MaxBytes)
+	}
+	util.Logger.Printf("Garbage collection (dry run: %t) removed %d chunks (%d bytes), forgot %d files and evicted %d files",
+		opts.DryRun, len(report.RemovedChunks), report.FreedBytes, len(report.ForgottenFiles), len(report.EvictedFiles))
+}
 
-	// Print performance metrics.
-	fmt.Printf("\nPerformance Metrics:\n")
-	fmt.Printf("Execution Time: %v\n", elapsedTime)
-	fmt.Printf("Memory Usage: %d bytes\n", usedMemory)
-	fmt.Printf("Approximate CPU Usage: %.2f%%\n", cpuPercentage)
+// printScrubReport prints the outcome of a scrub.
+func printScrubReport(report file.ScrubReport) {
+	repaired := make(map[string]bool)
+	for _, chunkHash := range report.Repaired {
+		repaired[chunkHash] = true
+	}
+	for _, chunkHash := range report.Corrupt {
+		fmt.Printf("Corrupt chunk %s quarantined (repaired: %t)\n", chunkHash, repaired[chunkHash])
+	}
+	for _, chunkHash := range report.Missing {
+		fmt.Printf("Missing chunk %s (repaired: %t)\n", chunkHash, repaired[chunkHash])
+	}
+	for _, chunkHash := range report.Unreadable {
+		fmt.Printf("Unreadable chunk %s left in place\n", chunkHash)
+	}
+	fmt.Printf("Checked %d chunks (%d bytes): %d corrupt, %d missing, %d unreadable, %d repaired\n",
+		report.Checked, report.CheckedBytes, len(report.Corrupt), len(report.Missing), len(report.Unreadable), len(report.Repaired))
+	util.Logger.Printf("Scrub checked %d chunks: %d corrupt, %d missing, %d unreadable, %d repaired",
+		report.Checked, len(report.Corrupt), len(report.Missing), len(report.Unreadable), len(report.Repaired))
 }
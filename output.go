@@ -0,0 +1,164 @@
+// Package main is the entry point of the application, handling user commands via a CLI interface.
+// This file contains the machine-readable output of the commands. With -output json, ls and status
+// print a single JSON document and get prints newline-delimited JSON events. The field names are
+// part of the CLI's interface: fields may be added, but existing ones are never renamed or removed.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"go-to-peer/peer"
+	"os"
+)
+
+// Output formats of the commands printing results.
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// addOutputFlag registers the -output flag.
+func addOutputFlag(fs *flag.FlagSet) *string {
+	return fs.String("output", outputText, "Output format: text, or json for scripts")
+}
+
+// validOutput reports whether an -output format is supported.
+func validOutput(format string) bool {
+	return format == outputText || format == outputJSON
+}
+
+// printJSON writes a value to stdout as a single line of JSON.
+func printJSON(v any) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	_ = encoder.Encode(v)
+}
+
+// catalogJSON is the output of ls.
+type catalogJSON struct {
+	Files   []catalogFileJSON `json:"files"`
+	Servers []serverJSON      `json:"servers"`
+	Metrics *metricsJSON      `json:"metrics,omitempty"`
+}
+
+// catalogFileJSON is a file of the merged catalog.
+type catalogFileJSON struct {
+	Hash    string   `json:"hash"`
+	Name    string   `json:"name"`
+	Path    string   `json:"path,omitempty"`
+	Size    int64    `json:"size"`
+	Chunks  int      `json:"chunks"`
+	Servers []string `json:"servers"` // Servers sharing the file.
+}
+
+// serverJSON is the availability of a server queried by ls.
+type serverJSON struct {
+	Address   string `json:"address"`
+	Available bool   `json:"available"`
+	Files     int    `json:"files"`
+	Error     string `json:"error,omitempty"`
+}
+
+// metricsJSON is the performance metrics of a command.
+type metricsJSON struct {
+	Event         string  `json:"event,omitempty"` // "metrics" in the event stream of get.
+	ElapsedMS     int64   `json:"elapsed_ms"`
+	MemoryBytes   int64   `json:"memory_bytes"`
+	CPUPercentage float64 `json:"cpu_percent"`
+}
+
+// startEventJSON is a "start" event of get, announcing the chunks of a file about to be downloaded.
+type startEventJSON struct {
+	Event    string `json:"event"`
+	FileHash string `json:"file_hash"`
+	Name     string `json:"name"`
+	Chunks   int    `json:"chunks"`
+	Bytes    int64  `json:"bytes"` // Total size of the chunks, or 0 if unknown.
+}
+
+// chunkEventJSON is a "chunk" event of get, reporting an attempt to download a chunk.
+type chunkEventJSON struct {
+	Event      string `json:"event"`
+	FileHash   string `json:"file_hash"`
+	ChunkID    string `json:"chunk_id"`
+	Server     string `json:"server"`
+	OK         bool   `json:"ok"`
+	Bytes      int64  `json:"bytes"`
+	DurationMS int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// resultJSON is a "result" event of get, reporting the outcome of downloading a file.
+type resultJSON struct {
+	Event      string `json:"event"`
+	FileHash   string `json:"file_hash"`
+	JobID      int    `json:"job_id,omitempty"`  // The daemon job that downloaded the file, if any.
+	ShareLink  bool   `json:"share_link"`        // Whether the file was given by share link and decrypted.
+	Pattern    string `json:"pattern,omitempty"` // The name or pattern given for the file, if any.
+	Name       string `json:"name,omitempty"`    // Name of the file in the catalog, if it was looked up.
+	OK         bool   `json:"ok"`
+	Path       string `json:"path,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// queuedEventJSON is a "queued" event of get, reporting a download queued on the daemon.
+type queuedEventJSON struct {
+	Event    string `json:"event"`
+	JobID    int    `json:"job_id"`
+	FileHash string `json:"file_hash"`
+}
+
+// newCatalogJSON converts a merged catalog and the availability of its servers.
+func newCatalogJSON(entries []peer.CatalogEntry, availability []peer.ServerAvailability) catalogJSON {
+	output := catalogJSON{Files: []catalogFileJSON{}, Servers: []serverJSON{}}
+	for _, entry := range entries {
+		output.Files = append(output.Files, catalogFileJSON{
+			Hash:    entry.Hash,
+			Name:    entry.Name,
+			Path:    entry.Path,
+			Size:    entry.Size,
+			Chunks:  len(entry.Chunks),
+			Servers: entry.Servers,
+		})
+	}
+	for _, server := range availability {
+		output.Servers = append(output.Servers, newServerJSON(server))
+	}
+	return output
+}
+
+// newServerJSON converts the availability of a server.
+func newServerJSON(server peer.ServerAvailability) serverJSON {
+	output := serverJSON{Address: server.Address, Available: server.Available, Files: server.Files}
+	if server.Err != nil {
+		output.Error = server.Err.Error()
+	}
+	return output
+}
+
+// newChunkEventJSON converts a chunk download attempt.
+func newChunkEventJSON(event peer.ChunkEvent) chunkEventJSON {
+	output := chunkEventJSON{
+		Event:      "chunk",
+		FileHash:   event.FileHash,
+		ChunkID:    event.ChunkID,
+		Server:     event.Server,
+		OK:         event.Err == nil,
+		Bytes:      event.Size,
+		DurationMS: event.Duration.Milliseconds(),
+	}
+	if event.Err != nil {
+		output.Error = event.Err.Error()
+	}
+	return output
+}
+
+// newMetricsJSON converts performance metrics.
+func newMetricsJSON(metrics performanceMetrics) *metricsJSON {
+	return &metricsJSON{
+		ElapsedMS:     metrics.ElapsedTime.Milliseconds(),
+		MemoryBytes:   metrics.MemoryUsage,
+		CPUPercentage: metrics.CPUPercentage,
+	}
+}
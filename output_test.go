@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"go-to-peer/peer"
+	"testing"
+	"time"
+)
+
+// TestOutputJSON pins the JSON documents and events printed with -output json. Their field names are
+// part of the CLI's interface: a failure here means a script reading the output would break.
+func TestOutputJSON(t *testing.T) {
+	fileHash, chunkID := testHash('a'), testHash('b')
+	entries := []peer.CatalogEntry{
+		{FileMetadata: peer.FileMetadata{Name: "notes.txt", Hash: fileHash, Path: "docs/notes.txt", Size: 2048, Chunks: []string{chunkID, chunkID}}, Servers: []string{"s1", "s2"}},
+	}
+	availability := []peer.ServerAvailability{
+		{Address: "s1", Available: true, Files: 1},
+		{Address: "s3", Err: errors.New("connection refused")},
+	}
+	ls := newCatalogJSON(entries, availability)
+	performance := performanceMetrics{ElapsedTime: 1500 * time.Millisecond, MemoryUsage: 4096, CPUPercentage: 12.5}
+	ls.Metrics = newMetricsJSON(performance)
+	metrics := newMetricsJSON(performance)
+	metrics.Event = "metrics"
+	result := resultJSON{Event: "result", FileHash: fileHash, JobID: 3, ShareLink: true, Pattern: "*.txt", Name: "notes.txt", OK: true, Path: "/tmp/notes.txt", DurationMS: 250}
+
+	tests := []struct {
+		name     string
+		value    any
+		expected string
+	}{
+		{
+			name:  "ls",
+			value: ls,
+			expected: `{"files":[{"hash":"` + fileHash + `","name":"notes.txt","path":"docs/notes.txt","size":2048,"chunks":2,"servers":["s1","s2"]}],` +
+				`"servers":[{"address":"s1","available":true,"files":1},{"address":"s3","available":false,"files":0,"error":"connection refused"}],` +
+				`"metrics":{"elapsed_ms":1500,"memory_bytes":4096,"cpu_percent":12.5}}`,
+		},
+		{
+			name:     "empty ls",
+			value:    newCatalogJSON(nil, nil),
+			expected: `{"files":[],"servers":[]}`,
+		},
+		{
+			name:     "start",
+			value:    startEventJSON{Event: "start", FileHash: fileHash, Name: "notes.txt", Chunks: 2, Bytes: 2048},
+			expected: `{"event":"start","file_hash":"` + fileHash + `","name":"notes.txt","chunks":2,"bytes":2048}`,
+		},
+		{
+			name:     "chunk",
+			value:    newChunkEventJSON(peer.ChunkEvent{FileHash: fileHash, ChunkID: chunkID, Server: "s1", Size: 1024, Duration: 20 * time.Millisecond}),
+			expected: `{"event":"chunk","file_hash":"` + fileHash + `","chunk_id":"` + chunkID + `","server":"s1","ok":true,"bytes":1024,"duration_ms":20}`,
+		},
+		{
+			name:     "failed chunk",
+			value:    newChunkEventJSON(peer.ChunkEvent{FileHash: fileHash, ChunkID: chunkID, Server: "s1", Duration: 20 * time.Millisecond, Err: errors.New("timeout")}),
+			expected: `{"event":"chunk","file_hash":"` + fileHash + `","chunk_id":"` + chunkID + `","server":"s1","ok":false,"bytes":0,"duration_ms":20,"error":"timeout"}`,
+		},
+		{
+			name:  "result",
+			value: result,
+			expected: `{"event":"result","file_hash":"` + fileHash + `","job_id":3,"share_link":true,"pattern":"*.txt","name":"notes.txt",` +
+				`"ok":true,"path":"/tmp/notes.txt","duration_ms":250}`,
+		},
+		{
+			name:     "failed result",
+			value:    resultJSON{Event: "result", FileHash: fileHash, DurationMS: 250, Error: "no servers"},
+			expected: `{"event":"result","file_hash":"` + fileHash + `","share_link":false,"ok":false,"duration_ms":250,"error":"no servers"}`,
+		},
+		{
+			name:     "queued",
+			value:    queuedEventJSON{Event: "queued", JobID: 3, FileHash: fileHash},
+			expected: `{"event":"queued","job_id":3,"file_hash":"` + fileHash + `"}`,
+		},
+		{
+			name:     "metrics",
+			value:    metrics,
+			expected: `{"event":"metrics","elapsed_ms":1500,"memory_bytes":4096,"cpu_percent":12.5}`,
+		},
+		{
+			name:  "batch result",
+			value: batchResultJSON{resultJSON: result, Line: 7, Bytes: 2048},
+			expected: `{"event":"result","file_hash":"` + fileHash + `","job_id":3,"share_link":true,"pattern":"*.txt","name":"notes.txt",` +
+				`"ok":true,"path":"/tmp/notes.txt","duration_ms":250,"line":7,"bytes":2048}`,
+		},
+		{
+			name:     "batch summary",
+			value:    batchSummaryJSON{Event: "summary", Files: 3, Succeeded: 2, Failed: 1, Bytes: 4096, DurationMS: 900},
+			expected: `{"event":"summary","files":3,"succeeded":2,"failed":1,"bytes":4096,"duration_ms":900}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Encode as printJSON does.
+			var buf bytes.Buffer
+			encoder := json.NewEncoder(&buf)
+			encoder.SetEscapeHTML(false)
+			if err := encoder.Encode(tt.value); err != nil {
+				t.Fatal(err)
+			}
+			if got := bytes.TrimSuffix(buf.Bytes(), []byte("\n")); string(got) != tt.expected {
+				t.Fatalf("got\n%s\nexpected\n%s", got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+// Package peer manages peer connectivity and server file catalog functionality.
+// This file contains the access control lists restricting which shared files a peer may see and download.
+package peer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+)
+
+// ACL maps peer addresses and certificates to the shared files they may access.
+//
+// Paths are relative to the shared directory and use forward slashes. A path ending in "/"
+// grants the whole directory tree, "**" grants everything, and any other entry is matched
+// with path.Match (so "*.pdf" only matches top-level PDF files).
+//
+// Example configuration:
+//
+//	{
+//	  "default": ["public/"],
+//	  "rules": [
+//	    {"peers": ["10.0.0.0/8"], "allow": ["**"]},
+//	    {"peers": ["192.168.1.20", "cert:alice"], "allow": ["reports/", "*.txt"]}
+//	  ]
+//	}
+type ACL struct {
+	Default []string  `json:"default"` // Paths visible to peers matching no rule.
+	Rules   []ACLRule `json:"rules"`   // Rules granting access to specific peers.
+}
+
+// ACLRule grants a set of peers access to a set of paths.
+//
+// Peers are identified by their address ("10.1.2.3" or "10.0.0.0/8") or, when the server uses TLS
+// with a CA, by the common name of their verified client certificate ("cert:alice"). The peer ID a
+// peer announces in its HELLO message could be claimed by anyone: rules cannot name one.
+type ACLRule struct {
+	Peers []string `json:"peers"` // Peer addresses, networks or certificate names.
+	Allow []string `json:"allow"` // Paths the peers may see and download.
+}
+
+// ServerACL is the access control list enforced by the server. A nil ACL allows every peer to access every file.
+var ServerACL *ACL
+
+// certPeerPrefix marks the ACL entries naming the common name of a client certificate.
+const certPeerPrefix = "cert:"
+
+// PeerIdentity is what the server knows of a connected peer to apply its ACL.
+type PeerIdentity struct {
+	Addr     string // Network address of the connection.
+	CertName string // Common name of the verified TLS client certificate, or "" if none.
+}
+
+// LoadACL reads and validates an ACL configuration file.
+//
+// Parameters:
+// - aclPath: The path to the JSON ACL configuration.
+//
+// Returns:
+// - *ACL: The parsed access control list.
+// - error: An error object if the file cannot be read or contains invalid entries.
+func LoadACL(aclPath string) (*ACL, error) {
+	data, err := os.ReadFile(aclPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ACL file: %w", err)
+	}
+
+	var acl ACL
+	if err := json.Unmarshal(data, &acl); err != nil {
+		return nil, fmt.Errorf("failed to parse ACL file: %w", err)
+	}
+
+	for i, rule := range acl.Rules {
+		if len(rule.Peers) == 0 {
+			return nil, fmt.Errorf("ACL rule %d has no peers", i)
+		}
+		for _, p := range rule.Peers {
+			if strings.HasPrefix(p, "id:") {
+				return nil, fmt.Errorf("ACL rule %d: peer %q: peer IDs are not authenticated and cannot be used in an ACL; use a client certificate name", i, p)
+			}
+			if name, ok := strings.CutPrefix(p, certPeerPrefix); ok {
+				if name == "" {
+					return nil, fmt.Errorf("ACL rule %d: peer %q has no certificate name", i, p)
+				}
+				continue
+			}
+			if net.ParseIP(p) == nil {
+				if _, _, err := net.ParseCIDR(p); err != nil {
+					return nil, fmt.Errorf("ACL rule %d: invalid peer %q", i, p)
+				}
+			}
+		}
+		if err := validateACLPaths(rule.Allow); err != nil {
+			return nil, fmt.Errorf("ACL rule %d: %w", i, err)
+		}
+	}
+	if err := validateACLPaths(acl.Default); err != nil {
+		return nil, fmt.Errorf("ACL default: %w", err)
+	}
+
+	return &acl, nil
+}
+
+// validateACLPaths checks that every allowed path is a valid pattern.
+func validateACLPaths(paths []string) error {
+	for _, p := range paths {
+		if p == "" || strings.HasPrefix(p, "/") {
+			return fmt.Errorf("invalid path %q", p)
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid path %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// NamesCertificates reports whether a rule of the ACL identifies peers by client certificate,
+// which requires the server to use TLS with a CA.
+func (acl *ACL) NamesCertificates() bool {
+	for _, rule := range acl.Rules {
+		for _, p := range rule.Peers {
+			if strings.HasPrefix(p, certPeerPrefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Allows reports whether a peer may access a shared file.
+//
+// Parameters:
+// - peer: The identity of the peer.
+// - filePath: The path of the file relative to the shared directory, using forward slashes.
+//
+// Returns:
+// - bool: true if the peer may see and download the file.
+func (acl *ACL) Allows(peer PeerIdentity, filePath string) bool {
+	if acl == nil {
+		return true
+	}
+
+	matched := false
+	for _, rule := range acl.Rules {
+		if !rule.matchesPeer(peer) {
+			continue
+		}
+		matched = true
+		if matchesAnyPath(rule.Allow, filePath) {
+			return true
+		}
+	}
+	if matched {
+		return false
+	}
+	return matchesAnyPath(acl.Default, filePath)
+}
+
+// matchesPeer reports whether a rule applies to the given peer.
+func (rule ACLRule) matchesPeer(peer PeerIdentity) bool {
+	host, _, err := net.SplitHostPort(peer.Addr)
+	if err != nil {
+		host = peer.Addr
+	}
+	ip := net.ParseIP(host)
+
+	for _, p := range rule.Peers {
+		if name, ok := strings.CutPrefix(p, certPeerPrefix); ok {
+			if peer.CertName != "" && name == peer.CertName {
+				return true
+			}
+			continue
+		}
+		if ip == nil {
+			continue
+		}
+		if _, network, err := net.ParseCIDR(p); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if ruleIP := net.ParseIP(p); ruleIP != nil && ruleIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAnyPath reports whether a file path matches any of the allowed paths.
+func matchesAnyPath(allowed []string, filePath string) bool {
+	for _, p := range allowed {
+		switch {
+		case p == "**":
+			return true
+		case strings.HasSuffix(p, "/"):
+			if strings.HasPrefix(filePath, p) {
+				return true
+			}
+		default:
+			if ok, _ := path.Match(p, filePath); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
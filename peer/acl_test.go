@@ -0,0 +1,197 @@
+package peer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeACL writes an ACL configuration file and returns its path.
+func writeACL(t *testing.T, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "acl.json")
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadACL(t *testing.T) {
+	acl, err := LoadACL(writeACL(t, `{
+		"default": ["public/"],
+		"rules": [
+			{"peers": ["10.0.0.0/8", "fd00::/8"], "allow": ["**"]},
+			{"peers": ["192.168.1.20", "2001:db8::1", "cert:alice"], "allow": ["reports/", "*.txt"]}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(acl.Rules) != 2 || len(acl.Default) != 1 {
+		t.Fatalf("loaded %+v", acl)
+	}
+	if !acl.NamesCertificates() {
+		t.Fatal("the ACL does not report its certificate names")
+	}
+}
+
+func TestLoadACLErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{"invalid JSON", `{"rules": [`, "failed to parse ACL file"},
+		{"rule without peers", `{"rules": [{"peers": [], "allow": ["**"]}]}`, "ACL rule 0 has no peers"},
+		{"peer ID", `{"rules": [{"peers": ["id:alice"], "allow": ["**"]}]}`, `ACL rule 0: peer "id:alice": peer IDs are not authenticated`},
+		{"empty certificate name", `{"rules": [{"peers": ["cert:"], "allow": ["**"]}]}`, `ACL rule 0: peer "cert:" has no certificate name`},
+		{"host name", `{"rules": [{"peers": ["example.com"], "allow": ["**"]}]}`, `ACL rule 0: invalid peer "example.com"`},
+		{"address with port", `{"rules": [{"peers": ["10.0.0.1:8080"], "allow": ["**"]}]}`, `ACL rule 0: invalid peer "10.0.0.1:8080"`},
+		{"invalid network", `{"rules": [{"peers": ["10.0.0.0/33"], "allow": ["**"]}]}`, `ACL rule 0: invalid peer "10.0.0.0/33"`},
+		{"second rule", `{"rules": [{"peers": ["10.0.0.1"], "allow": ["**"]}, {"peers": ["x"], "allow": ["**"]}]}`, `ACL rule 1: invalid peer "x"`},
+		{"empty path", `{"rules": [{"peers": ["10.0.0.1"], "allow": [""]}]}`, `ACL rule 0: invalid path ""`},
+		{"absolute path", `{"rules": [{"peers": ["10.0.0.1"], "allow": ["/etc/"]}]}`, `ACL rule 0: invalid path "/etc/"`},
+		{"invalid pattern", `{"rules": [{"peers": ["10.0.0.1"], "allow": ["[a-"]}]}`, `ACL rule 0: invalid path "[a-"`},
+		{"invalid default", `{"default": ["/"]}`, `ACL default: invalid path "/"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := LoadACL(writeACL(t, test.config))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got %v, expected an error containing %q", err, test.err)
+			}
+		})
+	}
+	if _, err := LoadACL(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Fatal("loaded a missing ACL file")
+	}
+}
+
+func TestACLAllows(t *testing.T) {
+	acl := &ACL{
+		Default: []string{"public/"},
+		Rules: []ACLRule{
+			{Peers: []string{"10.0.0.0/8"}, Allow: []string{"**"}},
+			{Peers: []string{"192.168.1.20", "2001:db8::1"}, Allow: []string{"a/b/", "*.txt"}},
+			{Peers: []string{"fd00::/8"}, Allow: []string{"a/b"}},
+		},
+	}
+	tests := []struct {
+		remoteAddr string
+		filePath   string
+		allowed    bool
+	}{
+		// Networks and single addresses.
+		{"10.1.2.3:5000", "secret/plans.pdf", true},
+		{"10.255.255.255:1", "anything", true},
+		{"11.0.0.1:5000", "secret/plans.pdf", false},
+		{"192.168.1.20:5000", "a/b/report.pdf", true},
+		{"192.168.1.21:5000", "a/b/report.pdf", false},
+
+		// Directory prefixes do not match siblings sharing a prefix.
+		{"192.168.1.20:5000", "a/b/c/deep.pdf", true},
+		{"192.168.1.20:5000", "a/bc/report.pdf", false},
+		{"192.168.1.20:5000", "a/b", false},
+
+		// Patterns match a single path segment.
+		{"192.168.1.20:5000", "notes.txt", true},
+		{"192.168.1.20:5000", "a/notes.txt", false},
+
+		// A plain path only matches that file.
+		{"[fd00::7]:5000", "a/b", true},
+		{"[fd00::7]:5000", "a/bc", false},
+		{"[fd00::7]:5000", "a/b/c", false},
+
+		// IPv6 addresses, with and without a port.
+		{"[2001:db8::1]:5000", "notes.txt", true},
+		{"2001:db8::1", "notes.txt", true},
+		{"[2001:db8:0:0:0:0:0:1]:5000", "notes.txt", true},
+		{"[2001:db8::2]:5000", "notes.txt", false},
+		{"[fe80::1]:5000", "a/b", false},
+
+		// Peers matching a rule do not fall back to the default.
+		{"192.168.1.20:5000", "public/readme.md", false},
+		{"10.1.2.3:5000", "public/readme.md", true},
+
+		// Other peers get the default, and nothing else.
+		{"172.16.0.1:5000", "public/readme.md", true},
+		{"172.16.0.1:5000", "public", false},
+		{"172.16.0.1:5000", "publicity/readme.md", false},
+		{"172.16.0.1:5000", "notes.txt", false},
+
+		// Addresses that cannot be parsed match no rule.
+		{"not an address", "a/b/report.pdf", false},
+		{"not an address", "public/readme.md", true},
+	}
+	for _, test := range tests {
+		if allowed := acl.Allows(PeerIdentity{Addr: test.remoteAddr}, test.filePath); allowed != test.allowed {
+			t.Errorf("Allows(%q, %q) = %v, expected %v", test.remoteAddr, test.filePath, allowed, test.allowed)
+		}
+	}
+}
+
+// TestACLAllowsCertificates checks that rules naming a client certificate only apply to peers
+// authenticated with it, whatever their address.
+func TestACLAllowsCertificates(t *testing.T) {
+	acl := &ACL{
+		Default: []string{"public/"},
+		Rules: []ACLRule{
+			{Peers: []string{"cert:alice", "10.0.0.1"}, Allow: []string{"reports/"}},
+			{Peers: []string{"cert:bob"}, Allow: []string{"**"}},
+		},
+	}
+	tests := []struct {
+		peer     PeerIdentity
+		filePath string
+		allowed  bool
+	}{
+		{PeerIdentity{Addr: "172.16.0.1:5000", CertName: "alice"}, "reports/q1.pdf", true},
+		{PeerIdentity{Addr: "172.16.0.1:5000", CertName: "alice"}, "secret/plans.pdf", false},
+		{PeerIdentity{Addr: "172.16.0.1:5000", CertName: "alice"}, "public/readme.md", false},
+		{PeerIdentity{Addr: "not an address", CertName: "bob"}, "secret/plans.pdf", true},
+
+		// Certificate names are matched exactly.
+		{PeerIdentity{Addr: "172.16.0.1:5000", CertName: "Alice"}, "reports/q1.pdf", false},
+		{PeerIdentity{Addr: "172.16.0.1:5000", CertName: "alice2"}, "reports/q1.pdf", false},
+
+		// Peers without a certificate are matched by address only.
+		{PeerIdentity{Addr: "172.16.0.1:5000"}, "reports/q1.pdf", false},
+		{PeerIdentity{Addr: "172.16.0.1:5000"}, "public/readme.md", true},
+		{PeerIdentity{Addr: "10.0.0.1:5000"}, "reports/q1.pdf", true},
+	}
+	for _, test := range tests {
+		if allowed := acl.Allows(test.peer, test.filePath); allowed != test.allowed {
+			t.Errorf("Allows(%+v, %q) = %v, expected %v", test.peer, test.filePath, allowed, test.allowed)
+		}
+	}
+}
+
+func TestACLDenyByDefault(t *testing.T) {
+	acl := &ACL{Rules: []ACLRule{{Peers: []string{"10.0.0.1"}, Allow: []string{"**"}}}}
+	for _, filePath := range []string{"file.txt", "dir/file.txt", "public/readme.md"} {
+		if acl.Allows(PeerIdentity{Addr: "10.0.0.2:5000"}, filePath) {
+			t.Errorf("a peer matching no rule may access %s without a default", filePath)
+		}
+		if !acl.Allows(PeerIdentity{Addr: "10.0.0.1:5000"}, filePath) {
+			t.Errorf("the peer of the rule may not access %s", filePath)
+		}
+	}
+
+	var none *ACL
+	if !none.Allows(PeerIdentity{Addr: "10.0.0.2:5000"}, "file.txt") {
+		t.Error("a nil ACL denies access")
+	}
+}
+
+func TestFilterCatalog(t *testing.T) {
+	catalog := &FileCatalog{Files: []FileMetadata{{Path: "public/a.txt"}, {Path: "private/b.txt"}}}
+	acl := &ACL{Default: []string{"public/"}}
+	visible := filterCatalog(catalog, acl, PeerIdentity{Addr: "10.0.0.1:5000"})
+	if len(visible.Files) != 1 || visible.Files[0].Path != "public/a.txt" {
+		t.Fatalf("filtered catalog is %+v", visible.Files)
+	}
+	if all := filterCatalog(catalog, nil, PeerIdentity{Addr: "10.0.0.1:5000"}); len(all.Files) != 2 {
+		t.Fatalf("a nil ACL filtered the catalog to %+v", all.Files)
+	}
+}
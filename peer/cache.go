@@ -0,0 +1,60 @@
+// Package peer manages peer connectivity and server file catalog functionality.
+// This file caches the catalogs of servers, so that a long-running node does not fetch every
+// catalog again for each listing or download.
+package peer
+
+import (
+	"sync"
+	"time"
+)
+
+// CatalogCacheTTL is how long a catalog fetched from a server is reused, or 0 to fetch catalogs
+// for every request.
+var CatalogCacheTTL time.Duration
+
+// cachedCatalog is a catalog and when it was fetched.
+type cachedCatalog struct {
+	catalog *FileCatalog
+	fetched time.Time
+}
+
+// catalogCache holds the catalogs of servers by address.
+type catalogCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedCatalog
+}
+
+// catalogs is the catalog cache of the client.
+var catalogs = &catalogCache{entries: make(map[string]cachedCatalog)}
+
+// get returns the catalog of a server if one was fetched within CatalogCacheTTL, or nil.
+// The catalog is shared and must not be modified.
+func (c *catalogCache) get(address string) *FileCatalog {
+	if CatalogCacheTTL <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.entries[address]
+	if !ok || time.Since(cached.fetched) >= CatalogCacheTTL {
+		return nil
+	}
+	return cached.catalog
+}
+
+// put records the catalog just fetched from a server.
+func (c *catalogCache) put(address string, catalog *FileCatalog) {
+	if CatalogCacheTTL <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[address] = cachedCatalog{catalog: catalog, fetched: time.Now()}
+}
+
+// InvalidateCatalogs drops the cached catalogs, so that the next requests fetch them again.
+func InvalidateCatalogs() {
+	catalogs.mu.Lock()
+	defer catalogs.mu.Unlock()
+	clear(catalogs.entries)
+}
@@ -7,9 +7,21 @@ import (
 	"go-to-peer/util"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 	//"strings"
 )
 
+// Store is the content-addressed store holding the chunks and manifests of shared and downloaded files.
+var Store file.Store = file.NewFSStore("chunks")
+
+// SharedDir is the directory of the files this node shares with its peers.
+var SharedDir = "server_files"
+
+// ServerChunking is how the server splits shared files into chunks, unless ServerChunkingRules
+// assigns other parameters to a file.
+var ServerChunking = file.AutoChunking()
+
 // FileCatalog represents the catalog of files available on the server.
 type FileCatalog struct {
 	Files []FileMetadata `json:"files"` // List of file metadata.
@@ -17,10 +29,75 @@ type FileCatalog struct {
 
 // FileMetadata represents metadata about a file available for sharing.
 type FileMetadata struct {
-	Name   string   `json:"name"`   // File name.
-	Size   int64    `json:"size"`   // File size in bytes.
-	Chunks []string `json:"chunks"` // List of chunk IDs for the file.
-	Hash   string   `json:"hash"`   // Hash of the entire file for integrity verification.
+	Name       string        `json:"name"`                  // File name.
+	Size       int64         `json:"size"`                  // File size in bytes.
+	Chunks     []string      `json:"chunks"`                // List of chunk IDs for the file.
+	ChunkSizes []int64       `json:"chunk_sizes,omitempty"` // Size of each chunk, in the same order as Chunks.
+	Hash       string        `json:"hash"`                  // Hash of the entire file for integrity verification.
+	Path       string        `json:"path,omitempty"`        // Path relative to the shared directory, using forward slashes.
+	Chunking   file.Chunking `json:"chunking"`              // How the file was split into chunks.
+
+	// Parity chunks of an erasure-coded file, from which missing chunks can be recovered.
+	ParityChunks []string `json:"parity_chunks,omitempty"`
+	ParitySizes  []int64  `json:"parity_sizes,omitempty"`
+}
+
+// sharedFileCache holds the catalog entries of shared files by path. Every request for the
+// catalog, a file or a chunk builds the catalog again, so shared files are only hashed and split
+// again when their size, modification time or chunking changed; otherwise a peer could make the
+// server read the whole share for every request it sends.
+type sharedFileCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedSharedFile
+}
+
+// cachedSharedFile is the catalog entry of a shared file, valid as long as the file keeps its
+// size and modification time and is split with the same chunking.
+type cachedSharedFile struct {
+	size     int64
+	modTime  time.Time
+	chunking file.Chunking
+	entry    FileMetadata
+}
+
+// sharedFiles is the cache of the catalog entries of the files this node shares.
+var sharedFiles = &sharedFileCache{entries: make(map[string]cachedSharedFile)}
+
+// get returns the cached catalog entry of a shared file, if it is still valid.
+func (c *sharedFileCache) get(filePath string, info os.FileInfo, chunking file.Chunking) (FileMetadata, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.entries[filePath]
+	if !ok || cached.size != info.Size() || !cached.modTime.Equal(info.ModTime()) || cached.chunking != chunking {
+		return FileMetadata{}, false
+	}
+	return cached.entry, true
+}
+
+// hash returns the cached hash of a shared file, if the file kept its size and modification time.
+// Unlike get, it accepts an entry split with other chunking, which does not change the hash.
+func (c *sharedFileCache) hash(filePath string, info os.FileInfo) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.entries[filePath]
+	if !ok || cached.size != info.Size() || !cached.modTime.Equal(info.ModTime()) {
+		return "", false
+	}
+	return cached.entry.Hash, true
+}
+
+// replace replaces the cached entries with those of the files found by the latest catalog, which
+// drops the entries of files that are no longer shared.
+func (c *sharedFileCache) replace(entries map[string]cachedSharedFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = entries
+}
+
+// reset forgets every cached entry, so that the next catalog checks the chunks of every shared
+// file again and splits the files missing some.
+func (c *sharedFileCache) reset() {
+	c.replace(make(map[string]cachedSharedFile))
 }
 
 // CreateCatalog generates a catalog from files stored in a given directory.
@@ -35,56 +112,171 @@ type FileMetadata struct {
 // CreateCatalog generates a catalog from files stored in a given directory.
 func createCatalog(directory string) (*FileCatalog, error) {
 	catalog := &FileCatalog{}
-	files, err := os.ReadDir(directory)
-	if err != nil {
+	if _, err := os.Stat(directory); err != nil {
 		return nil, fmt.Errorf("failed to read directory: %w", err)
 	}
 
-	for _, entry := range files {
-		if entry.IsDir() {
-			continue
+	// Walk the shared directory recursively so that files can be organized (and access-controlled) by directory.
+	seen := make(map[string]cachedSharedFile)
+	err := filepath.WalkDir(directory, func(filePath string, entry os.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			util.Logger.Printf("Failed to read %s: %v", filePath, walkErr)
+			return nil
+		}
+		if entry.IsDir() || !entry.Type().IsRegular() {
+			return nil
 		}
 
-		filePath := filepath.Join(directory, entry.Name())
 		fileInfo, statErr := os.Stat(filePath)
 		if statErr != nil {
 			util.Logger.Printf("Failed to stat file %s: %v", filePath, statErr)
-			continue
+			return nil
 		}
 
-		hash := util.CalculateFileHash(filePath)
-		err := file.SplitFile(filePath, hash) // Updated SplitFile to use hash-based directories.
+		relPath, relErr := filepath.Rel(directory, filePath)
+		if relErr != nil {
+			util.Logger.Printf("Failed to resolve path of %s: %v", filePath, relErr)
+			return nil
+		}
+
+		chunking := ServerChunkingRules.For(filepath.ToSlash(relPath), ServerChunking).Resolve(fileInfo.Size())
+		if cached, ok := sharedFiles.get(filePath, fileInfo, chunking); ok {
+			seen[filePath] = cachedSharedFile{fileInfo.Size(), fileInfo.ModTime(), chunking, cached}
+			catalog.Files = append(catalog.Files, cached)
+			return nil
+		}
+
+		hash, hashErr := util.HashFile(filePath)
+		if hashErr != nil {
+			util.Logger.Printf("Failed to hash file %s: %v", filePath, hashErr)
+			return nil
+		}
+		manifest, err := loadOrSplitFile(filePath, hash, chunking)
 		if err != nil {
-			return nil, fmt.Errorf("failed to split file %s: %w", entry.Name(), err)
+			return fmt.Errorf("failed to split file %s: %w", entry.Name(), err)
 		}
 
-		chunks := generateChunkList(hash)
-		catalog.Files = append(catalog.Files, FileMetadata{
-			Name:   entry.Name(),
-			Size:   fileInfo.Size(),
-			Hash:   hash,
-			Chunks: chunks,
-		})
+		metadata := FileMetadata{
+			Name:         entry.Name(),
+			Size:         fileInfo.Size(),
+			Hash:         hash,
+			Chunks:       manifest.Chunks,
+			ChunkSizes:   manifest.ChunkSizes,
+			Path:         filepath.ToSlash(relPath),
+			Chunking:     manifest.Chunking,
+			ParityChunks: manifest.ParityChunks,
+			ParitySizes:  manifest.ParitySizes,
+		}
+		seen[filePath] = cachedSharedFile{fileInfo.Size(), fileInfo.ModTime(), chunking, metadata}
+		catalog.Files = append(catalog.Files, metadata)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
+	sharedFiles.replace(seen)
 	return catalog, nil
 }
 
-// generateChunkList creates a list of chunk IDs for a file based on its hash.
-func generateChunkList(hash string) []string {
-	chunksDir := filepath.Join("chunks", hash)
-	chunks := []string{}
+// filterCatalog returns the entries of a catalog the given peer may access according to the ACL.
+//
+// Parameters:
+// - catalog: The full catalog of shared files.
+// - acl: The access control list to enforce, or nil to allow everything.
+// - peer: The identity of the peer.
+//
+// Returns:
+// - *FileCatalog: A catalog containing only the files visible to the peer.
+func filterCatalog(catalog *FileCatalog, acl *ACL, peer PeerIdentity) *FileCatalog {
+	if acl == nil {
+		return catalog
+	}
+	visible := &FileCatalog{}
+	for _, entry := range catalog.Files {
+		if acl.Allows(peer, entry.Path) {
+			visible.Files = append(visible.Files, entry)
+		}
+	}
+	return visible
+}
 
-	files, err := os.ReadDir(chunksDir)
-	if err != nil {
-		util.Logger.Printf("Failed to read chunks directory for hash %s: %v", hash, err)
-		return chunks
+// loadOrSplitFile returns the manifest of a shared file, splitting the file into the store only
+// if it has not been split before, was split with other chunking parameters, or some of its chunks are missing.
+func loadOrSplitFile(filePath string, hash string, chunking file.Chunking) (file.FileMetadata, error) {
+	manifest, err := Store.GetManifest(hash)
+	if err == nil && manifest.Downloading == nil && manifest.Chunking == chunking && hasAllChunks(manifest.AllChunks()) {
+		return manifest, nil
+	}
+	return file.SplitFile(Store, filePath, hash, chunking)
+}
+
+// hasAllChunks reports whether the store holds every one of the given chunks.
+func hasAllChunks(chunks []string) bool {
+	for _, chunk := range chunks {
+		if !Store.Has(chunk) {
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeCatalog removes catalog entries received from a peer whose hash, name or chunk IDs are invalid.
+// The catalog is later used to build local paths, so hostile entries are dropped and logged.
+//
+// Parameters:
+// - catalog: The catalog received from the peer.
+// - address: The address of the peer, used for logging.
+func sanitizeCatalog(catalog *FileCatalog, address string) {
+	valid := catalog.Files[:0]
+	for _, entry := range catalog.Files {
+		if err := validateFileMetadata(entry); err != nil {
+			util.Logger.Printf("Dropping invalid catalog entry from %s: %v", address, err)
+			continue
+		}
+		valid = append(valid, entry)
 	}
+	catalog.Files = valid
+}
 
-	for _, chunk := range files {
-		if !chunk.IsDir() {
-			chunks = append(chunks, chunk.Name())
+// validateFileMetadata checks the identifiers of a single catalog entry.
+func validateFileMetadata(entry FileMetadata) error {
+	if err := file.ValidateFileHash(entry.Hash); err != nil {
+		return err
+	}
+	if err := file.ValidateFileName(entry.Name); err != nil {
+		return err
+	}
+	for _, chunkID := range entry.manifest().AllChunks() {
+		if err := file.ValidateChunkID(chunkID); err != nil {
+			return err
 		}
 	}
-	return chunks
+	return file.ValidateChunkLayout(entry.manifest())
+}
+
+// chunkSizes maps the data and parity chunks of a catalog entry to their declared sizes.
+func (entry FileMetadata) chunkSizes() map[string]int64 {
+	sizes := make(map[string]int64, len(entry.ChunkSizes)+len(entry.ParitySizes))
+	for i, size := range entry.ChunkSizes {
+		sizes[entry.Chunks[i]] = size
+	}
+	for i, size := range entry.ParitySizes {
+		sizes[entry.ParityChunks[i]] = size
+	}
+	return sizes
+}
+
+// manifest returns the file manifest described by a catalog entry.
+func (entry FileMetadata) manifest() file.FileMetadata {
+	return file.FileMetadata{
+		Name:         entry.Name,
+		Size:         entry.Size,
+		Chunks:       entry.Chunks,
+		ChunkSizes:   entry.ChunkSizes,
+		Hash:         entry.Hash,
+		Chunking:     entry.Chunking,
+		ParityChunks: entry.ParityChunks,
+		ParitySizes:  entry.ParitySizes,
+	}
 }
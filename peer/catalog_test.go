@@ -0,0 +1,79 @@
+package peer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCatalogCache checks that the catalog only hashes shared files again when they change.
+func TestCatalogCache(t *testing.T) {
+	setupServer(t)
+	path := filepath.Join(SharedDir, "shared.txt")
+	catalog, err := createCatalog(SharedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := catalog.Files[0].Hash
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Content replaced behind the cache's back, keeping the size and modification time, is not hashed again.
+	content := strings.Repeat("x", int(info.Size()))
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if catalog, err := createCatalog(SharedDir); err != nil || catalog.Files[0].Hash != hash {
+		t.Fatalf("the cached entry was not used: %v", err)
+	}
+
+	// A modified file is hashed and split again.
+	later := info.ModTime().Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	catalog, err = createCatalog(SharedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if catalog.Files[0].Hash == hash {
+		t.Fatal("a modified file kept its cached hash")
+	}
+
+	// Removed files leave the catalog.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if catalog, err := createCatalog(SharedDir); err != nil || len(catalog.Files) != 0 {
+		t.Fatalf("catalog of an empty share has %d files: %v", len(catalog.Files), err)
+	}
+}
+
+// TestCatalogUnreadableFile checks that a shared file that cannot be read is left out of the
+// catalog instead of being listed with an empty hash.
+func TestCatalogUnreadableFile(t *testing.T) {
+	setupServer(t)
+	path := filepath.Join(SharedDir, "private.txt")
+	if err := os.WriteFile(path, []byte("private"), 0000); err != nil {
+		t.Fatal(err)
+	}
+	if file, err := os.Open(path); err == nil {
+		file.Close()
+		t.Skip("file permissions are not enforced for this user")
+	}
+
+	catalog, err := createCatalog(SharedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Files) != 1 || catalog.Files[0].Path != "shared.txt" {
+		t.Fatalf("catalog has %+v, expected only the readable file", catalog.Files)
+	}
+}
@@ -0,0 +1,89 @@
+// Package peer manages peer connectivity and server file catalog functionality.
+// This file contains the per-file chunking rules of the server.
+package peer
+
+import (
+	"encoding/json"
+	"fmt"
+	"go-to-peer/file"
+	"os"
+)
+
+// ChunkingRules assigns chunking parameters to shared files by path, overriding ServerChunking.
+// Paths use the same syntax as the ACL: "dir/" matches a directory tree, "**" everything, and any
+// other entry is matched with path.Match. The first matching rule wins.
+//
+// Example configuration:
+//
+//	{
+//	  "rules": [
+//	    {"paths": ["videos/"], "chunking": {"mode": "fixed", "size": 67108864, "data_shards": 8, "parity_shards": 2}},
+//	    {"paths": ["*.iso"], "chunking": {"mode": "cdc", "min_size": 1048576, "avg_size": 4194304, "max_size": 16777216}},
+//	    {"paths": ["docs/"], "chunking": {"mode": "auto"}}
+//	  ]
+//	}
+type ChunkingRules struct {
+	Rules []ChunkingRule `json:"rules"` // Rules in order of precedence.
+}
+
+// ChunkingRule applies chunking parameters to a set of paths.
+type ChunkingRule struct {
+	Paths    []string      `json:"paths"`    // Paths relative to the shared directory.
+	Chunking file.Chunking `json:"chunking"` // Chunking parameters for the matching files.
+}
+
+// ServerChunkingRules holds the per-file chunking rules of the server. Nil applies ServerChunking to every file.
+var ServerChunkingRules *ChunkingRules
+
+// LoadChunkingRules reads and validates a chunking rules file.
+//
+// Parameters:
+// - rulesPath: The path to the JSON chunking rules.
+//
+// Returns:
+// - *ChunkingRules: The parsed rules.
+// - error: An error object if the file cannot be read or contains invalid entries.
+func LoadChunkingRules(rulesPath string) (*ChunkingRules, error) {
+	data, err := os.ReadFile(rulesPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunking rules: %w", err)
+	}
+
+	var rules ChunkingRules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse chunking rules: %w", err)
+	}
+
+	for i, rule := range rules.Rules {
+		if len(rule.Paths) == 0 {
+			return nil, fmt.Errorf("chunking rule %d has no paths", i)
+		}
+		if err := validateACLPaths(rule.Paths); err != nil {
+			return nil, fmt.Errorf("chunking rule %d: %w", i, err)
+		}
+		if err := rule.Chunking.Validate(); err != nil {
+			return nil, fmt.Errorf("chunking rule %d: %w", i, err)
+		}
+	}
+	return &rules, nil
+}
+
+// For returns the chunking parameters of a shared file.
+//
+// Parameters:
+// - filePath: The path of the file relative to the shared directory, using forward slashes.
+// - fallback: The parameters to use if no rule matches.
+//
+// Returns:
+// - file.Chunking: The chunking parameters of the file.
+func (rules *ChunkingRules) For(filePath string, fallback file.Chunking) file.Chunking {
+	if rules == nil {
+		return fallback
+	}
+	for _, rule := range rules.Rules {
+		if matchesAnyPath(rule.Paths, filePath) {
+			return rule.Chunking
+		}
+	}
+	return fallback
+}
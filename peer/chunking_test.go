@@ -0,0 +1,118 @@
+package peer
+
+import (
+	"go-to-peer/file"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeChunkingRules writes a chunking rules file and returns its path.
+func writeChunkingRules(t *testing.T, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "chunking.json")
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadChunkingRules(t *testing.T) {
+	rules, err := LoadChunkingRules(writeChunkingRules(t, `{
+		"rules": [
+			{"paths": ["videos/"], "chunking": {"mode": "fixed", "size": 67108864, "data_shards": 8, "parity_shards": 2}},
+			{"paths": ["*.iso"], "chunking": {"mode": "cdc", "min_size": 1048576, "avg_size": 4194304, "max_size": 16777216}},
+			{"paths": ["docs/"], "chunking": {"mode": "auto"}}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []file.Chunking{
+		{Mode: file.ChunkingFixed, Size: 64 << 20, DataShards: 8, ParityShards: 2},
+		file.CDCChunking(1<<20, 4<<20, 16<<20),
+		file.AutoChunking(),
+	}
+	if len(rules.Rules) != len(expected) {
+		t.Fatalf("loaded %+v", rules)
+	}
+	for i, rule := range rules.Rules {
+		if rule.Chunking != expected[i] {
+			t.Errorf("rule %d has chunking %+v, expected %+v", i, rule.Chunking, expected[i])
+		}
+	}
+}
+
+func TestLoadChunkingRulesErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{"invalid JSON", `{"rules": [`, "failed to parse chunking rules"},
+		{"rule without paths", `{"rules": [{"paths": [], "chunking": {"mode": "auto"}}]}`, "chunking rule 0 has no paths"},
+		{"absolute path", `{"rules": [{"paths": ["/etc/"], "chunking": {"mode": "auto"}}]}`, `chunking rule 0: invalid path "/etc/"`},
+		{"invalid pattern", `{"rules": [{"paths": ["[a-"], "chunking": {"mode": "auto"}}]}`, `chunking rule 0: invalid path "[a-"`},
+		{"missing mode", `{"rules": [{"paths": ["**"], "chunking": {}}]}`, `chunking rule 0: unknown chunking mode ""`},
+		{"unknown mode", `{"rules": [{"paths": ["**"], "chunking": {"mode": "rabin"}}]}`, `chunking rule 0: unknown chunking mode "rabin"`},
+		{"fixed without size", `{"rules": [{"paths": ["**"], "chunking": {"mode": "fixed"}}]}`, "chunking rule 0: fixed chunk size"},
+		{"chunks too large", `{"rules": [{"paths": ["**"], "chunking": {"mode": "fixed", "size": 1073741824}}]}`, "chunking rule 0: fixed chunk size"},
+		{"cdc sizes out of order", `{"rules": [{"paths": ["**"], "chunking": {"mode": "cdc", "min_size": 4096, "avg_size": 1024, "max_size": 8192}}]}`, "chunking rule 0: content-defined chunk sizes"},
+		{"auto with size", `{"rules": [{"paths": ["**"], "chunking": {"mode": "auto", "size": 1024}}]}`, "chunking rule 0: automatic chunking takes no chunk sizes"},
+		{"parity without data", `{"rules": [{"paths": ["**"], "chunking": {"mode": "auto", "parity_shards": 2}}]}`, "chunking rule 0: erasure coding"},
+		{"second rule", `{"rules": [{"paths": ["**"], "chunking": {"mode": "auto"}}, {"paths": ["x"], "chunking": {"mode": "x"}}]}`, `chunking rule 1: unknown chunking mode "x"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := LoadChunkingRules(writeChunkingRules(t, test.config))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got %v, expected an error containing %q", err, test.err)
+			}
+		})
+	}
+	if _, err := LoadChunkingRules(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Fatal("loaded a missing chunking rules file")
+	}
+}
+
+func TestChunkingRulesFor(t *testing.T) {
+	videos := file.FixedChunking(64 << 20)
+	isos := file.CDCChunking(1<<20, 4<<20, 16<<20)
+	docs := file.AutoChunking()
+	fallback := file.FixedChunking(1 << 20)
+	rules := &ChunkingRules{Rules: []ChunkingRule{
+		{Paths: []string{"videos/"}, Chunking: videos},
+		{Paths: []string{"*.iso", "images/*.iso"}, Chunking: isos},
+		{Paths: []string{"docs/", "videos/"}, Chunking: docs},
+	}}
+	tests := []struct {
+		filePath string
+		expected file.Chunking
+	}{
+		{"videos/holiday.mp4", videos},
+		{"videos/2024/holiday.mp4", videos},
+		{"debian.iso", isos},
+		{"images/debian.iso", isos},
+		{"docs/manual.pdf", docs},
+
+		// The first matching rule wins.
+		{"videos/debian.iso", videos},
+
+		// Files matching no rule get the server's chunking.
+		{"other/debian.iso", fallback},
+		{"videos", fallback},
+		{"videosx/holiday.mp4", fallback},
+		{"readme.md", fallback},
+	}
+	for _, test := range tests {
+		if got := rules.For(test.filePath, fallback); got != test.expected {
+			t.Errorf("For(%q) = %+v, expected %+v", test.filePath, got, test.expected)
+		}
+	}
+
+	var none *ChunkingRules
+	if got := none.For("videos/holiday.mp4", fallback); got != fallback {
+		t.Errorf("nil rules returned %+v", got)
+	}
+}
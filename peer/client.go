@@ -3,79 +3,372 @@ package peer
 
 // Import statements:
 // - "bufio": For buffered reading from a network connection.
-// - "encoding/json": For encoding and decoding JSON messages.
 // - "fmt": For user-facing messages.
 // - "net": For establishing TCP connections.
 // - "go-to-peer/util": For logging significant events.
 import (
-	"bufio"         // Buffered reading/writing to TCP connections.
-	"encoding/json" // JSON encoding/decoding for structured message exchange.
-	"fmt"           // Formatted I/O for user-facing messages.
+	"bufio" // Buffered reading/writing to TCP connections.
+	"context"
+	"errors"
+	"fmt" // Formatted I/O for user-facing messages.
 	"go-to-peer/file"
+	"io"
+	"path"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	//"go-to-peer/file"
 	"go-to-peer/util"
 	"net" // TCP networking for peer connections.
-	"os"
 	//"strings"
 	//"sync"
 )
 
+// Client-side timeouts for connecting to a server and for transferring a single chunk.
+const (
+	dialTimeout  = 10 * time.Second
+	chunkTimeout = 5 * time.Minute
+)
+
+// DownloadWorkers is the number of chunks downloaded in parallel.
+var DownloadWorkers = 10
+
 // DownloadFileFromMultipleServers downloads a file using its hash from multiple servers.
-func DownloadFileFromMultipleServers(fileHash string, fileName string, servers []string) error {
-	// Fetch metadata for the file from one of the servers.
-	catalog, err := fetchCatalog(servers[0])
+// Nothing is downloaded if the destination file exists and may not be replaced. With dest.InPlace,
+// chunks are written directly into the file instead of storing them in the chunk store and
+// reconstructing the file afterwards; files written to a stream always go through the chunk store.
+//
+// Parameters:
+// - ctx: Cancels the download. Chunks already downloaded are kept, so the download can resume later.
+// - fileHash: The hash of the file to download.
+// - servers: The addresses of the servers to download from.
+// - dest: Where to write the file.
+//
+// Returns:
+// - string: The path of the downloaded file, or "" if it was written to dest.Writer.
+// - error: An error object if downloading or reconstructing the file fails, or ctx.Err() if it was cancelled.
+func DownloadFileFromMultipleServers(ctx context.Context, fileHash string, servers []string, dest file.Destination) (string, error) {
+	entry, servers, err := findFile(fileHash, servers)
+	if err != nil {
+		return "", err
+	}
+	if err := file.ValidateFileName(entry.Name); err != nil {
+		return "", fmt.Errorf("invalid file name in metadata: %w", err)
+	}
+	if _, err := dest.Target(entry.Name); err != nil {
+		return "", err
+	}
+
+	if dest.InPlace && dest.Writer == nil {
+		outputPath, err := downloadFileInPlace(ctx, entry, dest, servers)
+		if err != nil {
+			return "", err
+		}
+		util.Logger.Printf("Successfully downloaded file in place: %s", outputPath)
+		return outputPath, nil
+	}
+
+	if err := downloadEntryChunks(ctx, entry, servers); err != nil {
+		return "", err
+	}
+
+	// Reconstruct the file after all chunks are downloaded.
+	outputPath, err := file.ReconstructFile(Store, dest, fileHash)
+	if err != nil {
+		return "", fmt.Errorf("failed to reconstruct file: %w", err)
+	}
+
+	util.Logger.Printf("Successfully downloaded and reconstructed file %s to %q", fileHash, outputPath)
+	return outputPath, nil
+}
+
+// DownloadSharedFile downloads an end-to-end encrypted file using a share link and decrypts it.
+// Servers only ever send the ciphertext; the key embedded in the link never leaves this node.
+//
+// Parameters:
+// - shareLink: A link of the form "gtp://<file hash>#<key>".
+// - ctx: Cancels the download.
+// - servers: The addresses of the servers to download from.
+// - dest: Where to write the decrypted file.
+//
+// Returns:
+// - string: The path of the decrypted file, or "" if it was written to dest.Writer.
+// - error: An error object if downloading or decrypting fails, or ctx.Err() if it was cancelled.
+func DownloadSharedFile(ctx context.Context, shareLink string, servers []string, dest file.Destination) (string, error) {
+	fileHash, key, err := file.ParseShareLink(shareLink)
+	if err != nil {
+		return "", err
+	}
+	if dest.Path != "" {
+		// The name of the file is encrypted, so only an exact output path can be checked before downloading.
+		if _, err := dest.Target(""); err != nil {
+			return "", err
+		}
+	}
+	if err := downloadFileChunks(ctx, fileHash, servers); err != nil {
+		return "", err
+	}
+
+	outputPath, err := file.ReconstructEncryptedFile(Store, dest, fileHash, key)
 	if err != nil {
-		return fmt.Errorf("failed to fetch catalog from server: %w", err)
+		return "", fmt.Errorf("failed to decrypt file: %w", err)
 	}
 
-	var fileChunks []string
-	for _, file := range catalog.Files {
-		if file.Hash == fileHash {
-			fileChunks = file.Chunks
+	util.Logger.Printf("Successfully downloaded and decrypted shared file %s", fileHash)
+	return outputPath, nil
+}
+
+// downloadFileChunks downloads every chunk of a file the local store does not hold yet, distributing
+// them across the given servers, and stores the file's manifest once all chunks are present.
+func downloadFileChunks(ctx context.Context, fileHash string, servers []string) error {
+	entry, servers, err := findFile(fileHash, servers)
+	if err != nil {
+		return err
+	}
+	return downloadEntryChunks(ctx, entry, servers)
+}
+
+// downloadEntryChunks downloads the chunks of a catalog entry into the local store and stores its manifest.
+func downloadEntryChunks(ctx context.Context, entry *FileMetadata, servers []string) error {
+	if err := putProvisionalManifest(entry); err != nil {
+		return err
+	}
+
+	// Chunks are content-addressed, so chunks already held locally (for this or any other file)
+	// and chunks repeated within the file are only downloaded once.
+	fileChunks := missingChunks(entry.Chunks)
+	util.Logger.Printf("File %s has %d chunks, %d missing locally", entry.Hash, len(entry.Chunks), len(fileChunks))
+
+	if err := downloadChunks(ctx, entry, servers, fileChunks, Store.Put); err != nil {
+		if ctx.Err() != nil || entry.Chunking.DataShards == 0 {
+			return err
+		}
+		util.Logger.Printf("Failed to download every chunk of %s, recovering from parity: %v", entry.Hash, err)
+		if err := recoverEntryChunks(ctx, entry, servers, Store, Store.Put); err != nil {
+			return err
+		}
+	}
+
+	// Record the manifest so the file can be reconstructed and its chunks stay referenced.
+	return Store.PutManifest(entry.manifest())
+}
+
+// putProvisionalManifest stores the provisional manifest of a file about to be downloaded, so that
+// garbage collection keeps the chunks fetched so far, unless the file already has a complete manifest.
+// The provisional manifest of an earlier, interrupted download is replaced to restart its clock.
+func putProvisionalManifest(entry *FileMetadata) error {
+	existing, err := Store.GetManifest(entry.Hash)
+	if err == nil && existing.Downloading == nil {
+		return nil
+	}
+	if err != nil && !errors.Is(err, file.ErrManifestNotFound) {
+		return err
+	}
+	manifest := entry.manifest()
+	started := time.Now()
+	manifest.Downloading = &started
+	return Store.PutManifest(manifest)
+}
+
+// downloadFileInPlace downloads a file directly to its destination: the file is preallocated and every
+// chunk is written at its offset as soon as it is verified, next to a completion map that lets an
+// interrupted download resume. The chunks are not kept in the chunk store, which saves the disk
+// space and the extra pass of a reconstruction. Files whose manifest does not declare chunk sizes
+// are downloaded through the chunk store instead.
+//
+// Parameters:
+// - entry: The catalog entry of the file to download.
+// - dest: Where to write the file; dest.Writer must be nil.
+// - servers: The addresses of the servers sharing the file.
+//
+// Returns:
+// - string: The path of the downloaded file.
+// - error: An error object if the download fails.
+func downloadFileInPlace(ctx context.Context, entry *FileMetadata, dest file.Destination, servers []string) (string, error) {
+	fileHash := entry.Hash
+	if len(entry.ChunkSizes) == 0 {
+		util.Logger.Printf("Manifest of %s declares no chunk sizes, downloading through the chunk store", fileHash)
+		if err := downloadEntryChunks(ctx, entry, servers); err != nil {
+			return "", err
+		}
+		outputPath, err := file.ReconstructFile(Store, dest, fileHash)
+		if err != nil {
+			return "", fmt.Errorf("failed to reconstruct file: %w", err)
+		}
+		return outputPath, nil
+	}
+
+	outputPath, err := dest.Target(entry.Name)
+	if err != nil {
+		return "", err
+	}
+	partial, err := file.OpenPartialFile(outputPath, entry.manifest(), dest.Overwrite)
+	if err != nil {
+		return "", err
+	}
+	defer partial.Close()
+
+	// Chunks the local store already holds are copied from it rather than downloaded.
+	for _, chunkID := range partial.Missing() {
+		if !Store.Has(chunkID) {
+			continue
+		}
+		chunk, err := Store.Get(chunkID)
+		if err != nil {
+			continue
+		}
+		_, err = partial.WriteChunk(chunkID, chunk)
+		chunk.Close()
+		if err != nil {
+			util.Logger.Printf("Failed to copy chunk %s from the chunk store: %v", chunkID, err)
+		}
+	}
+
+	fileChunks := partial.Missing()
+	util.Logger.Printf("File %s has %d chunks, %d still to download", fileHash, len(entry.Chunks), len(fileChunks))
+	if err := downloadChunks(ctx, entry, servers, fileChunks, partial.WriteChunk); err != nil {
+		if ctx.Err() != nil || entry.Chunking.DataShards == 0 {
+			return "", err
+		}
+		// Parity chunks go to the chunk store, where garbage collection reclaims them as unreferenced.
+		util.Logger.Printf("Failed to download every chunk of %s, recovering from parity: %v", fileHash, err)
+		if err := recoverEntryChunks(ctx, entry, servers, shardSources{partial, Store}, partial.WriteChunk); err != nil {
+			return "", err
+		}
+	}
+	return partial.Complete()
+}
+
+// recoverEntryChunks recovers the data chunks of an erasure-coded file that could not be
+// downloaded: the parity chunks of the incomplete groups are downloaded into the chunk store,
+// as many as the servers can provide, and every missing data chunk is rebuilt from any k
+// chunks of its group and handed to save.
+func recoverEntryChunks(ctx context.Context, entry *FileMetadata, servers []string, source file.ShardSource, save chunkSink) error {
+	manifest := entry.manifest()
+	parity := file.MissingParity(manifest, source)
+	if len(parity) > 0 {
+		// Some parity chunks may be unavailable too; recovery only needs k chunks per group.
+		if err := downloadChunks(ctx, entry, servers, parity, Store.Put); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			util.Logger.Printf("Failed to download some parity chunks of %s: %v", entry.Hash, err)
+		}
+	}
+	if err := file.RecoverChunks(manifest, source, save); err != nil {
+		return fmt.Errorf("failed to recover chunks of %s: %w", entry.Hash, err)
+	}
+	util.Logger.Printf("Recovered the missing chunks of %s from parity", entry.Hash)
+	return nil
+}
+
+// shardSources combines the places holding the chunks of a file into one file.ShardSource.
+type shardSources []file.ShardSource
+
+// Has implements file.ShardSource.
+func (s shardSources) Has(chunkHash string) bool {
+	for _, source := range s {
+		if source.Has(chunkHash) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get implements file.ShardSource, reading the chunk from the first source holding it.
+func (s shardSources) Get(chunkHash string) (io.ReadCloser, error) {
+	for _, source := range s {
+		if source.Has(chunkHash) {
+			return source.Get(chunkHash)
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", file.ErrChunkNotFound, chunkHash)
+}
+
+// findFile looks a file up in the catalog of the first server that answers.
+//
+// Returns:
+// - *FileMetadata: The catalog entry of the file.
+// - []string: The servers that are not banned, best first.
+// - error: An error object if no server answers or the file is not found.
+func findFile(fileHash string, servers []string) (*FileMetadata, []string, error) {
+	if err := file.ValidateFileHash(fileHash); err != nil {
+		return nil, nil, err
+	}
+	if len(servers) == 0 {
+		return nil, nil, fmt.Errorf("no servers specified")
+	}
+
+	// Skip banned servers and try the most reputable ones first.
+	servers = PeerReputation.Rank(servers)
+	if len(servers) == 0 {
+		return nil, nil, fmt.Errorf("all servers are banned")
+	}
+
+	// Fetch metadata for the file from the first server that answers.
+	var catalog *FileCatalog
+	var err error
+	for _, server := range servers {
+		catalog, err = fetchCatalog(server)
+		if err == nil {
 			break
 		}
+		PeerReputation.RecordError(server, err)
 	}
-	if len(fileChunks) == 0 {
-		return fmt.Errorf("file with hash %s not found on servers", fileHash)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch catalog from server: %w", err)
 	}
 
-	// Distribute chunks across servers in a round-robin manner.
-	chunkToServer := make(map[string]string)
-	for i, chunk := range fileChunks {
-		chunkToServer[chunk] = servers[i%len(servers)]
+	for i := range catalog.Files {
+		if catalog.Files[i].Hash == fileHash {
+			entry := catalog.Files[i] // Catalogs may be shared by the catalog cache.
+			return &entry, servers, nil
+		}
 	}
+	return nil, nil, fmt.Errorf("file with hash %s not found on servers", fileHash)
+}
 
-	// Display progress to the user.
-	progress := make(chan string, len(fileChunks))
-	defer close(progress)
-	go func() {
-		for msg := range progress {
-			fmt.Println(msg)
+// downloadChunks downloads the given chunks of a file in parallel, distributing them across servers
+// in a round-robin manner, and hands each chunk's data to save as it arrives. The download is
+// reported to the reporter of ctx, and takes its slots from the scheduler of ctx if it has one.
+// Cancelling ctx interrupts the chunks being downloaded and skips the others.
+func downloadChunks(ctx context.Context, entry *FileMetadata, servers []string, chunks []string, save chunkSink) error {
+	chunkSizes := entry.chunkSizes()
+	progress := progressFor(ctx)
+	if progress != nil {
+		info := DownloadInfo{FileHash: entry.Hash, Name: entry.Name, Chunks: len(chunks)}
+		for _, chunk := range chunks {
+			info.Bytes += chunkSizes[chunk]
 		}
-	}()
+		progress.DownloadStarted(info)
+	}
 
-	// Download chunks in parallel.
-	chunkQueue := make(chan string, len(fileChunks))
-	errChan := make(chan error, len(fileChunks))
+	chunkQueue := make(chan chunkJob, len(chunks))
+	errChan := make(chan error, len(chunks))
 	var wg sync.WaitGroup
 
-	for chunk, server := range chunkToServer {
-		chunkQueue <- fmt.Sprintf("%s|%s", server, chunk) // Encode server and chunk.
+	// The manifest declares the size of each chunk, which bounds how much a server may send for it.
+	for i, chunk := range chunks {
+		chunkQueue <- chunkJob{fileHash: entry.Hash, chunkID: chunk, size: chunkSizes[chunk], first: i % len(servers), save: save, progress: progress}
 	}
 	close(chunkQueue)
 
-	numWorkers := 10 // Adjust as needed.
-	for i := 0; i < numWorkers; i++ {
+	for i := 0; i < DownloadWorkers; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			for job := range chunkQueue {
-				parts := strings.Split(job, "|")
-				server, chunk := parts[0], parts[1]
-				err := downloadChunkFromServer(server, chunk, fileHash, progress)
+				if ctx.Err() != nil {
+					continue
+				}
+				release, err := acquireSlot(ctx)
+				if err != nil {
+					continue
+				}
+				err = downloadChunkWithRetry(ctx, servers, job)
+				release()
 				if err != nil {
 					errChan <- err
 				}
@@ -85,78 +378,98 @@ func DownloadFileFromMultipleServers(fileHash string, fileName string, servers [
 
 	wg.Wait()
 	close(errChan)
+	if err := PeerReputation.Save(); err != nil {
+		util.Logger.Printf("Failed to save peer reputation: %v", err)
+	}
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	for err := range errChan {
 		if err != nil {
 			return fmt.Errorf("error during chunk download: %w", err)
 		}
 	}
-
-	// Reconstruct the file after all chunks are downloaded.
-	outputDir := "downloads"
-	err = file.ReconstructFile(outputDir, fileHash)
-	if err != nil {
-		fmt.Printf("Failed to reconstruct file: %v\n", err)
-	}
-
-	util.Logger.Printf("Successfully downloaded and reconstructed file: %s", fileName)
 	return nil
 }
 
-func RequestFileCatalog(servers []string) {
-	for _, address := range servers {
-		conn, err := net.Dial("tcp", address)
-		if err != nil {
-			util.Logger.Printf("Failed to connect to server at %s: %v", address, err)
-			fmt.Printf("Failed to connect to server at %s. Check logs for details.\n", address)
+// missingChunks returns the distinct chunks, in order, that the local store does not hold.
+func missingChunks(chunks []string) []string {
+	missing := []string{}
+	seen := make(map[string]bool)
+	for _, chunk := range chunks {
+		if seen[chunk] || Store.Has(chunk) {
 			continue
 		}
-		defer conn.Close()
+		seen[chunk] = true
+		missing = append(missing, chunk)
+	}
+	return missing
+}
 
-		// Send a FILE_CATALOG_REQUEST message.
-		request := Message{Type: FileCatalogRequest}
-		data, err := EncodeMessage(request)
-		if err != nil {
-			util.Logger.Printf("Failed to encode FILE_CATALOG_REQUEST: %v", err)
-			continue
-		}
-		_, _ = conn.Write(append(data, '\n'))
-		util.Logger.Printf("Requested file catalog from server at %s", address)
+// chunkSink receives the data of a downloaded chunk, verifying it against the chunk ID.
+// It returns an error wrapping file.ErrChunkHashMismatch if the data does not match.
+type chunkSink func(chunkID string, r io.Reader) (int64, error)
+
+// chunkJob describes a chunk to download and the index of the server to try first.
+type chunkJob struct {
+	fileHash string
+	chunkID  string
+	size     int64 // Size declared by the manifest, or 0 if unknown.
+	first    int
+	save     chunkSink        // Where the chunk data goes.
+	progress ProgressReporter // Where the download is reported, or nil.
+}
 
-		// Read the file catalog response.
-		reader := bufio.NewReader(conn)
-		response, err := reader.ReadString('\n')
-		if err != nil {
-			util.Logger.Printf("Failed to read file catalog response from server at %s: %v", address, err)
+// downloadChunkWithRetry downloads a chunk from its assigned server, falling back to the other
+// servers when it fails. Every attempt is recorded in the peer reputation, so servers serving
+// corrupt data or timing out get banned and are skipped by later downloads.
+func downloadChunkWithRetry(ctx context.Context, servers []string, job chunkJob) error {
+	var lastErr error
+	for attempt := 0; attempt < len(servers); attempt++ {
+		server := servers[(job.first+attempt)%len(servers)]
+		if PeerReputation.IsBanned(server) {
 			continue
 		}
 
-		respMsg, decodeErr := DecodeMessage([]byte(response))
-		if decodeErr != nil {
-			util.Logger.Printf("Failed to decode file catalog response from server at %s: %v", address, decodeErr)
-			continue
+		start := time.Now()
+		size, err := downloadChunkFromServer(ctx, server, job)
+		elapsed := time.Since(start)
+		if ctx.Err() != nil {
+			// The download was cancelled, which says nothing about the server.
+			return ctx.Err()
 		}
-
-		if respMsg.Type != FileCatalogResponse {
-			util.Logger.Printf("Unexpected response type: %s", respMsg.Type)
-			fmt.Printf("Unexpected response type: %s\n", respMsg.Type)
-			continue
+		if job.progress != nil {
+			job.progress.ChunkFinished(ChunkEvent{FileHash: job.fileHash, ChunkID: job.chunkID, Server: server, Size: size, Duration: elapsed, Err: err})
 		}
-
-		var catalog FileCatalog
-		payloadBytes, _ := json.Marshal(respMsg.Payload)
-		_ = json.Unmarshal(payloadBytes, &catalog)
-
-		// Display the catalog for the server.
-		fmt.Printf("Received File Catalog from server %s:\n", address)
-		for _, file := range catalog.Files {
-			fmt.Printf("- %s (Size: %d bytes, Chunks: %d, Hash: %s)\n", file.Name, file.Size, len(file.Chunks), file.Hash)
+		if err == nil {
+			PeerReputation.RecordSuccess(server, size, elapsed)
+			return nil
 		}
-		util.Logger.Printf("Successfully received and displayed file catalog from server %s", address)
+		PeerReputation.RecordError(server, err)
+		util.Logger.Printf("Attempt to download chunk %s from %s failed: %v", job.chunkID, server, err)
+		lastErr = err
 	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no available server for chunk %s", job.chunkID)
+	}
+	return lastErr
 }
 
-func downloadChunk(conn net.Conn, chunkID string) ([]byte, error) {
+// downloadChunk requests a chunk over an established connection and streams it into a chunk sink.
+// The manifest declares the chunk size; the data must have that size and hash to the chunk ID.
+//
+// Parameters:
+// - conn: The connection to the server, after the handshake.
+// - chunkID: The ID of the chunk to download.
+// - chunkSize: The size of the chunk declared by the manifest, or 0 if unknown.
+// - encoding: The chunk encoding negotiated in the handshake, or "".
+// - save: Where to stream the chunk data.
+//
+// Returns:
+// - int64: The number of bytes received.
+// - error: An error wrapping ErrCorruptChunk if the server sent invalid data, or another error.
+func downloadChunk(conn net.Conn, chunkID string, chunkSize int64, encoding string, save chunkSink) (int64, error) {
 	// Send a CHUNK_REQUEST for the specified chunk.
 	request := Message{
 		Type: ChunkRequest,
@@ -167,42 +480,94 @@ func downloadChunk(conn net.Conn, chunkID string) ([]byte, error) {
 	data, err := EncodeMessage(request)
 	if err != nil {
 		util.Logger.Printf("Failed to encode CHUNK_REQUEST: %v", err)
-		return nil, err
+		return 0, err
 	}
 	_, _ = conn.Write(append(data, '\n'))
 	util.Logger.Printf("Requested chunk %s", chunkID)
 
-	// Read the CHUNK_RESPONSE.
+	// Read the CHUNK_RESPONSE header; the chunk data follows it.
 	reader := bufio.NewReader(conn)
-	response, err := reader.ReadString('\n')
+	response, err := readMessage(reader, maxResponseSize)
 	if err != nil {
 		util.Logger.Printf("Failed to read CHUNK_RESPONSE for chunk %s: %v", chunkID, err)
-		return nil, err
+		return 0, err
 	}
 
-	respMsg, decodeErr := DecodeMessage([]byte(response))
+	respMsg, decodeErr := DecodeMessage(response)
 	if decodeErr != nil {
 		util.Logger.Printf("Failed to decode CHUNK_RESPONSE for chunk %s: %v", chunkID, decodeErr)
-		return nil, decodeErr
+		return 0, decodeErr
 	}
 
-	if respMsg.Type != ChunkResponse {
-		util.Logger.Printf("Unexpected response type: %s", respMsg.Type)
-		return nil, fmt.Errorf("unexpected response type: %s", respMsg.Type)
+	if err := checkResponse(respMsg, ChunkResponse); err != nil {
+		util.Logger.Printf("Failed to get chunk %s: %v", chunkID, err)
+		return 0, err
 	}
 
-	// Validate the chunk data and hash.
 	var chunkPayload ChunkResponsePayload
-	payloadBytes, _ := json.Marshal(respMsg.Payload)
-	_ = json.Unmarshal(payloadBytes, &chunkPayload)
+	if err := decodePayload(respMsg, &chunkPayload); err != nil {
+		util.Logger.Printf("Failed to decode CHUNK_RESPONSE for chunk %s: %v", chunkID, err)
+		return 0, err
+	}
+	if chunkPayload.ChunkID != chunkID {
+		util.Logger.Printf("Received chunk %q while requesting chunk %s", chunkPayload.ChunkID, chunkID)
+		return 0, fmt.Errorf("received chunk %q while requesting chunk %s", chunkPayload.ChunkID, chunkID)
+	}
+	if chunkPayload.Size <= 0 || chunkPayload.Size > file.MaxChunkSize || (chunkSize > 0 && chunkPayload.Size != chunkSize) {
+		util.Logger.Printf("Chunk %s announced with %d bytes instead of %d", chunkID, chunkPayload.Size, chunkSize)
+		return 0, fmt.Errorf("%w for chunk %s: unexpected size %d", ErrCorruptChunk, chunkID, chunkPayload.Size)
+	}
 
-	if util.CalculateHash(chunkPayload.Data) != chunkPayload.Hash {
-		util.Logger.Printf("Integrity check failed for chunk %s", chunkPayload.ChunkID)
-		return nil, fmt.Errorf("integrity check failed for chunk %s", chunkPayload.ChunkID)
+	chunkData, finish, err := decompressChunk(reader, chunkPayload.Encoding, encoding)
+	if err != nil {
+		util.Logger.Printf("Failed to decompress chunk %s: %v", chunkID, err)
+		return 0, err
 	}
 
-	util.Logger.Printf("Successfully received and validated chunk %s", chunkPayload.ChunkID)
-	return chunkPayload.Data, nil
+	// Chunks are content-addressed: the sink verifies that the uncompressed data hashes to the
+	// chunk ID we asked for, whatever hash the server claims, and discards it otherwise.
+	n, err := save(chunkID, &exactReader{r: chunkData, remaining: chunkPayload.Size})
+	if errors.Is(err, file.ErrChunkHashMismatch) || corruptCompression(err) {
+		util.Logger.Printf("Integrity check failed for chunk %s", chunkID)
+		return 0, fmt.Errorf("%w for chunk %s", ErrCorruptChunk, chunkID)
+	}
+	if err != nil {
+		util.Logger.Printf("Failed to receive chunk %s: %v", chunkID, err)
+		return 0, err
+	}
+	if err := finish(); err != nil {
+		util.Logger.Printf("Failed to receive chunk %s: %v", chunkID, err)
+		return 0, err
+	}
+
+	util.Logger.Printf("Successfully received and validated chunk %s", chunkID)
+	return n, nil
+}
+
+// exactReader reads exactly remaining bytes from r. Unlike io.LimitReader it reports a stream
+// ending early as io.ErrUnexpectedEOF, so that a dropped connection is not mistaken for corrupt data.
+type exactReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+// Read implements io.Reader.
+func (e *exactReader) Read(p []byte) (int, error) {
+	if e.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > e.remaining {
+		p = p[:e.remaining]
+	}
+	n, err := e.r.Read(p)
+	e.remaining -= int64(n)
+	if err == io.EOF && e.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
 }
 
 // FetchFileCatalogs fetches catalogs from multiple servers and maps file hashes to servers.
@@ -227,77 +592,206 @@ func FetchFileCatalogs(servers []string) (map[string][]string, error) {
 	return fileSources, nil
 }
 
-func fetchCatalog(address string) (*FileCatalog, error) {
-	conn, err := net.Dial("tcp", address)
-	if err != nil {
-		util.Logger.Printf("Failed to connect to server at %s: %v", address, err)
-		return nil, err
-	}
-	defer conn.Close()
+// CatalogEntry is a file of the merged catalogs of several servers.
+type CatalogEntry struct {
+	FileMetadata
+	Servers []string `json:"servers"` // Servers sharing the file.
+}
 
-	request := Message{Type: FileCatalogRequest}
-	data, err := EncodeMessage(request)
-	if err != nil {
-		util.Logger.Printf("Failed to encode FILE_CATALOG_REQUEST: %v", err)
-		return nil, err
+// ServerAvailability describes whether a server answered a catalog request.
+type ServerAvailability struct {
+	Address   string // Address of the server.
+	Available bool   // Whether the server sent its catalog.
+	Files     int    // Number of files in its catalog.
+	Err       error  // Why the catalog could not be fetched, or nil.
+}
+
+// FetchMergedCatalog fetches the catalogs of several servers and merges their entries by file hash.
+//
+// Parameters:
+// - servers: The addresses of the servers.
+//
+// Returns:
+// - []CatalogEntry: The files shared by at least one server, sorted by name then hash.
+// - []ServerAvailability: Whether each server answered, in the order given.
+// - error: An error object if no server answered.
+func FetchMergedCatalog(servers []string) ([]CatalogEntry, []ServerAvailability, error) {
+	entries := make(map[string]*CatalogEntry)
+	availability := make([]ServerAvailability, 0, len(servers))
+	var lastErr error
+	answered := 0
+	for _, server := range servers {
+		catalog, err := fetchCatalog(server)
+		if err != nil {
+			util.Logger.Printf("Failed to fetch catalog from %s: %v", server, err)
+			availability = append(availability, ServerAvailability{Address: server, Err: err})
+			lastErr = err
+			continue
+		}
+		answered++
+		availability = append(availability, ServerAvailability{Address: server, Available: true, Files: len(catalog.Files)})
+		for _, metadata := range catalog.Files {
+			entry, ok := entries[metadata.Hash]
+			if !ok {
+				entry = &CatalogEntry{FileMetadata: metadata}
+				entries[metadata.Hash] = entry
+			}
+			// A server sharing the same content under several paths is listed once.
+			if n := len(entry.Servers); n == 0 || entry.Servers[n-1] != server {
+				entry.Servers = append(entry.Servers, server)
+			}
+		}
+	}
+	if answered == 0 && lastErr != nil {
+		return nil, availability, fmt.Errorf("no server answered: %w", lastErr)
 	}
-	_, _ = conn.Write(append(data, '\n'))
-	util.Logger.Printf("Requested file catalog from server at %s", address)
 
-	reader := bufio.NewReader(conn)
-	response, err := reader.ReadString('\n')
-	if err != nil {
-		util.Logger.Printf("Failed to read file catalog response: %v", err)
-		return nil, err
+	merged := make([]CatalogEntry, 0, len(entries))
+	for _, entry := range entries {
+		merged = append(merged, *entry)
 	}
+	sort.Slice(merged, func(i, j int) bool {
+		if merged[i].Name != merged[j].Name {
+			return merged[i].Name < merged[j].Name
+		}
+		return merged[i].Hash < merged[j].Hash
+	})
+	return merged, availability, nil
+}
 
-	respMsg, decodeErr := DecodeMessage([]byte(response))
-	if decodeErr != nil {
-		util.Logger.Printf("Failed to decode file catalog response: %v", decodeErr)
-		return nil, decodeErr
+// MatchCatalog returns the entries of a merged catalog whose file matches a name or glob pattern.
+// A pattern containing a slash is matched against the path of the file in the shared directory,
+// any other pattern against its name, using the syntax of path.Match.
+//
+// Parameters:
+// - entries: The merged catalog.
+// - pattern: A file name, a path, or a glob pattern such as "*.pdf" or "docs/*".
+//
+// Returns:
+// - []CatalogEntry: The matching entries, in catalog order.
+// - error: An error wrapping path.ErrBadPattern if the pattern is malformed.
+func MatchCatalog(entries []CatalogEntry, pattern string) ([]CatalogEntry, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
 	}
+	matches := []CatalogEntry{}
+	for _, entry := range entries {
+		subject := entry.Name
+		if strings.Contains(pattern, "/") && entry.Path != "" {
+			subject = entry.Path
+		}
+		if ok, _ := path.Match(pattern, subject); ok {
+			matches = append(matches, entry)
+		}
+	}
+	return matches, nil
+}
 
-	if respMsg.Type != FileCatalogResponse {
-		util.Logger.Printf("Unexpected response type: %s", respMsg.Type)
-		return nil, fmt.Errorf("unexpected response type: %s", respMsg.Type)
+// fetchCatalog returns the catalog of a server, from the catalog cache if it holds a recent one.
+func fetchCatalog(address string) (*FileCatalog, error) {
+	if catalog := catalogs.get(address); catalog != nil {
+		return catalog, nil
 	}
 
 	var catalog FileCatalog
-	payloadBytes, _ := json.Marshal(respMsg.Payload)
-	_ = json.Unmarshal(payloadBytes, &catalog)
+	err := connections.do(context.Background(), address, func(c *pooledConn) error {
+		request := Message{Type: FileCatalogRequest}
+		data, err := EncodeMessage(request)
+		if err != nil {
+			util.Logger.Printf("Failed to encode FILE_CATALOG_REQUEST: %v", err)
+			return err
+		}
+		if _, err := c.Write(append(data, '\n')); err != nil {
+			return fmt.Errorf("failed to send FILE_CATALOG_REQUEST: %w", err)
+		}
+		util.Logger.Printf("Requested file catalog from server at %s", address)
+
+		response, err := readMessage(bufio.NewReader(c), maxResponseSize)
+		if err != nil {
+			util.Logger.Printf("Failed to read file catalog response: %v", err)
+			return err
+		}
+		respMsg, err := DecodeMessage(response)
+		if err != nil {
+			util.Logger.Printf("Failed to decode file catalog response: %v", err)
+			return err
+		}
+		if err := checkResponse(respMsg, FileCatalogResponse); err != nil {
+			util.Logger.Printf("Failed to get file catalog from %s: %v", address, err)
+			return err
+		}
+		if err := decodePayload(respMsg, &catalog); err != nil {
+			util.Logger.Printf("Failed to decode file catalog from %s: %v", address, err)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		util.Logger.Printf("Failed to fetch file catalog from %s: %v", address, err)
+		return nil, err
+	}
+	sanitizeCatalog(&catalog, address)
 	util.Logger.Printf("Received file catalog from %s: %+v", address, catalog)
+	catalogs.put(address, &catalog)
 	return &catalog, nil
 }
 
-func downloadChunkFromServer(server string, chunkID string, fileHash string, progress chan<- string) error {
-	conn, err := net.Dial("tcp", server)
+// downloadChunkFromServer downloads a single chunk from a server and saves it, returning its size.
+func downloadChunkFromServer(ctx context.Context, server string, job chunkJob) (int64, error) {
+	var size int64
+	err := connections.do(ctx, server, func(c *pooledConn) error {
+		var err error
+		size, err = downloadChunk(c, job.chunkID, job.size, c.encoding, reportingSink(throttledSink(ctx, job.save), job.progress, server))
+		if err != nil {
+			return fmt.Errorf("failed to download chunk %s from server %s: %w", job.chunkID, server, err)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to connect to server %s: %w", server, err)
+		return 0, err
 	}
-	defer conn.Close()
+	return size, nil
+}
 
-	chunkData, err := downloadChunk(conn, chunkID)
+// handshake introduces this node to a server by exchanging HELLO messages.
+// The offered chunk encodings let the server compress the chunks it sends.
+//
+// Returns:
+// - string: The chunk encoding the server chose, or "" for raw chunks.
+// - error: An error object if the exchange fails.
+func handshake(conn net.Conn) (string, error) {
+	request := Message{
+		Type:    Hello,
+		Payload: Metadata{PeerID: LocalPeerID, Compression: offeredCompression()},
+	}
+	data, err := EncodeMessage(request)
 	if err != nil {
-		return fmt.Errorf("failed to download chunk %s from server %s: %w", chunkID, server, err)
+		return "", err
+	}
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		return "", fmt.Errorf("failed to send HELLO: %w", err)
 	}
 
-	err = saveChunk(chunkID, fileHash, chunkData)
+	response, err := readMessage(bufio.NewReader(conn), maxResponseSize)
 	if err != nil {
-		return fmt.Errorf("failed to save chunk %s: %w", chunkID, err)
+		return "", fmt.Errorf("failed to read HELLO: %w", err)
 	}
-
-	progress <- fmt.Sprintf("Downloaded chunk %s from server %s", chunkID, server)
-	return nil
-}
-
-func saveChunk(chunkID string, fileHash string, data []byte) error {
-	// Use the file hash to organize chunks.
-	chunksDir := fmt.Sprintf("chunks/%s", fileHash)
-	err := os.MkdirAll(chunksDir, 0755)
+	respMsg, err := DecodeMessage(response)
 	if err != nil {
-		return fmt.Errorf("failed to create chunks directory: %w", err)
+		return "", err
+	}
+	if err := checkResponse(respMsg, Hello); err != nil {
+		return "", err
 	}
 
-	chunkPath := fmt.Sprintf("%s/%s", chunksDir, chunkID)
-	return os.WriteFile(chunkPath, data, 0644)
+	var server Metadata
+	if err := decodePayload(respMsg, &server); err != nil {
+		return "", err
+	}
+	encoding := ""
+	if len(server.Compression) > 0 {
+		encoding = server.Compression[0]
+	}
+	util.Logger.Printf("Connected to server %s (peer ID %q, compression %q)", conn.RemoteAddr(), server.PeerID, encoding)
+	return encoding, nil
 }
@@ -0,0 +1,86 @@
+// Package peer manages peer connectivity and server file catalog functionality.
+// This file keeps track of the peers connected to the server of this node and of the chunks
+// being uploaded to them, for the user interfaces of a long-running node.
+package peer
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ClientInfo describes a peer connected to the server of this node.
+type ClientInfo struct {
+	Address   string    `json:"address"`
+	PeerID    string    `json:"peer_id,omitempty"` // Peer ID announced by the peer, if any.
+	Connected time.Time `json:"connected"`
+	Chunks    int       `json:"chunks"`              // Chunks sent to the peer.
+	Bytes     int64     `json:"bytes"`               // Bytes of chunk data sent, as sent on the wire.
+	Uploading string    `json:"uploading,omitempty"` // Chunk being sent, if any.
+}
+
+// clientState is the live state of a connected peer, updated by its connection and read by ConnectedClients.
+type clientState struct {
+	mu   sync.Mutex
+	info ClientInfo
+}
+
+// clients holds the peers connected to the server.
+var clients = struct {
+	mu    sync.Mutex
+	peers map[*clientState]bool
+}{peers: make(map[*clientState]bool)}
+
+// connectClient records a peer connecting to the server and returns its state.
+func connectClient(address string) *clientState {
+	client := &clientState{info: ClientInfo{Address: address, Connected: time.Now()}}
+	clients.mu.Lock()
+	clients.peers[client] = true
+	clients.mu.Unlock()
+	return client
+}
+
+// disconnect forgets a peer that disconnected from the server.
+func (c *clientState) disconnect() {
+	clients.mu.Lock()
+	delete(clients.peers, c)
+	clients.mu.Unlock()
+}
+
+// identify records the peer ID announced by the peer.
+func (c *clientState) identify(peerID string) {
+	c.mu.Lock()
+	c.info.PeerID = peerID
+	c.mu.Unlock()
+}
+
+// upload records a chunk being sent to the peer by send, which returns the bytes it sent. The
+// bytes are counted once the chunk is sent, so that the copy can still use sendfile.
+func (c *clientState) upload(chunkID string, send func() (int64, error)) error {
+	c.mu.Lock()
+	c.info.Uploading = chunkID
+	c.mu.Unlock()
+	n, err := send()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.info.Uploading = ""
+	c.info.Bytes += n
+	if err == nil {
+		c.info.Chunks++
+	}
+	return err
+}
+
+// ConnectedClients returns the peers connected to the server of this node, in the order they connected.
+func ConnectedClients() []ClientInfo {
+	clients.mu.Lock()
+	result := make([]ClientInfo, 0, len(clients.peers))
+	for client := range clients.peers {
+		client.mu.Lock()
+		result = append(result, client.info)
+		client.mu.Unlock()
+	}
+	clients.mu.Unlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].Connected.Before(result[j].Connected) })
+	return result
+}
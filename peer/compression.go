@@ -0,0 +1,204 @@
+// Package peer manages peer connectivity and server file catalog functionality.
+// This file contains the transparent compression of chunk data on the wire. Peers offer the
+// encodings they accept in their HELLO and the server picks one; chunks are then compressed one by
+// one, unless a sample of the chunk shows the data does not compress. Chunk IDs and the sizes
+// declared in CHUNK_RESPONSE always refer to the uncompressed data, so integrity checks are unchanged.
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// CompressionGzip is the gzip chunk encoding.
+const CompressionGzip = "gzip"
+
+// Compression is the chunk encoding this node offers as a client and accepts as a server,
+// or "" to always transfer raw chunks.
+var Compression = CompressionGzip
+
+// compressionSampleSize is how much of a chunk is compressed to decide whether the whole chunk is worth compressing.
+const compressionSampleSize = 64 * 1024
+
+// compressionBlockSize is the size of the blocks read from a chunk while compressing it.
+const compressionBlockSize = 32 * 1024
+
+// ValidateCompression checks that a chunk encoding is supported.
+//
+// Parameters:
+// - encoding: The encoding to validate; "" means no compression.
+//
+// Returns:
+// - error: An error if the encoding is not supported, or nil.
+func ValidateCompression(encoding string) error {
+	if encoding != "" && encoding != CompressionGzip {
+		return fmt.Errorf("unsupported compression %q", encoding)
+	}
+	return nil
+}
+
+// offeredCompression returns the encodings this node announces in its HELLO.
+func offeredCompression() []string {
+	if Compression == "" {
+		return nil
+	}
+	return []string{Compression}
+}
+
+// negotiateCompression picks the encoding a server uses with a peer offering the given encodings.
+func negotiateCompression(offered []string) string {
+	for _, encoding := range offered {
+		if Compression != "" && encoding == Compression {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// compressChunk prepares the body of a CHUNK_RESPONSE. The start of the chunk is compressed as a
+// sample: if it shrinks by less than a tenth, the data is most likely already compressed or
+// encrypted, and the chunk is sent raw.
+//
+// Parameters:
+// - chunk: The chunk data.
+// - encoding: The encoding negotiated with the peer, or "".
+//
+// Returns:
+// - io.Reader: The body to send.
+// - string: The encoding of the body, or "" if it is raw.
+// - error: An error object if the sample cannot be read.
+func compressChunk(chunk io.Reader, encoding string) (io.Reader, string, error) {
+	if encoding == "" {
+		return chunk, "", nil
+	}
+
+	sample := make([]byte, compressionSampleSize)
+	n, err := io.ReadFull(chunk, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, "", err
+	}
+	sample = sample[:n]
+	body := io.MultiReader(bytes.NewReader(sample), chunk)
+
+	var compressed countingWriter
+	writer, _ := gzip.NewWriterLevel(&compressed, gzip.BestSpeed)
+	writer.Write(sample)
+	writer.Close()
+	if n == 0 || compressed.n*10 > int64(n)*9 {
+		return body, "", nil
+	}
+	return newGzipReader(body), encoding, nil
+}
+
+// countingWriter counts the bytes written to it and discards them.
+type countingWriter struct {
+	n int64
+}
+
+// Write implements io.Writer.
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// gzipReader compresses a stream as it is read, a block at a time, so that a chunk is never held
+// in memory whole.
+type gzipReader struct {
+	source     io.Reader
+	block      []byte
+	compressed bytes.Buffer
+	writer     *gzip.Writer
+	done       bool
+}
+
+// newGzipReader creates a reader of the gzip compression of source.
+func newGzipReader(source io.Reader) *gzipReader {
+	g := &gzipReader{source: source, block: make([]byte, compressionBlockSize)}
+	g.writer, _ = gzip.NewWriterLevel(&g.compressed, gzip.BestSpeed)
+	return g
+}
+
+// Read implements io.Reader.
+func (g *gzipReader) Read(p []byte) (int, error) {
+	for g.compressed.Len() == 0 {
+		if g.done {
+			return 0, io.EOF
+		}
+		n, err := g.source.Read(g.block)
+		if n > 0 {
+			if _, err := g.writer.Write(g.block[:n]); err != nil {
+				return 0, err
+			}
+		}
+		if err == io.EOF {
+			if err := g.writer.Close(); err != nil {
+				return 0, err
+			}
+			g.done = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return g.compressed.Read(p)
+}
+
+// decompressChunk returns a reader of the uncompressed data of a chunk body and a function to
+// call once the declared size has been read, which checks that the compressed stream ends there
+// so that the connection stays in sync.
+//
+// Parameters:
+// - reader: The connection, positioned at the start of the chunk body.
+// - encoding: The encoding announced in the CHUNK_RESPONSE.
+// - negotiated: The encoding negotiated in the handshake.
+//
+// Returns:
+// - io.Reader: The uncompressed chunk data.
+// - func() error: Checks the end of the compressed stream.
+// - error: An error wrapping ErrCorruptChunk if the encoding was not negotiated or the stream is invalid.
+func decompressChunk(reader *bufio.Reader, encoding string, negotiated string) (io.Reader, func() error, error) {
+	if encoding == "" {
+		return reader, func() error { return nil }, nil
+	}
+	if encoding != negotiated {
+		return nil, nil, fmt.Errorf("%w: unexpected chunk encoding %q", ErrCorruptChunk, encoding)
+	}
+
+	// A bufio.Reader is an io.ByteReader, so gzip reads exactly the compressed stream and no further.
+	decompressed, err := gzip.NewReader(reader)
+	if corruptCompression(err) {
+		return nil, nil, fmt.Errorf("%w: %v", ErrCorruptChunk, err)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	decompressed.Multistream(false)
+	finish := func() error {
+		var extra [1]byte
+		n, err := decompressed.Read(extra[:])
+		if n > 0 || corruptCompression(err) {
+			return fmt.Errorf("%w: compressed chunk does not end at its declared size", ErrCorruptChunk)
+		}
+		if err != io.EOF {
+			return err
+		}
+		// The server sends nothing but the chunk until the next request, so data already
+		// received after the compressed stream, such as a second gzip member, is corrupt.
+		if reader.Buffered() > 0 {
+			return fmt.Errorf("%w: data follows the compressed chunk", ErrCorruptChunk)
+		}
+		return nil
+	}
+	return decompressed, finish, nil
+}
+
+// corruptCompression reports whether an error returned while decompressing a chunk means the
+// compressed data is invalid, rather than that the connection failed.
+func corruptCompression(err error) bool {
+	var corrupt flate.CorruptInputError
+	return errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) || errors.As(err, &corrupt)
+}
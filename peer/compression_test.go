@@ -0,0 +1,192 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// compressible returns data larger than both the compression sample and a compression block that
+// gzip shrinks well.
+func compressible() []byte {
+	return []byte(strings.Repeat("go-to-peer compresses chunks on the wire\n", 8192))
+}
+
+// gzipped compresses data in a single gzip member.
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// decompress reads size bytes of a chunk body sent with the given encoding and checks its end.
+func decompress(body []byte, encoding string, size int64) ([]byte, error) {
+	decompressed, finish, err := decompressChunk(bufio.NewReader(bytes.NewReader(body)), encoding, CompressionGzip)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(decompressed, data); err != nil {
+		if corruptCompression(err) {
+			return nil, errors.Join(ErrCorruptChunk, err)
+		}
+		return nil, err
+	}
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// TestCompressChunk checks that compressible chunks are sent gzipped and come back unchanged, and
+// that incompressible ones are sent raw.
+func TestCompressChunk(t *testing.T) {
+	random := make([]byte, 3*compressionSampleSize)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		encoding string
+		expected string
+	}{
+		{name: "compressible", data: compressible(), encoding: CompressionGzip, expected: CompressionGzip},
+		{name: "incompressible", data: random, encoding: CompressionGzip, expected: ""},
+		{name: "empty", data: nil, encoding: CompressionGzip, expected: ""},
+		{name: "not negotiated", data: compressible(), encoding: "", expected: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, encoding, err := compressChunk(bytes.NewReader(tt.data), tt.encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encoding != tt.expected {
+				t.Fatalf("chunk sent with encoding %q, expected %q", encoding, tt.expected)
+			}
+			sent, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encoding == "" && !bytes.Equal(sent, tt.data) {
+				t.Fatal("raw chunk was modified")
+			}
+			if encoding != "" && len(sent) >= len(tt.data) {
+				t.Fatalf("compressed chunk has %d bytes, the data %d", len(sent), len(tt.data))
+			}
+
+			received, err := decompress(sent, encoding, int64(len(tt.data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(received, tt.data) {
+				t.Fatal("chunk changed in the round trip")
+			}
+		})
+	}
+}
+
+// TestDecompressChunkCorrupt checks that invalid compressed bodies, and bodies that do not end
+// where the chunk does, are reported as corrupt chunks.
+func TestDecompressChunkCorrupt(t *testing.T) {
+	data := compressible()
+	valid := gzipped(t, data)
+
+	flipped := bytes.Clone(valid)
+	flipped[len(flipped)/2] ^= 0xff
+	badChecksum := bytes.Clone(valid)
+	badChecksum[len(badChecksum)-5] ^= 0xff
+
+	tests := []struct {
+		name     string
+		body     []byte
+		encoding string
+		size     int64
+	}{
+		{name: "unnegotiated encoding", body: valid, encoding: "br", size: int64(len(data))},
+		{name: "bad header", body: append([]byte("not gzip"), valid...), encoding: CompressionGzip, size: int64(len(data))},
+		{name: "corrupt body", body: flipped, encoding: CompressionGzip, size: int64(len(data))},
+		{name: "bad checksum", body: badChecksum, encoding: CompressionGzip, size: int64(len(data))},
+		{name: "longer than declared", body: valid, encoding: CompressionGzip, size: int64(len(data)) - 1},
+		{name: "data after trailer", body: append(bytes.Clone(valid), "extra"...), encoding: CompressionGzip, size: int64(len(data))},
+		{name: "second member", body: append(bytes.Clone(valid), gzipped(t, []byte("more"))...), encoding: CompressionGzip, size: int64(len(data))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decompress(tt.body, tt.encoding, tt.size); !errors.Is(err, ErrCorruptChunk) {
+				t.Fatalf("got %v, expected %v", err, ErrCorruptChunk)
+			}
+		})
+	}
+}
+
+// TestChunkResponseCompression checks that a client and a server agree on gzip in their HELLO
+// exchange and that chunks are then sent compressed, or raw when compression is disabled.
+func TestChunkResponseCompression(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression string
+	}{
+		{name: "gzip", compression: CompressionGzip},
+		{name: "disabled", compression: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := setupServer(t)
+			defer func(previous string) { Compression = previous }(Compression)
+			Compression = tt.compression
+
+			conn, reader := connect(t, Limits{})
+			encoding, err := handshake(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encoding != tt.compression {
+				t.Fatalf("negotiated %q, expected %q", encoding, tt.compression)
+			}
+
+			data, err := EncodeMessage(Message{Type: ChunkRequest, Payload: ChunkRequestPayload{ChunkID: chunks[0]}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := conn.Write(append(data, '\n')); err != nil {
+				t.Fatal(err)
+			}
+			msg := readResponse(t, reader)
+			var payload ChunkResponsePayload
+			if msg.Type != ChunkResponse || decodePayload(msg, &payload) != nil {
+				t.Fatalf("got %s %v, expected a CHUNK_RESPONSE", msg.Type, msg.Payload)
+			}
+			if payload.Encoding != tt.compression {
+				t.Fatalf("chunk sent with encoding %q, expected %q", payload.Encoding, tt.compression)
+			}
+			checkChunkBody(t, reader, msg)
+
+			// The connection stays in sync for the next chunk.
+			var received bytes.Buffer
+			size, err := downloadChunk(conn, chunks[0], payload.Size, encoding, func(_ string, r io.Reader) (int64, error) {
+				return io.Copy(&received, r)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size != payload.Size || int64(received.Len()) != payload.Size {
+				t.Fatalf("downloaded %d bytes, expected %d", received.Len(), payload.Size)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+// Package peer manages peer connectivity and server file catalog functionality.
+// This file runs garbage collection of the chunk store, keeping shared and pinned files.
+package peer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-to-peer/file"
+	"go-to-peer/util"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultGCGracePeriod protects unreferenced chunks younger than this from garbage collection, and
+// is how long a download may go without storing a chunk before it is considered abandoned.
+const DefaultGCGracePeriod = time.Hour
+
+// Pins records the files that garbage collection must never evict, persisted in a JSON file.
+type Pins struct {
+	mu    sync.Mutex
+	path  string
+	Files []string `json:"files"` // Hashes of the pinned files.
+}
+
+// LoadPins reads the pins file, or starts with no pins if it does not exist yet.
+//
+// Parameters:
+// - path: The path of the JSON pins file.
+//
+// Returns:
+// - *Pins: The loaded pins.
+// - error: An error object if the file exists but cannot be read or parsed.
+func LoadPins(path string) (*Pins, error) {
+	p := &Pins{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pins file: %w", err)
+	}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("failed to parse pins file: %w", err)
+	}
+	for _, fileHash := range p.Files {
+		if err := file.ValidateFileHash(fileHash); err != nil {
+			return nil, fmt.Errorf("invalid pin: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// Pin pins a file and saves the pins file.
+func (p *Pins) Pin(fileHash string) error {
+	if err := file.ValidateFileHash(fileHash); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pinned := range p.Files {
+		if pinned == fileHash {
+			return nil
+		}
+	}
+	p.Files = append(p.Files, fileHash)
+	sort.Strings(p.Files)
+	return p.save()
+}
+
+// Unpin unpins a file and saves the pins file.
+func (p *Pins) Unpin(fileHash string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	kept := p.Files[:0]
+	for _, pinned := range p.Files {
+		if pinned != fileHash {
+			kept = append(kept, pinned)
+		}
+	}
+	p.Files = kept
+	return p.save()
+}
+
+// save writes the pins file. The caller must hold p.mu.
+func (p *Pins) save() error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode pins: %w", err)
+	}
+	tmpPath := p.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write pins file: %w", err)
+	}
+	return os.Rename(tmpPath, p.path)
+}
+
+// hashes returns the pinned file hashes as a set.
+func (p *Pins) hashes() map[string]bool {
+	pinned := make(map[string]bool)
+	if p == nil {
+		return pinned
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, fileHash := range p.Files {
+		pinned[fileHash] = true
+	}
+	return pinned
+}
+
+// sharedFileHashes returns the hashes of the files in a shared directory, without splitting them.
+// Files unchanged since the catalog was last built are not hashed again, and files that cannot be
+// read are logged and left out. A missing directory shares nothing.
+func sharedFileHashes(directory string) (map[string]bool, error) {
+	shared := make(map[string]bool)
+	if _, err := os.Stat(directory); errors.Is(err, os.ErrNotExist) {
+		return shared, nil
+	}
+	err := filepath.WalkDir(directory, func(filePath string, entry os.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := os.Stat(filePath)
+		if err != nil {
+			util.Logger.Printf("Failed to stat shared file %s for garbage collection: %v", filePath, err)
+			return nil
+		}
+		if hash, ok := sharedFiles.hash(filePath, info); ok {
+			shared[hash] = true
+			return nil
+		}
+		hash, err := util.HashFile(filePath)
+		if err != nil {
+			util.Logger.Printf("Failed to hash shared file %s for garbage collection: %v", filePath, err)
+			return nil
+		}
+		shared[hash] = true
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read shared directory: %w", err)
+	}
+	return shared, nil
+}
+
+// CollectGarbage collects the chunk store, keeping the files shared from sharedDir and the pinned files.
+// Files no longer shared are forgotten, and downloaded files are cached content, evicted first
+// when the store exceeds its quota.
+//
+// Parameters:
+// - sharedDir: The directory of shared files.
+// - pins: The pinned files, or nil.
+// - opts: The garbage collection options; Keep is filled in from the shared and pinned files.
+//
+// Returns:
+// - file.GCReport: What was (or would be) removed.
+// - error: An error object if the shared directory or the store cannot be read.
+func CollectGarbage(sharedDir string, pins *Pins, opts file.GCOptions) (file.GCReport, error) {
+	keep, err := sharedFileHashes(sharedDir)
+	if err != nil {
+		return file.GCReport{}, err
+	}
+	for fileHash := range pins.hashes() {
+		keep[fileHash] = true
+	}
+	opts.Keep = keep
+	return file.CollectGarbage(Store, opts)
+}
+
+// StartGarbageCollector runs CollectGarbage in the background at the given interval.
+//
+// Parameters:
+// - interval: Time between two runs.
+// - sharedDir: The directory of shared files.
+// - pins: The pinned files, or nil.
+// - opts: The garbage collection options.
+func StartGarbageCollector(interval time.Duration, sharedDir string, pins *Pins, opts file.GCOptions) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			report, err := CollectGarbage(sharedDir, pins, opts)
+			if err != nil {
+				util.Logger.Printf("Garbage collection failed: %v", err)
+				continue
+			}
+			util.Logger.Printf("Garbage collection removed %d chunks (%d bytes), forgot %d files and evicted %d files; %d bytes remain",
+				len(report.RemovedChunks), report.FreedBytes, len(report.ForgottenFiles), len(report.EvictedFiles), report.RemainingBytes)
+			if report.OverQuota {
+				util.Logger.Printf("Chunk store exceeds its quota of %d bytes with only shared and pinned files left", opts.MaxBytes)
+			}
+		}
+	}()
+}
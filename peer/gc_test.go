@@ -0,0 +1,113 @@
+package peer
+
+import (
+	"go-to-peer/file"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCollectGarbageEditedSharedFile checks that the chunks of the previous version of an edited
+// shared file are collected, unless it is pinned, without a quota.
+func TestCollectGarbageEditedSharedFile(t *testing.T) {
+	oldChunks := setupServer(t)
+	oldCatalog, err := createCatalog(SharedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldHash := oldCatalog.Files[0].Hash
+
+	path := filepath.Join(SharedDir, "shared.txt")
+	if err := os.WriteFile(path, []byte(strings.Repeat("edited content\n", 4096)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	catalog, err := createCatalog(SharedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newChunks := catalog.Files[0].manifest().AllChunks()
+
+	pins, err := LoadPins(filepath.Join(t.TempDir(), "pins.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pins.Pin(oldHash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CollectGarbage(SharedDir, pins, file.GCOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Store.GetManifest(oldHash); err != nil {
+		t.Fatalf("the pinned previous version was forgotten: %v", err)
+	}
+
+	if err := pins.Unpin(oldHash); err != nil {
+		t.Fatal(err)
+	}
+	report, err := CollectGarbage(SharedDir, pins, file.GCOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.ForgottenFiles) != 1 || report.ForgottenFiles[0] != oldHash {
+		t.Fatalf("forgot %v, expected the previous version %s", report.ForgottenFiles, oldHash)
+	}
+	for _, chunkHash := range oldChunks {
+		if Store.Has(chunkHash) {
+			t.Fatalf("chunk %s of the previous version is still stored", chunkHash)
+		}
+	}
+	for _, chunkHash := range newChunks {
+		if !Store.Has(chunkHash) {
+			t.Fatalf("chunk %s of the shared file was removed", chunkHash)
+		}
+	}
+
+	// A file removed from the share is forgotten too.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CollectGarbage(SharedDir, pins, file.GCOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if chunks, _ := Store.List(); len(chunks) != 0 {
+		t.Fatalf("%d chunks left after unsharing every file", len(chunks))
+	}
+}
+
+// TestSharedFileHashesCache checks that garbage collection takes the hashes of unchanged shared
+// files from the catalog cache, and hashes changed files again.
+func TestSharedFileHashesCache(t *testing.T) {
+	setupServer(t)
+	path := filepath.Join(SharedDir, "shared.txt")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, _ := sharedFiles.hash(path, info)
+	sharedFiles.mu.Lock()
+	entry := sharedFiles.entries[path]
+	entry.entry.Hash = strings.Repeat("c", 64) // Only the cache knows this hash.
+	sharedFiles.entries[path] = entry
+	sharedFiles.mu.Unlock()
+
+	shared, err := sharedFileHashes(SharedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shared) != 1 || !shared[strings.Repeat("c", 64)] {
+		t.Fatalf("got %v, expected the cached hash", shared)
+	}
+
+	if err := os.Chtimes(path, time.Now(), info.ModTime().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	shared, err = sharedFileHashes(SharedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shared) != 1 || !shared[cached] {
+		t.Fatalf("got %v, expected the hash %s of the modified file", shared, cached)
+	}
+}
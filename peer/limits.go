@@ -0,0 +1,90 @@
+// Package peer manages peer connectivity and server file catalog functionality.
+// This file contains the resource limits enforced on connections accepted by the server.
+package peer
+
+import (
+	"errors"
+	"go-to-peer/file"
+	"sync"
+	"time"
+)
+
+// Limits bounds the resources a single peer, and all peers together, may consume on the server.
+// A zero value for any field disables that particular limit.
+type Limits struct {
+	MaxMessageSize           int           // Largest request message (in bytes) accepted from a peer.
+	MaxConnections           int           // Maximum number of concurrently connected peers.
+	MaxRequestsPerConnection int           // Maximum number of requests served on a single connection.
+	IdleTimeout              time.Duration // Maximum time to wait for a peer to start its next request.
+	ReadTimeout              time.Duration // Maximum time to read a request once the peer started sending it.
+	WriteTimeout             time.Duration // Maximum time to write a single response to a peer.
+	MaxInFlightBytes         int64         // Maximum number of chunk bytes being sent to all peers at once.
+}
+
+// DefaultLimits returns the limits used by the server unless configured otherwise.
+func DefaultLimits() Limits {
+	return Limits{
+		MaxMessageSize:           64 * 1024,
+		MaxConnections:           64,
+		MaxRequestsPerConnection: 10000,
+		IdleTimeout:              2 * time.Minute,
+		ReadTimeout:              30 * time.Second,
+		WriteTimeout:             5 * time.Minute,
+		MaxInFlightBytes:         4 * file.MaxChunkSize,
+	}
+}
+
+// ServerLimits holds the limits applied by StartServer. It must be set before the server is started.
+var ServerLimits = DefaultLimits()
+
+// maxResponseSize is the largest response message a client accepts from a server.
+// Chunk data is streamed after the CHUNK_RESPONSE message rather than inside it, so this only
+// bounds catalogs and other metadata.
+const maxResponseSize = 64 * 1024 * 1024
+
+// ErrMessageTooLarge is returned when a peer sends a message exceeding the configured maximum size.
+var ErrMessageTooLarge = errors.New("message exceeds maximum size")
+
+// ErrTooManyRequests is returned when a peer sends more requests than a connection may serve.
+var ErrTooManyRequests = errors.New("too many requests on this connection")
+
+// byteBudget limits the number of bytes in flight across all connections.
+// Acquiring more than the total budget is allowed once the budget is otherwise unused,
+// so a single oversized response cannot block forever.
+type byteBudget struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int64
+	used  int64
+}
+
+// newByteBudget creates a byteBudget allowing at most limit bytes in flight. A limit of 0 disables it.
+func newByteBudget(limit int64) *byteBudget {
+	b := &byteBudget{limit: limit}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire blocks until n bytes are available and reserves them.
+// It returns a function that releases the reservation.
+func (b *byteBudget) acquire(n int64) func() {
+	if b.limit <= 0 || n <= 0 {
+		return func() {}
+	}
+	b.mu.Lock()
+	for b.used > 0 && b.used+n > b.limit {
+		b.cond.Wait()
+	}
+	b.used += n
+	b.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			b.used -= n
+			b.mu.Unlock()
+			b.cond.Broadcast()
+		})
+	}
+}
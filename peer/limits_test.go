@@ -0,0 +1,150 @@
+package peer
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connect serves a connection with the given limits over a pipe and returns the client end.
+func connect(t *testing.T, limits Limits) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleConnection(&session{conn: server, limits: limits, budget: newByteBudget(0)})
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	_ = client.SetDeadline(time.Now().Add(10 * time.Second))
+	return client, bufio.NewReader(client)
+}
+
+// readResponse reads the next response from the server.
+func readResponse(t *testing.T, reader *bufio.Reader) Message {
+	t.Helper()
+	line, err := readMessage(reader, maxResponseSize)
+	if err != nil {
+		t.Fatalf("no response: %v", err)
+	}
+	msg, err := DecodeMessage(line)
+	if err != nil {
+		t.Fatalf("invalid response %q: %v", line, err)
+	}
+	return msg
+}
+
+// expectRejected reads an ERROR response mentioning reason.
+func expectRejected(t *testing.T, reader *bufio.Reader, reason error) {
+	t.Helper()
+	msg := readResponse(t, reader)
+	var payload ErrorPayload
+	if msg.Type != ErrorResponse || decodePayload(msg, &payload) != nil || !strings.Contains(payload.Message, reason.Error()) {
+		t.Fatalf("got %s %v, expected an ERROR for %q", msg.Type, msg.Payload, reason)
+	}
+}
+
+// expectClosed checks that the server closed the connection.
+func expectClosed(t *testing.T, reader *bufio.Reader) {
+	t.Helper()
+	if line, err := reader.ReadBytes('\n'); !errors.Is(err, io.EOF) {
+		t.Fatalf("got %q, %v, expected the connection to be closed", line, err)
+	}
+}
+
+const catalogRequest = `{"type":"FILE_CATALOG_REQUEST","payload":null}` + "\n"
+
+func TestOversizedRequest(t *testing.T) {
+	setupServer(t)
+	client, reader := connect(t, Limits{MaxMessageSize: 1024})
+
+	// The server stops reading the request, so it is sent while the response is read.
+	go func() {
+		_, _ = client.Write([]byte(`{"type":"FILE_CATALOG_REQUEST","payload":"` + strings.Repeat("x", 4096) + "\"}\n"))
+	}()
+	expectRejected(t, reader, ErrMessageTooLarge)
+	expectClosed(t, reader)
+}
+
+func TestRequestLimit(t *testing.T) {
+	setupServer(t)
+	client, reader := connect(t, Limits{MaxRequestsPerConnection: 2})
+	for range 2 {
+		if _, err := client.Write([]byte(catalogRequest)); err != nil {
+			t.Fatal(err)
+		}
+		if msg := readResponse(t, reader); msg.Type != FileCatalogResponse {
+			t.Fatalf("got %s, expected %s", msg.Type, FileCatalogResponse)
+		}
+	}
+	if _, err := client.Write([]byte(catalogRequest)); err != nil {
+		t.Fatal(err)
+	}
+	expectRejected(t, reader, ErrTooManyRequests)
+	expectClosed(t, reader)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	setupServer(t)
+	_, reader := connect(t, Limits{IdleTimeout: 50 * time.Millisecond, ReadTimeout: time.Hour})
+	start := time.Now()
+	expectClosed(t, reader)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("idle peer disconnected after %v", elapsed)
+	}
+}
+
+// TestReadTimeout checks that a peer starting a request but never finishing it is disconnected,
+// even though it is not idle.
+func TestReadTimeout(t *testing.T) {
+	setupServer(t)
+	client, reader := connect(t, Limits{IdleTimeout: time.Hour, ReadTimeout: 50 * time.Millisecond})
+	if _, err := client.Write([]byte(catalogRequest[:10])); err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(t, reader)
+}
+
+func TestByteBudget(t *testing.T) {
+	budget := newByteBudget(100)
+	release := budget.acquire(60)
+
+	acquired := make(chan func())
+	go func() { acquired <- budget.acquire(60) }()
+	select {
+	case <-acquired:
+		t.Fatal("acquired more than the budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	release() // Releasing twice must not return the bytes twice.
+	releaseSecond := <-acquired
+
+	// Once the budget is unused, a reservation larger than the whole budget goes through.
+	releaseSecond()
+	done := make(chan struct{})
+	go func() {
+		budget.acquire(500)()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("an oversized reservation blocked on an unused budget")
+	}
+	if budget.used != 0 {
+		t.Fatalf("%d bytes still reserved", budget.used)
+	}
+
+	// A disabled budget never blocks.
+	unlimited := newByteBudget(0)
+	unlimited.acquire(1 << 40)
+	unlimited.acquire(1 << 40)()
+}
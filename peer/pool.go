@@ -0,0 +1,183 @@
+// Package peer manages peer connectivity and server file catalog functionality.
+// This file keeps connections to servers open between requests, so that the chunks of a download,
+// and the downloads of a long-running node, share connections and handshakes instead of dialing
+// the server for every chunk.
+package peer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Limits of the connection pool. Idle connections are dropped before the server's default
+// IdleTimeout would close them.
+const (
+	poolIdleTimeout = time.Minute
+	poolMaxIdle     = 16 // Idle connections kept per server.
+)
+
+// pooledConn is a connection to a server after the handshake.
+type pooledConn struct {
+	net.Conn
+	encoding  string    // Chunk encoding negotiated in the handshake, or "".
+	idleSince time.Time // When the connection was returned to the pool.
+	reused    bool      // Whether the connection served an earlier request.
+	received  int64     // Bytes read during the current request.
+}
+
+// Read implements io.Reader, counting the bytes received.
+func (c *pooledConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.received += int64(n)
+	return n, err
+}
+
+// connPool holds the idle connections to every server.
+type connPool struct {
+	mu     sync.Mutex
+	idle   map[string][]*pooledConn
+	active map[string]int // Connections running a request, by server.
+}
+
+// connections is the connection pool of the client.
+var connections = &connPool{idle: make(map[string][]*pooledConn), active: make(map[string]int)}
+
+// ServerConnections counts the connections of the client to a server.
+type ServerConnections struct {
+	Address string `json:"address"`
+	Active  int    `json:"active"` // Connections running a request.
+	Idle    int    `json:"idle"`   // Connections kept open for later requests.
+}
+
+// do runs a request on a connection to a server: an idle one if there is one, else a new one.
+// The connection goes back to the pool if the request succeeds. A request failing on an idle
+// connection before the server sent anything is retried on another connection, since the server
+// may have closed the idle one. Cancelling ctx interrupts the request.
+//
+// Parameters:
+// - ctx: Cancels the request.
+// - server: The address of the server.
+// - request: Sends the request on the connection and reads the complete response.
+//
+// Returns:
+// - error: An error object if no connection can be made, or the error returned by request.
+func (p *connPool) do(ctx context.Context, server string, request func(c *pooledConn) error) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c, err := p.get(server)
+		if err != nil {
+			return err
+		}
+		p.track(server, 1)
+		_ = c.SetDeadline(time.Now().Add(chunkTimeout))
+		stop := context.AfterFunc(ctx, func() { _ = c.SetDeadline(time.Now()) })
+		err = request(c)
+		interrupted := !stop()
+		p.track(server, -1)
+		if err == nil && !interrupted {
+			p.put(server, c)
+			return nil
+		}
+		c.Close()
+		if err == nil || !c.reused || c.received > 0 || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+// get returns an idle connection to a server, or dials a new one and performs the handshake.
+func (p *connPool) get(server string) (*pooledConn, error) {
+	p.mu.Lock()
+	for conns := p.idle[server]; len(conns) > 0; conns = p.idle[server] {
+		c := conns[len(conns)-1]
+		p.idle[server] = conns[:len(conns)-1]
+		if time.Since(c.idleSince) < poolIdleTimeout {
+			p.mu.Unlock()
+			c.reused, c.received = true, 0
+			return c, nil
+		}
+		c.Close()
+	}
+	p.mu.Unlock()
+
+	conn, err := dialServer(server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to server %s: %w", server, err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(chunkTimeout))
+	encoding, err := handshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("handshake with server %s failed: %w", server, err)
+	}
+	return &pooledConn{Conn: conn, encoding: encoding}, nil
+}
+
+// put returns a connection to the pool once its request is complete.
+func (p *connPool) put(server string, c *pooledConn) {
+	_ = c.SetDeadline(time.Time{})
+	c.idleSince = time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle[server]) >= poolMaxIdle {
+		c.Close()
+		return
+	}
+	p.idle[server] = append(p.idle[server], c)
+}
+
+// track counts a connection starting or finishing a request.
+func (p *connPool) track(server string, delta int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.active[server] += delta; p.active[server] <= 0 {
+		delete(p.active, server)
+	}
+}
+
+// OpenConnections returns the connections of the client to each server it is connected to, by address.
+func OpenConnections() []ServerConnections {
+	connections.mu.Lock()
+	defer connections.mu.Unlock()
+	counts := make(map[string]*ServerConnections)
+	count := func(server string) *ServerConnections {
+		if counts[server] == nil {
+			counts[server] = &ServerConnections{Address: server}
+		}
+		return counts[server]
+	}
+	for server, n := range connections.active {
+		count(server).Active = n
+	}
+	for server, conns := range connections.idle {
+		for _, c := range conns {
+			if time.Since(c.idleSince) < poolIdleTimeout {
+				count(server).Idle++
+			}
+		}
+	}
+	result := make([]ServerConnections, 0, len(counts))
+	for _, c := range counts {
+		result = append(result, *c)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Address < result[j].Address })
+	return result
+}
+
+// CloseIdleConnections closes the connections to servers kept open for later requests.
+func CloseIdleConnections() {
+	connections.mu.Lock()
+	defer connections.mu.Unlock()
+	for server, conns := range connections.idle {
+		for _, c := range conns {
+			c.Close()
+		}
+		delete(connections.idle, server)
+	}
+}
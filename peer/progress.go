@@ -0,0 +1,97 @@
+// Package peer manages peer connectivity and server file catalog functionality.
+// This file reports the progress of downloads to the user interface: the chunks about to be
+// downloaded, the chunk data as it arrives, and the outcome of every attempt to download a chunk.
+package peer
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// DownloadInfo describes the chunks of a file about to be downloaded.
+type DownloadInfo struct {
+	FileHash string // Hash of the file.
+	Name     string // Name of the file, or "" if unknown.
+	Chunks   int    // Number of chunks to download.
+	Bytes    int64  // Total size of the chunks to download, or 0 if the manifest declares no sizes.
+}
+
+// ChunkEvent reports an attempt to download a chunk from a server.
+type ChunkEvent struct {
+	FileHash string        // Hash of the file the chunk belongs to.
+	ChunkID  string        // Hash of the chunk.
+	Server   string        // Address of the server the chunk was requested from.
+	Size     int64         // Size of the chunk received, or 0 if the attempt failed.
+	Duration time.Duration // Time the attempt took.
+	Err      error         // Why the attempt failed, or nil if the chunk was downloaded and verified.
+}
+
+// ProgressReporter receives the progress of downloads. Its methods are called from the download
+// workers, several at once, so implementations must be safe for concurrent use.
+type ProgressReporter interface {
+	// DownloadStarted is called before the chunks of a file are downloaded. It is called again
+	// when more chunks of the same file are needed, such as parity chunks to recover lost ones.
+	DownloadStarted(info DownloadInfo)
+
+	// Received is called as the data of a chunk arrives from a server, before it is verified.
+	Received(server string, chunkID string, n int64)
+
+	// ChunkFinished is called after every attempt to download a chunk.
+	ChunkFinished(event ChunkEvent)
+}
+
+// Progress receives the progress of downloads, or is nil to report nothing. A download whose
+// context carries a reporter of its own, set by WithProgress, reports to that one instead.
+var Progress ProgressReporter
+
+// progressKey is the context key of the reporter set by WithProgress.
+type progressKey struct{}
+
+// WithProgress returns a context whose downloads report their progress to reporter rather than
+// to Progress, so that concurrent downloads can be told apart.
+//
+// Parameters:
+// - ctx: The parent context.
+// - reporter: The reporter receiving the progress of the downloads run with the context.
+//
+// Returns:
+// - context.Context: The context to download with.
+func WithProgress(ctx context.Context, reporter ProgressReporter) context.Context {
+	return context.WithValue(ctx, progressKey{}, reporter)
+}
+
+// progressFor returns the reporter of the downloads run with ctx, or nil.
+func progressFor(ctx context.Context) ProgressReporter {
+	if reporter, ok := ctx.Value(progressKey{}).(ProgressReporter); ok {
+		return reporter
+	}
+	return Progress
+}
+
+// progressReader reports the data read from a chunk to a reporter.
+type progressReader struct {
+	r        io.Reader
+	reporter ProgressReporter
+	server   string
+	chunkID  string
+}
+
+// Read implements io.Reader.
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.reporter.Received(p.server, p.chunkID, int64(n))
+	}
+	return n, err
+}
+
+// reportingSink wraps the sink of a chunk download so that its data is reported as it arrives.
+func reportingSink(save chunkSink, reporter ProgressReporter, server string) chunkSink {
+	if reporter == nil {
+		return save
+	}
+	return func(chunkID string, r io.Reader) (int64, error) {
+		return save(chunkID, &progressReader{r: r, reporter: reporter, server: server, chunkID: chunkID})
+	}
+}
@@ -6,9 +6,12 @@ package peer
 // - "fmt": For formatted error messages.
 // - "go-to-peer/util": For logging significant events.
 import (
+	"bufio"
 	"encoding/json" // JSON encoding/decoding for structured message exchange.
-	"fmt"           // Formatted I/O for error handling.
+	"errors"
+	"fmt" // Formatted I/O for error handling.
 	"go-to-peer/util"
+	"io"
 )
 
 // Message represents the structure of messages exchanged between peers.
@@ -16,9 +19,11 @@ import (
 // Fields:
 // - Type: The type of the message (e.g., "HELLO", "METADATA").
 // - Payload: The actual data being sent, which varies depending on the message type.
+// - Body: Raw bytes sent right after the encoded message, used to stream chunk data.
 type Message struct {
 	Type    string      `json:"type"`    // Type of the message (e.g., "HELLO", "METADATA").
 	Payload interface{} `json:"payload"` // The actual data being sent.
+	Body    io.Reader   `json:"-"`       // Raw data following the message on the wire, if any.
 }
 
 // Metadata represents the structure of metadata exchanged between peers.
@@ -27,10 +32,41 @@ type Message struct {
 // - PeerID: A unique identifier for the peer.
 // - Hostname: The hostname or address of the peer.
 // - ChunkList: A list of available chunks on the peer.
+// - Compression: The chunk encodings a client accepts, or in the server's answer the one it uses.
 type Metadata struct {
-	PeerID    string   `json:"peer_id"`    // Unique identifier for the peer.
-	Hostname  string   `json:"hostname"`   // Peer hostname or address.
-	ChunkList []string `json:"chunk_list"` // List of available chunks.
+	PeerID      string   `json:"peer_id"`               // Unique identifier for the peer.
+	Hostname    string   `json:"hostname"`              // Peer hostname or address.
+	ChunkList   []string `json:"chunk_list"`            // List of available chunks.
+	Compression []string `json:"compression,omitempty"` // Chunk encodings, e.g. "gzip".
+}
+
+// Hello is the message type used by peers to introduce themselves when a connection is opened.
+// The payload is a Metadata struct; the server answers with a HELLO describing itself.
+const Hello = "HELLO"
+
+// LocalPeerID is the peer ID this node announces in its HELLO messages. It may be empty.
+var LocalPeerID string
+
+// maxPeerIDLength is the longest peer ID accepted in a HELLO message.
+const maxPeerIDLength = 64
+
+// ValidatePeerID checks that a peer ID only contains letters, digits, '.', '_' and '-'.
+//
+// Parameters:
+// - peerID: The peer ID to validate. An empty peer ID is valid and means "anonymous".
+//
+// Returns:
+// - error: An error describing why the peer ID is invalid, or nil.
+func ValidatePeerID(peerID string) error {
+	if len(peerID) > maxPeerIDLength {
+		return fmt.Errorf("peer ID is longer than %d characters", maxPeerIDLength)
+	}
+	for _, c := range peerID {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '.' && c != '_' && c != '-' {
+			return fmt.Errorf("invalid peer ID %q", peerID)
+		}
+	}
+	return nil
 }
 
 // EncodeMessage converts a Message struct into a JSON byte array.
@@ -88,10 +124,13 @@ type ChunkRequestPayload struct {
 }
 
 // ChunkResponsePayload represents the payload structure for chunk responses.
+// The chunk data is not part of the JSON message: exactly Size raw bytes follow the message's
+// newline, so neither side has to hold (or base64-encode) a whole chunk in memory.
 type ChunkResponsePayload struct {
-	ChunkID string `json:"chunk_id"` // ID of the chunk being sent.
-	Data    []byte `json:"data"`     // Actual chunk data.
-	Hash    string `json:"hash"`     // Hash of the chunk data for integrity verification.
+	ChunkID  string `json:"chunk_id"`           // ID of the chunk being sent.
+	Size     int64  `json:"size"`               // Size of the chunk data, before any compression.
+	Hash     string `json:"hash"`               // Hash of the uncompressed chunk data for integrity verification.
+	Encoding string `json:"encoding,omitempty"` // Compression of the data following the message, or "" if raw.
 }
 
 const (
@@ -109,3 +148,83 @@ type FileMetadataResponsePayload struct {
 	FileName string   `json:"file_name"` // The name of the file.
 	Chunks   []string `json:"chunks"`    // List of chunk IDs for the file.
 }
+
+// ErrorResponse is the message type a server answers a request it rejects with, so that the peer
+// learns why at once instead of waiting for a response that never comes. The payload is an ErrorPayload.
+const ErrorResponse = "ERROR"
+
+// ErrorPayload represents the payload of an ERROR message.
+type ErrorPayload struct {
+	Message string `json:"message"` // Why the request was rejected.
+}
+
+// ErrRequestRejected is returned when a server answers a request with an ERROR message.
+var ErrRequestRejected = errors.New("request rejected by server")
+
+// checkResponse checks that a response has the expected type.
+//
+// Parameters:
+// - msg: The decoded response.
+// - expected: The message type answering the request.
+//
+// Returns:
+// - error: An error wrapping ErrRequestRejected if the server sent an ERROR, an error if the
+// response has another type, or nil.
+func checkResponse(msg Message, expected string) error {
+	if msg.Type == ErrorResponse {
+		var payload ErrorPayload
+		_ = decodePayload(msg, &payload)
+		return fmt.Errorf("%w: %s", ErrRequestRejected, payload.Message)
+	}
+	if msg.Type != expected {
+		return fmt.Errorf("unexpected response type: %s", msg.Type)
+	}
+	return nil
+}
+
+// decodePayload converts the generic payload of a decoded Message into a typed payload struct.
+//
+// Parameters:
+// - msg: The decoded Message whose payload should be converted.
+// - v: A pointer to the payload struct to fill.
+//
+// Returns:
+// - error: An error object if the payload does not match the expected structure.
+func decodePayload(msg Message, v interface{}) error {
+	payloadBytes, err := json.Marshal(msg.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to re-encode %s payload: %w", msg.Type, err)
+	}
+	if err := json.Unmarshal(payloadBytes, v); err != nil {
+		return fmt.Errorf("failed to decode %s payload: %w", msg.Type, err)
+	}
+	return nil
+}
+
+// readMessage reads a single newline-terminated message from a peer.
+// Unlike bufio.Reader.ReadString, it stops buffering once maxSize bytes have been read
+// so that a peer cannot make us hold an arbitrarily long line in memory.
+//
+// Parameters:
+// - reader: The buffered reader wrapping the peer connection.
+// - maxSize: The maximum message size in bytes, or 0 for no limit.
+//
+// Returns:
+// - []byte: The message, including the trailing newline.
+// - error: ErrMessageTooLarge if the limit was exceeded, or the underlying read error.
+func readMessage(reader *bufio.Reader, maxSize int) ([]byte, error) {
+	var message []byte
+	for {
+		line, err := reader.ReadSlice('\n')
+		if maxSize > 0 && len(message)+len(line) > maxSize {
+			return nil, ErrMessageTooLarge
+		}
+		message = append(message, line...)
+		if err == nil {
+			return message, nil
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// Package peer manages peer connectivity and server file catalog functionality.
+// This file tracks the reputation of servers across downloads and bans servers that misbehave.
+package peer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-to-peer/util"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Reputation thresholds. A server reaching one of them is banned temporarily.
+const (
+	corruptBanThreshold = 2                // Corrupt chunks before a server is banned.
+	corruptBanDuration  = 24 * time.Hour   // Ban duration for serving corrupt data.
+	timeoutBanThreshold = 5                // Consecutive timeouts before a server is banned.
+	timeoutBanDuration  = 10 * time.Minute // Ban duration for unresponsive servers.
+)
+
+// ErrCorruptChunk is returned when a chunk received from a server fails its integrity check.
+var ErrCorruptChunk = errors.New("integrity check failed")
+
+// PeerStats holds what this node has observed about a server.
+type PeerStats struct {
+	Successes   int           `json:"successes"`            // Chunks downloaded and verified.
+	Corrupt     int           `json:"corrupt"`              // Chunks that failed their integrity check since the last ban.
+	Timeouts    int           `json:"timeouts"`             // Consecutive requests that timed out.
+	Failures    int           `json:"failures"`             // Other failed requests.
+	Bytes       int64         `json:"bytes"`                // Bytes downloaded successfully.
+	Duration    time.Duration `json:"duration"`             // Time spent downloading those bytes.
+	BannedUntil time.Time     `json:"banned_until"`         // End of the current ban, if any.
+	BanReason   string        `json:"ban_reason,omitempty"` // Why the server was banned.
+	Permanent   bool          `json:"permanent,omitempty"`  // Whether the ban never expires (set by hand in the file).
+}
+
+// Throughput returns the average download rate from the server in bytes per second.
+func (s *PeerStats) Throughput() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Duration.Seconds()
+}
+
+// Score rates a server for chunk assignment; higher is better.
+// Corrupt data weighs far more than timeouts or other failures, and throughput breaks ties.
+func (s *PeerStats) Score() float64 {
+	score := float64(s.Successes) - 50*float64(s.Corrupt) - 5*float64(s.Timeouts) - 2*float64(s.Failures)
+	return score + s.Throughput()/(1024*1024)
+}
+
+// Reputation records per-server statistics and bans, persisted across downloads in a JSON file.
+type Reputation struct {
+	mu     sync.Mutex
+	saveMu sync.Mutex // Serializes Save, whose temporary file is shared by concurrent downloads.
+	path   string
+	Peers  map[string]*PeerStats `json:"peers"`
+}
+
+// PeerReputation is the reputation store used by the client. A nil store disables reputation tracking.
+var PeerReputation *Reputation
+
+// OnBan is called, if not nil, whenever a server is banned, so that the user interface can report
+// it; bans are logged either way. It is called with the reputation store locked and must not use it.
+var OnBan func(server string, until time.Time, reason string)
+
+// LoadReputation reads the reputation file, or starts with an empty store if it does not exist yet.
+//
+// Parameters:
+// - path: The path of the JSON reputation file.
+//
+// Returns:
+// - *Reputation: The loaded reputation store.
+// - error: An error object if the file exists but cannot be read or parsed.
+func LoadReputation(path string) (*Reputation, error) {
+	r := &Reputation{path: path, Peers: make(map[string]*PeerStats)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read reputation file: %w", err)
+	}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("failed to parse reputation file: %w", err)
+	}
+	if r.Peers == nil {
+		r.Peers = make(map[string]*PeerStats)
+	}
+	return r, nil
+}
+
+// Save writes the reputation store back to its file. It may be called by concurrent downloads.
+func (r *Reputation) Save() error {
+	if r == nil {
+		return nil
+	}
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+	r.mu.Lock()
+	data, err := json.MarshalIndent(r, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode reputation: %w", err)
+	}
+
+	// Write to a temporary file first so that a crash never leaves a truncated ban list.
+	tmpPath := r.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write reputation file: %w", err)
+	}
+	return os.Rename(tmpPath, r.path)
+}
+
+// stats returns the statistics of a server, creating them if needed. The caller must hold r.mu.
+func (r *Reputation) stats(server string) *PeerStats {
+	s, ok := r.Peers[server]
+	if !ok {
+		s = &PeerStats{}
+		r.Peers[server] = s
+	}
+	return s
+}
+
+// IsBanned reports whether a server is currently banned.
+func (r *Reputation) IsBanned(server string) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.Peers[server]
+	return ok && (s.Permanent || time.Now().Before(s.BannedUntil))
+}
+
+// Rank returns the servers that are not banned, best first.
+func (r *Reputation) Rank(servers []string) []string {
+	if r == nil {
+		return servers
+	}
+	ranked := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if r.IsBanned(server) {
+			util.Logger.Printf("Skipping banned server %s", server)
+			continue
+		}
+		ranked = append(ranked, server)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return r.stats(ranked[i]).Score() > r.stats(ranked[j]).Score()
+	})
+	return ranked
+}
+
+// Banned returns the servers currently banned, sorted.
+func (r *Reputation) Banned() []string {
+	banned := []string{}
+	if r == nil {
+		return banned
+	}
+	r.mu.Lock()
+	servers := make([]string, 0, len(r.Peers))
+	for server := range r.Peers {
+		servers = append(servers, server)
+	}
+	r.mu.Unlock()
+	for _, server := range servers {
+		if r.IsBanned(server) {
+			banned = append(banned, server)
+		}
+	}
+	sort.Strings(banned)
+	return banned
+}
+
+// Stats returns what this node has observed about a server, or zero stats if it never contacted it.
+func (r *Reputation) Stats(server string) PeerStats {
+	if r == nil {
+		return PeerStats{}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok := r.Peers[server]; ok {
+		return *s
+	}
+	return PeerStats{}
+}
+
+// Known returns the number of servers the reputation store has observed.
+func (r *Reputation) Known() int {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.Peers)
+}
+
+// RecordSuccess records a chunk successfully downloaded from a server.
+func (r *Reputation) RecordSuccess(server string, bytes int64, duration time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.stats(server)
+	s.Successes++
+	s.Timeouts = 0
+	s.Bytes += bytes
+	s.Duration += duration
+}
+
+// RecordError classifies a failed chunk download and updates the server's reputation,
+// banning the server if it crossed a threshold.
+func (r *Reputation) RecordError(server string, err error) {
+	if r == nil || err == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.stats(server)
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrCorruptChunk):
+		s.Corrupt++
+		if s.Corrupt >= corruptBanThreshold {
+			r.ban(server, s, corruptBanDuration, "served corrupt chunks")
+		}
+	case errors.As(err, &netErr) && netErr.Timeout():
+		s.Timeouts++
+		if s.Timeouts >= timeoutBanThreshold {
+			r.ban(server, s, timeoutBanDuration, "timed out repeatedly")
+		}
+	default:
+		s.Failures++
+	}
+}
+
+// ban bans a server for the given duration and resets the counters that triggered the ban.
+// The caller must hold r.mu.
+func (r *Reputation) ban(server string, s *PeerStats, duration time.Duration, reason string) {
+	s.BannedUntil = time.Now().Add(duration)
+	s.BanReason = reason
+	s.Corrupt = 0
+	s.Timeouts = 0
+	util.Logger.Printf("Banned server %s until %s: %s", server, s.BannedUntil.Format(time.RFC3339), reason)
+	if OnBan != nil {
+		OnBan(server, s.BannedUntil, reason)
+	}
+}
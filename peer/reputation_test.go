@@ -0,0 +1,201 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"go-to-peer/util"
+	"io"
+	"log"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// timeoutError is a net.Error reporting a timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// recordOutcomes records download outcomes for a server: "ok", "corrupt", "timeout" or "failure".
+func recordOutcomes(r *Reputation, server string, outcomes []string) {
+	for _, outcome := range outcomes {
+		switch outcome {
+		case "ok":
+			r.RecordSuccess(server, 1024, time.Millisecond)
+		case "corrupt":
+			r.RecordError(server, fmt.Errorf("chunk 0: %w", ErrCorruptChunk))
+		case "timeout":
+			r.RecordError(server, fmt.Errorf("read: %w", timeoutError{}))
+		case "failure":
+			r.RecordError(server, errors.New("connection refused"))
+		}
+	}
+}
+
+func TestReputationBans(t *testing.T) {
+	util.Logger = log.New(io.Discard, "", 0)
+	defer func() { OnBan = nil }()
+	repeat := func(outcome string, n int) []string {
+		return slices.Repeat([]string{outcome}, n)
+	}
+	tests := []struct {
+		name     string
+		outcomes []string
+		duration time.Duration // Expected ban duration, or 0 for no ban.
+		reason   string
+	}{
+		{"one corrupt chunk", []string{"corrupt"}, 0, ""},
+		{"two corrupt chunks", repeat("corrupt", 2), corruptBanDuration, "served corrupt chunks"},
+		{"corrupt chunks between successes", []string{"corrupt", "ok", "ok", "corrupt"}, corruptBanDuration, "served corrupt chunks"},
+		{"four timeouts", repeat("timeout", 4), 0, ""},
+		{"five consecutive timeouts", repeat("timeout", 5), timeoutBanDuration, "timed out repeatedly"},
+		{"timeouts interrupted by a success", append(append(repeat("timeout", 4), "ok"), repeat("timeout", 4)...), 0, ""},
+		{"timeouts interrupted by failures", append(append(repeat("timeout", 4), "failure"), "timeout"), timeoutBanDuration, "timed out repeatedly"},
+		{"other failures", repeat("failure", 20), 0, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := LoadReputation(filepath.Join(t.TempDir(), "reputation.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var bans []string
+			OnBan = func(server string, until time.Time, reason string) {
+				bans = append(bans, server+": "+reason)
+			}
+			const server = "10.0.0.1:8080"
+			start := time.Now()
+			recordOutcomes(r, server, test.outcomes)
+
+			stats := r.Stats(server)
+			if test.duration == 0 {
+				if r.IsBanned(server) || len(bans) != 0 {
+					t.Fatalf("server banned until %s (%v)", stats.BannedUntil, bans)
+				}
+				return
+			}
+			if !r.IsBanned(server) || !slices.Equal(bans, []string{server + ": " + test.reason}) {
+				t.Fatalf("server not banned once for %q: %v", test.reason, bans)
+			}
+			if stats.BannedUntil.Before(start.Add(test.duration)) || stats.BannedUntil.After(time.Now().Add(test.duration)) {
+				t.Fatalf("server banned until %s, expected %s from now", stats.BannedUntil, test.duration)
+			}
+			if stats.BanReason != test.reason || stats.Corrupt != 0 || stats.Timeouts != 0 {
+				t.Fatalf("got reason %q and counters %d/%d after the ban", stats.BanReason, stats.Corrupt, stats.Timeouts)
+			}
+		})
+	}
+}
+
+func TestReputationIsBanned(t *testing.T) {
+	now := time.Now()
+	r := &Reputation{Peers: map[string]*PeerStats{
+		"expired":   {BannedUntil: now.Add(-time.Second), BanReason: "served corrupt chunks"},
+		"banned":    {BannedUntil: now.Add(time.Minute)},
+		"permanent": {BannedUntil: now.Add(-time.Hour), Permanent: true},
+		"good":      {Successes: 10},
+	}}
+	tests := []struct {
+		server string
+		banned bool
+	}{
+		{"expired", false},
+		{"banned", true},
+		{"permanent", true},
+		{"good", false},
+		{"unknown", false},
+	}
+	for _, test := range tests {
+		if banned := r.IsBanned(test.server); banned != test.banned {
+			t.Errorf("IsBanned(%q) = %t, expected %t", test.server, banned, test.banned)
+		}
+	}
+	if banned := r.Banned(); !slices.Equal(banned, []string{"banned", "permanent"}) {
+		t.Errorf("Banned() = %v", banned)
+	}
+	var disabled *Reputation
+	if disabled.IsBanned("banned") {
+		t.Error("a nil reputation store banned a server")
+	}
+}
+
+func TestReputationRank(t *testing.T) {
+	util.Logger = log.New(io.Discard, "", 0)
+	r, err := LoadReputation(filepath.Join(t.TempDir(), "reputation.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordOutcomes(r, "good", slices.Repeat([]string{"ok"}, 10))
+	recordOutcomes(r, "best", slices.Repeat([]string{"ok"}, 20))
+	recordOutcomes(r, "flaky", append(slices.Repeat([]string{"ok"}, 10), "failure", "timeout"))
+	recordOutcomes(r, "corrupt", append(slices.Repeat([]string{"ok"}, 10), "corrupt"))
+	recordOutcomes(r, "banned", append(slices.Repeat([]string{"ok"}, 30), "corrupt", "corrupt"))
+
+	tests := []struct {
+		servers []string
+		ranked  []string
+	}{
+		{[]string{"good", "best"}, []string{"best", "good"}},
+		{[]string{"corrupt", "flaky", "good"}, []string{"good", "flaky", "corrupt"}},
+		{[]string{"banned", "unknown", "corrupt"}, []string{"unknown", "corrupt"}},
+		{[]string{"banned"}, []string{}},
+		{[]string{"best", "banned", "unknown", "good", "corrupt", "flaky"}, []string{"best", "good", "flaky", "unknown", "corrupt"}},
+	}
+	for _, test := range tests {
+		if ranked := r.Rank(test.servers); !slices.Equal(ranked, test.ranked) {
+			t.Errorf("Rank(%v) = %v, expected %v", test.servers, ranked, test.ranked)
+		}
+	}
+
+	var disabled *Reputation
+	if ranked := disabled.Rank([]string{"banned", "good"}); !slices.Equal(ranked, []string{"banned", "good"}) {
+		t.Errorf("a nil reputation store ranked %v", ranked)
+	}
+}
+
+// TestReputationSaveConcurrent checks that downloads saving the reputation at once always leave a
+// complete file behind.
+func TestReputationSaveConcurrent(t *testing.T) {
+	util.Logger = log.New(io.Discard, "", 0)
+	path := filepath.Join(t.TempDir(), "reputation.json")
+	reputation, err := LoadReputation(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const downloads, saves = 16, 200
+	var wg sync.WaitGroup
+	for i := range downloads {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server := fmt.Sprintf("10.0.0.%d:8080", i)
+			for range saves {
+				reputation.RecordSuccess(server, 1024, time.Millisecond)
+				if err := reputation.Save(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	loaded, err := LoadReputation(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Known() != downloads {
+		t.Fatalf("saved %d servers, expected %d", loaded.Known(), downloads)
+	}
+	for i := range downloads {
+		server := fmt.Sprintf("10.0.0.%d:8080", i)
+		if stats := loaded.Stats(server); stats.Successes != saves {
+			t.Fatalf("saved %d successes for %s, expected %d", stats.Successes, server, saves)
+		}
+	}
+}
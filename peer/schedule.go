@@ -0,0 +1,109 @@
+// Package peer manages peer connectivity and server file catalog functionality.
+// This file shares the network between concurrent downloads: a download may take its chunk
+// download slots from a scheduler deciding which download goes next, and every download is held
+// under MaxDownloadRate. Downloads holding more slots receive more of the bandwidth.
+package peer
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// MaxDownloadRate caps the bytes per second received by all downloads together, or is 0 for no cap.
+var MaxDownloadRate int64
+
+// SlotScheduler hands out the slots chunks are downloaded in to concurrent downloads. Every
+// chunk download, including its retries on other servers, holds one slot.
+type SlotScheduler interface {
+	// Acquire waits for a slot until ctx is cancelled, and returns the function releasing it.
+	Acquire(ctx context.Context) (release func(), err error)
+}
+
+// slotsKey is the context key of the scheduler set by WithSlots.
+type slotsKey struct{}
+
+// WithSlots returns a context whose downloads take a slot from scheduler for every chunk, on top
+// of running at most DownloadWorkers chunks at once.
+//
+// Parameters:
+// - ctx: The parent context.
+// - scheduler: The scheduler handing out the slots of the downloads run with the context.
+//
+// Returns:
+// - context.Context: The context to download with.
+func WithSlots(ctx context.Context, scheduler SlotScheduler) context.Context {
+	return context.WithValue(ctx, slotsKey{}, scheduler)
+}
+
+// acquireSlot waits for a slot from the scheduler of ctx, if any, and returns the function releasing it.
+func acquireSlot(ctx context.Context) (func(), error) {
+	scheduler, ok := ctx.Value(slotsKey{}).(SlotScheduler)
+	if !ok {
+		return func() {}, nil
+	}
+	return scheduler.Acquire(ctx)
+}
+
+// downloadRate holds every download under MaxDownloadRate.
+var downloadRate rateLimiter
+
+// rateLimiter spaces out the data read by its callers so that it stays under a rate. Every read is
+// given the next free stretch of time, in the order the reads arrive.
+type rateLimiter struct {
+	mu   sync.Mutex
+	next time.Time // When the data already read will have been spread out.
+}
+
+// wait charges n bytes to the limiter and sleeps until they fit under rate bytes per second.
+func (l *rateLimiter) wait(ctx context.Context, n int, rate int64) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / rate))
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledReader reads from a chunk download under MaxDownloadRate.
+type throttledReader struct {
+	ctx  context.Context
+	r    io.Reader
+	rate int64
+}
+
+// Read implements io.Reader.
+func (t *throttledReader) Read(b []byte) (int, error) {
+	n, err := t.r.Read(b)
+	if n > 0 {
+		if waitErr := downloadRate.wait(t.ctx, n, t.rate); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+// throttledSink wraps the sink of a chunk download so that its data is read under MaxDownloadRate.
+func throttledSink(ctx context.Context, save chunkSink) chunkSink {
+	rate := MaxDownloadRate
+	if rate <= 0 {
+		return save
+	}
+	return func(chunkID string, r io.Reader) (int64, error) {
+		return save(chunkID, &throttledReader{ctx: ctx, r: r, rate: rate})
+	}
+}
@@ -0,0 +1,127 @@
+// Package peer manages peer connectivity and server file catalog functionality.
+// This file scrubs the chunk store and repairs the damaged chunks it finds.
+package peer
+
+import (
+	"context"
+	"go-to-peer/file"
+	"go-to-peer/util"
+	"os"
+	"time"
+)
+
+// ScrubStore scrubs the chunk store and repairs the damaged chunks: chunks of shared files are
+// split again from the shared files themselves, and the others are fetched again from peers that
+// share a file containing them.
+//
+// Parameters:
+// - sharedDir: The directory of shared files.
+// - peers: The addresses of the peers to repair from; may be empty.
+//
+// Returns:
+// - file.ScrubReport: The chunks checked, found damaged and repaired.
+// - error: An error object if the store cannot be scrubbed.
+func ScrubStore(sharedDir string, peers []string) (file.ScrubReport, error) {
+	report, err := file.Scrub(Store)
+	if err != nil {
+		return report, err
+	}
+	damaged := report.Damaged()
+	if len(damaged) == 0 {
+		return report, nil
+	}
+	util.Logger.Printf("Scrub found %d corrupt and %d missing chunks", len(report.Corrupt), len(report.Missing))
+
+	// Rebuilding the catalog splits every shared file whose chunks are no longer all present.
+	if _, err := os.Stat(sharedDir); err == nil {
+		sharedFiles.reset()
+		if _, err := createCatalog(sharedDir); err != nil {
+			util.Logger.Printf("Failed to restore chunks from shared files: %v", err)
+		}
+	}
+
+	if len(peers) > 0 {
+		repairFromPeers(missingChunks(damaged), peers)
+	}
+
+	for _, chunkHash := range damaged {
+		if Store.Has(chunkHash) {
+			report.Repaired = append(report.Repaired, chunkHash)
+		}
+	}
+	return report, nil
+}
+
+// repairFromPeers fetches damaged chunks again from the peers sharing a file that contains them.
+func repairFromPeers(damaged []string, peers []string) {
+	if len(damaged) == 0 {
+		return
+	}
+	wanted := make(map[string]bool, len(damaged))
+	for _, chunkHash := range damaged {
+		wanted[chunkHash] = true
+	}
+
+	sources, err := FetchFileCatalogs(peers)
+	if err != nil {
+		util.Logger.Printf("Failed to fetch catalogs for repair: %v", err)
+		return
+	}
+
+	manifests, err := file.StoredFiles(Store)
+	if err != nil {
+		util.Logger.Printf("Failed to list manifests for repair: %v", err)
+		return
+	}
+	for _, manifest := range manifests {
+		fileHash := manifest.Hash
+		servers := PeerReputation.Rank(sources[fileHash])
+		if len(servers) == 0 {
+			continue
+		}
+		entry := FileMetadata{
+			Name:         manifest.Name,
+			Hash:         fileHash,
+			Chunks:       manifest.Chunks,
+			ChunkSizes:   manifest.ChunkSizes,
+			ParityChunks: manifest.ParityChunks,
+			ParitySizes:  manifest.ParitySizes,
+		}
+
+		chunks := []string{}
+		for _, chunkHash := range missingChunks(manifest.AllChunks()) {
+			if wanted[chunkHash] {
+				chunks = append(chunks, chunkHash)
+			}
+		}
+		if len(chunks) == 0 {
+			continue
+		}
+		util.Logger.Printf("Repairing %d chunks of %s from %d peers", len(chunks), fileHash, len(servers))
+		if err := downloadChunks(context.Background(), &entry, servers, chunks, Store.Put); err != nil {
+			util.Logger.Printf("Failed to repair chunks of %s: %v", fileHash, err)
+		}
+	}
+}
+
+// StartScrubber scrubs and repairs the chunk store in the background at the given interval.
+//
+// Parameters:
+// - interval: Time between two scrubs.
+// - sharedDir: The directory of shared files.
+// - peers: The addresses of the peers to repair from; may be empty.
+func StartScrubber(interval time.Duration, sharedDir string, peers []string) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			report, err := ScrubStore(sharedDir, peers)
+			if err != nil {
+				util.Logger.Printf("Scrub failed: %v", err)
+				continue
+			}
+			util.Logger.Printf("Scrub checked %d chunks (%d bytes): %d corrupt, %d missing, %d unreadable, %d repaired",
+				report.Checked, report.CheckedBytes, len(report.Corrupt), len(report.Missing), len(report.Unreadable), len(report.Repaired))
+		}
+	}()
+}
@@ -0,0 +1,148 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// corruptStoredChunk replaces the data of a chunk in the store created by setupServer.
+func corruptStoredChunk(t *testing.T, chunkHash string) {
+	t.Helper()
+	chunkPath := filepath.Join(filepath.Dir(SharedDir), "chunks", "objects", chunkHash[:2], chunkHash)
+	if err := os.WriteFile(chunkPath, []byte("rotten"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readStoredChunk returns the data of a stored chunk.
+func readStoredChunk(t *testing.T, chunkHash string) []byte {
+	t.Helper()
+	chunk, err := Store.Get(chunkHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chunk.Close()
+	data, err := io.ReadAll(chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// startStubPeer serves a single file to the peers connecting to it, independently of the chunk
+// store of this node, and returns its address.
+func startStubPeer(t *testing.T, metadata FileMetadata, chunks map[string][]byte) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveStub(conn, metadata, chunks)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// serveStub answers the HELLO, FILE_CATALOG_REQUEST and CHUNK_REQUEST messages of a connection.
+func serveStub(conn net.Conn, metadata FileMetadata, chunks map[string][]byte) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := readMessage(reader, 0)
+		if err != nil {
+			return
+		}
+		msg, err := DecodeMessage(line)
+		if err != nil {
+			return
+		}
+		var response Message
+		var body []byte
+		switch msg.Type {
+		case Hello:
+			response = Message{Type: Hello, Payload: Metadata{PeerID: "stub"}}
+		case FileCatalogRequest:
+			response = Message{Type: FileCatalogResponse, Payload: FileCatalog{Files: []FileMetadata{metadata}}}
+		case ChunkRequest:
+			var payload ChunkRequestPayload
+			if decodePayload(msg, &payload) != nil {
+				return
+			}
+			body = chunks[payload.ChunkID]
+			response = Message{Type: ChunkResponse, Payload: ChunkResponsePayload{ChunkID: payload.ChunkID, Size: int64(len(body))}}
+		default:
+			return
+		}
+		data, err := EncodeMessage(response)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(append(append(data, '\n'), body...)); err != nil {
+			return
+		}
+	}
+}
+
+// TestScrubStoreFromSharedFile checks that a corrupt chunk of a shared file is quarantined and
+// split again from the file.
+func TestScrubStoreFromSharedFile(t *testing.T) {
+	chunks := setupServer(t)
+	original := readStoredChunk(t, chunks[0])
+	corruptStoredChunk(t, chunks[0])
+
+	report, err := ScrubStore(SharedDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.Corrupt, chunks[:1]) || !slices.Equal(report.Repaired, chunks[:1]) {
+		t.Fatalf("got corrupt %v and repaired %v, expected %s", report.Corrupt, report.Repaired, chunks[0])
+	}
+	if !bytes.Equal(readStoredChunk(t, chunks[0]), original) {
+		t.Fatal("the repaired chunk has the wrong data")
+	}
+}
+
+// TestScrubStoreFromPeers checks that a corrupt chunk of a file no longer shared is quarantined
+// and downloaded again from a peer sharing the file.
+func TestScrubStoreFromPeers(t *testing.T) {
+	chunks := setupServer(t)
+	catalog, err := createCatalog(SharedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := make(map[string][]byte)
+	for _, chunkHash := range chunks {
+		stored[chunkHash] = readStoredChunk(t, chunkHash)
+	}
+	peer := startStubPeer(t, catalog.Files[0], stored)
+
+	if err := os.Remove(filepath.Join(SharedDir, "shared.txt")); err != nil {
+		t.Fatal(err)
+	}
+	corruptStoredChunk(t, chunks[0])
+
+	report, err := ScrubStore(SharedDir, []string{peer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.Corrupt, chunks[:1]) || !slices.Equal(report.Repaired, chunks[:1]) {
+		t.Fatalf("got corrupt %v and repaired %v, expected %s", report.Corrupt, report.Repaired, chunks[0])
+	}
+	if !bytes.Equal(readStoredChunk(t, chunks[0]), stored[chunks[0]]) {
+		t.Fatal("the repaired chunk has the wrong data")
+	}
+}
@@ -9,9 +9,11 @@ package peer
 // - "go-to-peer/util": For logging significant events.
 import (
 	"bufio" // Buffered reading/writing to TCP connections.
-	"encoding/json"
-	"path/filepath"
-	"strings"
+	"crypto/tls"
+	"errors"
+	"go-to-peer/file"
+	"io"
+	"time"
 
 	//"encoding/json"
 	"fmt"             // Formatted I/O for user-facing messages.
@@ -28,14 +30,27 @@ import (
 // Behavior:
 // - Listens on the specified port for incoming connections.
 // - Handles each connection in a separate goroutine to support concurrent peers.
-func StartServer(port string) {
+// - Enforces ServerLimits on every connection, disconnecting peers that exceed them.
+//
+// Returns:
+// - error: An error object if the server cannot listen on the port; otherwise it serves forever.
+func StartServer(port string) error {
+	limits := ServerLimits
+	budget := newByteBudget(limits.MaxInFlightBytes)
+	var slots chan struct{}
+	if limits.MaxConnections > 0 {
+		slots = make(chan struct{}, limits.MaxConnections)
+	}
+
 	// Start the TCP listener on the specified port.
 	listener, err := net.Listen("tcp", ":"+port)
 	if err != nil {
 		// Log the startup failure and terminate the application.
 		util.Logger.Printf("Error starting server on port %s: %v", port, err)
-		fmt.Printf("Error: Unable to start server on port %s. Check logs for details.\n", port)
-		os.Exit(1)
+		return fmt.Errorf("unable to start server on port %s: %w", port, err)
+	}
+	if ServerTLS != nil {
+		listener = tls.NewListener(listener, ServerTLS)
 	}
 	defer func() {
 		if closeErr := listener.Close(); closeErr != nil {
@@ -55,9 +70,50 @@ func StartServer(port string) {
 			fmt.Println("Error: Failed to accept a connection. Check logs for details.")
 			continue
 		}
+
+		// Refuse the connection if the server is already serving the maximum number of peers.
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			default:
+				util.Logger.Printf("Rejected connection from %s: connection limit of %d reached", conn.RemoteAddr(), limits.MaxConnections)
+				_ = conn.Close()
+				continue
+			}
+		}
+
 		// Handle the connection in a separate goroutine for concurrency.
-		go handleConnection(conn)
+		go func() {
+			defer func() {
+				if slots != nil {
+					<-slots
+				}
+			}()
+			handleConnection(&session{conn: conn, limits: limits, budget: budget})
+		}()
+	}
+}
+
+// session holds the per-connection state of a connected peer.
+type session struct {
+	conn     net.Conn     // The network connection established with the peer.
+	limits   Limits       // The limits enforced on this connection.
+	budget   *byteBudget  // The in-flight byte budget shared by all connections.
+	requests int          // Number of requests served so far.
+	peerID   string       // Peer ID announced in the peer's HELLO message, if any.
+	certName string       // Common name of the peer's verified TLS client certificate, if any.
+	greeted  bool         // Whether the peer has already sent a HELLO message.
+	encoding string       // Chunk encoding negotiated in the HELLO exchange, or "" for raw chunks.
+	client   *clientState // What the peer is sent, for ConnectedClients.
+}
+
+// visibleCatalog generates the catalog of shared files and filters it by the server ACL for this peer.
+func (s *session) visibleCatalog() (*FileCatalog, error) {
+	catalog, err := createCatalog(SharedDir)
+	if err != nil {
+		return nil, err
 	}
+	return filterCatalog(catalog, ServerACL, s.identity()), nil
 }
 
 // handleConnection handles an incoming peer connection.
@@ -75,7 +131,8 @@ const (
 )
 
 // Updated handleConnection to handle catalog requests.
-func handleConnection(conn net.Conn) {
+func handleConnection(s *session) {
+	conn := s.conn
 	defer func() {
 		if closeErr := conn.Close(); closeErr != nil {
 			util.Logger.Printf("Warning: Failed to close connection to peer %s: %v", conn.RemoteAddr(), closeErr)
@@ -83,14 +140,39 @@ func handleConnection(conn net.Conn) {
 	}()
 
 	peerAddr := conn.RemoteAddr().String()
+	s.client = connectClient(peerAddr)
+	defer s.client.disconnect()
 	util.Logger.Printf("Connected to peer: %s", peerAddr)
 	fmt.Printf("Peer connected: %s\n", peerAddr)
+	if err := s.authenticate(); err != nil {
+		util.Logger.Printf("Disconnecting peer %s: TLS handshake failed: %v", peerAddr, err)
+		fmt.Printf("Peer disconnected: %s\n", peerAddr)
+		return
+	}
+	if s.certName != "" {
+		util.Logger.Printf("Peer %s authenticated as %q", peerAddr, s.certName)
+	}
 
 	reader := bufio.NewReader(conn)
 	for {
-		message, err := reader.ReadString('\n')
+		message, err := s.readRequest(reader)
 		if err != nil {
-			util.Logger.Printf("Connection closed by peer %s: %v", peerAddr, err)
+			if errors.Is(err, ErrMessageTooLarge) {
+				util.Logger.Printf("Disconnecting peer %s: %v (limit %d bytes)", peerAddr, err, s.limits.MaxMessageSize)
+				s.reject(err)
+			} else if errors.Is(err, os.ErrDeadlineExceeded) {
+				util.Logger.Printf("Disconnecting peer %s: %v", peerAddr, err)
+			} else {
+				util.Logger.Printf("Connection closed by peer %s: %v", peerAddr, err)
+			}
+			fmt.Printf("Peer disconnected: %s\n", peerAddr)
+			return
+		}
+
+		s.requests++
+		if s.limits.MaxRequestsPerConnection > 0 && s.requests > s.limits.MaxRequestsPerConnection {
+			util.Logger.Printf("Disconnecting peer %s: exceeded %d requests per connection", peerAddr, s.limits.MaxRequestsPerConnection)
+			s.reject(ErrTooManyRequests)
 			fmt.Printf("Peer disconnected: %s\n", peerAddr)
 			return
 		}
@@ -99,134 +181,273 @@ func handleConnection(conn net.Conn) {
 		msg, decodeErr := DecodeMessage([]byte(message))
 		if decodeErr != nil {
 			util.Logger.Printf("Failed to decode message from peer %s: %v", peerAddr, decodeErr)
+			if !s.reject(decodeErr) {
+				return
+			}
 			continue
 		}
 
-		// Handle different message types.
-		switch msg.Type {
-
-		// Handle FILE_CATALOG_REQUEST messages.
-		case FileCatalogRequest:
-			// Generate the file catalog dynamically.
-			catalog, err := createCatalog("server_files") // Directory with server files.
-			if err != nil {
-				util.Logger.Printf("Failed to generate file catalog: %v", err)
-				continue
+		// Handle the message and send the response, if any, back to the peer.
+		response, release, handleErr := handleMessage(s, msg)
+		if handleErr != nil {
+			util.Logger.Printf("Failed to handle %s from peer %s: %v", msg.Type, peerAddr, handleErr)
+			if !s.reject(handleErr) {
+				return
 			}
+			continue
+		}
+		writeErr := s.writeResponse(*response)
+		release()
+		if writeErr != nil {
+			util.Logger.Printf("Disconnecting peer %s: failed to send %s: %v", peerAddr, response.Type, writeErr)
+			fmt.Printf("Peer disconnected: %s\n", peerAddr)
+			return
+		}
+		util.Logger.Printf("Sent %s to peer %s", response.Type, peerAddr)
+	}
+}
 
-			// Send the file catalog to the client.
-			response := Message{
-				Type:    FileCatalogResponse,
-				Payload: catalog,
-			}
-			data, encodeErr := EncodeMessage(response)
-			if encodeErr == nil {
-				_, _ = conn.Write(append(data, '\n'))
-				util.Logger.Printf("Sent file catalog to peer %s", peerAddr)
-			} else {
-				util.Logger.Printf("Failed to encode FILE_CATALOG_RESPONSE: %v", encodeErr)
-			}
+// readRequest reads the next request from the peer, applying the idle and read deadlines
+// and the maximum message size.
+func (s *session) readRequest(reader *bufio.Reader) ([]byte, error) {
+	// Wait for the first byte of the next request under the idle timeout.
+	if s.limits.IdleTimeout > 0 {
+		_ = s.conn.SetReadDeadline(time.Now().Add(s.limits.IdleTimeout))
+	}
+	if _, err := reader.Peek(1); err != nil {
+		return nil, err
+	}
 
-		// Handle FILE_METADATA_REQUEST messages.
-		case FileMetadataRequest:
-			var payload FileMetadataRequestPayload
-			payloadBytes, _ := json.Marshal(msg.Payload)
-			_ = json.Unmarshal(payloadBytes, &payload)
+	// The rest of the request must arrive within the read timeout.
+	if s.limits.ReadTimeout > 0 {
+		_ = s.conn.SetReadDeadline(time.Now().Add(s.limits.ReadTimeout))
+	}
+	return readMessage(reader, s.limits.MaxMessageSize)
+}
 
-			// Get the catalog and find the requested file.
-			catalog, err := createCatalog("server_files")
-			if err != nil {
-				util.Logger.Printf("Failed to load catalog: %v", err)
-				continue
-			}
+// writeResponse encodes a response and writes it to the peer under the write deadline,
+// followed by the response body, if any, which is streamed through a pooled buffer.
+func (s *session) writeResponse(response Message) error {
+	data, err := EncodeMessage(response)
+	if err != nil {
+		return err
+	}
+	if s.limits.WriteTimeout > 0 {
+		_ = s.conn.SetWriteDeadline(time.Now().Add(s.limits.WriteTimeout))
+	}
+	if _, err := s.conn.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if response.Body == nil {
+		return nil
+	}
+	send := func() (int64, error) { return file.Copy(s.conn, response.Body) }
+	if payload, ok := response.Payload.(ChunkResponsePayload); ok {
+		return s.client.upload(payload.ChunkID, send)
+	}
+	_, err = send()
+	return err
+}
 
-			var responsePayload FileMetadataResponsePayload
-			for _, file := range catalog.Files {
-				if file.Name == payload.FileName {
-					responsePayload = FileMetadataResponsePayload{
-						FileName: file.Name,
-						Chunks:   file.Chunks,
-					}
-					break
-				}
-			}
+// reject answers a request that could not be served with an ERROR message, and reports whether
+// it was sent. A peer that cannot be answered is disconnected, as is a peer exceeding a limit
+// once it has been told why.
+func (s *session) reject(reason error) bool {
+	err := s.writeResponse(Message{Type: ErrorResponse, Payload: ErrorPayload{Message: reason.Error()}})
+	if err != nil {
+		util.Logger.Printf("Disconnecting peer %s: failed to send %s: %v", s.conn.RemoteAddr(), ErrorResponse, err)
+		fmt.Printf("Peer disconnected: %s\n", s.conn.RemoteAddr())
+		return false
+	}
+	return true
+}
 
-			// Send the file metadata to the client.
-			response := Message{
-				Type:    FileMetadataResponse,
-				Payload: responsePayload,
-			}
-			data, encodeErr := EncodeMessage(response)
-			if encodeErr == nil {
-				_, _ = conn.Write(append(data, '\n'))
-				util.Logger.Printf("Sent metadata for file %s to peer %s", payload.FileName, peerAddr)
-			} else {
-				util.Logger.Printf("Failed to encode FILE_METADATA_RESPONSE: %v", encodeErr)
-			}
+// handleMessage dispatches a decoded message to the handler for its type.
+//
+// Parameters:
+// - msg: The decoded message received from the peer.
+//
+// Returns:
+// - *Message: The response to send back.
+// - func(): Releases the resources reserved for the response; it must be called once the response is sent.
+// - error: An error object if the request was malformed, of an unknown type or could not be served.
+func handleMessage(s *session, msg Message) (*Message, func(), error) {
+	noRelease := func() {}
+	switch msg.Type {
+	case Hello:
+		response, err := handleHello(s, msg)
+		return response, noRelease, err
+	case FileCatalogRequest:
+		response, err := handleFileCatalogRequest(s)
+		return response, noRelease, err
+	case FileMetadataRequest:
+		response, err := handleFileMetadataRequest(s, msg)
+		return response, noRelease, err
+	case ChunkRequest:
+		return handleChunkRequest(s, msg)
+	default:
+		return nil, noRelease, fmt.Errorf("unknown message type %q", msg.Type)
+	}
+}
 
-		// Add logic for other message types (e.g., CHUNK_REQUEST) here as needed.
-		case ChunkRequest:
-			var payload ChunkRequestPayload
-			payloadBytes, _ := json.Marshal(msg.Payload)
-			_ = json.Unmarshal(payloadBytes, &payload)
+// handleHello records the identity announced by the peer and answers with this node's own HELLO.
+func handleHello(s *session, msg Message) (*Message, error) {
+	var payload Metadata
+	if err := decodePayload(msg, &payload); err != nil {
+		return nil, err
+	}
+	if err := ValidatePeerID(payload.PeerID); err != nil {
+		return nil, err
+	}
+	if s.greeted {
+		return nil, fmt.Errorf("duplicate HELLO")
+	}
+	s.greeted = true
+	s.peerID = payload.PeerID
+	s.client.identify(s.peerID)
+	s.encoding = negotiateCompression(payload.Compression)
+	util.Logger.Printf("Peer %s identified as %q", s.conn.RemoteAddr(), s.peerID)
 
-			// Fetch fileHash from the catalog
-			catalog, err := createCatalog("server_files")
-			if err != nil {
-				util.Logger.Printf("Failed to load catalog: %v", err)
-				continue
-			}
+	hostname, _ := os.Hostname()
+	response := Metadata{
+		PeerID:   LocalPeerID,
+		Hostname: hostname,
+	}
+	if s.encoding != "" {
+		response.Compression = []string{s.encoding}
+	}
+	return &Message{
+		Type:    Hello,
+		Payload: response,
+	}, nil
+}
 
-			fileHash := ""
-			for _, file := range catalog.Files {
-				for _, chunk := range file.Chunks {
-					if chunk == payload.ChunkID {
-						fileHash = file.Hash
-						break
-					}
-				}
-				if fileHash != "" {
-					break
-				}
-			}
+// handleFileCatalogRequest builds the FILE_CATALOG_RESPONSE for a FILE_CATALOG_REQUEST.
+// Only the files the peer may access according to the ACL are listed.
+func handleFileCatalogRequest(s *session) (*Message, error) {
+	// Generate the file catalog dynamically.
+	catalog, err := s.visibleCatalog()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate file catalog: %w", err)
+	}
 
-			chunkData, chunkHash, err := getChunkData(payload.ChunkID, fileHash)
-			if err != nil {
-				util.Logger.Printf("Failed to retrieve chunk %s: %v", payload.ChunkID, err)
-				continue
-			}
+	return &Message{
+		Type:    FileCatalogResponse,
+		Payload: catalog,
+	}, nil
+}
 
-			response := Message{
-				Type: ChunkResponse,
-				Payload: ChunkResponsePayload{
-					ChunkID: payload.ChunkID,
-					Data:    chunkData,
-					Hash:    chunkHash,
-				},
-			}
-			data, encodeErr := EncodeMessage(response)
-			if encodeErr == nil {
-				_, _ = conn.Write(append(data, '\n'))
-				util.Logger.Printf("Sent chunk %s", payload.ChunkID)
-			} else {
-				util.Logger.Printf("Failed to encode CHUNK_RESPONSE: %v", encodeErr)
-			}
+// handleFileMetadataRequest builds the FILE_METADATA_RESPONSE for a FILE_METADATA_REQUEST.
+func handleFileMetadataRequest(s *session, msg Message) (*Message, error) {
+	var payload FileMetadataRequestPayload
+	if err := decodePayload(msg, &payload); err != nil {
+		return nil, err
+	}
+	if err := file.ValidateFileName(payload.FileName); err != nil {
+		return nil, err
+	}
 
-		default:
-			util.Logger.Printf("Received unknown message type from peer %s: %s", peerAddr, msg.Type)
+	// Get the catalog and find the requested file among those visible to the peer.
+	catalog, err := s.visibleCatalog()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load catalog: %w", err)
+	}
+
+	var responsePayload FileMetadataResponsePayload
+	for _, file := range catalog.Files {
+		if file.Name == payload.FileName {
+			responsePayload = FileMetadataResponsePayload{
+				FileName: file.Name,
+				Chunks:   file.Chunks,
+			}
+			break
 		}
 	}
+
+	return &Message{
+		Type:    FileMetadataResponse,
+		Payload: responsePayload,
+	}, nil
 }
 
-func getChunkData(chunkID string, fileName string) ([]byte, string, error) {
-	filePrefix := strings.TrimSuffix(fileName, filepath.Ext(fileName))
-	chunkFilePath := filepath.Join("chunks", filePrefix, chunkID)
+// handleChunkRequest builds the CHUNK_RESPONSE for a CHUNK_REQUEST. The chunk is streamed from
+// the chunk store as the response body. The size of the chunk is reserved from the in-flight byte
+// budget, and the chunk kept open, until the returned release function is called.
+func handleChunkRequest(s *session, msg Message) (*Message, func(), error) {
+	noRelease := func() {}
+
+	var payload ChunkRequestPayload
+	if err := decodePayload(msg, &payload); err != nil {
+		return nil, noRelease, err
+	}
+	if err := file.ValidateChunkID(payload.ChunkID); err != nil {
+		return nil, noRelease, err
+	}
+
+	// Only serve chunks belonging to files visible to the peer, so the ACL applies to chunks too.
+	catalog, err := s.visibleCatalog()
+	if err != nil {
+		return nil, noRelease, fmt.Errorf("failed to load catalog: %w", err)
+	}
+	if !catalogHasChunk(catalog, payload.ChunkID) {
+		return nil, noRelease, fmt.Errorf("chunk %s is not part of any shared file", payload.ChunkID)
+	}
+
+	// Reserve the chunk size before opening it.
+	size, err := getChunkSize(payload.ChunkID)
+	if err != nil {
+		return nil, noRelease, fmt.Errorf("failed to retrieve chunk %s: %w", payload.ChunkID, err)
+	}
+	releaseBudget := s.budget.acquire(size)
+
+	// The chunk store validates the chunk ID, so a hostile request cannot read outside of it.
+	chunk, err := Store.Get(payload.ChunkID)
+	if err != nil {
+		releaseBudget()
+		return nil, noRelease, fmt.Errorf("failed to retrieve chunk %s: %w", payload.ChunkID, err)
+	}
+	release := func() {
+		chunk.Close()
+		releaseBudget()
+	}
 
-	data, err := os.ReadFile(chunkFilePath)
+	body, encoding, err := compressChunk(io.LimitReader(chunk, size), s.encoding)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to read chunk %s: %w", chunkID, err)
+		release()
+		return nil, noRelease, fmt.Errorf("failed to read chunk %s: %w", payload.ChunkID, err)
+	}
+
+	// Chunks are content-addressed and verified when stored, so the chunk ID is the hash of the data.
+	// Clients verify it again while receiving the chunk, after decompressing it.
+	return &Message{
+		Type: ChunkResponse,
+		Payload: ChunkResponsePayload{
+			ChunkID:  payload.ChunkID,
+			Size:     size,
+			Hash:     payload.ChunkID,
+			Encoding: encoding,
+		},
+		Body: body,
+	}, release, nil
+}
+
+// catalogHasChunk reports whether any file in the catalog is made of the given chunk, counting parity chunks.
+func catalogHasChunk(catalog *FileCatalog, chunkID string) bool {
+	for _, entry := range catalog.Files {
+		for _, chunk := range entry.manifest().AllChunks() {
+			if chunk == chunkID {
+				return true
+			}
+		}
 	}
+	return false
+}
 
-	hash := util.CalculateHash(data)
-	return data, hash, nil
+// getChunkSize returns the size of a stored chunk without reading it.
+func getChunkSize(chunkID string) (int64, error) {
+	info, err := Store.Stat(chunkID)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
 }
@@ -0,0 +1,170 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"go-to-peer/file"
+	"go-to-peer/util"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupServer shares a single file from a temporary directory and returns its chunks.
+func setupServer(t testing.TB) []string {
+	t.Helper()
+	dir := t.TempDir()
+	util.Logger = log.New(io.Discard, "", 0)
+	SharedDir = filepath.Join(dir, "server_files")
+	Store = file.NewFSStore(filepath.Join(dir, "chunks"))
+	ServerACL = nil
+	if err := os.MkdirAll(SharedDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Repetitive content, so that chunks are sent compressed to peers accepting gzip.
+	content := strings.Repeat("go-to-peer shares files in chunks\n", 4096)
+	if err := os.WriteFile(filepath.Join(SharedDir, "shared.txt"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	catalog, err := createCatalog(SharedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return catalog.Files[0].manifest().AllChunks()
+}
+
+// expectedResponse returns the type of the response the server must send to a request line, or
+// ErrorResponse if the request must be rejected. greeted tracks whether a HELLO was accepted.
+func expectedResponse(line []byte, chunks []string, greeted *bool) string {
+	msg, err := DecodeMessage(line)
+	if err != nil {
+		return ErrorResponse
+	}
+	switch msg.Type {
+	case Hello:
+		var payload Metadata
+		if decodePayload(msg, &payload) != nil || ValidatePeerID(payload.PeerID) != nil || *greeted {
+			return ErrorResponse
+		}
+		*greeted = true
+		return Hello
+	case FileCatalogRequest:
+		return FileCatalogResponse
+	case FileMetadataRequest:
+		var payload FileMetadataRequestPayload
+		if decodePayload(msg, &payload) != nil || file.ValidateFileName(payload.FileName) != nil {
+			return ErrorResponse
+		}
+		return FileMetadataResponse
+	case ChunkRequest:
+		var payload ChunkRequestPayload
+		if decodePayload(msg, &payload) != nil || file.ValidateChunkID(payload.ChunkID) != nil {
+			return ErrorResponse
+		}
+		for _, chunk := range chunks {
+			if chunk == payload.ChunkID {
+				return ChunkResponse
+			}
+		}
+		return ErrorResponse
+	default:
+		return ErrorResponse
+	}
+}
+
+// FuzzHandleMessage sends newline-delimited requests, followed by whatever trailing bytes the
+// input ends with, to a server over a pipe. Every request must be answered: valid ones with their
+// response, and malformed ones with an ERROR, without the server panicking or hanging.
+func FuzzHandleMessage(f *testing.F) {
+	chunks := setupServer(f)
+	seeds := []string{
+		`{"type":"HELLO","payload":{"peer_id":"alice","compression":["gzip"]}}` + "\n" +
+			`{"type":"CHUNK_REQUEST","payload":{"chunk_id":"` + chunks[0] + `"}}` + "\n",
+		`{"type":"FILE_CATALOG_REQUEST","payload":null}` + "\n",
+		`{"type":"FILE_METADATA_REQUEST","payload":{"file_name":"shared.txt"}}` + "\n",
+		`{"type":"FILE_METADATA_REQUEST","payload":{"file_name":"../../etc/passwd"}}` + "\n",
+		`{"type":"CHUNK_REQUEST","payload":{"chunk_id":"../../../etc/passwd"}}` + "\n",
+		`{"type":"CHUNK_REQUEST","payload":{"chunk_id":"` + strings.Repeat("0", 64) + `"}}` + "\n",
+		`{"type":"CHUNK_REQUEST","payload":"` + chunks[0] + `"}` + "\n",
+		`{"type":"HELLO","payload":{"peer_id":"a/b"}}` + "\n",
+		`{"type":"HELLO","payload":{}}` + "\n" + `{"type":"HELLO","payload":{}}` + "\n",
+		`{"type":"UNKNOWN"}` + "\n",
+		"not json\n\n",
+		`{"type":"CHUNK_REQUEST","payload":{"chunk_id":"` + chunks[0] + `"}}` + "\n" + "\x00\xff trailing chunk body",
+	}
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		server, client := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			handleConnection(&session{conn: server, limits: Limits{}, budget: newByteBudget(0)})
+		}()
+		defer func() {
+			client.Close()
+			<-done
+		}()
+
+		reader := bufio.NewReader(client)
+		greeted := false
+		for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+			_ = client.SetDeadline(time.Now().Add(10 * time.Second))
+			if _, err := client.Write(line); err != nil {
+				t.Fatalf("failed to send %q: %v", line, err)
+			}
+			if !bytes.HasSuffix(line, []byte("\n")) {
+				// Trailing bytes without a newline are not a request yet.
+				return
+			}
+
+			response, err := readMessage(reader, maxResponseSize)
+			if err != nil {
+				t.Fatalf("no response to %q: %v", line, err)
+			}
+			msg, err := DecodeMessage(response)
+			if err != nil {
+				t.Fatalf("invalid response to %q: %v", line, err)
+			}
+			expected := expectedResponse(line, chunks, &greeted)
+			if msg.Type != expected {
+				t.Fatalf("got %s in response to %q, expected %s: %s", msg.Type, line, expected, response)
+			}
+			if msg.Type == ChunkResponse {
+				checkChunkBody(t, reader, msg)
+			}
+		}
+	})
+}
+
+// checkChunkBody reads the body of a CHUNK_RESPONSE and checks that it is the requested chunk.
+func checkChunkBody(t *testing.T, reader *bufio.Reader, msg Message) {
+	t.Helper()
+	var payload ChunkResponsePayload
+	if err := decodePayload(msg, &payload); err != nil {
+		t.Fatal(err)
+	}
+	body, finish, err := decompressChunk(reader, payload.Encoding, payload.Encoding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hasher := sha256.New()
+	if _, err := io.CopyN(hasher, body, payload.Size); err != nil {
+		t.Fatalf("failed to read chunk %s: %v", payload.ChunkID, err)
+	}
+	if err := finish(); err != nil {
+		t.Fatalf("failed to read chunk %s: %v", payload.ChunkID, err)
+	}
+	if hash := hex.EncodeToString(hasher.Sum(nil)); hash != payload.ChunkID {
+		t.Fatalf("received chunk %s with hash %s", payload.ChunkID, hash)
+	}
+}
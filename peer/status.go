@@ -0,0 +1,79 @@
+// Package peer manages peer connectivity and server file catalog functionality.
+// This file reports the local state of the node: shared files, the chunk store, pins and peers.
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"go-to-peer/file"
+	"os"
+	"path/filepath"
+)
+
+// Status describes the local state of the node.
+type Status struct {
+	PeerID      string   `json:"peer_id"`      // Peer ID announced to other peers, if any.
+	SharedFiles int      `json:"shared_files"` // Files in the shared directory.
+	StoredFiles int      `json:"stored_files"` // Files with a manifest in the chunk store.
+	Chunks      int      `json:"chunks"`       // Chunks in the chunk store.
+	ChunkBytes  int64    `json:"chunk_bytes"`  // Total size of the chunks in the chunk store.
+	PinnedFiles int      `json:"pinned_files"` // Files pinned against garbage collection.
+	KnownPeers  int      `json:"known_peers"`  // Servers with a recorded reputation.
+	BannedPeers []string `json:"banned_peers"` // Servers currently banned.
+}
+
+// NodeStatus gathers the local state of the node without contacting any peer.
+//
+// Parameters:
+// - sharedDir: The directory of shared files.
+// - pins: The pinned files, or nil.
+//
+// Returns:
+// - Status: The state of the node.
+// - error: An error object if the shared directory or the chunk store cannot be read.
+func NodeStatus(sharedDir string, pins *Pins) (Status, error) {
+	status := Status{
+		PeerID:      LocalPeerID,
+		PinnedFiles: len(pins.hashes()),
+		KnownPeers:  PeerReputation.Known(),
+		BannedPeers: PeerReputation.Banned(),
+	}
+
+	if _, err := os.Stat(sharedDir); err == nil {
+		err := filepath.WalkDir(sharedDir, func(_ string, entry os.DirEntry, walkErr error) error {
+			if walkErr != nil {
+				return walkErr
+			}
+			if entry.Type().IsRegular() {
+				status.SharedFiles++
+			}
+			return nil
+		})
+		if err != nil {
+			return status, fmt.Errorf("failed to read shared directory: %w", err)
+		}
+	}
+
+	files, err := file.StoredFiles(Store)
+	if err != nil {
+		return status, err
+	}
+	status.StoredFiles = len(files)
+
+	chunkHashes, err := Store.List()
+	if err != nil {
+		return status, err
+	}
+	for _, chunkHash := range chunkHashes {
+		info, err := Store.Stat(chunkHash)
+		if errors.Is(err, file.ErrChunkNotFound) {
+			continue
+		}
+		if err != nil {
+			return status, err
+		}
+		status.Chunks++
+		status.ChunkBytes += info.Size
+	}
+	return status, nil
+}
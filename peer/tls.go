@@ -0,0 +1,116 @@
+// Package peer manages peer connectivity and server file catalog functionality.
+// This file contains the optional TLS transport. A node given a certificate serves over TLS and
+// presents the certificate to the servers it connects to, so that servers can authenticate their
+// peers by the common name of a client certificate signed by a trusted CA.
+package peer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// ServerTLS is the TLS configuration of the server, or nil to serve plain TCP.
+var ServerTLS *tls.Config
+
+// ClientTLS is the TLS configuration used to connect to servers, or nil to connect over plain TCP.
+var ClientTLS *tls.Config
+
+// tlsHandshakeTimeout bounds the TLS handshake of a peer connecting to the server, when the
+// server limits do not set a read timeout.
+const tlsHandshakeTimeout = 30 * time.Second
+
+// ConfigureTLS sets ServerTLS and ClientTLS from certificate files. Without a certificate, the
+// server keeps serving plain TCP; the client still connects over TLS if a CA is given.
+//
+// Parameters:
+// - certFile: The PEM certificate of this node, or "" for none.
+// - keyFile: The PEM private key of the certificate; required with certFile.
+// - caFile: The PEM certificates of the CAs that sign the certificates of peers, or "" to verify
+// servers against the system roots and not authenticate clients.
+//
+// Returns:
+// - error: An error object if a file cannot be loaded.
+func ConfigureTLS(certFile, keyFile, caFile string) error {
+	ServerTLS, ClientTLS = nil, nil
+	if (certFile == "") != (keyFile == "") {
+		return errors.New("a TLS certificate and its key must be given together")
+	}
+	if certFile == "" && caFile == "" {
+		return nil
+	}
+
+	var certificates []tls.Certificate
+	if certFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		certificates = []tls.Certificate{certificate}
+	}
+	var roots *x509.CertPool
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read TLS CA file: %w", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in TLS CA file %s", caFile)
+		}
+	}
+
+	ClientTLS = &tls.Config{Certificates: certificates, RootCAs: roots, MinVersion: tls.VersionTLS12}
+	if certFile != "" {
+		ServerTLS = &tls.Config{Certificates: certificates, MinVersion: tls.VersionTLS12}
+		if roots != nil {
+			// Peers without a certificate are still served, as anonymous peers.
+			ServerTLS.ClientCAs = roots
+			ServerTLS.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	return nil
+}
+
+// dialServer connects to a server, over TLS if ClientTLS is set.
+func dialServer(server string) (net.Conn, error) {
+	if ClientTLS == nil {
+		return net.DialTimeout("tcp", server, dialTimeout)
+	}
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: dialTimeout}, Config: ClientTLS}
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	return dialer.DialContext(ctx, "tcp", server)
+}
+
+// authenticate completes the TLS handshake of a peer connected over TLS and records the common
+// name of its client certificate, if it presented one signed by a trusted CA.
+func (s *session) authenticate() error {
+	tlsConn, ok := s.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	timeout := s.limits.ReadTimeout
+	if timeout <= 0 {
+		timeout = tlsHandshakeTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return err
+	}
+	if state := tlsConn.ConnectionState(); len(state.VerifiedChains) > 0 {
+		s.certName = state.PeerCertificates[0].Subject.CommonName
+	}
+	return nil
+}
+
+// identity returns how the ACL identifies the peer of the session.
+func (s *session) identity() PeerIdentity {
+	return PeerIdentity{Addr: s.conn.RemoteAddr().String(), CertName: s.certName}
+}
@@ -0,0 +1,258 @@
+package peer
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority issuing the certificates of a test.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string // PEM file of the CA certificate.
+}
+
+// newTestCA creates a certificate authority.
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	ca := &testCA{}
+	ca.cert, ca.key = createCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	ca.file = writePEM(t, name+".pem", "CERTIFICATE", ca.cert.Raw)
+	return ca
+}
+
+// issue creates a certificate for a peer, valid for client and server authentication on the
+// loopback address, and returns its certificate and key files.
+func (ca *testCA) issue(t *testing.T, name string) (string, string) {
+	t.Helper()
+	cert, key := createCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}, ca.cert, ca.key)
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writePEM(t, name+".pem", "CERTIFICATE", cert.Raw), writePEM(t, name+".key", "EC PRIVATE KEY", der)
+}
+
+// createCertificate signs a certificate with a new key, by its own key if parent is nil.
+func createCertificate(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore, template.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// writePEM writes a PEM block to a temporary file and returns its path.
+func writePEM(t *testing.T, name string, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// startTLSServer serves connections over TLS with the current ServerTLS and returns the address.
+func startTLSServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener = tls.NewListener(listener, ServerTLS)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleConnection(&session{conn: conn, limits: Limits{}, budget: newByteBudget(0)})
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// TestTLSCertificateACL checks that a server using TLS authenticates peers by their client
+// certificate, so that ACL rules naming a certificate apply to them and to no one else.
+func TestTLSCertificateACL(t *testing.T) {
+	setupServer(t)
+	t.Cleanup(func() { _ = ConfigureTLS("", "", "") })
+	ServerACL = &ACL{Default: []string{}, Rules: []ACLRule{{Peers: []string{"cert:alice"}, Allow: []string{"**"}}}}
+
+	ca := newTestCA(t, "ca")
+	serverCert, serverKey := ca.issue(t, "server")
+	if err := ConfigureTLS(serverCert, serverKey, ca.file); err != nil {
+		t.Fatal(err)
+	}
+	address := startTLSServer(t)
+
+	aliceCert, aliceKey := ca.issue(t, "alice")
+	bobCert, bobKey := ca.issue(t, "bob")
+	malloryCert, malloryKey := newTestCA(t, "other-ca").issue(t, "alice")
+	tests := []struct {
+		name     string
+		cert     string
+		key      string
+		files    int
+		rejected bool
+	}{
+		{name: "named certificate", cert: aliceCert, key: aliceKey, files: 1},
+		{name: "other certificate", cert: bobCert, key: bobKey, files: 0},
+		{name: "no certificate", files: 0},
+		{name: "untrusted CA", cert: malloryCert, key: malloryKey, rejected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverTLS := ServerTLS
+			if err := ConfigureTLS(tt.cert, tt.key, ca.file); err != nil {
+				t.Fatal(err)
+			}
+			ServerTLS = serverTLS
+			if tt.rejected {
+				// Present the certificate even though the server does not list its CA, as an attacker would.
+				certificate := ClientTLS.Certificates[0]
+				ClientTLS.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					return &certificate, nil
+				}
+			}
+
+			conn, err := dialServer(address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+			data, err := EncodeMessage(Message{Type: FileCatalogRequest})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := conn.Write(append(data, '\n')); err != nil {
+				t.Fatal(err)
+			}
+
+			reader := bufio.NewReader(conn)
+			if tt.rejected {
+				if _, err := readMessage(reader, maxResponseSize); err == nil {
+					t.Fatal("a peer with a certificate from an untrusted CA was served")
+				}
+				return
+			}
+			var catalog FileCatalog
+			if msg := readResponse(t, reader); msg.Type != FileCatalogResponse || decodePayload(msg, &catalog) != nil {
+				t.Fatalf("got %s %v, expected a catalog", msg.Type, msg.Payload)
+			}
+			if len(catalog.Files) != tt.files {
+				t.Fatalf("got %d files, expected %d", len(catalog.Files), tt.files)
+			}
+		})
+	}
+}
+
+// TestTLSPlainClient checks that a server using TLS does not serve peers connecting over plain TCP.
+func TestTLSPlainClient(t *testing.T) {
+	setupServer(t)
+	t.Cleanup(func() { _ = ConfigureTLS("", "", "") })
+	ca := newTestCA(t, "ca")
+	serverCert, serverKey := ca.issue(t, "server")
+	if err := ConfigureTLS(serverCert, serverKey, ca.file); err != nil {
+		t.Fatal(err)
+	}
+	address := startTLSServer(t)
+	ClientTLS = nil
+
+	conn, err := dialServer(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	data, err := EncodeMessage(Message{Type: FileCatalogRequest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		t.Fatal(err)
+	}
+	if response, err := readMessage(bufio.NewReader(conn), maxResponseSize); err == nil {
+		t.Fatalf("a plain TCP peer got %q", response)
+	}
+}
+
+func TestConfigureTLS(t *testing.T) {
+	t.Cleanup(func() { _ = ConfigureTLS("", "", "") })
+	ca := newTestCA(t, "ca")
+	cert, key := ca.issue(t, "node")
+	notPEM := filepath.Join(t.TempDir(), "ca.txt")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		cert, key, ca  string
+		server, client bool
+		clientAuth     tls.ClientAuthType
+		fails          bool
+	}{
+		{name: "plain TCP"},
+		{name: "certificate and CA", cert: cert, key: key, ca: ca.file, server: true, client: true, clientAuth: tls.VerifyClientCertIfGiven},
+		{name: "certificate only", cert: cert, key: key, server: true, client: true, clientAuth: tls.NoClientCert},
+		{name: "CA only", ca: ca.file, client: true},
+		{name: "certificate without key", cert: cert, fails: true},
+		{name: "key without certificate", key: key, fails: true},
+		{name: "missing certificate", cert: cert + ".missing", key: key, fails: true},
+		{name: "missing CA", ca: ca.file + ".missing", fails: true},
+		{name: "invalid CA", ca: notPEM, fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ConfigureTLS(tt.cert, tt.key, tt.ca)
+			if (err != nil) != tt.fails {
+				t.Fatalf("got error %v, expected failure: %t", err, tt.fails)
+			}
+			if (ServerTLS != nil) != tt.server || (ClientTLS != nil) != tt.client {
+				t.Fatalf("server TLS set: %t, client TLS set: %t", ServerTLS != nil, ClientTLS != nil)
+			}
+			if ServerTLS != nil && ServerTLS.ClientAuth != tt.clientAuth {
+				t.Fatalf("server verifies client certificates with %v, expected %v", ServerTLS.ClientAuth, tt.clientAuth)
+			}
+		})
+	}
+}
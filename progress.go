@@ -0,0 +1,388 @@
+// Package main is the entry point of the application, handling user commands via a CLI interface.
+// This file contains the progress display of downloads: a live progress bar with the throughput of
+// every peer when stdout is a terminal, and periodic progress lines otherwise.
+package main
+
+import (
+	"fmt"
+	"go-to-peer/peer"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Progress display modes of get.
+const (
+	progressAuto  = "auto"  // A progress bar on a terminal, progress lines otherwise.
+	progressBar   = "bar"   // Always a progress bar.
+	progressLines = "lines" // Always progress lines.
+	progressNone  = "none"  // No progress display.
+)
+
+// Refresh intervals of the progress display.
+const (
+	progressTick         = 250 * time.Millisecond // How often rates are sampled and the bar redrawn.
+	progressLineInterval = 5 * time.Second        // How often a progress line is printed.
+	progressBarWidth     = 24
+	progressMaxPeers     = 8 // Peers shown under the progress bar; the others are summarized.
+)
+
+// rateSmoothing is the weight of the latest sample in the moving average of transfer rates.
+const rateSmoothing = 0.2
+
+// isTerminal reports whether f is an interactive terminal able to redraw a progress bar.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0 && os.Getenv("TERM") != "dumb"
+}
+
+// rateMeter estimates a transfer rate from a growing byte count.
+type rateMeter struct {
+	last    int64   // Byte count at the previous sample.
+	rate    float64 // Moving average in bytes per second.
+	sampled bool
+}
+
+// sample updates the rate with the byte count after an interval. The count goes down when a
+// partly received chunk fails, which is counted as no progress rather than a negative rate.
+func (m *rateMeter) sample(total int64, interval time.Duration) {
+	instant := max(0, float64(total-m.last)/interval.Seconds())
+	if m.sampled {
+		m.rate += rateSmoothing * (instant - m.rate)
+	} else {
+		m.rate, m.sampled = instant, true
+	}
+	m.last = total
+}
+
+// peerProgress is the progress of a single peer.
+type peerProgress struct {
+	received int64 // Bytes received from the peer, including failed attempts.
+	rate     rateMeter
+}
+
+// inFlightChunk identifies a chunk being received from a server.
+type inFlightChunk struct {
+	server  string
+	chunkID string
+}
+
+// progressDisplay is a peer.ProgressReporter drawing the progress of a download.
+type progressDisplay struct {
+	mu       sync.Mutex
+	out      io.Writer
+	bar      bool // Redraw a progress bar rather than print progress lines.
+	fileHash string
+	name     string
+	total    int64 // Bytes to download, or 0 if unknown.
+	done     int64 // Bytes of the chunks downloaded and verified.
+	inFlight map[inFlightChunk]int64
+	peers    map[string]*peerProgress
+	rate     rateMeter
+	lines    int // Lines of the progress bar currently on screen.
+	started  time.Time
+	lastLine time.Time
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+// newProgressDisplay starts a progress display writing to out until it is closed.
+func newProgressDisplay(out io.Writer, bar bool) *progressDisplay {
+	d := &progressDisplay{
+		out:      out,
+		bar:      bar,
+		inFlight: make(map[inFlightChunk]int64),
+		peers:    make(map[string]*peerProgress),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+// run samples the rates and refreshes the display until the display is closed.
+func (d *progressDisplay) run() {
+	defer close(d.stopped)
+	ticker := time.NewTicker(progressTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case now := <-ticker.C:
+			d.tick(now, progressTick)
+		}
+	}
+}
+
+// tick samples the rates after an interval and refreshes the display: the progress bar is
+// redrawn every time, and a progress line printed once every progressLineInterval.
+func (d *progressDisplay) tick(now time.Time, interval time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sample(interval)
+	switch {
+	case d.fileHash == "":
+	case d.bar:
+		d.draw()
+	case now.Sub(d.lastLine) >= progressLineInterval:
+		fmt.Fprintln(d.out, d.statusLine(true))
+		d.lastLine = now
+	}
+}
+
+// DownloadStarted implements peer.ProgressReporter.
+func (d *progressDisplay) DownloadStarted(info peer.DownloadInfo) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if info.FileHash == d.fileHash {
+		// More chunks of the same file, such as parity chunks.
+		d.total += info.Bytes
+		return
+	}
+	d.reset()
+	d.fileHash, d.name, d.total = info.FileHash, info.Name, info.Bytes
+	if d.name == "" {
+		d.name = info.FileHash[:min(12, len(info.FileHash))]
+	}
+	d.started, d.lastLine = time.Now(), time.Now()
+}
+
+// Received implements peer.ProgressReporter.
+func (d *progressDisplay) Received(server string, chunkID string, n int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.inFlight[inFlightChunk{server, chunkID}] += n
+	p := d.peers[server]
+	if p == nil {
+		p = &peerProgress{}
+		d.peers[server] = p
+	}
+	p.received += n
+}
+
+// ChunkFinished implements peer.ProgressReporter.
+func (d *progressDisplay) ChunkFinished(event peer.ChunkEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.inFlight, inFlightChunk{event.Server, event.ChunkID})
+	if event.Err == nil {
+		d.done += event.Size
+	}
+}
+
+// finish draws the final state of the current download, with its average rate, and leaves it on
+// screen, so that the next output starts on a line of its own.
+func (d *progressDisplay) finish() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.bar && d.fileHash != "" {
+		clear(d.inFlight)
+		if elapsed := time.Since(d.started).Seconds(); elapsed > 0 {
+			d.rate.rate = float64(d.completed()) / elapsed
+		}
+		d.draw()
+		fmt.Fprintln(d.out)
+	}
+	d.reset()
+}
+
+// close finishes the current download and stops the display.
+func (d *progressDisplay) close() {
+	d.finish()
+	close(d.stop)
+	<-d.stopped
+}
+
+// reset forgets the current download. The caller must hold d.mu.
+func (d *progressDisplay) reset() {
+	d.fileHash, d.name, d.total, d.done = "", "", 0, 0
+	d.rate = rateMeter{}
+	d.lines = 0
+	clear(d.inFlight)
+	clear(d.peers)
+}
+
+// completed returns the bytes received so far, including the partly received chunks. The caller must hold d.mu.
+func (d *progressDisplay) completed() int64 {
+	completed := d.done
+	for _, n := range d.inFlight {
+		completed += n
+	}
+	if d.total > 0 {
+		completed = min(completed, d.total)
+	}
+	return completed
+}
+
+// sample updates the transfer rates. The caller must hold d.mu.
+func (d *progressDisplay) sample(interval time.Duration) {
+	if d.fileHash == "" {
+		return
+	}
+	d.rate.sample(d.completed(), interval)
+	for _, p := range d.peers {
+		p.rate.sample(p.received, interval)
+	}
+}
+
+// activePeers returns the number of chunks each peer is sending. The caller must hold d.mu.
+func (d *progressDisplay) activePeers() map[string]int {
+	active := make(map[string]int)
+	for chunk := range d.inFlight {
+		active[chunk.server]++
+	}
+	return active
+}
+
+// statusLine describes the progress of the download on one line, with the throughput of the
+// active peers if withPeers is set. The caller must hold d.mu.
+func (d *progressDisplay) statusLine(withPeers bool) string {
+	completed := d.completed()
+	active := d.activePeers()
+
+	var b strings.Builder
+	b.WriteString(d.name)
+	if d.bar && d.total > 0 {
+		filled := int(int64(progressBarWidth) * completed / d.total)
+		fmt.Fprintf(&b, " [%s%s]", strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled))
+	}
+	if d.total > 0 {
+		fmt.Fprintf(&b, " %3d%% %s / %s", 100*completed/d.total, formatBytes(completed), formatBytes(d.total))
+	} else {
+		fmt.Fprintf(&b, " %s", formatBytes(completed))
+	}
+	fmt.Fprintf(&b, "  %s/s", formatBytes(int64(d.rate.rate)))
+	if d.total > 0 {
+		fmt.Fprintf(&b, "  ETA %s", formatETA(d.total-completed, d.rate.rate))
+	}
+	fmt.Fprintf(&b, "  %d %s", len(active), plural(len(active), "peer", "peers"))
+
+	if withPeers && len(active) > 0 {
+		parts := []string{}
+		for _, server := range sortedKeys(active) {
+			parts = append(parts, fmt.Sprintf("%s %s/s", server, formatBytes(int64(d.peers[server].rate.rate))))
+		}
+		fmt.Fprintf(&b, ": %s", strings.Join(parts, ", "))
+	}
+	return b.String()
+}
+
+// draw redraws the progress bar, with a line per active peer under it. The caller must hold d.mu.
+func (d *progressDisplay) draw() {
+	lines := []string{d.statusLine(false)}
+	active := d.activePeers()
+	servers := sortedKeys(active)
+	for i, server := range servers {
+		if i == progressMaxPeers {
+			lines = append(lines, fmt.Sprintf("  ... and %d more", len(servers)-i))
+			break
+		}
+		lines = append(lines, fmt.Sprintf("  %-21s %9s/s  %d %s", server, formatBytes(int64(d.peers[server].rate.rate)),
+			active[server], plural(active[server], "chunk", "chunks")))
+	}
+
+	var b strings.Builder
+	if d.lines > 1 {
+		fmt.Fprintf(&b, "\x1b[%dA", d.lines-1) // Back to the first line of the bar.
+	}
+	b.WriteString("\r")
+	for i, line := range lines {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(line + "\x1b[K")
+	}
+	if len(lines) < d.lines {
+		b.WriteString("\x1b[J") // Clear the lines of peers no longer active.
+	}
+	fmt.Fprint(d.out, b.String())
+	d.lines = len(lines)
+}
+
+// message prints a line of text, above the progress bar if it is drawn.
+func (d *progressDisplay) message(text string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.bar || d.lines == 0 {
+		fmt.Fprintln(d.out, text)
+		return
+	}
+	if d.lines > 1 {
+		fmt.Fprintf(d.out, "\x1b[%dA", d.lines-1) // Back to the first line of the bar.
+	}
+	fmt.Fprintf(d.out, "\r%s\x1b[K\n\x1b[J", text)
+	d.lines = 0
+	d.draw()
+}
+
+// formatBytes formats a byte count with a binary unit.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, exponent := float64(n)/unit, 0
+	for value >= unit && exponent < 4 {
+		value /= unit
+		exponent++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[exponent])
+}
+
+// formatETA formats the time left to transfer the remaining bytes at a rate.
+func formatETA(remaining int64, rate float64) string {
+	if remaining <= 0 {
+		return "0s"
+	}
+	if rate < 1 {
+		return "--"
+	}
+	return time.Duration(float64(remaining) / rate * float64(time.Second)).Round(time.Second).String()
+}
+
+// plural returns singular if n is 1 and plural otherwise.
+func plural(n int, singular string, plural string) string {
+	if n == 1 {
+		return singular
+	}
+	return plural
+}
+
+// sortedKeys returns the keys of a map in order.
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// jsonProgress is a peer.ProgressReporter printing the progress of downloads as JSON events.
+type jsonProgress struct {
+	mu sync.Mutex
+}
+
+// DownloadStarted implements peer.ProgressReporter.
+func (j *jsonProgress) DownloadStarted(info peer.DownloadInfo) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	printJSON(startEventJSON{Event: "start", FileHash: info.FileHash, Name: info.Name, Chunks: info.Chunks, Bytes: info.Bytes})
+}
+
+// Received implements peer.ProgressReporter. Partial chunks are not reported.
+func (j *jsonProgress) Received(string, string, int64) {}
+
+// ChunkFinished implements peer.ProgressReporter.
+func (j *jsonProgress) ChunkFinished(event peer.ChunkEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	printJSON(newChunkEventJSON(event))
+}
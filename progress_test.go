@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"go-to-peer/peer"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDisplay returns a progress display drawing to a buffer, refreshed only by explicit ticks.
+func testDisplay(bar bool) (*progressDisplay, *bytes.Buffer) {
+	var out bytes.Buffer
+	return &progressDisplay{
+		out:      &out,
+		bar:      bar,
+		inFlight: make(map[inFlightChunk]int64),
+		peers:    make(map[string]*peerProgress),
+	}, &out
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n        int64
+		expected string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{1 << 20, "1.0 MiB"},
+		{5 << 30, "5.0 GiB"},
+		{1 << 50, "1.0 PiB"},
+		{1 << 60, "1024.0 PiB"},
+	}
+	for _, tt := range tests {
+		if got := formatBytes(tt.n); got != tt.expected {
+			t.Errorf("formatBytes(%d) = %q, expected %q", tt.n, got, tt.expected)
+		}
+	}
+}
+
+func TestFormatETA(t *testing.T) {
+	tests := []struct {
+		remaining int64
+		rate      float64
+		expected  string
+	}{
+		{0, 1000, "0s"},
+		{-10, 1000, "0s"},
+		{1000, 0, "--"},
+		{1000, 0.5, "--"},
+		{1000, 100, "10s"},
+		{1500, 1000, "2s"},
+		{90 << 10, 1 << 10, "1m30s"},
+		{2 << 30, 1 << 20, "34m8s"},
+	}
+	for _, tt := range tests {
+		if got := formatETA(tt.remaining, tt.rate); got != tt.expected {
+			t.Errorf("formatETA(%d, %v) = %q, expected %q", tt.remaining, tt.rate, got, tt.expected)
+		}
+	}
+}
+
+func TestRateMeter(t *testing.T) {
+	tests := []struct {
+		name     string
+		totals   []int64
+		interval time.Duration
+		expected float64
+	}{
+		{name: "first sample", totals: []int64{1000}, interval: time.Second, expected: 1000},
+		{name: "shorter interval", totals: []int64{500}, interval: 500 * time.Millisecond, expected: 1000},
+		{name: "steady", totals: []int64{1000, 2000, 3000}, interval: time.Second, expected: 1000},
+		{name: "speeding up", totals: []int64{1000, 3000}, interval: time.Second, expected: 1200},
+		{name: "stalled", totals: []int64{1000, 1000}, interval: time.Second, expected: 800},
+		{name: "failed chunk", totals: []int64{1000, 500}, interval: time.Second, expected: 800},
+		{name: "failed first chunk", totals: []int64{-500}, interval: time.Second, expected: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var meter rateMeter
+			for _, total := range tt.totals {
+				meter.sample(total, tt.interval)
+			}
+			if math.Abs(meter.rate-tt.expected) > 1e-9 {
+				t.Fatalf("rate is %v, expected %v", meter.rate, tt.expected)
+			}
+		})
+	}
+}
+
+func TestStatusLine(t *testing.T) {
+	tests := []struct {
+		name      string
+		bar       bool
+		total     int64
+		active    bool
+		withPeers bool
+		expected  string
+	}{
+		{
+			name: "bar", bar: true, total: 4096, active: true,
+			expected: "file.bin [============            ]  50% 2.0 KiB / 4.0 KiB  1.0 KiB/s  ETA 2s  1 peer",
+		},
+		{
+			name: "line with peers", total: 4096, active: true, withPeers: true,
+			expected: "file.bin  50% 2.0 KiB / 4.0 KiB  1.0 KiB/s  ETA 2s  1 peer: 10.0.0.1:8080 2.0 KiB/s",
+		},
+		{
+			name: "unknown size", active: true, withPeers: true,
+			expected: "file.bin 2.0 KiB  1.0 KiB/s  1 peer: 10.0.0.1:8080 2.0 KiB/s",
+		},
+		{
+			name: "no active peer", total: 4096, withPeers: true,
+			expected: "file.bin  25% 1.0 KiB / 4.0 KiB  1.0 KiB/s  ETA 3s  0 peers",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := testDisplay(tt.bar)
+			d.DownloadStarted(peer.DownloadInfo{FileHash: testHash('a'), Name: "file.bin", Bytes: tt.total})
+			d.done = 1024
+			d.rate.rate = 1024
+			if tt.active {
+				d.Received("10.0.0.1:8080", testHash('b'), 1024)
+				d.peers["10.0.0.1:8080"].rate.rate = 2048
+			}
+			if got := d.statusLine(tt.withPeers); got != tt.expected {
+				t.Fatalf("got status line\n%q, expected\n%q", got, tt.expected)
+			}
+		})
+	}
+}
+
+// TestProgressLines checks that progress is printed as periodic lines rather than a progress bar
+// when stdout is not a terminal.
+func TestProgressLines(t *testing.T) {
+	out, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	for _, tt := range []struct {
+		progress string
+		bar      bool
+	}{
+		{progressAuto, false},
+		{progressLines, false},
+		{progressBar, true},
+	} {
+		_, display := newGetReporter(outputText, tt.progress, out)
+		if display.bar != tt.bar {
+			t.Errorf("progress %s to a file draws a bar: %t, expected %t", tt.progress, display.bar, tt.bar)
+		}
+		display.close()
+	}
+
+	d, buf := testDisplay(false)
+	d.DownloadStarted(peer.DownloadInfo{FileHash: testHash('a'), Name: "file.bin", Bytes: 4096})
+	d.Received("10.0.0.1:8080", testHash('b'), 1024)
+	start := d.lastLine
+	d.tick(start.Add(progressTick), progressTick)
+	if buf.Len() != 0 {
+		t.Fatalf("printed %q before a line was due", buf.String())
+	}
+	d.tick(start.Add(progressLineInterval), progressTick)
+	d.tick(start.Add(progressLineInterval+progressTick), progressTick)
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], "file.bin  25% 1.0 KiB / 4.0 KiB") || strings.Contains(buf.String(), "\x1b") {
+		t.Fatalf("got %q, expected a single plain progress line", buf.String())
+	}
+
+	d.message("banned")
+	d.finish()
+	if !strings.HasSuffix(buf.String(), "\nbanned\n") {
+		t.Fatalf("got %q, expected the message on a line of its own and nothing when finished", buf.String())
+	}
+}
+
+// TestProgressBar checks that the progress bar is redrawn in place, with a line per active peer.
+func TestProgressBar(t *testing.T) {
+	d, buf := testDisplay(true)
+	d.DownloadStarted(peer.DownloadInfo{FileHash: testHash('a'), Name: "file.bin", Bytes: 4096})
+	d.Received("10.0.0.1:8080", testHash('b'), 1024)
+	d.Received("10.0.0.2:8080", testHash('c'), 1024)
+	d.tick(time.Now(), progressTick)
+	first := buf.String()
+	if !strings.HasPrefix(first, "\rfile.bin [") || strings.Count(first, "\n") != 2 || strings.Count(first, "\x1b[K") != 3 {
+		t.Fatalf("got %q, expected the bar and a line per peer", first)
+	}
+
+	buf.Reset()
+	d.ChunkFinished(peer.ChunkEvent{Server: "10.0.0.2:8080", ChunkID: testHash('c'), Size: 1024})
+	d.tick(time.Now(), progressTick)
+	if redraw := buf.String(); !strings.HasPrefix(redraw, "\x1b[2A\r") || !strings.HasSuffix(redraw, "\x1b[J") {
+		t.Fatalf("got %q, expected the bar redrawn in place and the finished peer cleared", redraw)
+	}
+
+	buf.Reset()
+	d.finish()
+	if final := buf.String(); !strings.Contains(final, " 25% 1.0 KiB / 4.0 KiB") || !strings.HasSuffix(final, "\n") {
+		t.Fatalf("got %q, expected the final state left on screen", final)
+	}
+}
@@ -0,0 +1,762 @@
+// Package main is the entry point of the application, handling user commands via a CLI interface.
+// This file contains the tui command: a full-screen view of a running daemon showing its peers,
+// the peers downloading from it, its downloads and the merged catalog of its peers, in which
+// downloads are started, paused, resumed and cancelled with keystrokes.
+package main
+
+import (
+	"context"
+	"fmt"
+	"go-to-peer/daemon"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// Refresh intervals of the TUI.
+const (
+	tuiTick            = time.Second      // How often the daemon is polled and rates sampled.
+	tuiCatalogInterval = 30 * time.Second // How often the catalog is fetched again.
+	tuiMessageTimeout  = 5 * time.Second  // How long a message stays in the status line.
+)
+
+// Terminal control sequences.
+const (
+	ansiAltScreen  = "\x1b[?1049h\x1b[?25l" // Switch to the alternate screen and hide the cursor.
+	ansiMainScreen = "\x1b[?25h\x1b[?1049l" // Show the cursor and switch back.
+	ansiReverse    = "\x1b[7m"
+	ansiBold       = "\x1b[1m"
+	ansiReset      = "\x1b[0m"
+)
+
+// Panes of the TUI that can be focused.
+const (
+	paneDownloads = iota
+	paneCatalog
+)
+
+// tuiHelp lists the keys of the TUI.
+const tuiHelp = "tab switch · ↑↓ move · enter download · p pause · r resume · c cancel · +/- priority · x clear · R refresh · q quit"
+
+// runTUI shows a full-screen view of the daemon until the user quits.
+func runTUI(args []string) int {
+	fs := newFlagSet("tui")
+	socket := fs.String("socket", settings.Daemon.Socket, "Unix socket of the daemon")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() > 0 {
+		return usageError(fs, "unexpected argument %q", fs.Arg(0))
+	}
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		return fail("tui needs an interactive terminal")
+	}
+	client, err := daemon.Dial(*socket)
+	if err != nil {
+		return fail("no daemon is listening on %s; start one with '%s daemon'", *socket, programName)
+	}
+
+	restore, err := rawTerminal()
+	if err != nil {
+		return fail("%v", err)
+	}
+	fmt.Print(ansiAltScreen)
+	err = func() error {
+		// The terminal is restored even if the TUI panics.
+		defer restore()
+		defer fmt.Print(ansiMainScreen)
+		return newTUI(client).run()
+	}()
+	if err != nil {
+		return fail("%v", err)
+	}
+	return exitOK
+}
+
+// rawTerminal makes the terminal deliver keys as they are pressed, without echoing them or
+// turning Ctrl-C into a signal, and returns the function restoring its settings.
+func rawTerminal() (func(), error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the terminal settings: %w", err)
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return nil, fmt.Errorf("failed to set up the terminal: %w", err)
+	}
+	return func() { _, _ = stty(strings.TrimSpace(saved)) }, nil
+}
+
+// terminalSize returns the number of rows and columns of the terminal, or 24 by 80 if unknown.
+func terminalSize() (int, int) {
+	out, err := stty("size")
+	if err == nil {
+		var rows, cols int
+		if _, err := fmt.Sscan(out, &rows, &cols); err == nil && rows > 0 && cols > 0 {
+			return rows, cols
+		}
+	}
+	return 24, 80
+}
+
+// stty runs stty on the terminal of stdin.
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+// catalogResult is the outcome of fetching the catalog in the background.
+type catalogResult struct {
+	catalog daemon.Catalog
+	err     error
+}
+
+// tui is the state of the TUI. It is only used by the goroutine running it.
+type tui struct {
+	client  *daemon.Client
+	rows    int
+	cols    int
+	status  daemon.Status
+	peers   daemon.Peers
+	jobs    []daemon.Job
+	catalog daemon.Catalog
+
+	fetching bool // Whether the catalog is being fetched.
+	focus    int
+	cursor   [2]int // Selected row of each pane.
+	offset   [2]int // First row shown of each pane.
+
+	message     string
+	messageTime time.Time
+
+	// Transfer rates, from the data received by each job and from each server, and the data
+	// sent to each client.
+	jobReceived    map[int]int64
+	jobRates       map[int]*rateMeter
+	serverReceived map[string]int64
+	serverRates    map[string]*rateMeter
+	clientRates    map[string]*rateMeter
+}
+
+// newTUI creates the TUI of a daemon.
+func newTUI(client *daemon.Client) *tui {
+	return &tui{
+		client:         client,
+		focus:          paneCatalog,
+		jobReceived:    make(map[int]int64),
+		jobRates:       make(map[int]*rateMeter),
+		serverReceived: make(map[string]int64),
+		serverRates:    make(map[string]*rateMeter),
+		clientRates:    make(map[string]*rateMeter),
+	}
+}
+
+// run draws the TUI and handles keys and events until the user quits.
+//
+// Returns:
+// - error: An error object if the daemon cannot be reached.
+func (t *tui) run() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := t.client.Events(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	events := make(chan daemon.Event, 256)
+	streamErr := make(chan error, 1)
+	go func() {
+		for {
+			event, err := stream.Next()
+			if err != nil {
+				streamErr <- err
+				return
+			}
+			events <- event
+		}
+	}()
+
+	keys := make(chan string)
+	go readKeys(keys)
+	resized := make(chan os.Signal, 1)
+	signal.Notify(resized, syscall.SIGWINCH)
+	defer signal.Stop(resized)
+	catalogs := make(chan catalogResult, 1)
+	ticker := time.NewTicker(tuiTick)
+	defer ticker.Stop()
+
+	t.rows, t.cols = terminalSize()
+	if err := t.poll(); err != nil {
+		return err
+	}
+	t.fetchCatalog(catalogs, false)
+	lastFetch := time.Now()
+	for {
+		t.draw()
+		select {
+		case key, ok := <-keys:
+			if !ok || key == "q" || key == "ctrl-c" {
+				return nil
+			}
+			t.handleKey(key, catalogs)
+		case event := <-events:
+			t.handleEvent(event)
+		case err := <-streamErr:
+			if ctx.Err() == nil {
+				return fmt.Errorf("lost the connection to the daemon: %w", err)
+			}
+			return nil
+		case result := <-catalogs:
+			t.fetching = false
+			if result.err != nil {
+				t.notify("Failed to fetch the catalog: %v", result.err)
+			} else {
+				t.catalog = result.catalog
+				t.clampCursors()
+			}
+		case <-resized:
+			t.rows, t.cols = terminalSize()
+		case <-ticker.C:
+			if err := t.poll(); err != nil {
+				return err
+			}
+			t.sample()
+			if time.Since(lastFetch) >= tuiCatalogInterval {
+				t.fetchCatalog(catalogs, false)
+				lastFetch = time.Now()
+			}
+		}
+	}
+}
+
+// readKeys sends the keys pressed on the terminal, naming the special ones.
+func readKeys(keys chan<- string) {
+	buffer := make([]byte, 64)
+	for {
+		n, err := os.Stdin.Read(buffer)
+		if err != nil {
+			close(keys)
+			return
+		}
+		input := string(buffer[:n])
+		for input != "" {
+			key, size := parseKey(input)
+			input = input[size:]
+			if key != "" {
+				keys <- key
+			}
+		}
+	}
+}
+
+// parseKey returns the first key of terminal input and the bytes it took, or "" for an unknown key.
+func parseKey(input string) (string, int) {
+	sequences := []struct{ sequence, key string }{
+		{"\x1b[A", "up"}, {"\x1bOA", "up"},
+		{"\x1b[B", "down"}, {"\x1bOB", "down"},
+		{"\x1b[5~", "pgup"}, {"\x1b[6~", "pgdn"},
+		{"\x1b[H", "home"}, {"\x1b[F", "end"},
+	}
+	for _, s := range sequences {
+		if strings.HasPrefix(input, s.sequence) {
+			return s.key, len(s.sequence)
+		}
+	}
+	switch input[0] {
+	case '\x1b':
+		// An unknown escape sequence is skipped up to its final byte; the input after it holds
+		// other keys. An escape starting no complete sequence is the Esc key.
+		if size := escapeSequenceSize(input); size > 0 {
+			return "", size
+		}
+		return "esc", 1
+	case '\t':
+		return "tab", 1
+	case '\r', '\n':
+		return "enter", 1
+	case 3:
+		return "ctrl-c", 1
+	}
+	r, size := utf8.DecodeRuneInString(input)
+	return string(r), size
+}
+
+// escapeSequenceSize returns the size of the CSI ("\x1b[", parameters, final byte) or SS3 ("\x1bO",
+// final byte) sequence starting the input, or 0 if it starts with no complete one.
+func escapeSequenceSize(input string) int {
+	if len(input) < 3 {
+		return 0
+	}
+	switch input[1] {
+	case 'O':
+		if input[2] >= 0x40 && input[2] <= 0x7e {
+			return 3
+		}
+	case '[':
+		for i := 2; i < len(input); i++ {
+			switch c := input[i]; {
+			case c >= 0x40 && c <= 0x7e:
+				return i + 1
+			case c < 0x20 || c > 0x3f:
+				// Not a parameter or intermediate byte.
+				return 0
+			}
+		}
+	}
+	return 0
+}
+
+// poll fetches the status, peers and jobs of the daemon.
+func (t *tui) poll() error {
+	status, err := t.client.Status()
+	if err != nil {
+		return fmt.Errorf("lost the connection to the daemon: %w", err)
+	}
+	peers, err := t.client.Peers()
+	if err != nil {
+		return err
+	}
+	jobs, err := t.client.Jobs()
+	if err != nil {
+		return err
+	}
+	t.status, t.peers, t.jobs = status, peers, jobs
+	t.clampCursors()
+	return nil
+}
+
+// fetchCatalog fetches the catalog in the background, unless it is already being fetched.
+func (t *tui) fetchCatalog(results chan<- catalogResult, refresh bool) {
+	if t.fetching {
+		return
+	}
+	t.fetching = true
+	go func() {
+		catalog, err := t.client.Catalog(nil, refresh)
+		if err == nil {
+			err = catalog.Err()
+		}
+		results <- catalogResult{catalog: catalog, err: err}
+	}()
+}
+
+// handleEvent applies an event of the daemon: jobs are updated at once, and received data counts
+// towards the transfer rates.
+func (t *tui) handleEvent(event daemon.Event) {
+	switch event.Type {
+	case daemon.EventJob:
+		if event.Job == nil {
+			return
+		}
+		for i := range t.jobs {
+			if t.jobs[i].ID == event.Job.ID {
+				t.jobs[i] = *event.Job
+				return
+			}
+		}
+		t.jobs = append(t.jobs, *event.Job)
+	case daemon.EventReceived:
+		t.jobReceived[event.JobID] += event.Bytes
+		t.serverReceived[event.Server] += event.Bytes
+	}
+}
+
+// sample updates the transfer rates.
+func (t *tui) sample() {
+	for id, received := range t.jobReceived {
+		meter(t.jobRates, id).sample(received, tuiTick)
+	}
+	for server, received := range t.serverReceived {
+		meter(t.serverRates, server).sample(received, tuiTick)
+	}
+	for _, client := range t.peers.Clients {
+		meter(t.clientRates, client.Address).sample(client.Bytes, tuiTick)
+	}
+}
+
+// meter returns the rate meter of a key, creating it if needed.
+func meter[K comparable](meters map[K]*rateMeter, key K) *rateMeter {
+	m, ok := meters[key]
+	if !ok {
+		m = &rateMeter{}
+		meters[key] = m
+	}
+	return m
+}
+
+// notify shows a message in the status line.
+func (t *tui) notify(format string, args ...any) {
+	t.message, t.messageTime = fmt.Sprintf(format, args...), time.Now()
+}
+
+// handleKey applies a key pressed by the user.
+func (t *tui) handleKey(key string, catalogs chan<- catalogResult) {
+	rows := t.paneRows()[t.focus]
+	switch key {
+	case "tab":
+		t.focus = 1 - t.focus
+	case "up", "k":
+		t.cursor[t.focus]--
+	case "down", "j":
+		t.cursor[t.focus]++
+	case "pgup":
+		t.cursor[t.focus] -= max(rows, 1)
+	case "pgdn":
+		t.cursor[t.focus] += max(rows, 1)
+	case "home", "g":
+		t.cursor[t.focus] = 0
+	case "end", "G":
+		t.cursor[t.focus] = t.paneLength(t.focus) - 1
+	case "R":
+		t.fetchCatalog(catalogs, true)
+		t.notify("Fetching the catalogs of the peers")
+	case "x":
+		cleared, err := t.client.Clear()
+		if err != nil {
+			t.notify("%v", err)
+			break
+		}
+		t.notify("Cleared %d finished %s", len(cleared), plural(len(cleared), "download", "downloads"))
+		_ = t.poll()
+	case "enter", "d":
+		t.download()
+	case "p", "r", "c", "+", "-":
+		t.manage(key)
+	}
+	t.clampCursors()
+}
+
+// clampCursors keeps the cursor of each pane on one of its rows, after it moved or its list changed.
+func (t *tui) clampCursors() {
+	for pane := range t.cursor {
+		t.cursor[pane] = max(min(t.cursor[pane], t.paneLength(pane)-1), 0)
+	}
+}
+
+// download queues the download of the file selected in the catalog.
+func (t *tui) download() {
+	if t.focus != paneCatalog || t.cursor[paneCatalog] >= len(t.catalog.Files) {
+		t.notify("Select a file in the catalog to download it")
+		return
+	}
+	entry := t.catalog.Files[t.cursor[paneCatalog]]
+	job, err := t.client.Add(daemon.JobRequest{Target: entry.Hash, Name: entry.Name, Servers: entry.Servers})
+	if err != nil {
+		t.notify("Failed to queue %s: %v", entry.Name, err)
+		return
+	}
+	t.notify("Queued job %d: %s", job.ID, entry.Name)
+	t.handleEvent(daemon.Event{Type: daemon.EventJob, JobID: job.ID, Job: &job})
+}
+
+// manage pauses, resumes, cancels or reprioritizes the selected download.
+func (t *tui) manage(key string) {
+	if t.focus != paneDownloads || t.cursor[paneDownloads] >= len(t.jobs) {
+		t.notify("Select a download to manage it")
+		return
+	}
+	job := t.jobs[t.cursor[paneDownloads]]
+	var err error
+	switch key {
+	case "p":
+		job, err = t.client.Pause(job.ID)
+	case "r":
+		job, err = t.client.Resume(job.ID)
+	case "c":
+		job, err = t.client.Cancel(job.ID)
+	case "+", "-":
+		priorities := []string{daemon.PriorityLow, daemon.PriorityNormal, daemon.PriorityHigh}
+		i := 0
+		for i < len(priorities)-1 && priorities[i] != job.Priority {
+			i++
+		}
+		if key == "+" {
+			i = min(i+1, len(priorities)-1)
+		} else {
+			i = max(i-1, 0)
+		}
+		job, err = t.client.SetPriority(job.ID, priorities[i])
+	}
+	if err != nil {
+		t.notify("%v", err)
+		return
+	}
+	t.notify("Job %d is %s with %s priority", job.ID, job.State, job.Priority)
+	t.handleEvent(daemon.Event{Type: daemon.EventJob, JobID: job.ID, Job: &job})
+}
+
+// paneLength returns the number of rows of a pane's list.
+func (t *tui) paneLength(pane int) int {
+	if pane == paneDownloads {
+		return len(t.jobs)
+	}
+	return len(t.catalog.Files)
+}
+
+// fixedRows returns the rows of the peers and uploads sections, which are not scrolled.
+func (t *tui) fixedRows() (int, int) {
+	return min(max(len(t.peers.Servers), 1), 4), min(max(len(t.peers.Clients), 1), 3)
+}
+
+// paneRows returns the rows the downloads and catalog panes have for their lists.
+func (t *tui) paneRows() [2]int {
+	peerRows, clientRows := t.fixedRows()
+	// Title, four section headers, and the help and status lines.
+	free := max(t.rows-7-peerRows-clientRows, 2)
+	downloads := min(max(len(t.jobs), 1), max(free/2, 1))
+	return [2]int{downloads, free - downloads}
+}
+
+// draw redraws the whole screen.
+func (t *tui) draw() {
+	var screen strings.Builder
+	row := 0
+	line := func(style string, format string, args ...any) {
+		row++
+		if row > t.rows {
+			return
+		}
+		text := truncate(fmt.Sprintf(format, args...), t.cols)
+		fmt.Fprintf(&screen, "\x1b[%d;1H%s%s\x1b[K%s", row, style, text, ansiReset)
+	}
+
+	t.drawTitle(line)
+	peerRows, clientRows := t.fixedRows()
+	t.drawPeers(line, peerRows)
+	t.drawClients(line, clientRows)
+	rows := t.paneRows()
+	t.drawDownloads(line, rows[paneDownloads])
+	t.drawCatalog(line, rows[paneCatalog])
+
+	for row < t.rows-2 {
+		line("", "")
+	}
+	line("", "%s", tuiHelp)
+	if t.message != "" && time.Since(t.messageTime) < tuiMessageTimeout {
+		line(ansiBold, "%s", t.message)
+	} else {
+		line("", "")
+	}
+	screen.WriteString("\x1b[J")
+	fmt.Print(screen.String())
+}
+
+// drawTitle draws the title bar: the daemon and the overall transfer rates.
+func (t *tui) drawTitle(line func(string, string, ...any)) {
+	sharing := "not sharing files"
+	if t.status.Port != 0 {
+		sharing = fmt.Sprintf("sharing on port %d", t.status.Port)
+	}
+	var down, up float64
+	for _, m := range t.serverRates {
+		down += m.rate
+	}
+	for _, m := range t.clientRates {
+		up += m.rate
+	}
+	line(ansiReverse, " go-to-peer · daemon %d · up %s · %s · ↓ %s/s ↑ %s/s · %d running, %d queued",
+		t.status.PID, time.Since(t.status.Started).Round(time.Second), sharing,
+		formatBytes(int64(down)), formatBytes(int64(up)), t.status.Jobs[daemon.StateRunning], t.status.Jobs[daemon.StateQueued])
+}
+
+// drawPeers draws the servers the daemon downloads from.
+func (t *tui) drawPeers(line func(string, string, ...any), rows int) {
+	line(ansiBold, "PEERS (%d)", len(t.peers.Servers))
+	if len(t.peers.Servers) == 0 {
+		line("", "  no peers; start the daemon with -connect")
+		return
+	}
+	available := make(map[string]daemon.ServerStatus)
+	for _, server := range t.catalog.Servers {
+		available[server.Address] = server
+	}
+	for i, server := range t.peers.Servers {
+		if i == rows {
+			break
+		}
+		if i == rows-1 && len(t.peers.Servers) > rows {
+			line("", "  … %d more", len(t.peers.Servers)-i)
+			break
+		}
+		state, files := "unknown", "-"
+		if s, ok := available[server.Address]; ok {
+			state, files = "down", "-"
+			if s.Available {
+				state, files = "up", strconv.Itoa(s.Files)
+			}
+		}
+		if server.Banned {
+			state = "banned"
+		}
+		var rate float64
+		if m, ok := t.serverRates[server.Address]; ok {
+			rate = m.rate
+		}
+		line("", "  %-24s %-7s %6s files  %2d active %2d idle  ↓ %10s/s  %10s total",
+			server.Address, state, files, server.Active, server.Idle, formatBytes(int64(rate)), formatBytes(server.Downloaded))
+	}
+}
+
+// drawClients draws the peers downloading from the daemon.
+func (t *tui) drawClients(line func(string, string, ...any), rows int) {
+	line(ansiBold, "UPLOADS (%d %s)", len(t.peers.Clients), plural(len(t.peers.Clients), "peer", "peers"))
+	if len(t.peers.Clients) == 0 {
+		if t.status.Port == 0 {
+			line("", "  not sharing files; start the daemon with -serve")
+		} else {
+			line("", "  no peers connected")
+		}
+		return
+	}
+	for i, client := range t.peers.Clients {
+		if i == rows {
+			break
+		}
+		if i == rows-1 && len(t.peers.Clients) > rows {
+			line("", "  … %d more", len(t.peers.Clients)-i)
+			break
+		}
+		name := client.Address
+		if client.PeerID != "" {
+			name += " (" + client.PeerID + ")"
+		}
+		var rate float64
+		if m, ok := t.clientRates[client.Address]; ok {
+			rate = m.rate
+		}
+		sending := ""
+		if client.Uploading != "" {
+			sending = "  sending " + shortHash(client.Uploading)
+		}
+		line("", "  %-32s %6d %-6s %10s  ↑ %10s/s%s", name, client.Chunks, plural(client.Chunks, "chunk", "chunks"),
+			formatBytes(client.Bytes), formatBytes(int64(rate)), sending)
+	}
+}
+
+// drawDownloads draws the jobs of the daemon.
+func (t *tui) drawDownloads(line func(string, string, ...any), rows int) {
+	line(t.headerStyle(paneDownloads), "DOWNLOADS (%d)", len(t.jobs))
+	if len(t.jobs) == 0 {
+		line("", "  no downloads; select a file in the catalog and press enter")
+		return
+	}
+	start := t.scroll(paneDownloads, rows)
+	for i := start; i < start+rows && i < len(t.jobs); i++ {
+		job := t.jobs[i]
+		progress, rate := "-", ""
+		switch {
+		case job.State == daemon.StateDone:
+			progress = "100%"
+		case job.Bytes > 0:
+			progress = fmt.Sprintf("%d%%", 100*job.Done/job.Bytes)
+		}
+		if m, ok := t.jobRates[job.ID]; ok && job.State == daemon.StateRunning {
+			rate = formatBytes(int64(m.rate)) + "/s"
+		}
+		name := job.Name
+		if name == "" {
+			name = shortHash(job.FileHash)
+		}
+		detail := ""
+		switch {
+		case job.Error != "":
+			detail = "  " + job.Error
+		case job.Output != "":
+			detail = "  -> " + job.Output
+		}
+		line(t.rowStyle(paneDownloads, i), "  %-5d %-9s %-6s %5s %12s  %s%s", job.ID, job.State, job.Priority, progress, rate, name, detail)
+	}
+}
+
+// drawCatalog draws the merged catalog of the daemon's peers.
+func (t *tui) drawCatalog(line func(string, string, ...any), rows int) {
+	title := fmt.Sprintf("CATALOG (%d %s)", len(t.catalog.Files), plural(len(t.catalog.Files), "file", "files"))
+	if t.fetching {
+		title += " fetching…"
+	}
+	line(t.headerStyle(paneCatalog), "%s", title)
+	if rows <= 0 {
+		return
+	}
+	if len(t.catalog.Files) == 0 {
+		line("", "  no files shared by the peers")
+		return
+	}
+
+	// The latest download of each file.
+	latest := make(map[string]daemon.Job)
+	for _, job := range t.jobs {
+		latest[job.FileHash] = job
+	}
+	available := 0
+	for _, server := range t.catalog.Servers {
+		if server.Available {
+			available++
+		}
+	}
+	start := t.scroll(paneCatalog, rows)
+	for i := start; i < start+rows && i < len(t.catalog.Files); i++ {
+		entry := t.catalog.Files[i]
+		state := ""
+		if job, ok := latest[entry.Hash]; ok {
+			state = job.State
+		}
+		line(t.rowStyle(paneCatalog, i), "  %-40s %10s  %d/%d peers  %s  %s",
+			displayPath(entry), formatBytes(entry.Size), len(entry.Servers), available, shortHash(entry.Hash), state)
+	}
+}
+
+// scroll returns the first row of a pane to show so that its selected row is visible.
+func (t *tui) scroll(pane int, rows int) int {
+	cursor := t.cursor[pane]
+	if cursor < t.offset[pane] {
+		t.offset[pane] = cursor
+	}
+	if rows > 0 && cursor >= t.offset[pane]+rows {
+		t.offset[pane] = cursor - rows + 1
+	}
+	t.offset[pane] = max(min(t.offset[pane], t.paneLength(pane)-rows), 0)
+	return t.offset[pane]
+}
+
+// headerStyle returns the style of a pane's header, highlighted when it has the focus.
+func (t *tui) headerStyle(pane int) string {
+	if t.focus == pane {
+		return ansiBold + ansiReverse
+	}
+	return ansiBold
+}
+
+// rowStyle returns the style of a row of a pane, highlighted when it is selected.
+func (t *tui) rowStyle(pane int, i int) string {
+	if t.focus == pane && t.cursor[pane] == i {
+		return ansiReverse
+	}
+	return ""
+}
+
+// truncate cuts a line to a number of columns, counting one column per rune.
+func truncate(text string, cols int) string {
+	if utf8.RuneCountInString(text) <= cols {
+		return text
+	}
+	runes := []rune(text)
+	if cols <= 1 {
+		return string(runes[:max(cols, 0)])
+	}
+	return string(runes[:cols-1]) + "…"
+}
+
+// shortHash abbreviates a hash for display.
+func shortHash(hash string) string {
+	if len(hash) <= 12 {
+		return hash
+	}
+	return hash[:12]
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"go-to-peer/daemon"
+	"go-to-peer/peer"
+	"slices"
+	"testing"
+)
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		input string
+		keys  []string
+	}{
+		{"j", []string{"j"}},
+		{"\r\n\t\x03", []string{"enter", "enter", "tab", "ctrl-c"}},
+		{"é", []string{"é"}},
+		{"\x1b[A\x1bOB\x1b[5~\x1b[6~\x1b[H\x1b[F", []string{"up", "down", "pgup", "pgdn", "home", "end"}},
+		{"\x1b", []string{"esc"}},
+		{"\x1bj", []string{"esc", "j"}},
+		{"\x1b\x1b[A", []string{"esc", "up"}},
+		{"\x1b[1;5Cj", []string{"", "j"}}, // Ctrl-Right, unknown.
+		{"\x1b[15~d", []string{"", "d"}},  // F5, unknown.
+		{"\x1bOPk", []string{"", "k"}},    // F1, unknown.
+		{"\x1b[200~x", []string{"", "x"}}, // Start of a paste, unknown.
+		{"\x1b[1;", []string{"esc", "[", "1", ";"}},
+		{"\x1b[\rp", []string{"esc", "[", "enter", "p"}},
+	}
+	for _, test := range tests {
+		var keys []string
+		for input := test.input; input != ""; {
+			key, size := parseKey(input)
+			if size <= 0 || size > len(input) {
+				t.Fatalf("parseKey(%q) took %d bytes", input, size)
+			}
+			keys = append(keys, key)
+			input = input[size:]
+		}
+		if !slices.Equal(keys, test.keys) {
+			t.Errorf("%q parsed as %q, expected %q", test.input, keys, test.keys)
+		}
+	}
+}
+
+func TestCursorAfterListsShrink(t *testing.T) {
+	ui := newTUI(nil)
+	ui.jobs = []daemon.Job{{ID: 1}, {ID: 2}, {ID: 3}}
+	ui.catalog.Files = make([]peer.CatalogEntry, 3)
+	ui.cursor = [2]int{2, 2}
+
+	// Another client cleared jobs and a refresh returned fewer files: the keys acting on the
+	// selection must not index past the lists before the cursors are clamped.
+	ui.jobs = ui.jobs[:1]
+	ui.catalog.Files = nil
+	ui.focus = paneCatalog
+	ui.download()
+	ui.focus = paneDownloads
+	for _, key := range []string{"p", "r", "c", "+", "-"} {
+		ui.message = ""
+		ui.manage(key)
+		if ui.message == "" {
+			t.Errorf("%s on a job past the end of the list did not ask to select one", key)
+		}
+	}
+
+	ui.clampCursors()
+	if ui.cursor != [2]int{0, 0} {
+		t.Errorf("cursors %v after the lists shrank, expected [0 0]", ui.cursor)
+	}
+	ui.jobs = nil
+	ui.clampCursors()
+	if ui.cursor != [2]int{0, 0} {
+		t.Errorf("cursors %v with empty lists, expected [0 0]", ui.cursor)
+	}
+}
@@ -14,22 +14,36 @@ func CalculateHash(data []byte) string {
 	return fmt.Sprintf("%x", hash)
 }
 
-// CalculateFileHash computes the SHA-256 hash of the given file.
+// CalculateFileHash computes the SHA-256 hash of the given file, or "" if it cannot be opened.
 //
 // Parameters:
 // - filePath: The path to the file.
 //
 // Returns:
 // - string: The computed hash as a hexadecimal string.
-// - error: An error object if any issues occur while accessing the file.
 func CalculateFileHash(filePath string) string {
+	hash, _ := HashFile(filePath)
+	return hash
+}
+
+// HashFile computes the SHA-256 hash of the given file.
+//
+// Parameters:
+// - filePath: The path to the file.
+//
+// Returns:
+// - string: The computed hash as a hexadecimal string.
+// - error: An error object if the file cannot be opened or read.
+func HashFile(filePath string) (string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
-		return ""
+		return "", err
 	}
 	defer file.Close()
 
 	hasher := sha256.New()
-	_, _ = io.Copy(hasher, file)
-	return hex.EncodeToString(hasher.Sum(nil))
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
@@ -15,9 +15,9 @@ import (
 var Logger *log.Logger
 
 // InitLogger initializes the global Logger instance.
-// It creates or appends to a log file ("go-to-peer.log") and sets the logging format.
+// It creates or appends to the log file at path and sets the logging format.
 // SIL 4 compliance ensures every log entry has a timestamp, severity level, and source reference.
-func InitLogger() {
+func InitLogger(path string) {
 	// Open or create the log file with write and append permissions.
 	/* source: https://pkg.go.dev/os
 	const (
@@ -32,7 +32,7 @@ func InitLogger() {
 		O_SYNC   int = syscall.O_SYNC   // open for synchronous I/O.
 		O_TRUNC  int = syscall.O_TRUNC  // truncate regular writable file when opened.
 	) */
-	file, err := os.OpenFile("go-to-peer.log", os.O_CREATE|os.O_WRONLY /*|os.O_APPEND*/, 0666)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY /*|os.O_APPEND*/, 0666)
 
 	if err != nil {
 		// Critical error: Unable to initialize logging. Application should not proceed.